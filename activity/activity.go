@@ -2,20 +2,76 @@ package activity
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"github.com/kotalco/crossover-managed/logger"
+	"github.com/kotalco/crossover-managed/metrics"
 	"io"
-	"log"
 	"net/http"
+	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const DefaultTimeout = 10
+const (
+	DefaultTimeout           = 10
+	DefaultMaxRetryQueueSize = 10000 // max number of entries kept for retry while the activity backend is failing
+	PriorityBufferSize       = 1000  // buffer size of the high-priority entries channel
+)
+
+var (
+	flushedBatches   = metrics.NewCounter("crossover_activity_flushed_batches_total", "Number of activity batches flushed successfully")
+	failedFlushes    = metrics.NewCounter("crossover_activity_flush_failures_total", "Number of activity batch flushes that failed")
+	retriedFlushes   = metrics.NewCounter("crossover_activity_flush_retries_total", "Number of activity batch flushes retrying previously failed entries")
+	droppedTotal     = metrics.NewCounter("crossover_activity_dropped_entries_total", "Number of activity entries dropped due to full buffers")
+	droppedEvents    = metrics.NewCounter("crossover_activity_stream_dropped_events_total", "Number of real-time activity events dropped due to a full stream")
+	flushBatchSize   = metrics.NewHistogram("crossover_activity_batch_size", "Number of entries per flushed activity batch", []float64{1, 5, 10, 20, 50, 100, 500, 1000})
+	flushLatencySecs = metrics.NewHistogram("crossover_activity_flush_latency_seconds", "Latency of the activity batch flushes", []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10})
+)
+
+// authentication schemes of the activity backend
+const (
+	AuthAPIKey = "apikey" // X-Api-Key header
+	AuthBearer = "bearer" // Authorization: Bearer header
+	AuthHMAC   = "hmac"   // X-Signature header carrying the hex HMAC-SHA256 of the body
+)
+
+// Options configure the activity service
+type Options struct {
+	RemoteAddress     string            // address used to store the request activity
+	APIKey            string            // key used by the apikey and bearer schemes
+	BufferSize        int               // buffer size of the activity entries channel
+	BatchSize         int               // number of activity entries sent together
+	FlushInterval     int               // interval in seconds to flush the activity entries
+	MaxFlushInterval  int               // upper bound in seconds of the flush interval backoff
+	MaxRetryQueueSize int               // max number of entries kept for retry
+	AuthScheme        string            // one of apikey, bearer or hmac, defaults to apikey
+	HMACSecret        string            // shared secret signing the body with the hmac scheme
+	ProxyURL          string            // outbound http proxy of the activity requests, empty uses the default transport
+	Stream            chan<- Event      // optional real-time stream receiving every logged entry, independent of the batches
+	SpillPath         string            // file receiving the entries that would be dropped, empty disables the spill
+	MaxSpillBytes     int64             // size of the spill file before it's rotated, defaults to DefaultMaxSpillBytes
+	SpillReplay       int               // interval in seconds to replay the spilled entries, defaults to DefaultSpillReplayInterval
+	Tags              map[string]string // labels sent with every entry, e.g. region or environment, so the backend can segment the usage
+	Logger            *logger.Logger    // throttle of the error logs, nil logs every message
+}
+
+// Event a logged activity entry emitted to the real-time stream
+type Event struct {
+	RequestId string // the request id matched by the plugin pattern, the key the batched entries are logged under
+	Count     int
+}
 
 // loggingRequestDto used to send request to the third party to save no of requests
 type activityRequestDto struct {
-	RequestId string `json:"request_id"`
-	Count     int    `json:"count"`
+	RequestId string            `json:"request_id"`
+	Count     int               `json:"count"`
+	Tags      map[string]string `json:"tags,omitempty"`
 }
 
 // implement buffer pool using the sync.Pool type,to reduce the allocation when you are encoding JSON
@@ -27,33 +83,94 @@ var bufferPool = sync.Pool{
 
 type IActivity interface {
 	LogActivity(requestId string, count int)
+	LogPriorityActivity(requestId string, count int)
 	BatchProcessor()
-	FlushLogs(batch []activityRequestDto)
+	FlushLogs(ctx context.Context, batch []activityRequestDto) error
+	Close(ctx context.Context) error
 }
 
 type activity struct {
-	client        *http.Client
-	logsChannel   chan activityRequestDto
-	remoteAddress string
-	apiKey        string
-	batchSize     int
-	flushInterval int
+	client            *http.Client
+	logsChannel       chan activityRequestDto
+	priorityChannel   chan activityRequestDto
+	remoteAddress     string
+	apiKey            string
+	batchSize         int
+	flushInterval     int
+	maxFlushInterval  int
+	maxRetryQueueSize int
+	droppedEntries    uint64
+	authScheme        string
+	hmacSecret        string
+	stream            chan<- Event
+	done              chan struct{}
+	flushed           chan struct{}
+	closeOnce         sync.Once
+	ctx               context.Context // bound the flush requests, cancelled when Close gives up on the last flush
+	cancel            context.CancelFunc
+	spill             *spill
+	spillReplay       int
+	tags              map[string]string
+	logger            *logger.Logger
 }
 
-func NewActivity(remoteAddress string, apiKey string, bufferSize int, batchSize int, flushInterval int) IActivity {
-	return &activity{
-		client: &http.Client{
-			Timeout: DefaultTimeout * time.Second,
-		},
-		logsChannel:   make(chan activityRequestDto, bufferSize),
-		remoteAddress: remoteAddress,
-		apiKey:        apiKey,
-		batchSize:     batchSize,
-		flushInterval: flushInterval,
+func NewActivity(options Options) IActivity {
+	if options.MaxFlushInterval < options.FlushInterval {
+		options.MaxFlushInterval = options.FlushInterval
+	}
+	if options.MaxRetryQueueSize <= 0 {
+		options.MaxRetryQueueSize = DefaultMaxRetryQueueSize
+	}
+	if options.AuthScheme == "" {
+		options.AuthScheme = AuthAPIKey
 	}
+	client := &http.Client{
+		Timeout: DefaultTimeout * time.Second,
+	}
+	if proxyURL, err := url.Parse(options.ProxyURL); err == nil && options.ProxyURL != "" {
+		client.Transport = &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	}
+	a := &activity{
+		client:            client,
+		logsChannel:       make(chan activityRequestDto, options.BufferSize),
+		priorityChannel:   make(chan activityRequestDto, PriorityBufferSize),
+		remoteAddress:     options.RemoteAddress,
+		apiKey:            options.APIKey,
+		batchSize:         options.BatchSize,
+		flushInterval:     options.FlushInterval,
+		maxFlushInterval:  options.MaxFlushInterval,
+		maxRetryQueueSize: options.MaxRetryQueueSize,
+		authScheme:        options.AuthScheme,
+		hmacSecret:        options.HMACSecret,
+		stream:            options.Stream,
+		done:              make(chan struct{}),
+		flushed:           make(chan struct{}),
+		logger:            options.Logger,
+	}
+	a.ctx, a.cancel = context.WithCancel(context.Background())
+	if len(options.Tags) > 0 {
+		a.tags = make(map[string]string, len(options.Tags))
+		for key, value := range options.Tags {
+			a.tags[key] = value
+		}
+	}
+	if options.SpillPath != "" {
+		if options.SpillReplay <= 0 {
+			options.SpillReplay = DefaultSpillReplayInterval
+		}
+		a.spill = newSpill(options.SpillPath, options.MaxSpillBytes, options.Logger)
+		a.spillReplay = options.SpillReplay
+	}
+	return a
 }
 
 func (a *activity) LogActivity(requestId string, count int) {
+	a.emit(requestId, count)
+	a.enqueue(requestId, count)
+}
+
+// enqueue add the entry to the batched pipeline
+func (a *activity) enqueue(requestId string, count int) {
 	buf := bufferPool.Get().(*bytes.Buffer)
 	buf.Reset()
 	defer bufferPool.Put(buf)
@@ -62,41 +179,206 @@ func (a *activity) LogActivity(requestId string, count int) {
 	logEntry := activityRequestDto{
 		RequestId: requestId,
 		Count:     count,
+		Tags:      a.tags,
 	}
 
 	//send logEntry to logsChannel with select and don't block
 	select {
 	case a.logsChannel <- logEntry:
 	default:
-		log.Printf("Dropped some log entries due to full buffer channel")
+		if a.spillEntries([]activityRequestDto{logEntry}) {
+			return
+		}
+		droppedTotal.Inc()
+		a.logger.Printf("Dropped some log entries due to full buffer channel")
 	}
 
 }
 
+// LogPriorityActivity log a high-value entry that triggers an immediate flush of the current batch
+// it falls back to the batched path if the priority channel is full
+func (a *activity) LogPriorityActivity(requestId string, count int) {
+	logEntry := activityRequestDto{
+		RequestId: requestId,
+		Count:     count,
+		Tags:      a.tags,
+	}
+
+	a.emit(requestId, count)
+	select {
+	case a.priorityChannel <- logEntry:
+	default:
+		a.enqueue(requestId, count)
+	}
+}
+
+// emit send the entry to the real-time stream without blocking, it's dropped if the stream is full
+func (a *activity) emit(requestId string, count int) {
+	if a.stream == nil {
+		return
+	}
+	select {
+	case a.stream <- Event{RequestId: requestId, Count: count}:
+	default:
+		droppedEvents.Inc()
+	}
+}
+
 // BatchProcessor runs in a separate goroutine and batches logs.
+// failed batches are kept for retry and the flush interval backs off exponentially until the backend recovers
 func (a *activity) BatchProcessor() {
 	var batch []activityRequestDto
-	flushTimer := time.NewTimer(time.Duration(a.flushInterval) * time.Second)
+	interval := a.flushInterval
+	flushTimer := time.NewTimer(time.Duration(interval) * time.Second)
+	var replay <-chan time.Time
+	if a.spill != nil {
+		// recover the entries spilled before a restart
+		a.replaySpill()
+		replayTicker := time.NewTicker(time.Duration(a.spillReplay) * time.Second)
+		defer replayTicker.Stop()
+		replay = replayTicker.C
+	}
 	for {
 		select {
 		case logEntry := <-a.logsChannel:
 			batch = append(batch, logEntry)
-			if len(batch) >= a.batchSize {
-				a.FlushLogs(batch)
-				batch = nil // clear the batch
+			// while backing off only the timer flushes, so we don't hammer a failing backend
+			if len(batch) >= a.batchSize && interval == a.flushInterval {
+				batch, interval = a.flush(batch, interval)
+			}
+			batch = a.trimRetryQueue(batch)
+		case logEntry := <-a.priorityChannel:
+			batch = append(batch, logEntry)
+			// the priority entries wait for the timer too while backing off
+			if interval == a.flushInterval {
+				batch, interval = a.flush(batch, interval)
 			}
+			batch = a.trimRetryQueue(batch)
 		case <-flushTimer.C:
 			if len(batch) > 0 {
-				a.FlushLogs(batch)
-				batch = nil // clear the batch
+				batch, interval = a.flush(batch, interval)
 			}
-			flushTimer.Reset(time.Duration(a.flushInterval) * time.Second)
+			flushTimer.Reset(time.Duration(interval) * time.Second)
+		case <-replay:
+			// don't replay into a failing backend, the spill is retried on the next tick
+			if interval == a.flushInterval {
+				a.replaySpill()
+			}
+		case <-a.done:
+			// flush the buffered entries once before stopping
+			flushTimer.Stop()
+			for len(a.logsChannel) > 0 {
+				batch = append(batch, <-a.logsChannel)
+			}
+			for len(a.priorityChannel) > 0 {
+				batch = append(batch, <-a.priorityChannel)
+			}
+			if len(batch) > 0 {
+				if remaining, _ := a.flush(batch, a.flushInterval); len(remaining) > 0 {
+					a.spillEntries(remaining)
+				}
+			}
+			close(a.flushed)
+			return
 		}
 	}
 }
 
+// Close stop the batch processor after a last flush of the buffered entries
+// it waits for the last flush to complete until the context is done, then the in-flight flush is cancelled
+// and its entries are spilled if a spill is configured
+func (a *activity) Close(ctx context.Context) error {
+	a.closeOnce.Do(func() {
+		close(a.done)
+	})
+	select {
+	case <-a.flushed:
+		return nil
+	case <-ctx.Done():
+		a.cancel()
+		return ctx.Err()
+	}
+}
+
+// flush sends the pending entries in chunks of batchSize
+// it returns the entries that couldn't be flushed and the next flush interval
+func (a *activity) flush(pending []activityRequestDto, interval int) ([]activityRequestDto, int) {
+	if interval != a.flushInterval {
+		// backing off means the pending entries already failed to flush
+		retriedFlushes.Inc()
+	}
+	for len(pending) > 0 {
+		end := a.batchSize
+		if end > len(pending) {
+			end = len(pending)
+		}
+		start := time.Now()
+		err := a.FlushLogs(a.ctx, pending[:end])
+		flushLatencySecs.Observe(time.Since(start).Seconds())
+		if err != nil {
+			failedFlushes.Inc()
+			//backoff exponentially while the backend is failing
+			interval *= 2
+			if interval > a.maxFlushInterval {
+				interval = a.maxFlushInterval
+			}
+			return pending, interval
+		}
+		flushedBatches.Inc()
+		flushBatchSize.Observe(float64(end))
+		pending = pending[end:]
+	}
+	// clear the batch and return to the normal cadence
+	return nil, a.flushInterval
+}
+
+// trimRetryQueue drops the oldest entries when the pending entries exceed maxRetryQueueSize
+func (a *activity) trimRetryQueue(pending []activityRequestDto) []activityRequestDto {
+	overflow := len(pending) - a.maxRetryQueueSize
+	if overflow <= 0 {
+		return pending
+	}
+	if a.spillEntries(pending[:overflow]) {
+		return append([]activityRequestDto(nil), pending[overflow:]...)
+	}
+	droppedTotal.Add(uint64(overflow))
+	dropped := atomic.AddUint64(&a.droppedEntries, uint64(overflow))
+	a.logger.Printf("Dropped %d oldest log entries due to full retry queue, total dropped: %d", overflow, dropped)
+	return append([]activityRequestDto(nil), pending[overflow:]...)
+}
+
+// spillEntries write the entries to the spill file, it returns false when they must be dropped instead
+func (a *activity) spillEntries(entries []activityRequestDto) bool {
+	if a.spill == nil {
+		return false
+	}
+	if err := a.spill.write(entries); err != nil {
+		a.logger.Printf("Failed to spill %d log entries: %s", len(entries), err.Error())
+		return false
+	}
+	return true
+}
+
+// replaySpill flush the spilled entries, the entries that still fail are spilled again
+func (a *activity) replaySpill() {
+	entries, err := a.spill.take()
+	if err != nil {
+		a.logger.Printf("Failed to read the spilled log entries: %s", err.Error())
+		return
+	}
+	if len(entries) > 0 {
+		remaining, _ := a.flush(entries, a.flushInterval)
+		replayedTotal.Add(uint64(len(entries) - len(remaining)))
+		if len(remaining) > 0 && !a.spillEntries(remaining) {
+			// keep the files aside so the entries are replayed on the next tick
+			return
+		}
+	}
+	a.spill.release()
+}
+
 // FlushLogs sends a batch of logs to the database.
-func (a *activity) FlushLogs(batch []activityRequestDto) {
+func (a *activity) FlushLogs(ctx context.Context, batch []activityRequestDto) error {
 	// Aggregate the data and send it to the database in batches
 	// Get a buffer from the pool and reset it back
 	buffer := bufferPool.Get().(*bytes.Buffer)
@@ -106,29 +388,45 @@ func (a *activity) FlushLogs(batch []activityRequestDto) {
 	encoder := json.NewEncoder(buffer)
 	err := encoder.Encode(batch)
 	if err != nil {
-		log.Printf("FLUSH_LOGS: %s", err.Error())
-		return
+		a.logger.Printf("FLUSH_LOGS: %s", err.Error())
+		return err
 	}
 	//log.Println(a.remoteAddress, buffer)
-	httpReq, err := http.NewRequest(http.MethodPost, a.remoteAddress, buffer)
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, a.remoteAddress, bytes.NewReader(buffer.Bytes()))
 	if err != nil {
-		log.Printf("FLUSH_LOGS: %s", err.Error())
-		return
+		a.logger.Printf("FLUSH_LOGS: %s", err.Error())
+		return err
 	}
 	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("X-Api-Key", a.apiKey)
+	a.authenticate(httpReq, buffer.Bytes())
 
 	httpRes, err := a.client.Do(httpReq)
-	defer httpRes.Body.Close()
 	if err != nil {
-		log.Printf("FLUSH_LOGS: %s", err.Error())
-		return
+		// the response is nil on transport errors, closing its body would panic the batch processor
+		a.logger.Printf("FLUSH_LOGS: %s", err.Error())
+		return err
 	}
+	defer httpRes.Body.Close()
 
 	if httpRes.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(httpRes.Body)
-		log.Printf("unexpected status code: %d, body: %s", httpRes.StatusCode, string(bodyBytes))
-		return
+		a.logger.Printf("unexpected status code: %d, body: %s", httpRes.StatusCode, string(bodyBytes))
+		return fmt.Errorf("unexpected status code: %d", httpRes.StatusCode)
 	}
 
+	return nil
+}
+
+// authenticate set the authentication headers of the configured scheme
+func (a *activity) authenticate(httpReq *http.Request, body []byte) {
+	switch a.authScheme {
+	case AuthBearer:
+		httpReq.Header.Set("Authorization", "Bearer "+a.apiKey)
+	case AuthHMAC:
+		mac := hmac.New(sha256.New, []byte(a.hmacSecret))
+		mac.Write(body)
+		httpReq.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	default:
+		httpReq.Header.Set("X-Api-Key", a.apiKey)
+	}
 }
@@ -0,0 +1,460 @@
+package activity
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testBackend record the batches posted to the activity backend, it fails them while failing is set
+type testBackend struct {
+	mu      sync.Mutex
+	batches [][]activityRequestDto
+	headers []http.Header
+	hosts   []string
+	bodies  [][]byte
+	failing bool
+	posts   chan struct{}
+}
+
+func newTestBackend(t *testing.T) (*testBackend, *httptest.Server) {
+	backend := &testBackend{posts: make(chan struct{}, 100)}
+	server := httptest.NewServer(backend)
+	t.Cleanup(server.Close)
+	return backend, server
+}
+
+func (b *testBackend) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	b.mu.Lock()
+	failing := b.failing
+	if !failing {
+		var batch []activityRequestDto
+		_ = json.Unmarshal(body, &batch)
+		b.batches = append(b.batches, batch)
+		b.headers = append(b.headers, req.Header.Clone())
+		b.hosts = append(b.hosts, req.Host)
+		b.bodies = append(b.bodies, body)
+	}
+	b.mu.Unlock()
+	select {
+	case b.posts <- struct{}{}:
+	default:
+	}
+	if failing {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+}
+
+func (b *testBackend) fail(failing bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failing = failing
+}
+
+// received return the number of entries of the successful batches
+func (b *testBackend) received() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	received := 0
+	for _, batch := range b.batches {
+		received += len(batch)
+	}
+	return received
+}
+
+// awaitPost wait for a post to reach the backend, false if none did within the timeout
+func (b *testBackend) awaitPost(timeout time.Duration) bool {
+	select {
+	case <-b.posts:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func newTestActivity(options Options) *activity {
+	if options.BufferSize == 0 {
+		options.BufferSize = 100
+	}
+	if options.BatchSize == 0 {
+		options.BatchSize = 10
+	}
+	if options.FlushInterval == 0 {
+		options.FlushInterval = 60
+	}
+	return NewActivity(options).(*activity)
+}
+
+func entries(count int) []activityRequestDto {
+	pending := make([]activityRequestDto, count)
+	for i := range pending {
+		pending[i] = activityRequestDto{RequestId: "user", Count: i + 1}
+	}
+	return pending
+}
+
+func TestFlushBacksOffDuringOutage(t *testing.T) {
+	backend, server := newTestBackend(t)
+	a := newTestActivity(Options{RemoteAddress: server.URL, BatchSize: 5, FlushInterval: 1, MaxFlushInterval: 8, MaxRetryQueueSize: 20})
+	backend.fail(true)
+
+	pending, interval := entries(5), a.flushInterval
+	var intervals []int
+	for i := 0; i < 6; i++ {
+		// new entries keep arriving during the outage
+		pending = append(pending, entries(10)...)
+		pending, interval = a.flush(pending, interval)
+		pending = a.trimRetryQueue(pending)
+		intervals = append(intervals, interval)
+		if len(pending) > a.maxRetryQueueSize {
+			t.Fatalf("expected at most %d pending entries, got %d", a.maxRetryQueueSize, len(pending))
+		}
+	}
+	expected := []int{2, 4, 8, 8, 8, 8}
+	for i := range expected {
+		if intervals[i] != expected[i] {
+			t.Fatalf("expected the intervals %v, got %v", expected, intervals)
+		}
+	}
+	// the newest entries are the ones kept
+	if last := pending[len(pending)-1]; last.Count != 10 {
+		t.Errorf("expected the oldest entries to be dropped, the last pending one is %+v", last)
+	}
+
+	backend.fail(false)
+	pending, interval = a.flush(pending, interval)
+	if len(pending) != 0 || interval != a.flushInterval {
+		t.Errorf("expected the recovery to flush everything at the normal interval, got %d pending at %ds", len(pending), interval)
+	}
+	if backend.received() != a.maxRetryQueueSize {
+		t.Errorf("expected the %d kept entries to be delivered, got %d", a.maxRetryQueueSize, backend.received())
+	}
+}
+
+// startTestActivity run the batch processor until the test ends
+func startTestActivity(t *testing.T, options Options) *activity {
+	a := newTestActivity(options)
+	go a.BatchProcessor()
+	t.Cleanup(func() {
+		_ = a.Close(context.Background())
+	})
+	return a
+}
+
+func TestPriorityActivityFlushesPromptly(t *testing.T) {
+	backend, server := newTestBackend(t)
+	a := startTestActivity(t, Options{RemoteAddress: server.URL, BatchSize: 10, FlushInterval: 60})
+
+	a.LogActivity("user", 1)
+	a.LogActivity("user", 1)
+	if backend.awaitPost(100 * time.Millisecond) {
+		t.Fatalf("expected the normal entries to wait for the batch")
+	}
+
+	a.LogPriorityActivity("user", 50)
+	if !backend.awaitPost(time.Second) {
+		t.Fatalf("expected the priority entry to be flushed promptly")
+	}
+	if received := backend.received(); received != 3 {
+		t.Errorf("expected the priority entry to flush the current batch, got %d entries", received)
+	}
+
+	a.LogActivity("user", 1)
+	if backend.awaitPost(100 * time.Millisecond) {
+		t.Errorf("expected the normal entries to keep batching after the priority flush")
+	}
+}
+
+func TestPriorityActivityWaitsWhileBackingOff(t *testing.T) {
+	backend, server := newTestBackend(t)
+	a := startTestActivity(t, Options{RemoteAddress: server.URL, BatchSize: 10, FlushInterval: 60, MaxFlushInterval: 600})
+	backend.fail(true)
+
+	a.LogPriorityActivity("user", 50)
+	if !backend.awaitPost(time.Second) {
+		t.Fatalf("expected the priority entry to be flushed promptly")
+	}
+	a.LogPriorityActivity("user", 50)
+	if backend.awaitPost(200 * time.Millisecond) {
+		t.Errorf("expected the priority entries to wait for the backoff timer of the failing backend")
+	}
+}
+
+func TestFlushLogsAuthSchemes(t *testing.T) {
+	tests := []struct {
+		name   string
+		scheme string
+		header string
+		value  func(body []byte) string
+	}{
+		{"apikey", AuthAPIKey, "X-Api-Key", func(body []byte) string { return "key" }},
+		{"default", "", "X-Api-Key", func(body []byte) string { return "key" }},
+		{"bearer", AuthBearer, "Authorization", func(body []byte) string { return "Bearer key" }},
+		{"hmac", AuthHMAC, "X-Signature", func(body []byte) string {
+			mac := hmac.New(sha256.New, []byte("shared"))
+			mac.Write(body)
+			return hex.EncodeToString(mac.Sum(nil))
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend, server := newTestBackend(t)
+			a := newTestActivity(Options{RemoteAddress: server.URL, APIKey: "key", AuthScheme: test.scheme, HMACSecret: "shared"})
+
+			if err := a.FlushLogs(context.Background(), entries(3)); err != nil {
+				t.Fatalf("failed to flush the logs: %s", err)
+			}
+			header, body := backend.headers[0], backend.bodies[0]
+			if value := header.Get(test.header); value != test.value(body) {
+				t.Errorf("expected the %s header %q, got %q", test.header, test.value(body), value)
+			}
+			for _, other := range []string{"X-Api-Key", "Authorization", "X-Signature"} {
+				if other != test.header && header.Get(other) != "" {
+					t.Errorf("expected only the %s header to be set, got %s too", test.header, other)
+				}
+			}
+		})
+	}
+}
+
+func TestFlushMetrics(t *testing.T) {
+	backend, server := newTestBackend(t)
+	a := newTestActivity(Options{RemoteAddress: server.URL, BatchSize: 5, FlushInterval: 1, MaxFlushInterval: 8})
+	batches, failures, retries := flushedBatches.Value(), failedFlushes.Value(), retriedFlushes.Value()
+	sizes, sizesSum, latencies := flushBatchSize.Count(), flushBatchSize.Sum(), flushLatencySecs.Count()
+
+	pending, interval := a.flush(entries(8), a.flushInterval)
+	backend.fail(true)
+	pending, interval = a.flush(entries(3), interval)
+	backend.fail(false)
+	pending, _ = a.flush(pending, interval)
+
+	if len(pending) != 0 {
+		t.Fatalf("expected every entry to be flushed, got %d pending", len(pending))
+	}
+	if delta := flushedBatches.Value() - batches; delta != 3 {
+		t.Errorf("expected 3 flushed batches, got %d", delta)
+	}
+	if delta := failedFlushes.Value() - failures; delta != 1 {
+		t.Errorf("expected 1 failed flush, got %d", delta)
+	}
+	if delta := retriedFlushes.Value() - retries; delta != 1 {
+		t.Errorf("expected 1 retried flush, got %d", delta)
+	}
+	if count, sum := flushBatchSize.Count()-sizes, flushBatchSize.Sum()-sizesSum; count != 3 || sum != 11 {
+		t.Errorf("expected 3 batches of 11 entries in total, got %d of %v", count, sum)
+	}
+	if delta := flushLatencySecs.Count() - latencies; delta != 4 {
+		t.Errorf("expected the latency of the 4 flushes, got %d", delta)
+	}
+}
+
+func TestFlushLogsOutboundProxy(t *testing.T) {
+	// the outbound proxy answers the activity requests itself
+	backend, proxy := newTestBackend(t)
+	a := newTestActivity(Options{RemoteAddress: "http://activity.invalid/stats", ProxyURL: proxy.URL})
+
+	if err := a.FlushLogs(context.Background(), entries(2)); err != nil {
+		t.Fatalf("failed to flush the logs through the proxy: %s", err)
+	}
+	if backend.received() != 2 || backend.hosts[0] != "activity.invalid" {
+		t.Errorf("expected the batch to go through the outbound proxy, got the hosts %v", backend.hosts)
+	}
+}
+
+func TestActivityStream(t *testing.T) {
+	stream := make(chan Event, 3)
+	_, server := newTestBackend(t)
+	a := newTestActivity(Options{RemoteAddress: server.URL, Stream: stream})
+	dropped := droppedEvents.Value()
+
+	a.LogActivity("alice", 1)
+	a.LogPriorityActivity("bob", 50)
+	a.LogActivity("alice", 3)
+	// the full stream drops the event instead of blocking the request
+	a.LogActivity("carol", 1)
+
+	expected := []Event{{RequestId: "alice", Count: 1}, {RequestId: "bob", Count: 50}, {RequestId: "alice", Count: 3}}
+	for _, event := range expected {
+		if received := <-stream; received != event {
+			t.Errorf("expected the event %+v, got %+v", event, received)
+		}
+	}
+	if delta := droppedEvents.Value() - dropped; delta != 1 {
+		t.Errorf("expected the event beyond the stream buffer to be dropped, got %d dropped", delta)
+	}
+}
+
+func TestActivityTags(t *testing.T) {
+	tests := []struct {
+		name string
+		tags map[string]string
+	}{
+		{"tagged", map[string]string{"region": "eu-west-1", "environment": "production"}},
+		{"untagged", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend, server := newTestBackend(t)
+			tags := map[string]string{}
+			for key, value := range test.tags {
+				tags[key] = value
+			}
+			a := startTestActivity(t, Options{RemoteAddress: server.URL, Tags: tags})
+			// the configured tags can't be changed behind the activity back
+			tags["region"] = "us-east-1"
+
+			a.LogActivity("user", 1)
+			a.LogPriorityActivity("user", 50)
+			if err := a.Close(context.Background()); err != nil {
+				t.Fatalf("failed to close the activity: %s", err)
+			}
+
+			if backend.received() != 2 {
+				t.Fatalf("expected the 2 entries to be flushed, got %d", backend.received())
+			}
+			for _, body := range backend.bodies {
+				var payload []map[string]json.RawMessage
+				if err := json.Unmarshal(body, &payload); err != nil {
+					t.Fatalf("failed to decode the payload %s: %s", body, err)
+				}
+				for _, entry := range payload {
+					raw, ok := entry["tags"]
+					if test.tags == nil {
+						if ok {
+							t.Errorf("expected the tags to be omitted, got %s", body)
+						}
+						continue
+					}
+					var tags map[string]string
+					_ = json.Unmarshal(raw, &tags)
+					if len(tags) != 2 || tags["region"] != "eu-west-1" || tags["environment"] != "production" {
+						t.Errorf("expected the configured tags with every entry, got %s", body)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCloseFlushesPendingOnce(t *testing.T) {
+	backend, server := newTestBackend(t)
+	a := startTestActivity(t, Options{RemoteAddress: server.URL, BatchSize: 10, FlushInterval: 60})
+
+	for i := 0; i < 3; i++ {
+		a.LogActivity("user", 1)
+	}
+	for i := 0; i < 2; i++ {
+		if err := a.Close(context.Background()); err != nil {
+			t.Fatalf("failed to close the activity: %s", err)
+		}
+	}
+
+	// the second close doesn't flush again
+	if len(backend.batches) != 1 || backend.received() != 3 {
+		t.Errorf("expected the pending entries to be flushed once, got the batches %v", backend.batches)
+	}
+}
+
+func TestCloseContextDone(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(release) })
+	a := startTestActivity(t, Options{RemoteAddress: server.URL, BatchSize: 10, FlushInterval: 60})
+	a.LogActivity("user", 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := a.Close(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected the close to give up with the context, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the close to return at the deadline, took %s", elapsed)
+	}
+}
+
+func TestFlushLogsUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	a := newTestActivity(Options{RemoteAddress: server.URL})
+
+	if err := a.FlushLogs(context.Background(), entries(2)); err == nil {
+		t.Errorf("expected the flush to an unreachable address to fail")
+	}
+}
+
+func TestBatchProcessorSurvivesTransportErrors(t *testing.T) {
+	backend, _ := newTestBackend(t)
+	var posts int32
+	failing := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&posts, 1) == 1 {
+			// the first flush gets its connection cut without a response
+			conn, _, _ := rw.(http.Hijacker).Hijack()
+			_ = conn.Close()
+			return
+		}
+		backend.ServeHTTP(rw, req)
+	}))
+	t.Cleanup(failing.Close)
+	a := startTestActivity(t, Options{RemoteAddress: failing.URL, FlushInterval: 1, MaxFlushInterval: 1})
+
+	a.LogPriorityActivity("user", 50)
+	if !backend.awaitPost(5 * time.Second) {
+		t.Fatalf("expected the batch processor to retry the flush after the transport error")
+	}
+	if backend.received() != 1 || atomic.LoadInt32(&posts) != 2 {
+		t.Errorf("expected the entry to be delivered by the retry, got %d entries after %d posts", backend.received(), posts)
+	}
+}
+
+func TestCloseCancelsInflightFlush(t *testing.T) {
+	cancelled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// the server only notices the client going away once the body is read
+		_, _ = io.Copy(io.Discard, req.Body)
+		select {
+		case <-req.Context().Done():
+			close(cancelled)
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	t.Cleanup(server.Close)
+	a := startTestActivity(t, Options{RemoteAddress: server.URL})
+	a.LogPriorityActivity("user", 50)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_ = a.Close(ctx)
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Errorf("expected the in-flight flush to be cancelled once Close gave up")
+	}
+}
+
+func TestFlushLogsContext(t *testing.T) {
+	_, server := newTestBackend(t)
+	a := newTestActivity(Options{RemoteAddress: server.URL})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := a.FlushLogs(ctx, entries(1)); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the flush to fail with the cancelled context, got %v", err)
+	}
+}
@@ -0,0 +1,124 @@
+package activity
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/kotalco/crossover-managed/logger"
+	"github.com/kotalco/crossover-managed/metrics"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+const (
+	DefaultMaxSpillBytes       = 64 << 20 // max size of the spill file before it's rotated
+	DefaultSpillReplayInterval = 60       // sec
+	RotatedSpillSuffix         = ".1"
+	ReplaySpillSuffix          = ".replay"
+)
+
+var (
+	spilledTotal  = metrics.NewCounter("crossover_activity_spilled_entries_total", "Number of activity entries spilled to disk instead of being dropped")
+	replayedTotal = metrics.NewCounter("crossover_activity_replayed_entries_total", "Number of spilled activity entries replayed to the backend")
+)
+
+// spill an append-only log of the entries that didn't fit in the buffers, one json entry per line
+// the active file is rotated once it reaches maxBytes, only the last rotated file is kept
+type spill struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	logger   *logger.Logger
+}
+
+func newSpill(path string, maxBytes int64, logger *logger.Logger) *spill {
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxSpillBytes
+	}
+	return &spill{path: path, maxBytes: maxBytes, logger: logger}
+}
+
+// write append the entries to the active spill file, rotating it when it would exceed maxBytes
+func (s *spill) write(entries []activityRequestDto) error {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if info, err := os.Stat(s.path); err == nil && info.Size()+int64(buffer.Len()) > s.maxBytes {
+		if _, err := os.Stat(s.path + RotatedSpillSuffix); err == nil {
+			s.logger.Printf("Spill file %s rotated before its entries were replayed, they're lost", s.path+RotatedSpillSuffix)
+		}
+		if err := os.Rename(s.path, s.path+RotatedSpillSuffix); err != nil {
+			return err
+		}
+	}
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(buffer.Bytes()); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	spilledTotal.Add(uint64(len(entries)))
+	return file.Close()
+}
+
+// take move the spilled files aside and return their entries, new entries keep being spilled to a fresh file
+// files left aside by an interrupted replay are taken again, so entries are replayed at least once
+func (s *spill) take() ([]activityRequestDto, error) {
+	files := []string{s.path + RotatedSpillSuffix, s.path}
+	s.mu.Lock()
+	for _, file := range files {
+		if _, err := os.Stat(file + ReplaySpillSuffix); err == nil {
+			continue
+		}
+		if err := os.Rename(file, file+ReplaySpillSuffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			s.mu.Unlock()
+			return nil, err
+		}
+	}
+	s.mu.Unlock()
+
+	var entries []activityRequestDto
+	for _, file := range files {
+		content, err := os.ReadFile(file + ReplaySpillSuffix)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(content))
+		for scanner.Scan() {
+			var entry activityRequestDto
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				// a torn write of a crash, skip the partial line
+				continue
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// release remove the files moved aside by take once their entries are flushed or spilled again
+func (s *spill) release() {
+	for _, file := range []string{s.path + RotatedSpillSuffix, s.path} {
+		if err := os.Remove(file + ReplaySpillSuffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			s.logger.Printf("Failed to remove replayed spill file %s: %s", file+ReplaySpillSuffix, err.Error())
+		}
+	}
+}
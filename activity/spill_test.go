@@ -0,0 +1,112 @@
+package activity
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSpillBufferOverflow(t *testing.T) {
+	backend, server := newTestBackend(t)
+	path := filepath.Join(t.TempDir(), "activity.spill")
+	a := newTestActivity(Options{RemoteAddress: server.URL, BufferSize: 2, SpillPath: path})
+	spilled := spilledTotal.Value()
+
+	for i := 0; i < 5; i++ {
+		a.LogActivity("user", 1)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("expected the overflowing entries to be spilled: %s", err)
+	}
+	if lines := bytes.Count(content, []byte("\n")); lines != 3 {
+		t.Errorf("expected the 3 entries beyond the buffer in the spill file, got %d", lines)
+	}
+	if delta := spilledTotal.Value() - spilled; delta != 3 {
+		t.Errorf("expected 3 spilled entries, got %d", delta)
+	}
+
+	replayed := replayedTotal.Value()
+	a.replaySpill()
+	if backend.received() != 3 || replayedTotal.Value()-replayed != 3 {
+		t.Errorf("expected the spilled entries to be replayed, got %d entries", backend.received())
+	}
+	if matches, _ := filepath.Glob(path + "*"); len(matches) != 0 {
+		t.Errorf("expected the replayed spill files to be removed, got %v", matches)
+	}
+}
+
+func TestSpillReplayFailure(t *testing.T) {
+	backend, server := newTestBackend(t)
+	path := filepath.Join(t.TempDir(), "activity.spill")
+	a := newTestActivity(Options{RemoteAddress: server.URL, SpillPath: path})
+	if err := a.spill.write(entries(4)); err != nil {
+		t.Fatalf("failed to spill the entries: %s", err)
+	}
+
+	backend.fail(true)
+	a.replaySpill()
+	if replay, err := a.spill.take(); err != nil || len(replay) != 4 {
+		t.Fatalf("expected the entries failing to replay to stay spilled, got %d %v", len(replay), err)
+	}
+
+	backend.fail(false)
+	a.replaySpill()
+	if backend.received() != 4 {
+		t.Errorf("expected the entries to be replayed once the backend recovers, got %d", backend.received())
+	}
+}
+
+func TestSpillReplayedOnStartup(t *testing.T) {
+	backend, server := newTestBackend(t)
+	path := filepath.Join(t.TempDir(), "activity.spill")
+	// the entries spilled by the previous process
+	if err := newSpill(path, 0, nil).write(entries(2)); err != nil {
+		t.Fatalf("failed to spill the entries: %s", err)
+	}
+
+	startTestActivity(t, Options{RemoteAddress: server.URL, SpillPath: path})
+
+	if !backend.awaitPost(time.Second) || backend.received() != 2 {
+		t.Errorf("expected the spilled entries to be replayed on startup, got %d", backend.received())
+	}
+}
+
+func TestSpillRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "activity.spill")
+	s := newSpill(path, 100, nil)
+
+	for i := 0; i < 4; i++ {
+		if err := s.write(entries(1)); err != nil {
+			t.Fatalf("failed to spill the entry: %s", err)
+		}
+	}
+	if _, err := os.Stat(path + RotatedSpillSuffix); err != nil {
+		t.Fatalf("expected the spill file to be rotated past 100 bytes: %s", err)
+	}
+	if info, _ := os.Stat(path); info.Size() > 100 {
+		t.Errorf("expected the active spill file within 100 bytes, got %d", info.Size())
+	}
+
+	spilled, err := s.take()
+	if err != nil || len(spilled) != 4 {
+		t.Errorf("expected the entries of both files to be taken, got %d %v", len(spilled), err)
+	}
+}
+
+func TestSpillSkipsTornWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "activity.spill")
+	s := newSpill(path, 0, nil)
+	if err := s.write(entries(2)); err != nil {
+		t.Fatalf("failed to spill the entries: %s", err)
+	}
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	_, _ = file.WriteString(`{"request_id":"user","cou`)
+	file.Close()
+
+	if spilled, err := s.take(); err != nil || len(spilled) != 2 {
+		t.Errorf("expected the partial line to be skipped, got %d entries %v", len(spilled), err)
+	}
+}
@@ -0,0 +1,259 @@
+package crossover_managed
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/kotalco/crossover-managed/cache"
+	"github.com/kotalco/resp"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	PlanOverridesRoute = "/plan-overrides"
+	CacheExplainRoute  = "/cache-explain"
+	CacheSavingsRoute  = "/cache-savings"
+	CacheKeysRoute     = "/cache-keys"
+)
+
+// MaxAdminBodyBytes bound the body of the admin routes, they're decoded whole in memory
+const MaxAdminBodyBytes = 64 << 10
+
+// planOverrideDto the body of the plan override admin route
+type planOverrideDto struct {
+	UserId string `json:"user_id"`
+	Limit  int    `json:"limit"`
+	TTL    int    `json:"ttl"`
+}
+
+// cacheExplainDto the sample request and response of the cache explain admin route
+type cacheExplainDto struct {
+	Method   string              `json:"method"`
+	Path     string              `json:"path"`
+	Query    string              `json:"query"`
+	Headers  map[string][]string `json:"headers"`
+	UserId   string              `json:"user_id"`
+	Response struct {
+		Status   int                 `json:"status"`
+		Headers  map[string][]string `json:"headers"`
+		BodySize int                 `json:"body_size"`
+	} `json:"response"`
+}
+
+// adminResponse the envelope of every admin route response
+type adminResponse struct {
+	Success bool        `json:"success"`
+	Data    interface{} `json:"data,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// adminError an admin route failure exposed to the client with its status code
+type adminError struct {
+	status  int
+	message string
+}
+
+func (e *adminError) Error() string {
+	return e.message
+}
+
+// adminHandler serve an admin route method and return the data of the envelope
+// errors other than adminError are logged and returned as 500
+type adminHandler func(req *http.Request, respClient resp.IClient) (interface{}, error)
+
+// adminRoute the handlers of an admin route per method
+type adminRoute struct {
+	methods map[string]adminHandler
+	noRedis bool // the handlers don't use redis, they get a nil client
+}
+
+// adminRoutes return the admin routes
+func (crossover *Crossover) adminRoutes() map[string]adminRoute {
+	return map[string]adminRoute{
+		PlanOverridesRoute: {methods: map[string]adminHandler{
+			http.MethodPut:    crossover.setPlanOverride,
+			http.MethodDelete: crossover.clearPlanOverride,
+		}},
+		CacheExplainRoute: {methods: map[string]adminHandler{
+			http.MethodPost: crossover.explainCache,
+		}, noRedis: true},
+		CacheSavingsRoute: {methods: map[string]adminHandler{
+			http.MethodGet: crossover.cacheSavings,
+		}, noRedis: true},
+		CacheKeysRoute: {methods: map[string]adminHandler{
+			http.MethodGet: crossover.cacheKeys,
+		}},
+	}
+}
+
+// serveAdmin handle the internal admin routes of the trusted requests, it returns false if the request isn't an admin one
+func (crossover *Crossover) serveAdmin(rw http.ResponseWriter, req *http.Request, trusted bool) bool {
+	// match the admin path segment by segment, /adminX is a regular request
+	path := req.URL.Path
+	if crossover.adminPath == "" || (path != crossover.adminPath && !strings.HasPrefix(path, crossover.adminPath+"/")) {
+		return false
+	}
+	if !trusted {
+		writeAdminError(rw, http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+		return true
+	}
+
+	route, ok := crossover.adminRoutes()[strings.TrimPrefix(req.URL.Path, crossover.adminPath)]
+	if !ok {
+		writeAdminError(rw, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		return true
+	}
+	handler, ok := route.methods[req.Method]
+	if !ok {
+		allowed := make([]string, 0, len(route.methods))
+		for method := range route.methods {
+			allowed = append(allowed, method)
+		}
+		sort.Strings(allowed)
+		rw.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeAdminError(rw, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return true
+	}
+
+	req.Body = http.MaxBytesReader(rw, req.Body, MaxAdminBodyBytes)
+
+	var respClient resp.IClient
+	if !route.noRedis {
+		redisClient, err := crossover.redisClient(req.Context())
+		if err != nil {
+			crossover.logger.Printf("Failed to create Redis Connection %s", err.Error())
+			writeAdminError(rw, http.StatusInternalServerError, "something went wrong")
+			return true
+		}
+		defer redisClient.Close()
+		respClient = redisClient
+	}
+
+	data, err := handler(req, respClient)
+	if err != nil {
+		var adminErr *adminError
+		if errors.As(err, &adminErr) {
+			writeAdminError(rw, adminErr.status, adminErr.message)
+			return true
+		}
+		crossover.logger.Printf("Admin route %s failed %s", req.URL.Path, err.Error())
+		writeAdminError(rw, http.StatusInternalServerError, "something went wrong")
+		return true
+	}
+	writeAdminResponse(rw, http.StatusOK, adminResponse{Success: true, Data: data})
+	return true
+}
+
+// decodeAdminBody decode the json body of an admin request, the bodies over MaxAdminBodyBytes are rejected as too large
+// and the malformed ones with the invalid message
+func decodeAdminBody(req *http.Request, dto interface{}, invalid string) error {
+	if err := json.NewDecoder(req.Body).Decode(dto); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return &adminError{status: http.StatusRequestEntityTooLarge, message: http.StatusText(http.StatusRequestEntityTooLarge)}
+		}
+		return &adminError{status: http.StatusBadRequest, message: invalid}
+	}
+	return nil
+}
+
+// setPlanOverride grant a user a custom limit
+func (crossover *Crossover) setPlanOverride(req *http.Request, respClient resp.IClient) (interface{}, error) {
+	var dto planOverrideDto
+	if err := decodeAdminBody(req, &dto, "invalid plan override"); err != nil {
+		return nil, err
+	}
+	if dto.UserId == "" || dto.Limit < 0 || dto.TTL <= 0 {
+		return nil, &adminError{status: http.StatusBadRequest, message: "invalid plan override"}
+	}
+	if err := crossover.limiterService.SetPlanOverride(req.Context(), dto.UserId, dto.Limit, dto.TTL, respClient); err != nil {
+		return nil, err
+	}
+	return dto, nil
+}
+
+// clearPlanOverride remove the custom limit of the ?user_id= user
+func (crossover *Crossover) clearPlanOverride(req *http.Request, respClient resp.IClient) (interface{}, error) {
+	userId := req.URL.Query().Get("user_id")
+	if userId == "" {
+		return nil, &adminError{status: http.StatusBadRequest, message: "invalid user_id"}
+	}
+	return nil, crossover.limiterService.ClearPlanOverride(req.Context(), userId, respClient)
+}
+
+// explainCache report the cache key and decision of a sample request and response without calling the upstream nor redis
+func (crossover *Crossover) explainCache(req *http.Request, respClient resp.IClient) (interface{}, error) {
+	var dto cacheExplainDto
+	if err := decodeAdminBody(req, &dto, "invalid request spec"); err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(dto.Path, "/") {
+		return nil, &adminError{status: http.StatusBadRequest, message: "invalid request spec"}
+	}
+	if dto.Method == "" {
+		dto.Method = http.MethodGet
+	}
+	sample, err := http.NewRequestWithContext(req.Context(), dto.Method, "http://explain"+dto.Path, nil)
+	if err != nil {
+		return nil, &adminError{status: http.StatusBadRequest, message: "invalid request spec"}
+	}
+	sample.URL.RawQuery = dto.Query
+	for key, values := range dto.Headers {
+		for _, value := range values {
+			sample.Header.Add(key, value)
+		}
+	}
+	if dto.UserId == "" {
+		dto.UserId = crossover.extractUserID(sample.URL.Path)
+	}
+	if _, bypass := crossover.cacheBypass.Match(sample.URL.Path); bypass {
+		return cache.Explanation{Reason: "path bypasses the cache"}, nil
+	}
+	sample = crossover.cacheKeyPath(crossover.blockTTL(sample))
+
+	if dto.Response.Status == 0 {
+		dto.Response.Status = http.StatusOK
+	}
+	// only the body size matters to the decision, bound it to avoid allocating arbitrary sizes
+	bodySize := dto.Response.BodySize
+	if bodySize < 0 {
+		bodySize = 0
+	}
+	if bodySize > cache.MaxCacheableBodySize+1 {
+		bodySize = cache.MaxCacheableBodySize + 1
+	}
+	response := cache.CachedResponse{
+		StatusCode: dto.Response.Status,
+		Headers:    http.Header{},
+		Body:       make([]byte, bodySize),
+	}
+	for key, values := range dto.Response.Headers {
+		for _, value := range values {
+			http.Header(response.Headers).Add(key, value)
+		}
+	}
+	return crossover.cacheService.Explain(sample, response, dto.UserId), nil
+}
+
+// cacheSavings report the backend calls avoided by the cache hits of this instance
+func (crossover *Crossover) cacheSavings(req *http.Request, respClient resp.IClient) (interface{}, error) {
+	return crossover.cacheService.Savings(), nil
+}
+
+// cacheKeys report the estimates of the distinct cache keys per path to spot the fragmented ones
+func (crossover *Crossover) cacheKeys(req *http.Request, respClient resp.IClient) (interface{}, error) {
+	return crossover.cacheService.Cardinality(req.Context(), respClient)
+}
+
+// writeAdminError write a failed admin envelope
+func writeAdminError(rw http.ResponseWriter, status int, message string) {
+	writeAdminResponse(rw, status, adminResponse{Success: false, Error: message})
+}
+
+// writeAdminResponse write the admin envelope as json
+func writeAdminResponse(rw http.ResponseWriter, status int, response adminResponse) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(response)
+}
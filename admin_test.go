@@ -0,0 +1,246 @@
+package crossover_managed
+
+import (
+	"encoding/json"
+	"github.com/kotalco/crossover-managed/cache"
+	"github.com/kotalco/crossover-managed/internal/redistest"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// adminRequest build a request of the admin route authenticated with the test APIKey
+func adminRequest(method string, route string, body string) *http.Request {
+	req := httptest.NewRequest(method, "/admin"+route, strings.NewReader(body))
+	req.Header.Set(TrustedKeyHeader, "secret")
+	return req
+}
+
+func TestPlanOverridesRoute(t *testing.T) {
+	config := testConfig()
+	config.AdminPath = "/admin/"
+	limiterService := &fakeLimiter{allow: true}
+	crossover := newTestPlugin(t, config, &testUpstream{}, WithLimiterService(limiterService))
+
+	rw := do(crossover, adminRequest(http.MethodPut, PlanOverridesRoute, `{"user_id":"`+testUserId+`","limit":500,"ttl":3600}`))
+	if rw.Code != http.StatusOK || limiterService.overrides[testUserId] != 500 {
+		t.Fatalf("expected the override to be set, got %d %s", rw.Code, rw.Body.String())
+	}
+	rw = do(crossover, adminRequest(http.MethodDelete, PlanOverridesRoute+"?user_id="+testUserId, ""))
+	if _, ok := limiterService.overrides[testUserId]; rw.Code != http.StatusOK || ok {
+		t.Errorf("expected the override to be cleared, got %d %s", rw.Code, rw.Body.String())
+	}
+}
+
+// decodeAdmin decode the admin envelope of the response
+func decodeAdmin(t *testing.T, rw *httptest.ResponseRecorder) adminResponse {
+	t.Helper()
+	if contentType := rw.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Fatalf("expected a json envelope, got the Content-Type %q", contentType)
+	}
+	var response adminResponse
+	if err := json.Unmarshal(rw.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to decode the envelope %s: %s", rw.Body.String(), err)
+	}
+	return response
+}
+
+func TestAdminRouter(t *testing.T) {
+	config := testConfig()
+	config.AdminPath = "/admin"
+	upstream := &testUpstream{}
+	crossover := newTestPlugin(t, config, upstream, WithLimiterService(&fakeLimiter{allow: true}))
+
+	for route, handlers := range crossover.adminRoutes() {
+		for method := range handlers.methods {
+			t.Run(method+" "+route, func(t *testing.T) {
+				for _, key := range []string{"", "guess"} {
+					req := adminRequest(method, route, "")
+					req.Header.Set(TrustedKeyHeader, key)
+					rw := do(crossover, req)
+					if response := decodeAdmin(t, rw); rw.Code != http.StatusUnauthorized || response.Success || response.Error == "" {
+						t.Errorf("expected 401 with a failed envelope for the key %q, got %d %s", key, rw.Code, rw.Body.String())
+					}
+				}
+
+				rw := do(crossover, adminRequest(http.MethodPatch, route, ""))
+				if response := decodeAdmin(t, rw); rw.Code != http.StatusMethodNotAllowed || response.Success || rw.Header().Get("Allow") == "" {
+					t.Errorf("expected 405 with the allowed methods, got %d %s", rw.Code, rw.Body.String())
+				}
+			})
+		}
+	}
+
+	rw := do(crossover, adminRequest(http.MethodGet, "/unknown", ""))
+	if response := decodeAdmin(t, rw); rw.Code != http.StatusNotFound || response.Success {
+		t.Errorf("expected 404 for an unknown route, got %d %s", rw.Code, rw.Body.String())
+	}
+	if upstream.count() != 0 {
+		t.Errorf("expected the admin requests never to reach the upstream")
+	}
+}
+
+func TestAdminEnvelope(t *testing.T) {
+	config := testConfig()
+	config.AdminPath = "/admin"
+	crossover := newTestPlugin(t, config, &testUpstream{}, WithLimiterService(&fakeLimiter{allow: true}))
+
+	rw := do(crossover, adminRequest(http.MethodPut, PlanOverridesRoute, `{"user_id":"user","limit":5,"ttl":60}`))
+	response := decodeAdmin(t, rw)
+	if rw.Code != http.StatusOK || !response.Success || response.Error != "" || response.Data == nil {
+		t.Errorf("expected a successful envelope with the data, got %d %s", rw.Code, rw.Body.String())
+	}
+
+	rw = do(crossover, adminRequest(http.MethodPut, PlanOverridesRoute, `{"limit":5}`))
+	response = decodeAdmin(t, rw)
+	if rw.Code != http.StatusBadRequest || response.Success || response.Error != "invalid plan override" {
+		t.Errorf("expected a failed envelope with the error, got %d %s", rw.Code, rw.Body.String())
+	}
+}
+
+func TestAdminPathSegment(t *testing.T) {
+	config := testConfig()
+	config.AdminPath = "/admin"
+	upstream := &testUpstream{body: "ok"}
+	crossover := newTestPlugin(t, config, upstream, WithLimiterService(&fakeLimiter{allow: true}))
+
+	// the paths merely sharing the admin prefix are proxied, not answered 401 or 404
+	for _, path := range []string{"/adminX/" + testRequestId, "/administrators/" + testRequestId} {
+		if rw := do(crossover, httptest.NewRequest(http.MethodGet, path, nil)); rw.Code != http.StatusOK {
+			t.Errorf("expected %s not to be routed to the admin, got %d %s", path, rw.Code, rw.Body.String())
+		}
+	}
+	if upstream.count() != 2 {
+		t.Errorf("expected the requests to reach the upstream, got %d", upstream.count())
+	}
+	for _, path := range []string{"/admin", "/admin/unknown"} {
+		rw := do(crossover, httptest.NewRequest(http.MethodGet, path, nil))
+		if rw.Code != http.StatusUnauthorized {
+			t.Errorf("expected %s to be routed to the admin, got %d", path, rw.Code)
+		}
+	}
+}
+
+func TestAdminBodyTooLarge(t *testing.T) {
+	config := testConfig()
+	config.AdminPath = "/admin"
+	limiterService := &fakeLimiter{allow: true}
+	crossover := newTestPlugin(t, config, &testUpstream{}, WithLimiterService(limiterService))
+
+	body := `{"user_id":"` + testUserId + `","limit":500,"ttl":3600,"padding":"` + strings.Repeat("a", MaxAdminBodyBytes) + `"}`
+	rw := do(crossover, adminRequest(http.MethodPut, PlanOverridesRoute, body))
+	if response := decodeAdmin(t, rw); rw.Code != http.StatusRequestEntityTooLarge || response.Success {
+		t.Errorf("expected 413 for the oversized body, got %d %s", rw.Code, rw.Body.String())
+	}
+	if _, ok := limiterService.overrides[testUserId]; ok {
+		t.Errorf("expected the oversized override not to be set")
+	}
+}
+
+func TestCacheExplainRoute(t *testing.T) {
+	large := strconv.Itoa(cache.MaxCacheableBodySize + 1)
+	tests := []struct {
+		name      string
+		spec      string
+		cacheable bool
+		reason    string
+		ttl       int
+	}{
+		{"cacheable", `{"path":"` + testPath + `"}`, true, "", 60},
+		{"max-age", `{"path":"` + testPath + `","response":{"headers":{"Cache-Control":["max-age=30"]}}}`, true, "", 30},
+		{"method", `{"method":"DELETE","path":"` + testPath + `"}`, false, cache.ReasonMethod, 0},
+		{"server error", `{"path":"` + testPath + `","response":{"status":502}}`, false, cache.ReasonServerError, 0},
+		{"no-store", `{"path":"` + testPath + `","response":{"headers":{"Cache-Control":["no-store"]}}}`, false, cache.ReasonNoStore, 0},
+		{"too large", `{"path":"` + testPath + `","response":{"body_size":` + large + `}}`, false, cache.ReasonBodyTooLarge, 0},
+		{"bypass", `{"path":"/health"}`, false, "path bypasses the cache", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.AdminPath = "/admin"
+			config.CacheBypassPaths = []string{"/health"}
+			server := redistest.NewServer()
+			upstream := &testUpstream{}
+			crossover := newTestPlugin(t, config, upstream, withRedis(server), WithCacheService(cache.NewCache(cache.Options{CacheExpiry: 60})))
+
+			rw := do(crossover, adminRequest(http.MethodPost, CacheExplainRoute, test.spec))
+			response := decodeAdmin(t, rw)
+			if rw.Code != http.StatusOK || !response.Success {
+				t.Fatalf("expected the explanation, got %d %s", rw.Code, rw.Body.String())
+			}
+			data, _ := json.Marshal(response.Data)
+			var explanation cache.Explanation
+			if err := json.Unmarshal(data, &explanation); err != nil {
+				t.Fatalf("failed to decode the explanation %s: %s", data, err)
+			}
+			if explanation.Cacheable != test.cacheable || explanation.Reason != test.reason || explanation.TTL != test.ttl {
+				t.Errorf("expected cacheable %t for %q with the ttl %d, got %+v", test.cacheable, test.reason, test.ttl, explanation)
+			}
+			if test.cacheable && explanation.Key == "" {
+				t.Errorf("expected the cacheable request to report its key")
+			}
+			if upstream.count() != 0 || server.Total() != 0 {
+				t.Errorf("expected neither the upstream nor redis to be called, got %d upstream and %d redis calls", upstream.count(), server.Total())
+			}
+		})
+	}
+}
+
+func TestCacheExplainRouteInvalidSpec(t *testing.T) {
+	config := testConfig()
+	config.AdminPath = "/admin"
+	crossover := newTestPlugin(t, config, &testUpstream{}, WithCacheService(cache.NewCache(cache.Options{CacheExpiry: 60})))
+
+	for _, spec := range []string{`{`, `{"path":"relative"}`} {
+		rw := do(crossover, adminRequest(http.MethodPost, CacheExplainRoute, spec))
+		if response := decodeAdmin(t, rw); rw.Code != http.StatusBadRequest || response.Success {
+			t.Errorf("expected 400 for the spec %s, got %d %s", spec, rw.Code, rw.Body.String())
+		}
+	}
+}
+
+func TestCacheSavingsRoute(t *testing.T) {
+	config := testConfig()
+	config.AdminPath = "/admin"
+	cacheService := cache.NewCache(cache.Options{CacheExpiry: 60, SavingsBreakdown: cache.SavingsByUser})
+	crossover := newTestPlugin(t, config, &testUpstream{body: "ok"}, WithCacheService(cacheService))
+
+	for i := 0; i < 3; i++ {
+		do(crossover, httptest.NewRequest(http.MethodGet, testPath, nil))
+	}
+
+	rw := do(crossover, adminRequest(http.MethodGet, CacheSavingsRoute, ""))
+	response := decodeAdmin(t, rw)
+	data, _ := json.Marshal(response.Data)
+	var savings cache.Savings
+	if err := json.Unmarshal(data, &savings); err != nil || !response.Success {
+		t.Fatalf("expected the savings summary, got %d %s", rw.Code, rw.Body.String())
+	}
+	if savings.Total != 2 || savings.Breakdown[testUserId] != 2 {
+		t.Errorf("expected the 2 hits of the user to be reported, got %+v", savings)
+	}
+}
+
+func TestCacheKeysRoute(t *testing.T) {
+	config := testConfig()
+	config.AdminPath = "/admin"
+	cacheService := cache.NewCache(cache.Options{CacheExpiry: 60, IncludeQuery: true, KeySamples: 1})
+	crossover := newTestPlugin(t, config, &testUpstream{body: "ok"}, WithCacheService(cacheService))
+
+	for _, block := range []string{"1", "2", "2"} {
+		do(crossover, httptest.NewRequest(http.MethodGet, testPath+"?block="+block, nil))
+	}
+
+	rw := do(crossover, adminRequest(http.MethodGet, CacheKeysRoute, ""))
+	response := decodeAdmin(t, rw)
+	data, _ := json.Marshal(response.Data)
+	var cardinality cache.Cardinality
+	if err := json.Unmarshal(data, &cardinality); err != nil || !response.Success {
+		t.Fatalf("expected the cardinality summary, got %d %s", rw.Code, rw.Body.String())
+	}
+	if cardinality.Total != 2 {
+		t.Errorf("expected the 2 distinct keys to be reported, got %+v", cardinality)
+	}
+}
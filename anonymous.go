@@ -0,0 +1,11 @@
+package crossover_managed
+
+// policies of the requests carrying no user id to resolve the plan of
+const (
+	AnonymousDeny   = "deny"   // reject them with 400
+	AnonymousLimit  = "limit"  // limit them on the shared AnonymousPlanLimit budget
+	AnonymousBypass = "bypass" // forward them unlimited, unmetered and uncached
+)
+
+// AnonymousSubject the subject the anonymous requests are limited on, they share a single budget
+const AnonymousSubject = "anonymous"
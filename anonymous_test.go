@@ -0,0 +1,90 @@
+package crossover_managed
+
+import (
+	"github.com/kotalco/crossover-managed/internal/redistest"
+	"github.com/kotalco/crossover-managed/limiter"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAnonymousPolicy(t *testing.T) {
+	tests := []struct {
+		policy   string
+		statuses []int
+		forwards int
+	}{
+		{AnonymousDeny, []int{http.StatusBadRequest, http.StatusBadRequest}, 0},
+		{AnonymousBypass, []int{http.StatusOK, http.StatusOK, http.StatusOK}, 3},
+		// the anonymous budget is the configured limit, never an unlimited plan
+		{AnonymousLimit, []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			config := testConfig()
+			config.AnonymousPolicy = test.policy
+			config.AnonymousPlanLimit = 2
+			server := redistest.NewServer()
+			// the plan service is unreachable, the anonymous plan must not be fetched
+			limiterService := limiter.NewLimiter(limiter.Options{PlanAddress: config.PlanAddress, Window: 60})
+			activityService := newFakeActivity()
+			upstream := &testUpstream{body: "ok"}
+			crossover := newTestPlugin(t, config, upstream, withRedis(server), WithLimiterService(limiterService), WithActivityService(activityService))
+
+			for i, status := range test.statuses {
+				if rw := do(crossover, httptest.NewRequest(http.MethodGet, "/public", nil)); rw.Code != status {
+					t.Errorf("expected %d for the request %d, got %d %q", status, i+1, rw.Code, rw.Body.String())
+				}
+			}
+			if upstream.count() != test.forwards {
+				t.Errorf("expected %d forwarded requests, got %d", test.forwards, upstream.count())
+			}
+			if len(activityService.logs) != 0 || len(activityService.priority) != 0 {
+				t.Errorf("expected the anonymous requests not to be metered, got %v %v", activityService.logs, activityService.priority)
+			}
+		})
+	}
+}
+
+func TestAnonymousLimitSeparateFromUsers(t *testing.T) {
+	config := testConfig()
+	config.AnonymousPolicy = AnonymousLimit
+	config.AnonymousPlanLimit = 1
+	server := redistest.NewServer()
+	server.Set(testUserId, "5")
+	limiterService := limiter.NewLimiter(limiter.Options{PlanAddress: config.PlanAddress, Window: 60})
+	crossover := newTestPlugin(t, config, &testUpstream{body: "ok"}, withRedis(server), WithLimiterService(limiterService))
+
+	do(crossover, httptest.NewRequest(http.MethodGet, "/public", nil))
+	if rw := do(crossover, httptest.NewRequest(http.MethodGet, "/public", nil)); rw.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the anonymous budget to be exhausted, got %d", rw.Code)
+	}
+	if rw := do(crossover, httptest.NewRequest(http.MethodGet, testPath, nil)); rw.Code != http.StatusOK {
+		t.Errorf("expected the user to keep their own plan, got %d", rw.Code)
+	}
+	if plan, ok := server.Value(AnonymousSubject); ok {
+		t.Errorf("expected the anonymous plan not to be cached, got %q", plan)
+	}
+}
+
+func TestValidateAnonymousPolicy(t *testing.T) {
+	tests := []struct {
+		policy string
+		limit  int
+		valid  bool
+	}{
+		{"", 0, true},
+		{AnonymousDeny, 0, true},
+		{AnonymousBypass, 0, true},
+		{AnonymousLimit, 10, true},
+		{AnonymousLimit, 0, false},
+		{"unlimited", 10, false},
+	}
+	for _, test := range tests {
+		config := testConfig()
+		config.AnonymousPolicy, config.AnonymousPlanLimit = test.policy, test.limit
+		if err := config.validate(); (err == nil) != test.valid {
+			t.Errorf("expected the policy %q with the limit %d valid %t, got %v", test.policy, test.limit, test.valid, err)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package crossover_managed
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var ErrBodyBudgetExhausted = errors.New("request body memory budget is exhausted")
+
+// bodyBudget bound the memory of the request bodies buffered concurrently, requests reserve the bytes they may buffer
+type bodyBudget struct {
+	mu        sync.Mutex
+	available int64
+	wait      time.Duration
+	released  chan struct{}
+}
+
+func newBodyBudget(capacity int64, wait time.Duration) *bodyBudget {
+	return &bodyBudget{
+		available: capacity,
+		wait:      wait,
+		released:  make(chan struct{}),
+	}
+}
+
+// acquire reserve n bytes, waiting up to the budget wait for other requests to release theirs
+// it returns ErrBodyBudgetExhausted when the wait elapses or the context error if it's done first
+func (b *bodyBudget) acquire(ctx context.Context, n int64) error {
+	timer := time.NewTimer(b.wait)
+	defer timer.Stop()
+	for {
+		b.mu.Lock()
+		if b.available >= n {
+			b.available -= n
+			b.mu.Unlock()
+			return nil
+		}
+		released := b.released
+		b.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-timer.C:
+			return ErrBodyBudgetExhausted
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release return n bytes to the budget and wake up the waiting requests
+func (b *bodyBudget) release(n int64) {
+	b.mu.Lock()
+	b.available += n
+	close(b.released)
+	b.released = make(chan struct{})
+	b.mu.Unlock()
+}
+
+// bufferedBodySize return the number of bytes the plugin may buffer for the request, only json bodies are buffered
+func (crossover *Crossover) bufferedBodySize(req *http.Request) int64 {
+	if !crossover.bufferedJSON(req) {
+		return 0
+	}
+	if req.ContentLength >= 0 && req.ContentLength < MaxRequestBodySize {
+		return req.ContentLength
+	}
+	return MaxRequestBodySize
+}
+
+// bufferedBody the request body read ahead by the plugin, the unread remainder of the oversized bodies stays on the original reader
+type bufferedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// bufferBody read the json body ahead once, bounded by the request context and BodyReadTimeout, so the batch counting
+// and parsing never block on a stalled client, the pending read is aborted by closing the body
+func (crossover *Crossover) bufferBody(req *http.Request) error {
+	ctx := req.Context()
+	if crossover.bodyReadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, crossover.bodyReadTimeout)
+		defer cancel()
+	}
+
+	body := req.Body
+	buf := new(bytes.Buffer)
+	copied := make(chan error, 1)
+	go func() {
+		_, err := io.CopyN(buf, body, MaxRequestBodySize)
+		copied <- err
+	}()
+	select {
+	case err := <-copied:
+		if err != nil && err != io.EOF {
+			return err
+		}
+	case <-ctx.Done():
+		body.Close()
+		return ctx.Err()
+	}
+	req.Body = &bufferedBody{Reader: io.MultiReader(bytes.NewReader(buf.Bytes()), body), Closer: body}
+	return nil
+}
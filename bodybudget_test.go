@@ -0,0 +1,150 @@
+package crossover_managed
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBodyBudget(t *testing.T) {
+	budget := newBodyBudget(100, 20*time.Millisecond)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if err := budget.acquire(ctx, 50); err != nil {
+			t.Fatalf("expected the request %d within the budget to be admitted, got %s", i+1, err)
+		}
+	}
+	if err := budget.acquire(ctx, 50); !errors.Is(err, ErrBodyBudgetExhausted) {
+		t.Errorf("expected the request beyond the budget to be rejected, got %v", err)
+	}
+
+	// the waiting request is admitted once another one releases its bytes
+	admitted := make(chan error)
+	budget.wait = time.Second
+	go func() {
+		admitted <- budget.acquire(ctx, 50)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	budget.release(50)
+	select {
+	case err := <-admitted:
+		if err != nil {
+			t.Errorf("expected the delayed request to be admitted, got %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("expected the delayed request to be admitted after the release")
+	}
+}
+
+func TestServeHTTPBodyBudgetExhausted(t *testing.T) {
+	config := testConfig()
+	config.MaxBufferedBodyBytes = 100
+	config.BodyBudgetWait = 10
+	upstream := &testUpstream{body: "ok"}
+	crossover := newTestPlugin(t, config, upstream)
+	// another in-flight request holds most of the budget
+	_ = crossover.bodyBudget.acquire(context.Background(), 80)
+
+	body := `{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"}`
+	if rw := do(crossover, rpcRequest(body)); rw.Code != http.StatusServiceUnavailable || upstream.count() != 0 {
+		t.Errorf("expected 503 without buffering the body, got %d", rw.Code)
+	}
+	crossover.bodyBudget.release(80)
+	if rw := do(crossover, rpcRequest(body)); rw.Code != http.StatusOK {
+		t.Errorf("expected the request to be admitted once the budget is released, got %d", rw.Code)
+	}
+}
+
+// stalledBody never yields a byte until it's closed
+type stalledBody struct {
+	closed chan struct{}
+}
+
+func newStalledBody() *stalledBody {
+	return &stalledBody{closed: make(chan struct{})}
+}
+
+func (b *stalledBody) Read(p []byte) (int, error) {
+	<-b.closed
+	return 0, io.ErrClosedPipe
+}
+
+func (b *stalledBody) Close() error {
+	select {
+	case <-b.closed:
+	default:
+		close(b.closed)
+	}
+	return nil
+}
+
+func TestBufferBodyStalledClient(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		cancel  bool
+		err     error
+	}{
+		{"cancelled", 0, true, context.Canceled},
+		{"read timeout", 20 * time.Millisecond, false, context.DeadlineExceeded},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			crossover := newTestPlugin(t, testConfig(), &testUpstream{})
+			crossover.bodyReadTimeout = test.timeout
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			body := newStalledBody()
+			req := rpcRequest("").WithContext(ctx)
+			req.Body = body
+			if test.cancel {
+				time.AfterFunc(20*time.Millisecond, cancel)
+			}
+
+			start := time.Now()
+			err := crossover.bufferBody(req)
+			if !errors.Is(err, test.err) || time.Since(start) > time.Second {
+				t.Errorf("expected %v promptly, got %v after %s", test.err, err, time.Since(start))
+			}
+			select {
+			case <-body.closed:
+			default:
+				t.Errorf("expected the stalled body to be closed to release the pending read")
+			}
+		})
+	}
+}
+
+func TestBufferBodyRestoresBody(t *testing.T) {
+	crossover := newTestPlugin(t, testConfig(), &testUpstream{})
+	body := `{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"}`
+	req := rpcRequest(body)
+
+	if err := crossover.bufferBody(req); err != nil {
+		t.Fatalf("failed to buffer the body: %s", err)
+	}
+	if read, _ := io.ReadAll(req.Body); string(read) != body {
+		t.Errorf("expected the buffered body %s, got %s", body, read)
+	}
+}
+
+func TestServeHTTPStalledBody(t *testing.T) {
+	config := testConfig()
+	config.BodyReadTimeout = 20
+	upstream := &testUpstream{body: "ok"}
+	limiterService := &fakeLimiter{allow: true}
+	crossover := newTestPlugin(t, config, upstream, WithLimiterService(limiterService))
+	req := rpcRequest("")
+	req.Body = newStalledBody()
+
+	if rw := do(crossover, req); rw.Code != http.StatusRequestTimeout {
+		t.Errorf("expected 408 for the stalled body, got %d", rw.Code)
+	}
+	if upstream.count() != 0 || len(limiterService.users) != 0 {
+		t.Errorf("expected the stalled request to be neither limited nor forwarded")
+	}
+}
@@ -0,0 +1,243 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/kotalco/crossover-managed/jsonrpc"
+	"github.com/kotalco/resp"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// CallKeyPrefix prefix of the per call cache keys of the json-rpc batches
+const CallKeyPrefix = "rpc:"
+
+// Discarder is implemented by the clients able to drop a connection whose replies can't be trusted anymore
+type Discarder interface {
+	Discard()
+}
+
+// discard stop using the connection of the client, e.g. once a reply was found out of sync with its command
+func discard(respClient resp.IClient) {
+	if discarder, ok := respClient.(Discarder); ok {
+		discarder.Discard()
+	}
+}
+
+// ServeBatch serve the cached calls of the json-rpc batch and forward only the uncached ones to the upstream
+// the upstream responses are matched back to their calls by id and merged in the batch order
+// batches it can't split safely (notifications, duplicate ids) are forwarded whole without caching
+func (c *cache) ServeBatch(rw http.ResponseWriter, req *http.Request, next http.Handler, respClient resp.IClient, userId string, calls []jsonrpc.Call) {
+	if requestReason(req, c.methods) != "" || c.personalized(req) != "" || c.dryRun != nil || !splittable(calls) {
+		next.ServeHTTP(rw, req)
+		return
+	}
+
+	keys := make([]string, len(calls))
+	responses := make([]map[string]json.RawMessage, len(calls))
+	var missing []jsonrpc.Call
+	trusted := true
+	for i, call := range calls {
+		keys[i] = c.callKey(req, userId, call)
+		if !trusted {
+			missing = append(missing, call)
+			continue
+		}
+		cached, err := respClient.Get(req.Context(), keys[i])
+		if err == nil && cached == "" {
+			missing = append(missing, call)
+			continue
+		}
+		var response map[string]json.RawMessage
+		if err == nil && json.Unmarshal([]byte(cached), &response) == nil && response != nil {
+			response["id"] = call.ID
+			responses[i] = response
+			c.savings.record(req, userId)
+			continue
+		}
+		// the next replies may be the ones of the previous calls, serving them would mix up the call results
+		trusted = false
+		discard(respClient)
+		missing = append(missing, call)
+	}
+
+	if len(missing) > 0 {
+		upstream, ok := c.forwardCalls(req, next, missing)
+		if !ok {
+			// the upstream didn't answer every call, hand its response over unchanged
+			writeRecorded(rw, upstream)
+			return
+		}
+		ttl, negativeTTL, storable := c.callTTLs(req, upstream)
+		for i, response := range responses {
+			if response != nil {
+				continue
+			}
+			response = upstream.results[string(calls[i].ID)]
+			responses[i] = response
+			if trusted && storable {
+				c.storeCall(req, respClient, keys[i], response, ttl, negativeTTL)
+			}
+		}
+	}
+
+	body, err := json.Marshal(responses)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	rw.WriteHeader(http.StatusOK)
+	_, _ = rw.Write(body)
+}
+
+// batchResponse the upstream response of the forwarded calls
+type batchResponse struct {
+	status  int
+	header  http.Header
+	body    []byte
+	results map[string]map[string]json.RawMessage // responses by call id
+}
+
+// forwardCalls send the calls as a batch to the upstream, ok is false if it didn't answer each of them
+func (c *cache) forwardCalls(req *http.Request, next http.Handler, calls []jsonrpc.Call) (*batchResponse, bool) {
+	body, err := json.Marshal(calls)
+	if err != nil {
+		return &batchResponse{status: http.StatusInternalServerError}, false
+	}
+	forwarded := req.Clone(req.Context())
+	forwarded.Body = io.NopCloser(bytes.NewReader(body))
+	forwarded.GetBody = nil
+	forwarded.ContentLength = int64(len(body))
+	forwarded.Header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	recorder := &bufferRecorder{header: http.Header{}}
+	next.ServeHTTP(recorder, forwarded)
+	upstream := &batchResponse{status: recorder.status, header: recorder.header, body: recorder.body.Bytes()}
+	if upstream.status == 0 {
+		upstream.status = http.StatusOK
+	}
+	if upstream.status != http.StatusOK {
+		return upstream, false
+	}
+
+	var responses []map[string]json.RawMessage
+	if err := json.Unmarshal(upstream.body, &responses); err != nil {
+		return upstream, false
+	}
+	upstream.results = make(map[string]map[string]json.RawMessage, len(responses))
+	for _, response := range responses {
+		upstream.results[string(compact(response["id"]))] = response
+	}
+	for _, call := range calls {
+		if upstream.results[string(call.ID)] == nil {
+			return upstream, false
+		}
+	}
+	return upstream, true
+}
+
+// callTTLs decide with the rules of the whole responses whether the calls answered by the upstream are stored and for how long
+// the null results are the negative ones, e.g. an unknown transaction, and get the not-found ttl
+func (c *cache) callTTLs(req *http.Request, upstream *batchResponse) (ttl int, negativeTTL int, ok bool) {
+	response := CachedResponse{StatusCode: upstream.status, Headers: upstream.header, Body: upstream.body}
+	ttl, reason := c.decide(req, response)
+	if reason != "" {
+		return 0, 0, false
+	}
+	response.StatusCode = http.StatusNotFound
+	negativeTTL, _ = c.decide(req, response)
+	return ttl, negativeTTL, true
+}
+
+// storeCall cache the successful response of a call without its id
+func (c *cache) storeCall(req *http.Request, respClient resp.IClient, key string, response map[string]json.RawMessage, ttl int, negativeTTL int) {
+	if _, failed := response["error"]; failed {
+		return
+	}
+	if result, ok := response["result"]; !ok || string(compact(result)) == "null" {
+		ttl = negativeTTL
+	}
+	stored := make(map[string]json.RawMessage, len(response))
+	for field, value := range response {
+		if field != "id" {
+			stored[field] = value
+		}
+	}
+	value, err := json.Marshal(stored)
+	if err != nil {
+		return
+	}
+	_ = respClient.SetWithTTL(req.Context(), key, string(value), ttl)
+}
+
+// callKey build the cache key of a call from its method and params, scoped like the request cache key
+func (c *cache) callKey(req *http.Request, userId string, call jsonrpc.Call) string {
+	hash := sha256.New()
+	hash.Write([]byte(call.Method))
+	hash.Write([]byte{0})
+	hash.Write(compact(call.Params))
+	return CallKeyPrefix + c.cacheKey(req, userId) + ":" + hex.EncodeToString(hash.Sum(nil))
+}
+
+// splittable check whether every call has a distinct id to match its response with
+func splittable(calls []jsonrpc.Call) bool {
+	ids := make(map[string]bool, len(calls))
+	for i := range calls {
+		calls[i].ID = compact(calls[i].ID)
+		id := string(calls[i].ID)
+		if id == "" || id == "null" || ids[id] {
+			return false
+		}
+		ids[id] = true
+	}
+	return true
+}
+
+// compact strip the insignificant whitespaces of the json value so equal values compare equal
+func compact(value json.RawMessage) json.RawMessage {
+	var buffer bytes.Buffer
+	if err := json.Compact(&buffer, value); err != nil {
+		return value
+	}
+	return buffer.Bytes()
+}
+
+// writeRecorded write the recorded upstream response
+func writeRecorded(rw http.ResponseWriter, upstream *batchResponse) {
+	for key, values := range upstream.header {
+		for _, value := range values {
+			rw.Header().Add(key, value)
+		}
+	}
+	rw.WriteHeader(upstream.status)
+	_, _ = rw.Write(upstream.body)
+}
+
+// bufferRecorder record the upstream response without writing it to the client
+type bufferRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *bufferRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *bufferRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.body.Write(b)
+}
+
+func (r *bufferRecorder) WriteHeader(statusCode int) {
+	if r.status == 0 {
+		r.status = statusCode
+	}
+}
@@ -0,0 +1,188 @@
+package cache
+
+import (
+	"encoding/json"
+	"github.com/kotalco/crossover-managed/internal/redistest"
+	"github.com/kotalco/crossover-managed/jsonrpc"
+	"github.com/kotalco/resp"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// rpcUpstream answer each call of the batches with its method, recording the forwarded methods
+type rpcUpstream struct {
+	mu        sync.Mutex
+	forwarded [][]string
+	result    string // result of every call, the method name if empty
+	failed    bool   // answer every call with an error
+}
+
+func (u *rpcUpstream) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var calls []jsonrpc.Call
+	_ = json.NewDecoder(req.Body).Decode(&calls)
+	methods := make([]string, len(calls))
+	responses := make([]map[string]interface{}, len(calls))
+	for i, call := range calls {
+		methods[i] = call.Method
+		var result interface{} = call.Method
+		if u.result != "" {
+			result = json.RawMessage(u.result)
+		}
+		responses[i] = map[string]interface{}{"jsonrpc": "2.0", "id": call.ID, "result": result}
+		if u.failed {
+			responses[i] = map[string]interface{}{"jsonrpc": "2.0", "id": call.ID, "error": map[string]interface{}{"code": -32000, "message": "failed"}}
+		}
+	}
+	u.mu.Lock()
+	u.forwarded = append(u.forwarded, methods)
+	u.mu.Unlock()
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(responses)
+}
+
+// serveBatch serve the json-rpc batch through the cache with the client
+func serveBatch(t *testing.T, c ICache, respClient resp.IClient, body string, next http.Handler) *httptest.ResponseRecorder {
+	t.Helper()
+	request, err := jsonrpc.Parse([]byte(body))
+	if err != nil {
+		t.Fatalf("failed to parse the batch: %s", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/rpc", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rw := httptest.NewRecorder()
+	c.ServeBatch(rw, req, next, respClient, "user", request.Calls)
+	return rw
+}
+
+func TestServeBatchPartialHits(t *testing.T) {
+	server := redistest.NewServer()
+	client := server.Client()
+	defer client.Close()
+	c := NewCache(Options{CacheExpiry: 60, Methods: []string{http.MethodPost}})
+	upstream := &rpcUpstream{}
+
+	serveBatch(t, c, client, `[{"jsonrpc":"2.0","id":1,"method":"eth_chainId"},{"jsonrpc":"2.0","id":2,"method":"eth_gasPrice"}]`, upstream)
+	rw := serveBatch(t, c, client, `[{"jsonrpc":"2.0","id":"a","method":"eth_gasPrice"},{"jsonrpc":"2.0","id":"b","method":"eth_blockNumber"},{"jsonrpc":"2.0","id":"c","method":"eth_chainId"},{"jsonrpc":"2.0","id":"d","method":"net_version"}]`, upstream)
+
+	if len(upstream.forwarded) != 2 || strings.Join(upstream.forwarded[1], ",") != "eth_blockNumber,net_version" {
+		t.Fatalf("expected only the uncached calls to be forwarded, got %v", upstream.forwarded)
+	}
+	expected := `[{"id":"a","jsonrpc":"2.0","result":"eth_gasPrice"},{"id":"b","jsonrpc":"2.0","result":"eth_blockNumber"},{"id":"c","jsonrpc":"2.0","result":"eth_chainId"},{"id":"d","jsonrpc":"2.0","result":"net_version"}]`
+	if rw.Code != http.StatusOK || rw.Body.String() != expected {
+		t.Errorf("expected the merged response in the batch order\n%s\ngot %d\n%s", expected, rw.Code, rw.Body.String())
+	}
+}
+
+func TestServeBatchNotSplittable(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"duplicate ids", `[{"jsonrpc":"2.0","id":1,"method":"eth_chainId"},{"jsonrpc":"2.0","id":1,"method":"eth_gasPrice"}]`},
+		{"notification", `[{"jsonrpc":"2.0","id":1,"method":"eth_chainId"},{"jsonrpc":"2.0","method":"eth_gasPrice"}]`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := redistest.NewServer()
+			client := server.Client()
+			defer client.Close()
+			c := NewCache(Options{CacheExpiry: 60, Methods: []string{http.MethodPost}})
+			upstream := &rpcUpstream{}
+
+			serveBatch(t, c, client, test.body, upstream)
+
+			if len(upstream.forwarded) != 1 || len(upstream.forwarded[0]) != 2 || len(server.Keys(CallKeyPrefix)) != 0 {
+				t.Errorf("expected the batch to be forwarded whole without caching, got %v and the keys %v", upstream.forwarded, server.Keys(""))
+			}
+		})
+	}
+}
+
+func TestServeBatchNotCacheable(t *testing.T) {
+	tests := []struct {
+		name    string
+		methods []string
+		failed  bool
+	}{
+		{"method not cacheable", nil, false},
+		{"errors", []string{http.MethodPost}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := redistest.NewServer()
+			client := server.Client()
+			defer client.Close()
+			c := NewCache(Options{CacheExpiry: 60, Methods: test.methods})
+			upstream := &rpcUpstream{failed: test.failed}
+			body := `[{"jsonrpc":"2.0","id":1,"method":"eth_getTransactionReceipt","params":["0x1"]},{"jsonrpc":"2.0","id":2,"method":"eth_getTransactionReceipt","params":["0x2"]}]`
+
+			serveBatch(t, c, client, body, upstream)
+			serveBatch(t, c, client, body, upstream)
+
+			if len(upstream.forwarded) != 2 {
+				t.Errorf("expected the calls to be forwarded again, got %v", upstream.forwarded)
+			}
+		})
+	}
+}
+
+func TestServeBatchNullResults(t *testing.T) {
+	server := redistest.NewServer()
+	client := server.Client()
+	defer client.Close()
+	c := NewCache(Options{CacheExpiry: 60, NegativeTTL: 5, Methods: []string{http.MethodPost}})
+
+	serveBatch(t, c, client, `[{"jsonrpc":"2.0","id":1,"method":"eth_getTransactionReceipt","params":["0x1"]},{"jsonrpc":"2.0","id":2,"method":"eth_chainId"}]`, &rpcUpstream{result: "null"})
+
+	keys := server.Keys(CallKeyPrefix)
+	if len(keys) != 2 {
+		t.Fatalf("expected both calls to be cached, got %v", keys)
+	}
+	for _, key := range keys {
+		if ttl := server.TTL(key); ttl != 5 {
+			t.Errorf("expected the null results to get the negative ttl 5, got %d", ttl)
+		}
+	}
+}
+
+// discardingClient record whether the cache dropped the connection
+type discardingClient struct {
+	*redistest.Client
+	discarded int
+}
+
+func (c *discardingClient) Discard() {
+	c.discarded++
+}
+
+func TestServeBatchInvalidCachedReply(t *testing.T) {
+	server := redistest.NewServer()
+	client := &discardingClient{Client: server.Client()}
+	defer client.Close()
+	c := NewCache(Options{CacheExpiry: 60, Methods: []string{http.MethodPost}})
+	upstream := &rpcUpstream{}
+	body := `[{"jsonrpc":"2.0","id":1,"method":"eth_chainId"},{"jsonrpc":"2.0","id":2,"method":"eth_gasPrice"},{"jsonrpc":"2.0","id":3,"method":"net_version"}]`
+	serveBatch(t, c, client, body, upstream)
+	// the reply of the first call is out of sync with its command
+	keys := server.Keys(CallKeyPrefix)
+	for _, key := range keys {
+		if value, _ := server.Value(key); strings.Contains(value, "eth_chainId") {
+			server.Set(key, "+OK")
+		}
+	}
+
+	rw := serveBatch(t, c, client, body, upstream)
+
+	if client.discarded != 1 {
+		t.Errorf("expected the connection to be discarded once, got %d", client.discarded)
+	}
+	if len(upstream.forwarded) != 2 || len(upstream.forwarded[1]) != 3 {
+		t.Errorf("expected no cached reply to be trusted after the invalid one, got %v", upstream.forwarded)
+	}
+	if !strings.Contains(rw.Body.String(), `"result":"eth_chainId"`) {
+		t.Errorf("expected the upstream result of the call, got %s", rw.Body.String())
+	}
+}
@@ -2,79 +2,546 @@ package cache
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"github.com/kotalco/crossover-managed/jsonrpc"
+	"github.com/kotalco/crossover-managed/logger"
+	"github.com/kotalco/crossover-managed/metrics"
 	"github.com/kotalco/resp"
-	"log"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	HitsKeySuffix     = "-hits"
+	StaleKeySuffix    = "-stale"
+	DefaultHitsWindow = 60 //sec
+)
+
+// MaxHashedBodySize request bodies larger than it aren't hashed into the cache key, like the plugin MaxRequestBodySize
+const MaxHashedBodySize int64 = 2 * 1024 * 1024 // 2 MB
+
+// ErrBodyTooLarge returned when the request body is too large to be part of the cache key
+var ErrBodyTooLarge = errors.New("request body too large to be hashed")
+
+// DefaultCacheableMethods the idempotent methods cached unless the other ones are opted in
+var DefaultCacheableMethods = []string{http.MethodGet, http.MethodHead}
+
+var (
+	codecBuckets  = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5}
+	encodeSeconds = metrics.NewHistogram("crossover_cache_encode_seconds", "Time spent serializing the responses stored in the cache", codecBuckets)
+	decodeSeconds = metrics.NewHistogram("crossover_cache_decode_seconds", "Time spent deserializing the responses served from the cache", codecBuckets)
+	corrupted     = metrics.NewCounter("crossover_cache_corrupted_entries_total", "Number of cached entries discarded because their checksum didn't match")
+)
+
+// policies of the requests carrying an Authorization header
+const (
+	AuthorizedSkip = "skip"
+	AuthorizedKey  = "key"
 )
 
 type CachedResponse struct {
 	StatusCode int
 	Headers    map[string][]string
 	Body       []byte
+	CreatedAt  int64  // unix time the response was stored at
+	Checksum   []byte // sha256 of the body when the integrity verification is enabled
 }
 
 type ICache interface {
-	ServeHTTP(rw http.ResponseWriter, req *http.Request, next http.Handler, respClient resp.IClient)
+	ServeHTTP(rw http.ResponseWriter, req *http.Request, next http.Handler, respClient resp.IClient, userId string)
+	ServeCached(rw http.ResponseWriter, req *http.Request, respClient resp.IClient, userId string) bool
+	Explain(req *http.Request, response CachedResponse, userId string) Explanation
+	Savings() Savings
+	Cardinality(ctx context.Context, respClient resp.IClient) (Cardinality, error)
+	ServeBatch(rw http.ResponseWriter, req *http.Request, next http.Handler, respClient resp.IClient, userId string, calls []jsonrpc.Call)
+}
+
+// Options configure the cache service
+type Options struct {
+	CacheExpiry      int      // default ttl in seconds of the cached responses
+	PerUser          bool     // isolate the cached entries per user
+	DebugKeyHeader   string   // response header carrying the computed cache key, empty disables it
+	MaxHeaderBytes   int      // responses with serialized headers larger than it aren't cached, 0 disables the guard
+	MinHits          int      // number of requests for the same key within HitsWindow before its response is cached
+	HitsWindow       int      // window in seconds used to count the requests of a key
+	IncludeQuery     bool     // add the canonical query string to the cache key
+	MaxQueryVariants int      // max number of distinct query variants cached per path, 0 disables the cap
+	AuthorizedPolicy string   // skip (default) doesn't cache requests with an Authorization header, key adds its hash to the cache key
+	CookiePolicy     string   // skip (default) doesn't cache requests with a Cookie header, key adds the hash of the CookieNames to the cache key
+	CookieNames      []string // cookies participating in the key with the key cookie policy, empty uses all of them
+	SavingsBreakdown string   // break the saved backend calls down per path or per user, empty only counts the total
+	MinBodySize      int      // responses with a smaller body aren't cached
+	MaxBodySize      int      // responses with a larger body aren't cached, 0 disables the bound
+	DryRun           bool     // compute the cache decisions and record would-hit/would-miss metrics without using redis
+	ContentTypes     []string // prefixes of the cacheable response content types, empty caches every content type
+	MaxAge           int      // max age in seconds of the served entries regardless of their ttl, 0 disables the ceiling
+	NegativeTTL      int      // default ttl in seconds of the not-found responses, 0 uses CacheExpiry
+	VerifyIntegrity  bool     // store a checksum of the body and discard the entries not matching it on read
+	SoftTimeout      int      // milliseconds to wait for the upstream before serving a stale entry, 0 disables it
+	StaleTTL         int      // seconds the stale copies outlive their entries, 0 uses CacheExpiry
+	CanonicalBody    bool     // store the decoded body once and encode it per client Accept-Encoding
+	KeySamples       int      // sample one of every KeySamples cache keys into the cardinality estimates, 0 disables them
+	RedirectTTL      int      // max ttl in seconds of the temporary redirects, 0 doesn't cache them
+	Methods          []string // request methods stored and served from the cache, empty uses DefaultCacheableMethods
+	IncludeBody      bool     // add the sha256 of the request body to the cache key
+	Format           string   // serialization format of the new entries, gob (default), json or msgpack
+	MaxHeaders       int      // max number of distinct headers of the cached responses, 0 disables the cap
+	HeadersPolicy    string   // skip (default) doesn't cache the responses with more headers, truncate drops the extra ones
+	VerifyTTL        int      // check one of every VerifyTTL stored entries got its ttl and sweep the expired ones otherwise, 0 disables it
+	Freshness        bool     // set the Cache-Control max-age of the hits to the remaining ttl of their entry and their Age
+
+	// Logger throttle the error logs, nil logs every message
+	Logger *logger.Logger
+
+	// RedisClient create the redis client storing the responses refreshed in the background after a soft timeout,
+	// nil stores them with the request client, holding the request until the upstream responds
+	RedisClient func(ctx context.Context) (resp.IClient, error)
 }
 
 type cache struct {
-	cacheExpiry int
+	cacheExpiry      int
+	perUser          bool
+	debugKeyHeader   string
+	maxHeaderBytes   int
+	minHits          int
+	hitsWindow       int
+	includeQuery     bool
+	maxQueryVariants int
+	authorizedPolicy string
+	cookiePolicy     string
+	cookieNames      map[string]bool
+	savings          *savingsIndex
+	minBodySize      int
+	maxBodySize      int
+	dryRun           *dryRunIndex
+	contentTypes     []string
+	maxAge           int
+	negativeTTL      int
+	verifyIntegrity  bool
+	softTimeout      time.Duration
+	staleTTL         int
+	canonicalBody    bool
+	cardinality      *cardinalityIndex
+	redirectTTL      int
+	methods          map[string]bool
+	includeBody      bool
+	format           string
+	maxHeaders       int
+	headersPolicy    string
+	ttlGuard         *ttlGuard
+	freshness        bool
+	redisClient      func(ctx context.Context) (resp.IClient, error)
+	logger           *logger.Logger
 }
 
-func NewCache(cacheExpiry int) ICache {
+func NewCache(options Options) ICache {
 	gob.Register(CachedResponse{})
-	return &cache{
-		cacheExpiry: cacheExpiry,
+	if options.HitsWindow <= 0 {
+		options.HitsWindow = DefaultHitsWindow
 	}
-
+	if options.StaleTTL <= 0 {
+		options.StaleTTL = options.CacheExpiry
+	}
+	c := &cache{
+		cacheExpiry:      options.CacheExpiry,
+		perUser:          options.PerUser,
+		debugKeyHeader:   options.DebugKeyHeader,
+		maxHeaderBytes:   options.MaxHeaderBytes,
+		minHits:          options.MinHits,
+		hitsWindow:       options.HitsWindow,
+		includeQuery:     options.IncludeQuery,
+		maxQueryVariants: options.MaxQueryVariants,
+		authorizedPolicy: options.AuthorizedPolicy,
+		cookiePolicy:     options.CookiePolicy,
+		cookieNames:      map[string]bool{},
+		savings:          newSavingsIndex(options.SavingsBreakdown),
+		minBodySize:      options.MinBodySize,
+		maxBodySize:      options.MaxBodySize,
+		contentTypes:     options.ContentTypes,
+		maxAge:           options.MaxAge,
+		negativeTTL:      options.NegativeTTL,
+		verifyIntegrity:  options.VerifyIntegrity,
+		softTimeout:      time.Duration(options.SoftTimeout) * time.Millisecond,
+		staleTTL:         options.StaleTTL,
+		canonicalBody:    options.CanonicalBody,
+		cardinality:      newCardinalityIndex(options.KeySamples),
+		redirectTTL:      options.RedirectTTL,
+		methods:          methodSet(options.Methods),
+		includeBody:      options.IncludeBody,
+		format:           options.Format,
+		maxHeaders:       options.MaxHeaders,
+		headersPolicy:    options.HeadersPolicy,
+		ttlGuard:         newTTLGuard(options.VerifyTTL),
+		freshness:        options.Freshness,
+		redisClient:      options.RedisClient,
+		logger:           options.Logger,
+	}
+	for _, name := range options.CookieNames {
+		c.cookieNames[name] = true
+	}
+	if options.DryRun {
+		c.dryRun = newDryRunIndex()
+	}
+	return c
 }
-func (c *cache) ServeHTTP(rw http.ResponseWriter, req *http.Request, next http.Handler, respClient resp.IClient) {
+
+func (c *cache) ServeHTTP(rw http.ResponseWriter, req *http.Request, next http.Handler, respClient resp.IClient, userId string) {
+	// stream non-cacheable requests straight to the client, there is no need to buffer their responses
+	if requestReason(req, c.methods) != "" {
+		next.ServeHTTP(rw, req)
+		return
+	}
+
+	// authenticated requests return user specific data, don't share them unless they're keyed on the credentials
+	if c.personalized(req) != "" {
+		next.ServeHTTP(rw, req)
+		return
+	}
+
 	// cache key based on the request
-	cacheKey := req.URL.Path
+	pathKey := c.cacheKey(req, userId)
+	cacheKey := pathKey
+	if variant := c.queryVariant(req); variant != "" {
+		cacheKey = pathKey + "?" + variant
+		// high-cardinality query params bypass the cache beyond the allowed variants
+		if c.maxQueryVariants > 0 && c.dryRun == nil && !c.admitVariant(req, respClient, pathKey, variant) {
+			next.ServeHTTP(rw, req)
+			return
+		}
+	}
+	if c.includeBody {
+		// distinct payloads posted to the same path must not share their responses
+		hash, err := bodyHash(req)
+		if err != nil {
+			next.ServeHTTP(rw, req)
+			return
+		}
+		if hash != "" {
+			cacheKey = cacheKey + ":" + hash
+		}
+	}
+	if c.debugKeyHeader != "" {
+		// expose the computed key for debugging cache fragmentation
+		rw.Header().Set(c.debugKeyHeader, cacheKey)
+	}
+
+	// dry-run never reads nor writes redis, it only estimates the hit rate
+	if c.dryRun != nil {
+		c.serveDryRun(rw, req, next, cacheKey)
+		return
+	}
+	c.sampleKey(req, respClient, userId, cacheKey)
+
+	// volatile paths prefer the upstream and only use the cache when it fails
+	if strategyFromContext(req.Context()) == StrategyNetworkFirst {
+		c.serveNetworkFirst(rw, req, next, respClient, cacheKey)
+		return
+	}
 
 	// retrieve the cached response
-	cachedData, err := respClient.Get(req.Context(), cacheKey)
-	if err == nil && cachedData != "" {
-		// Cache hit - parse the cached response and write it to the original ResponseWriter
-		var cachedResponse CachedResponse
-		buffer := bytes.NewBufferString(cachedData)
-		dec := gob.NewDecoder(buffer)
-		if err := dec.Decode(&cachedResponse); err == nil {
-			for key, values := range cachedResponse.Headers {
-				for _, value := range values {
-					rw.Header().Add(key, value)
-				}
-			}
-			rw.WriteHeader(cachedResponse.StatusCode)
-			_, _ = rw.Write(cachedResponse.Body)
-			return
+	if c.serveHit(rw, req, respClient, cacheKey, userId) {
+		return
+	}
+
+	// slow upstream - downgrade to the stale entry if there is one
+	if c.softTimeout > 0 && c.serveSoft(rw, req, next, respClient, cacheKey, userId) {
+		return
+	}
+
+	// Cache miss - record the response, then write it to the client once before storing it
+	recorder := &responseRecorder{rw: rw}
+	next.ServeHTTP(recorder, req)
+	_ = recorder.writeResponse()
+	c.store(req, respClient, cacheKey, recorder)
+}
+
+// ServeCached serve the cached response of the request without ever calling the upstream, it returns false on a miss
+func (c *cache) ServeCached(rw http.ResponseWriter, req *http.Request, respClient resp.IClient, userId string) bool {
+	if requestReason(req, c.methods) != "" || c.dryRun != nil {
+		return false
+	}
+	if c.personalized(req) != "" {
+		return false
+	}
+	cacheKey := c.cacheKey(req, userId)
+	if variant := c.queryVariant(req); variant != "" {
+		cacheKey = cacheKey + "?" + variant
+	}
+	if c.includeBody {
+		hash, err := bodyHash(req)
+		if err != nil {
+			return false
 		}
+		if hash != "" {
+			cacheKey = cacheKey + ":" + hash
+		}
+	}
+	return c.serveHit(rw, req, respClient, cacheKey, userId)
+}
+
+// serveHit write the cached response of the key, invalid entries are deleted and reported as a miss
+func (c *cache) serveHit(rw http.ResponseWriter, req *http.Request, respClient resp.IClient, cacheKey string, userId string) bool {
+	cachedResponse, ok := c.entry(req, respClient, cacheKey)
+	if !ok {
+		return false
+	}
+	if c.freshness {
+		cachedResponse = c.setFreshness(req.Context(), respClient, cacheKey, cachedResponse)
+	}
+	c.writeEntry(rw, req, cachedResponse)
+	c.savings.record(req, userId)
+	return true
+}
+
+// entry read and decode the cached response of the key, invalid entries are deleted and reported as missing
+func (c *cache) entry(req *http.Request, respClient resp.IClient, cacheKey string) (CachedResponse, bool) {
+	var cachedResponse CachedResponse
+	cachedData, err := respClient.Get(req.Context(), cacheKey)
+	if err != nil || cachedData == "" {
+		return cachedResponse, false
+	}
+	start := time.Now()
+	cachedResponse, err = decodeEntry([]byte(cachedData))
+	decodeSeconds.Observe(time.Since(start).Seconds())
+	if err == nil && c.verifyIntegrity && !validChecksum(cachedResponse) {
+		corrupted.Inc()
+		c.logger.Printf("Discarded corrupted cache entry %s", cacheKey)
+		err = errors.New("entry checksum mismatch")
+	}
+	if err == nil && c.tooOld(req, cachedResponse) {
+		// redis hasn't expired the entry yet but it's staler than allowed, refresh it as a miss
+		err = errors.New("entry exceeds the max cache age")
+	}
+	if err != nil {
 		//log.Printf("Failed to serialize response for caching: %s", err.Error())
 		_ = respClient.Delete(req.Context(), cacheKey)
+		return cachedResponse, false
+	}
+	return cachedResponse, true
+}
+
+// writeEntry write the cached response to the client
+func (c *cache) writeEntry(rw http.ResponseWriter, req *http.Request, cachedResponse CachedResponse) {
+	cachedResponse = c.encode(req, cachedResponse)
+	for key, values := range cachedResponse.Headers {
+		for _, value := range values {
+			rw.Header().Add(key, value)
+		}
+	}
+	// entries stored before the length was recomputed may carry a stale Content-Length,
+	// the HEAD ones keep the stored length of the body they have none of
+	if req.Method != http.MethodHead || rw.Header().Get("Content-Length") == "" {
+		rw.Header().Set("Content-Length", strconv.Itoa(len(cachedResponse.Body)))
 	}
+	if c.canonicalBody && !strings.Contains(strings.ToLower(strings.Join(rw.Header().Values("Vary"), ",")), "accept-encoding") {
+		rw.Header().Add("Vary", "Accept-Encoding")
+	}
+	rw.WriteHeader(cachedResponse.StatusCode)
+	_, _ = rw.Write(cachedResponse.Body)
+}
 
-	// Cache miss - record the response
-	recorder := &responseRecorder{rw: rw}
-	next.ServeHTTP(recorder, req)
+// store serialize the recorded response and store it in redis if it's cacheable
+func (c *cache) store(req *http.Request, respClient resp.IClient, cacheKey string, recorder *responseRecorder) {
+	cachedResponse, ttl, ok := c.storable(req, recorder)
+	if !ok {
+		return
+	}
+	if !c.hot(req, respClient, cacheKey) {
+		return
+	}
+
+	start := time.Now()
+	encoded, err := encodeEntry(c.format, cachedResponse)
+	encodeSeconds.Observe(time.Since(start).Seconds())
+	if err != nil {
+		c.logger.Printf("Failed to serialize response for caching: %s", err)
+		return
+	}
+
+	// Store the serialized response in Redis as a string with an expiration time derived from the upstream headers
+	_ = respClient.SetWithTTL(req.Context(), cacheKey, string(encoded), ttl)
+	c.guardTTL(req.Context(), respClient, cacheKey, ttl)
+	if c.softTimeout > 0 {
+		// keep a stale copy past the ttl to serve when the upstream is slower than the soft timeout
+		_ = respClient.SetWithTTL(req.Context(), cacheKey+StaleKeySuffix, string(encoded), ttl+c.staleTTL)
+		c.guardTTL(req.Context(), respClient, cacheKey+StaleKeySuffix, ttl+c.staleTTL)
+	}
+	c.sweep(req.Context(), respClient)
+}
+
+// storable build the cached response from the recorded one and decide whether it should be stored and for how long
+func (c *cache) storable(req *http.Request, recorder *responseRecorder) (CachedResponse, int, bool) {
+	if req.Method != http.MethodHead && !recorder.complete() {
+		c.logger.Printf("Skipped caching incomplete response for %s", req.URL.Path)
+		return CachedResponse{}, 0, false
+	}
 	// Serialize the response data
 	cachedResponse := CachedResponse{
 		StatusCode: recorder.status,
 		Headers:    recorder.Header().Clone(), // Convert http.Header to a map for serialization
 		Body:       recorder.body.Bytes(),
+		CreatedAt:  time.Now().Unix(),
+	}
+	if c.canonicalBody {
+		if err := canonicalize(&cachedResponse); err != nil {
+			c.logger.Printf("Skipped caching response for %s, %s", req.URL.Path, err)
+			return cachedResponse, 0, false
+		}
+	}
+	if c.verifyIntegrity {
+		checksum := sha256.Sum256(cachedResponse.Body)
+		cachedResponse.Checksum = checksum[:]
+	}
+	if c.debugKeyHeader != "" {
+		delete(cachedResponse.Headers, c.debugKeyHeader)
+	}
+	// cookies set for this client must never be replayed to the others
+	delete(cachedResponse.Headers, "Set-Cookie")
+	// the upstream Content-Length may not match the recorded body, store the actual length
+	// unless the response is to a HEAD request whose length is the one of the body it omits
+	if req.Method != http.MethodHead || http.Header(cachedResponse.Headers).Get("Content-Length") == "" {
+		cachedResponse.Headers["Content-Length"] = []string{strconv.Itoa(len(cachedResponse.Body))}
+	}
+	cachedResponse.Headers = c.truncateHeaders(cachedResponse.Headers)
+	ttl, reason := c.decide(req, cachedResponse)
+	if reason == ReasonHeadersTooLarge {
+		c.logger.Printf("Skipped caching response for %s, headers exceed %d bytes", req.URL.Path, c.maxHeaderBytes)
+	}
+	if reason == ReasonTooManyHeaders {
+		c.logger.Printf("Skipped caching response for %s, more than %d headers", req.URL.Path, c.maxHeaders)
 	}
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-	if err := enc.Encode(cachedResponse); err != nil {
-		log.Printf("Failed to serialize response for caching: %s", err)
+	if reason != "" {
+		return cachedResponse, 0, false
 	}
+	return cachedResponse, ttl, true
+}
 
-	// Store the serialized response in Redis as a string with an expiration time
-	err = respClient.SetWithTTL(req.Context(), cacheKey, buffer.String(), c.cacheExpiry)
+// validChecksum check the body of the entry against its checksum, entries stored without a checksum are invalid
+func validChecksum(cachedResponse CachedResponse) bool {
+	checksum := sha256.Sum256(cachedResponse.Body)
+	return bytes.Equal(checksum[:], cachedResponse.Checksum)
+}
 
-	//
-	// Write the original response
-	rw.WriteHeader(recorder.status)
-	_, _ = rw.Write(recorder.body.Bytes())
+// tooOld check whether the entry exceeds the max cache age or the max age of the request, entries stored without a creation time are always too old
+func (c *cache) tooOld(req *http.Request, cachedResponse CachedResponse) bool {
+	maxAge := c.maxAge
+	if requestMaxAge, ok := maxAgeFromContext(req.Context()); ok && (maxAge <= 0 || requestMaxAge < maxAge) {
+		maxAge = requestMaxAge
+	}
+	if maxAge <= 0 {
+		return false
+	}
+	return time.Now().Unix()-cachedResponse.CreatedAt > int64(maxAge)
+}
+
+// hot check whether the key has been requested at least minHits times within the hits window
+func (c *cache) hot(req *http.Request, respClient resp.IClient, cacheKey string) bool {
+	if c.minHits <= 1 {
+		return true
+	}
+	hitsKey := cacheKey + HitsKeySuffix
+	hits, err := respClient.Incr(req.Context(), hitsKey)
+	if err != nil {
+		return false
+	}
+	if hits == 1 {
+		_, _ = respClient.Expire(req.Context(), hitsKey, c.hitsWindow)
+	}
+	return hits >= c.minHits
+}
+
+// cacheKey build the cache key of the request, isolating the entries per user when perUser is enabled
+// and per credentials for authenticated requests
+func (c *cache) cacheKey(req *http.Request, userId string) string {
+	key := req.URL.Path
+	if path, ok := keyPathFromContext(req.Context()); ok {
+		key = path
+	}
+	if req.Method != http.MethodGet {
+		// the responses of the other methods differ, e.g. HEAD has no body
+		key = req.Method + ":" + key
+	}
+	if c.perUser {
+		key = userId + ":" + key
+	}
+	if authorization := req.Header.Get("Authorization"); authorization != "" {
+		hash := sha256.Sum256([]byte(authorization))
+		key = hex.EncodeToString(hash[:]) + ":" + key
+	}
+	if cookies := c.cookiesHash(req); cookies != "" {
+		key = "cookie-" + cookies + ":" + key
+	}
+	return key
+}
+
+// readCloser a body read from Reader and closed with Closer
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// bodyHash return the hex sha256 of the request body, empty without a body, the body is restored for the upstream
+// bodies larger than MaxHashedBodySize aren't read ahead and fail with ErrBodyTooLarge so they're streamed uncached
+func bodyHash(req *http.Request) (string, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return "", nil
+	}
+	if req.ContentLength > MaxHashedBodySize {
+		return "", ErrBodyTooLarge
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, MaxHashedBodySize+1))
+	if int64(len(body)) > MaxHashedBodySize {
+		// hand the upstream what was read ahead followed by the unread remainder
+		req.Body = &readCloser{Reader: io.MultiReader(bytes.NewReader(body), req.Body), Closer: req.Body}
+		return "", ErrBodyTooLarge
+	}
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	if len(body) == 0 {
+		return "", nil
+	}
+	hash := sha256.Sum256(body)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// queryVariant return the canonical (sorted) query string of the request when it's part of the cache key
+func (c *cache) queryVariant(req *http.Request) string {
+	if !c.includeQuery || req.URL.RawQuery == "" {
+		return ""
+	}
+	return req.URL.Query().Encode()
+}
+
+// cacheableContentType check the response content type against the allowed prefixes
+func (c *cache) cacheableContentType(contentType string) bool {
+	if len(c.contentTypes) == 0 {
+		return true
+	}
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	for _, allowed := range c.contentTypes {
+		if strings.HasPrefix(contentType, strings.ToLower(allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// headersSize return the approximate serialized size of the headers
+func headersSize(headers http.Header) (size int) {
+	for key, values := range headers {
+		for _, value := range values {
+			size += len(key) + len(value)
+		}
+	}
 	return
 }
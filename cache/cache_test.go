@@ -0,0 +1,279 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"github.com/kotalco/crossover-managed/internal/redistest"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// testUpstream answer every request with the response and count the calls reaching it
+type testUpstream struct {
+	status int
+	header http.Header
+	body   string
+	calls  int32
+}
+
+func (u *testUpstream) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	atomic.AddInt32(&u.calls, 1)
+	for key, values := range u.header {
+		rw.Header()[key] = values
+	}
+	if u.status != 0 {
+		rw.WriteHeader(u.status)
+	}
+	_, _ = io.WriteString(rw, u.body)
+}
+
+func (u *testUpstream) count() int {
+	return int(atomic.LoadInt32(&u.calls))
+}
+
+func newUpstream(status int, body string, header ...string) *testUpstream {
+	upstream := &testUpstream{status: status, header: http.Header{}, body: body}
+	for i := 0; i+1 < len(header); i += 2 {
+		upstream.header.Add(header[i], header[i+1])
+	}
+	return upstream
+}
+
+// serve the request through the cache with a client of the server
+func serve(t *testing.T, c ICache, server *redistest.Server, req *http.Request, next http.Handler, userId string) *httptest.ResponseRecorder {
+	t.Helper()
+	client := server.Client()
+	defer client.Close()
+	rw := httptest.NewRecorder()
+	c.ServeHTTP(rw, req, next, client, userId)
+	return rw
+}
+
+func get(path string) *http.Request {
+	return httptest.NewRequest(http.MethodGet, path, nil)
+}
+
+func post(path string, body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+// storedTTL return the ttl of the only entry of the server, the stale copies and the book keeping keys aside
+func storedTTL(t *testing.T, server *redistest.Server, key string) int {
+	t.Helper()
+	if _, ok := server.Value(key); !ok {
+		t.Fatalf("expected the entry %s to be stored, got the keys %v", key, server.Keys(""))
+	}
+	return server.TTL(key)
+}
+
+func TestServeHTTPMissThenHit(t *testing.T) {
+	server := redistest.NewServer()
+	c := NewCache(Options{CacheExpiry: 60})
+	upstream := newUpstream(http.StatusOK, `{"result":"0x1"}`, "Content-Type", "application/json")
+
+	miss := serve(t, c, server, get("/rpc"), upstream, "user")
+	hit := serve(t, c, server, get("/rpc"), upstream, "user")
+
+	if upstream.count() != 1 {
+		t.Fatalf("expected the upstream to be called once, got %d", upstream.count())
+	}
+	for _, rw := range []*httptest.ResponseRecorder{miss, hit} {
+		if rw.Code != http.StatusOK || rw.Body.String() != upstream.body {
+			t.Errorf("expected 200 %s, got %d %s", upstream.body, rw.Code, rw.Body.String())
+		}
+		if contentType := rw.Header().Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("expected the Content-Type to be replayed, got %q", contentType)
+		}
+	}
+}
+
+func TestServeHTTPMinHits(t *testing.T) {
+	server := redistest.NewServer()
+	c := NewCache(Options{CacheExpiry: 60, MinHits: 3, HitsWindow: 30})
+	upstream := newUpstream(http.StatusOK, `{"result":"0x1"}`)
+
+	for i := 1; i <= 3; i++ {
+		serve(t, c, server, get("/rpc"), upstream, "user")
+		if upstream.count() != i {
+			t.Fatalf("expected the request %d to reach the upstream, got %d calls", i, upstream.count())
+		}
+		if _, stored := server.Value("/rpc"); stored != (i == 3) {
+			t.Fatalf("expected the response to be stored on the request 3 only, got the keys %v after the request %d", server.Keys(""), i)
+		}
+	}
+	serve(t, c, server, get("/rpc"), upstream, "user")
+	if upstream.count() != 3 {
+		t.Errorf("expected the request after the 3 misses to be a hit, got %d calls", upstream.count())
+	}
+	if ttl := server.TTL("/rpc" + HitsKeySuffix); ttl != 30 {
+		t.Errorf("expected the hits counter to expire after the window, got a ttl of %d", ttl)
+	}
+}
+
+func TestServeHTTPPreservesRetryAfter(t *testing.T) {
+	server := redistest.NewServer()
+	c := NewCache(Options{CacheExpiry: 60})
+	upstream := newUpstream(http.StatusServiceUnavailable, "overloaded", "Retry-After", "17")
+
+	for i := 1; i <= 2; i++ {
+		rw := serve(t, c, server, get("/rpc"), upstream, "user")
+		if rw.Code != http.StatusServiceUnavailable || rw.Header().Get("Retry-After") != "17" {
+			t.Errorf("expected the upstream 503 with its Retry-After, got %d %q", rw.Code, rw.Header().Get("Retry-After"))
+		}
+		if upstream.count() != i {
+			t.Errorf("expected the server error not to be cached, got %d upstream calls after %d requests", upstream.count(), i)
+		}
+	}
+}
+
+func TestBodySizeBounds(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		stored bool
+	}{
+		{"below the lower bound", "tiny", false},
+		{"at the lower bound", strings.Repeat("x", 8), true},
+		{"within the range", strings.Repeat("x", 12), true},
+		{"at the upper bound", strings.Repeat("x", 16), true},
+		{"above the upper bound", strings.Repeat("x", 17), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := redistest.NewServer()
+			c := NewCache(Options{CacheExpiry: 60, MinBodySize: 8, MaxBodySize: 16})
+
+			rw := serve(t, c, server, get("/rpc"), newUpstream(http.StatusOK, test.body), "user")
+
+			if rw.Body.String() != test.body {
+				t.Errorf("expected the response to be served, got %q", rw.Body.String())
+			}
+			if _, stored := server.Value("/rpc"); stored != test.stored {
+				t.Errorf("expected the response stored %t, got %t", test.stored, stored)
+			}
+		})
+	}
+}
+
+func TestCodecHistograms(t *testing.T) {
+	server := redistest.NewServer()
+	c := NewCache(Options{CacheExpiry: 60})
+	upstream := newUpstream(http.StatusOK, `{"result":"0x1"}`)
+	encodes, decodes := encodeSeconds.Count(), decodeSeconds.Count()
+
+	serve(t, c, server, get("/rpc"), upstream, "user")
+	if encodeSeconds.Count()-encodes != 1 || decodeSeconds.Count()-decodes != 0 {
+		t.Errorf("expected the miss to only observe the encode, got %d encodes and %d decodes", encodeSeconds.Count()-encodes, decodeSeconds.Count()-decodes)
+	}
+	serve(t, c, server, get("/rpc"), upstream, "user")
+	if encodeSeconds.Count()-encodes != 1 || decodeSeconds.Count()-decodes != 1 {
+		t.Errorf("expected the hit to only observe the decode, got %d encodes and %d decodes", encodeSeconds.Count()-encodes, decodeSeconds.Count()-decodes)
+	}
+}
+
+// gzipped compress the body
+func gzipped(t *testing.T, body string) string {
+	t.Helper()
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	_, _ = io.WriteString(writer, body)
+	if err := writer.Close(); err != nil {
+		t.Fatalf("failed to compress the body: %s", err)
+	}
+	return buffer.String()
+}
+
+func TestContentLengthMatchesBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		upstream *testUpstream
+	}{
+		{"identity", newUpstream(http.StatusOK, `{"result":"0x1"}`)},
+		{"upstream length", newUpstream(http.StatusOK, `{"result":"0x1"}`, "Content-Length", "16")},
+		{"compressed", newUpstream(http.StatusOK, gzipped(t, `{"result":"0x1"}`), "Content-Encoding", "gzip")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := redistest.NewServer()
+			c := NewCache(Options{CacheExpiry: 60})
+
+			miss := serve(t, c, server, get("/rpc"), test.upstream, "user")
+			hit := serve(t, c, server, get("/rpc"), test.upstream, "user")
+
+			if test.upstream.count() != 1 {
+				t.Fatalf("expected the second request to be a hit, got %d upstream calls", test.upstream.count())
+			}
+			for name, rw := range map[string]*httptest.ResponseRecorder{"miss": miss, "hit": hit} {
+				if contentLength := rw.Header().Get("Content-Length"); contentLength != "" && contentLength != strconv.Itoa(rw.Body.Len()) {
+					t.Errorf("expected the %s Content-Length to match the %d bytes body, got %s", name, rw.Body.Len(), contentLength)
+				}
+			}
+			if contentLength := hit.Header().Get("Content-Length"); contentLength != strconv.Itoa(hit.Body.Len()) {
+				t.Errorf("expected the hit to carry the body Content-Length %d, got %q", hit.Body.Len(), contentLength)
+			}
+		})
+	}
+}
+
+// rewrite change the stored entry in place, keeping its ttl
+func rewrite(t *testing.T, server *redistest.Server, key string, change func(cachedResponse *CachedResponse)) {
+	t.Helper()
+	value, ok := server.Value(key)
+	if !ok {
+		t.Fatalf("expected the entry %s to be stored, got the keys %v", key, server.Keys(""))
+	}
+	cachedResponse, err := decodeEntry([]byte(value))
+	if err != nil {
+		t.Fatalf("failed to decode the entry: %s", err)
+	}
+	change(&cachedResponse)
+	encoded, err := encodeEntry(FormatGob, cachedResponse)
+	if err != nil {
+		t.Fatalf("failed to encode the entry: %s", err)
+	}
+	ttl := server.TTL(key)
+	server.Set(key, string(encoded))
+	client := server.Client()
+	defer client.Close()
+	_, _ = client.Expire(context.Background(), key, ttl)
+}
+
+// backdate move the creation time of the stored entry back by seconds
+func backdate(t *testing.T, server *redistest.Server, key string, seconds int64) {
+	t.Helper()
+	rewrite(t, server, key, func(cachedResponse *CachedResponse) {
+		cachedResponse.CreatedAt -= seconds
+	})
+}
+
+func TestVerifyIntegrity(t *testing.T) {
+	server := redistest.NewServer()
+	c := NewCache(Options{CacheExpiry: 60, VerifyIntegrity: true})
+	upstream := newUpstream(http.StatusOK, `{"result":"0x1"}`)
+	discarded := corrupted.Value()
+
+	serve(t, c, server, get("/rpc"), upstream, "user")
+	rewrite(t, server, "/rpc", func(cachedResponse *CachedResponse) {
+		cachedResponse.Body = []byte(`{"result":"0x2"}`)
+	})
+
+	rw := serve(t, c, server, get("/rpc"), upstream, "user")
+	if rw.Body.String() != upstream.body || upstream.count() != 2 {
+		t.Errorf("expected the corrupted entry to be re-fetched from the upstream, got %s after %d calls", rw.Body.String(), upstream.count())
+	}
+	if delta := corrupted.Value() - discarded; delta != 1 {
+		t.Errorf("expected the corruption to be counted, got %d", delta)
+	}
+	rw = serve(t, c, server, get("/rpc"), upstream, "user")
+	if rw.Body.String() != upstream.body || upstream.count() != 2 {
+		t.Errorf("expected the re-fetched entry to replace the corrupted one, got %s after %d calls", rw.Body.String(), upstream.count())
+	}
+}
@@ -0,0 +1,102 @@
+package cache
+
+import (
+	"net/http"
+	"strings"
+)
+
+// MaxCacheableBodySize responses with a larger body aren't cached
+const MaxCacheableBodySize = 10 * 1024 * 1024 // 10 MB
+
+// reasons a response isn't cacheable
+const (
+	ReasonRequestNotCacheable = "request not cacheable"
+	ReasonServerError         = "server error status"
+	ReasonNoStore             = "response cache-control forbids storing"
+	ReasonExpired             = "response already expired"
+	ReasonBodyTooLarge        = "response body too large"
+	ReasonAuthorized          = "authorized request not keyed on its credentials"
+	ReasonCookie              = "request cookies not part of the key"
+	ReasonContentType         = "response content type not cacheable"
+	ReasonBodySize            = "response body size out of the cacheable bounds"
+	ReasonHeadersTooLarge     = "response headers too large"
+	ReasonTemporaryRedirect   = "temporary redirect"
+	ReasonMethod              = "request method not cacheable"
+	ReasonTooManyHeaders      = "response has too many headers"
+)
+
+// defaultMethods the DefaultCacheableMethods set
+var defaultMethods = methodSet(nil)
+
+// IsCacheable decide whether the response of the request can be cached with the DefaultCacheableMethods, returning the reason when it can't
+// the cache instances decide with their own cacheable methods
+func IsCacheable(req *http.Request, resp CachedResponse) (bool, string) {
+	return isCacheable(req, resp, defaultMethods)
+}
+
+// isCacheable decide whether the response of the request can be cached when its method is one of methods
+func isCacheable(req *http.Request, resp CachedResponse, methods map[string]bool) (bool, string) {
+	if reason := requestReason(req, methods); reason != "" {
+		return false, reason
+	}
+	// server errors are never cached, replaying them would serve a stale upstream Retry-After to the clients
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return false, ReasonServerError
+	}
+	header := http.Header(resp.Headers)
+	if hasDirective(header.Get("Cache-Control"), "no-store") || hasDirective(header.Get("Cache-Control"), "private") {
+		return false, ReasonNoStore
+	}
+	if _, ok := responseTTL(header, 1); !ok {
+		return false, ReasonExpired
+	}
+	if len(resp.Body) > MaxCacheableBodySize {
+		return false, ReasonBodyTooLarge
+	}
+	return true, ""
+}
+
+// requestReason return why the response of the request can't be cached whatever it is, empty if it may be
+func requestReason(req *http.Request, methods map[string]bool) string {
+	if !methods[req.Method] {
+		return ReasonMethod
+	}
+	if !cacheableRequest(req) {
+		return ReasonRequestNotCacheable
+	}
+	return ""
+}
+
+// methodSet normalize the cacheable methods, empty uses DefaultCacheableMethods
+func methodSet(methods []string) map[string]bool {
+	if len(methods) == 0 {
+		methods = DefaultCacheableMethods
+	}
+	set := make(map[string]bool, len(methods))
+	for _, method := range methods {
+		set[strings.ToUpper(strings.TrimSpace(method))] = true
+	}
+	return set
+}
+
+// cacheableRequest check whether the request response could be cached at all
+// non-cacheable requests are streamed to the client without being recorded
+func cacheableRequest(req *http.Request) bool {
+	if req.Header.Get("Upgrade") != "" {
+		return false
+	}
+	if strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+		return false
+	}
+	return !hasDirective(req.Header.Get("Cache-Control"), "no-store")
+}
+
+// hasDirective check whether the Cache-Control header contains the directive
+func hasDirective(cacheControl string, directive string) bool {
+	for _, value := range strings.Split(cacheControl, ",") {
+		if strings.EqualFold(strings.TrimSpace(value), directive) {
+			return true
+		}
+	}
+	return false
+}
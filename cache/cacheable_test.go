@@ -0,0 +1,211 @@
+package cache
+
+import (
+	"github.com/kotalco/crossover-managed/internal/redistest"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// streamWriter count the bytes and flushes reaching the client
+type streamWriter struct {
+	header  http.Header
+	status  int
+	written int
+	flushes int
+}
+
+func (w *streamWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *streamWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	w.written += len(p)
+	return len(p), nil
+}
+
+func (w *streamWriter) Flush() {
+	w.flushes++
+}
+
+func TestServeHTTPStreamsNonCacheable(t *testing.T) {
+	const chunks, chunkSize = 64, 32 * 1024
+	server := redistest.NewServer()
+	c := NewCache(Options{CacheExpiry: 60})
+	client := &streamWriter{header: http.Header{}}
+	chunk := strings.Repeat("x", chunkSize)
+	upstream := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		for i := 0; i < chunks; i++ {
+			// every chunk must have reached the client before the next one is produced
+			if client.written != i*chunkSize {
+				t.Fatalf("expected %d bytes to be streamed before the chunk %d, got %d", i*chunkSize, i, client.written)
+			}
+			_, _ = rw.Write([]byte(chunk))
+			rw.(http.Flusher).Flush()
+		}
+	})
+
+	req := get("/rpc")
+	req.Header.Set("Accept", "text/event-stream")
+	redisClient := server.Client()
+	defer redisClient.Close()
+	c.ServeHTTP(client, req, upstream, redisClient, "user")
+
+	if client.written != chunks*chunkSize || client.flushes != chunks {
+		t.Errorf("expected %d bytes in %d flushes, got %d bytes in %d flushes", chunks*chunkSize, chunks, client.written, client.flushes)
+	}
+	if server.Total() != 0 {
+		t.Errorf("expected the streamed response to bypass redis, got %d ops", server.Total())
+	}
+}
+
+func TestIsCacheable(t *testing.T) {
+	ok := CachedResponse{StatusCode: http.StatusOK, Headers: map[string][]string{}, Body: []byte("ok")}
+	withHeader := func(key, value string) CachedResponse {
+		response := ok
+		response.Headers = map[string][]string{key: {value}}
+		return response
+	}
+	withRequestHeader := func(req *http.Request, key, value string) *http.Request {
+		req.Header.Set(key, value)
+		return req
+	}
+	tests := []struct {
+		name     string
+		req      *http.Request
+		response CachedResponse
+		reason   string
+	}{
+		{"cacheable", get("/rpc"), ok, ""},
+		{"head", httptest.NewRequest(http.MethodHead, "/rpc", nil), ok, ""},
+		{"method", post("/rpc", `{}`), ok, ReasonMethod},
+		{"upgrade", withRequestHeader(get("/rpc"), "Upgrade", "websocket"), ok, ReasonRequestNotCacheable},
+		{"event stream", withRequestHeader(get("/rpc"), "Accept", "text/event-stream"), ok, ReasonRequestNotCacheable},
+		{"request no-store", withRequestHeader(get("/rpc"), "Cache-Control", "max-age=0, no-store"), ok, ReasonRequestNotCacheable},
+		{"server error", get("/rpc"), CachedResponse{StatusCode: http.StatusBadGateway}, ReasonServerError},
+		{"response no-store", get("/rpc"), withHeader("Cache-Control", "no-store"), ReasonNoStore},
+		{"private", get("/rpc"), withHeader("Cache-Control", "private"), ReasonNoStore},
+		{"max-age zero", get("/rpc"), withHeader("Cache-Control", "max-age=0"), ReasonExpired},
+		{"expired", get("/rpc"), withHeader("Expires", "Thu, 01 Jan 1970 00:00:00 GMT"), ReasonExpired},
+		{"body too large", get("/rpc"), CachedResponse{StatusCode: http.StatusOK, Body: make([]byte, MaxCacheableBodySize+1)}, ReasonBodyTooLarge},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cacheable, reason := IsCacheable(test.req, test.response)
+			if cacheable != (test.reason == "") || reason != test.reason {
+				t.Errorf("expected %t %q, got %t %q", test.reason == "", test.reason, cacheable, reason)
+			}
+		})
+	}
+}
+
+func TestCacheableContentTypes(t *testing.T) {
+	tests := []struct {
+		name         string
+		contentTypes []string
+		contentType  string
+		stored       bool
+	}{
+		{"allowed", []string{"application/json"}, "application/json; charset=utf-8", true},
+		{"event stream", []string{"application/json"}, "text/event-stream", false},
+		{"binary", []string{"application/json"}, "application/octet-stream", false},
+		{"no allowlist", nil, "text/event-stream", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := redistest.NewServer()
+			c := NewCache(Options{CacheExpiry: 60, ContentTypes: test.contentTypes})
+			upstream := newUpstream(http.StatusOK, "data", "Content-Type", test.contentType)
+
+			rw := serve(t, c, server, get("/rpc"), upstream, "user")
+
+			if rw.Body.String() != "data" {
+				t.Errorf("expected the response to be served, got %q", rw.Body.String())
+			}
+			if _, stored := server.Value("/rpc"); stored != test.stored {
+				t.Errorf("expected the response stored %t, got %t", test.stored, stored)
+			}
+		})
+	}
+}
+
+func TestServeHTTPMethods(t *testing.T) {
+	tests := []struct {
+		name    string
+		methods []string
+		method  string
+		cached  bool
+	}{
+		{"get", nil, http.MethodGet, true},
+		{"head", nil, http.MethodHead, true},
+		{"post", nil, http.MethodPost, false},
+		{"put", nil, http.MethodPut, false},
+		{"delete", nil, http.MethodDelete, false},
+		{"post opted in", []string{"post"}, http.MethodPost, true},
+		{"get not opted in", []string{http.MethodPost}, http.MethodGet, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := redistest.NewServer()
+			c := NewCache(Options{CacheExpiry: 60, Methods: test.methods})
+			upstream := newUpstream(http.StatusOK, `{"result":"0x1"}`)
+			request := func() *http.Request {
+				return httptest.NewRequest(test.method, "/rpc", strings.NewReader(`{"method":"eth_blockNumber"}`))
+			}
+
+			serve(t, c, server, request(), upstream, "user")
+			serve(t, c, server, request(), upstream, "user")
+
+			if test.cached {
+				if upstream.count() != 1 {
+					t.Errorf("expected the second request to be a hit, the upstream got %d", upstream.count())
+				}
+				return
+			}
+			if upstream.count() != 2 {
+				t.Errorf("expected both requests to reach the upstream, got %d", upstream.count())
+			}
+			if total := server.Total(); total != 0 {
+				t.Errorf("expected the bypassed requests not to reach redis, got %d commands", total)
+			}
+		})
+	}
+}
+
+func TestServeHTTPMethodsNotShared(t *testing.T) {
+	server := redistest.NewServer()
+	c := NewCache(Options{CacheExpiry: 60, Methods: []string{http.MethodGet, http.MethodPost}})
+	getUpstream := newUpstream(http.StatusOK, `{"result":"get"}`)
+	postUpstream := newUpstream(http.StatusOK, `{"result":"post"}`)
+
+	serve(t, c, server, get("/rpc"), getUpstream, "user")
+	rw := serve(t, c, server, post("/rpc", `{}`), postUpstream, "user")
+
+	if postUpstream.count() != 1 || rw.Body.String() != postUpstream.body {
+		t.Errorf("expected the POST not to be served the cached GET, got %q", rw.Body.String())
+	}
+}
+
+func TestServeHTTPHead(t *testing.T) {
+	server := redistest.NewServer()
+	c := NewCache(Options{CacheExpiry: 60})
+	upstream := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// the HEAD response declares the length of the body it omits
+		rw.Header().Set("Content-Length", "16")
+	})
+
+	for i := 0; i < 2; i++ {
+		rw := serve(t, c, server, httptest.NewRequest(http.MethodHead, "/rpc", nil), upstream, "user")
+		if length := rw.Header().Get("Content-Length"); length != "16" || rw.Body.Len() != 0 {
+			t.Errorf("expected the Content-Length 16 without a body, got %q and %d bytes", length, rw.Body.Len())
+		}
+	}
+	if _, ok := server.Value("HEAD:/rpc"); !ok {
+		t.Errorf("expected the HEAD response to be stored apart from the GET one, got the keys %v", server.Keys(""))
+	}
+}
@@ -0,0 +1,120 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"github.com/kotalco/crossover-managed/metrics"
+	"github.com/kotalco/resp"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	PFAddCmd                 = "*3\r\n$5\r\nPFADD\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n"
+	PFCountCmd               = "*2\r\n$7\r\nPFCOUNT\r\n$%d\r\n%s\r\n"
+	CardinalityKeyPrefix     = "cache-key-cardinality:"
+	CardinalityTotalKey      = "cache-key-cardinality"
+	CardinalityWindow        = 24 * 60 * 60 // sec, the estimates cover the keys sampled within the last window
+	CardinalityRefresh       = 10 * time.Second
+	MaxCardinalityPaths      = 1000 // bound the number of paths tracked by the estimates, the others are counted as OtherSavings
+	CardinalityUserIdSegment = "{userId}"
+)
+
+var keyCardinality = metrics.NewGauge("crossover_cache_key_cardinality", "Estimate of the distinct cache keys sampled within the cardinality window")
+
+// Cardinality the estimates of the distinct cache keys, a path with many keys and few hits is fragmented
+type Cardinality struct {
+	Total int            `json:"total"`
+	Paths map[string]int `json:"paths,omitempty"`
+}
+
+// cardinalityIndex sample the cache keys into redis hyperloglogs, one per path and one for all of them
+type cardinalityIndex struct {
+	every     uint64
+	requests  uint64
+	mu        sync.Mutex
+	paths     map[string]bool
+	refreshed time.Time
+}
+
+func newCardinalityIndex(every int) *cardinalityIndex {
+	if every <= 0 {
+		return nil
+	}
+	return &cardinalityIndex{every: uint64(every), paths: map[string]bool{}}
+}
+
+// sampleKey add one of every n cache keys to the estimates of its path, the user id is masked so per user paths share their estimate
+func (c *cache) sampleKey(req *http.Request, respClient resp.IClient, userId string, cacheKey string) {
+	index := c.cardinality
+	if index == nil || atomic.AddUint64(&index.requests, 1)%index.every != 0 {
+		return
+	}
+	path := req.URL.Path
+	if keyPath, ok := keyPathFromContext(req.Context()); ok {
+		path = keyPath
+	}
+	if userId != "" {
+		path = strings.ReplaceAll(path, userId, CardinalityUserIdSegment)
+	}
+
+	index.mu.Lock()
+	if !index.paths[path] && len(index.paths) >= MaxCardinalityPaths {
+		path = OtherSavings
+	}
+	index.paths[path] = true
+	refresh := time.Since(index.refreshed) >= CardinalityRefresh
+	if refresh {
+		index.refreshed = time.Now()
+	}
+	index.mu.Unlock()
+
+	ctx := req.Context()
+	for _, key := range []string{CardinalityKeyPrefix + path, CardinalityTotalKey} {
+		if _, err := intReply(respClient.Do(ctx, fmt.Sprintf(PFAddCmd, len(key), key, len(cacheKey), cacheKey))); err != nil {
+			return
+		}
+		_, _ = respClient.Expire(ctx, key, CardinalityWindow)
+	}
+	if refresh {
+		if total, err := intReply(respClient.Do(ctx, fmt.Sprintf(PFCountCmd, len(CardinalityTotalKey), CardinalityTotalKey))); err == nil {
+			keyCardinality.Set(float64(total))
+		}
+	}
+}
+
+// Cardinality return the estimates of the distinct cache keys of the paths sampled by this instance
+func (c *cache) Cardinality(ctx context.Context, respClient resp.IClient) (Cardinality, error) {
+	var summary Cardinality
+	if c.cardinality == nil {
+		return summary, nil
+	}
+	c.cardinality.mu.Lock()
+	paths := make([]string, 0, len(c.cardinality.paths))
+	for path := range c.cardinality.paths {
+		paths = append(paths, path)
+	}
+	c.cardinality.mu.Unlock()
+	sort.Strings(paths)
+
+	total, err := intReply(respClient.Do(ctx, fmt.Sprintf(PFCountCmd, len(CardinalityTotalKey), CardinalityTotalKey)))
+	if err != nil {
+		return summary, err
+	}
+	keyCardinality.Set(float64(total))
+	summary.Total = total
+	summary.Paths = make(map[string]int, len(paths))
+	for _, path := range paths {
+		key := CardinalityKeyPrefix + path
+		count, err := intReply(respClient.Do(ctx, fmt.Sprintf(PFCountCmd, len(key), key)))
+		if err != nil {
+			return summary, err
+		}
+		summary.Paths[path] = count
+	}
+	return summary, nil
+}
@@ -0,0 +1,78 @@
+package cache
+
+import (
+	"context"
+	"github.com/kotalco/crossover-managed/internal/redistest"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestCardinality(t *testing.T) {
+	server := redistest.NewServer()
+	client := server.Client()
+	defer client.Close()
+	c := NewCache(Options{CacheExpiry: 60, IncludeQuery: true, KeySamples: 1})
+	upstream := newUpstream(http.StatusOK, "ok")
+	cardinality := func() Cardinality {
+		t.Helper()
+		summary, err := c.Cardinality(context.Background(), client)
+		if err != nil {
+			t.Fatalf("failed to estimate the cardinality: %s", err)
+		}
+		return summary
+	}
+
+	for i := 0; i < 5; i++ {
+		serve(t, c, server, get("/alice/rpc?block="+strconv.Itoa(i)), upstream, "alice")
+	}
+	if summary := cardinality(); summary.Total != 5 || summary.Paths["/"+CardinalityUserIdSegment+"/rpc"] != 5 {
+		t.Fatalf("expected the estimate to grow with the distinct keys, got %+v", summary)
+	}
+	if keyCardinality.Value() != 5 {
+		t.Errorf("expected the gauge to report the estimate, got %v", keyCardinality.Value())
+	}
+
+	for i := 0; i < 5; i++ {
+		serve(t, c, server, get("/alice/rpc?block=1"), upstream, "alice")
+	}
+	if summary := cardinality(); summary.Total != 5 {
+		t.Errorf("expected the estimate to stay flat with the repeated keys, got %+v", summary)
+	}
+
+	// the paths of every user share their estimate
+	serve(t, c, server, get("/bob/rpc?block=1"), upstream, "bob")
+	if summary := cardinality(); summary.Total != 6 || len(summary.Paths) != 1 {
+		t.Errorf("expected the user paths to share a single estimate, got %+v", summary)
+	}
+	if ttl := server.TTL(CardinalityTotalKey); ttl != CardinalityWindow {
+		t.Errorf("expected the estimates to expire after the window, got the ttl %d", ttl)
+	}
+}
+
+func TestCardinalitySampled(t *testing.T) {
+	server := redistest.NewServer()
+	client := server.Client()
+	defer client.Close()
+	c := NewCache(Options{CacheExpiry: 60, IncludeQuery: true, KeySamples: 4})
+	upstream := newUpstream(http.StatusOK, "ok")
+
+	for i := 0; i < 8; i++ {
+		serve(t, c, server, get("/rpc?block="+strconv.Itoa(i)), upstream, "user")
+	}
+	if summary, err := c.Cardinality(context.Background(), client); err != nil || summary.Total != 2 {
+		t.Errorf("expected one of every 4 keys to be sampled, got %+v %v", summary, err)
+	}
+}
+
+func TestCardinalityDisabled(t *testing.T) {
+	server := redistest.NewServer()
+	client := server.Client()
+	defer client.Close()
+	c := NewCache(Options{CacheExpiry: 60})
+
+	serve(t, c, server, get("/rpc"), newUpstream(http.StatusOK, "ok"), "user")
+	if summary, err := c.Cardinality(context.Background(), client); err != nil || summary.Total != 0 || server.Count("PFADD") != 0 {
+		t.Errorf("expected no sampling without KeySamples, got %+v %v", summary, err)
+	}
+}
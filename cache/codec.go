@@ -0,0 +1,340 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// serialization formats of the cached entries
+const (
+	FormatGob     = "gob"
+	FormatJSON    = "json"
+	FormatMsgpack = "msgpack"
+)
+
+// formatMarker start the entries carrying their format, gob never writes a zero length message
+// so the entries written before the marker existed are read as gob
+const formatMarker = 0x00
+
+var formatIds = map[string]byte{FormatGob: 'g', FormatJSON: 'j', FormatMsgpack: 'm'}
+
+var errMsgpackType = errors.New("unexpected msgpack type")
+
+// encodeEntry serialize the cached response in the format, prefixed with its marker
+func encodeEntry(format string, cachedResponse CachedResponse) ([]byte, error) {
+	id, ok := formatIds[format]
+	if !ok {
+		id = formatIds[FormatGob]
+	}
+	buffer := bytes.NewBuffer([]byte{formatMarker, id})
+	var err error
+	switch id {
+	case formatIds[FormatJSON]:
+		err = json.NewEncoder(buffer).Encode(cachedResponse)
+	case formatIds[FormatMsgpack]:
+		writeMsgpack(buffer, cachedResponse)
+	default:
+		err = gob.NewEncoder(buffer).Encode(cachedResponse)
+	}
+	return buffer.Bytes(), err
+}
+
+// decodeEntry deserialize the cached response whatever the format it was written in
+func decodeEntry(data []byte) (CachedResponse, error) {
+	var cachedResponse CachedResponse
+	if len(data) < 2 || data[0] != formatMarker {
+		err := gob.NewDecoder(bytes.NewReader(data)).Decode(&cachedResponse)
+		return cachedResponse, err
+	}
+	payload := data[2:]
+	switch data[1] {
+	case formatIds[FormatGob]:
+		err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&cachedResponse)
+		return cachedResponse, err
+	case formatIds[FormatJSON]:
+		err := json.Unmarshal(payload, &cachedResponse)
+		return cachedResponse, err
+	case formatIds[FormatMsgpack]:
+		return readMsgpack(payload)
+	default:
+		return cachedResponse, fmt.Errorf("unknown entry format %q", data[1])
+	}
+}
+
+// writeMsgpack write the cached response as a msgpack map keyed by the field names
+func writeMsgpack(buffer *bytes.Buffer, cachedResponse CachedResponse) {
+	buffer.WriteByte(0x80 | 5)
+	writeMsgpackString(buffer, "StatusCode")
+	writeMsgpackInt(buffer, int64(cachedResponse.StatusCode))
+	writeMsgpackString(buffer, "Headers")
+	writeMsgpackLength(buffer, len(cachedResponse.Headers), 0x80, 0xde)
+	keys := make([]string, 0, len(cachedResponse.Headers))
+	for key := range cachedResponse.Headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		writeMsgpackString(buffer, key)
+		writeMsgpackLength(buffer, len(cachedResponse.Headers[key]), 0x90, 0xdc)
+		for _, value := range cachedResponse.Headers[key] {
+			writeMsgpackString(buffer, value)
+		}
+	}
+	writeMsgpackString(buffer, "Body")
+	writeMsgpackBinary(buffer, cachedResponse.Body)
+	writeMsgpackString(buffer, "CreatedAt")
+	writeMsgpackInt(buffer, cachedResponse.CreatedAt)
+	writeMsgpackString(buffer, "Checksum")
+	writeMsgpackBinary(buffer, cachedResponse.Checksum)
+}
+
+// writeMsgpackLength write the header of a map or an array, using the fix variant for up to 15 elements
+func writeMsgpackLength(buffer *bytes.Buffer, length int, fix byte, long byte) {
+	switch {
+	case length < 16:
+		buffer.WriteByte(fix | byte(length))
+	case length <= math.MaxUint16:
+		buffer.WriteByte(long)
+		_ = binary.Write(buffer, binary.BigEndian, uint16(length))
+	default:
+		buffer.WriteByte(long + 1)
+		_ = binary.Write(buffer, binary.BigEndian, uint32(length))
+	}
+}
+
+func writeMsgpackString(buffer *bytes.Buffer, value string) {
+	switch length := len(value); {
+	case length < 32:
+		buffer.WriteByte(0xa0 | byte(length))
+	case length <= math.MaxUint8:
+		buffer.WriteByte(0xd9)
+		buffer.WriteByte(byte(length))
+	case length <= math.MaxUint16:
+		buffer.WriteByte(0xda)
+		_ = binary.Write(buffer, binary.BigEndian, uint16(length))
+	default:
+		buffer.WriteByte(0xdb)
+		_ = binary.Write(buffer, binary.BigEndian, uint32(length))
+	}
+	buffer.WriteString(value)
+}
+
+func writeMsgpackBinary(buffer *bytes.Buffer, value []byte) {
+	if value == nil {
+		buffer.WriteByte(0xc0)
+		return
+	}
+	switch length := len(value); {
+	case length <= math.MaxUint8:
+		buffer.WriteByte(0xc4)
+		buffer.WriteByte(byte(length))
+	case length <= math.MaxUint16:
+		buffer.WriteByte(0xc5)
+		_ = binary.Write(buffer, binary.BigEndian, uint16(length))
+	default:
+		buffer.WriteByte(0xc6)
+		_ = binary.Write(buffer, binary.BigEndian, uint32(length))
+	}
+	buffer.Write(value)
+}
+
+func writeMsgpackInt(buffer *bytes.Buffer, value int64) {
+	if value >= 0 && value < 128 {
+		buffer.WriteByte(byte(value))
+		return
+	}
+	buffer.WriteByte(0xd3)
+	_ = binary.Write(buffer, binary.BigEndian, value)
+}
+
+// readMsgpack read a cached response written by writeMsgpack
+func readMsgpack(payload []byte) (CachedResponse, error) {
+	var cachedResponse CachedResponse
+	reader := &msgpackReader{data: payload}
+	fields, err := reader.length(0x80, 0xde)
+	if err != nil {
+		return cachedResponse, err
+	}
+	for i := 0; i < fields; i++ {
+		name, err := reader.string()
+		if err != nil {
+			return cachedResponse, err
+		}
+		switch name {
+		case "StatusCode":
+			var status int64
+			status, err = reader.int()
+			cachedResponse.StatusCode = int(status)
+		case "CreatedAt":
+			cachedResponse.CreatedAt, err = reader.int()
+		case "Body":
+			cachedResponse.Body, err = reader.binary()
+		case "Checksum":
+			cachedResponse.Checksum, err = reader.binary()
+		case "Headers":
+			cachedResponse.Headers, err = reader.headers()
+		default:
+			err = fmt.Errorf("unknown msgpack field %s", name)
+		}
+		if err != nil {
+			return cachedResponse, err
+		}
+	}
+	return cachedResponse, nil
+}
+
+// msgpackReader decode the subset of msgpack written by writeMsgpack
+type msgpackReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *msgpackReader) next(n int) ([]byte, error) {
+	if n < 0 || r.pos+n > len(r.data) {
+		return nil, errors.New("truncated msgpack entry")
+	}
+	value := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return value, nil
+}
+
+func (r *msgpackReader) byte() (byte, error) {
+	value, err := r.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return value[0], nil
+}
+
+func (r *msgpackReader) uint(size int) (int, error) {
+	value, err := r.next(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return int(value[0]), nil
+	case 2:
+		return int(binary.BigEndian.Uint16(value)), nil
+	default:
+		return int(binary.BigEndian.Uint32(value)), nil
+	}
+}
+
+// length read the header of a map (fix 0x80, long 0xde) or an array (fix 0x90, long 0xdc)
+func (r *msgpackReader) length(fix byte, long byte) (int, error) {
+	kind, err := r.byte()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case kind&0xf0 == fix:
+		return int(kind & 0x0f), nil
+	case kind == long:
+		return r.uint(2)
+	case kind == long+1:
+		return r.uint(4)
+	}
+	return 0, errMsgpackType
+}
+
+func (r *msgpackReader) string() (string, error) {
+	kind, err := r.byte()
+	if err != nil {
+		return "", err
+	}
+	var length int
+	switch {
+	case kind&0xe0 == 0xa0:
+		length = int(kind & 0x1f)
+	case kind == 0xd9:
+		length, err = r.uint(1)
+	case kind == 0xda:
+		length, err = r.uint(2)
+	case kind == 0xdb:
+		length, err = r.uint(4)
+	default:
+		return "", errMsgpackType
+	}
+	if err != nil {
+		return "", err
+	}
+	value, err := r.next(length)
+	return string(value), err
+}
+
+func (r *msgpackReader) binary() ([]byte, error) {
+	kind, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	var length int
+	switch kind {
+	case 0xc0:
+		return nil, nil
+	case 0xc4:
+		length, err = r.uint(1)
+	case 0xc5:
+		length, err = r.uint(2)
+	case 0xc6:
+		length, err = r.uint(4)
+	default:
+		return nil, errMsgpackType
+	}
+	if err != nil {
+		return nil, err
+	}
+	value, err := r.next(length)
+	return append([]byte(nil), value...), err
+}
+
+func (r *msgpackReader) int() (int64, error) {
+	kind, err := r.byte()
+	if err != nil {
+		return 0, err
+	}
+	if kind < 0x80 {
+		return int64(kind), nil
+	}
+	if kind != 0xd3 {
+		return 0, errMsgpackType
+	}
+	value, err := r.next(8)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(value)), nil
+}
+
+func (r *msgpackReader) headers() (map[string][]string, error) {
+	count, err := r.length(0x80, 0xde)
+	if err != nil {
+		return nil, err
+	}
+	headers := make(map[string][]string, count)
+	for i := 0; i < count; i++ {
+		key, err := r.string()
+		if err != nil {
+			return nil, err
+		}
+		values, err := r.length(0x90, 0xdc)
+		if err != nil {
+			return nil, err
+		}
+		headers[key] = make([]string, 0, values)
+		for j := 0; j < values; j++ {
+			value, err := r.string()
+			if err != nil {
+				return nil, err
+			}
+			headers[key] = append(headers[key], value)
+		}
+	}
+	return headers, nil
+}
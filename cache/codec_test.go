@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"github.com/kotalco/crossover-managed/internal/redistest"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func testEntry(headers int, body int) CachedResponse {
+	cachedResponse := CachedResponse{
+		StatusCode: http.StatusOK,
+		Headers:    map[string][]string{},
+		Body:       []byte(strings.Repeat("b", body)),
+		CreatedAt:  1700000000,
+		Checksum:   []byte{0xde, 0xad, 0xbe, 0xef},
+	}
+	for i := 0; i < headers; i++ {
+		cachedResponse.Headers["X-Header-"+strconv.Itoa(i)] = []string{strings.Repeat("v", i*20), "second"}
+	}
+	return cachedResponse
+}
+
+func TestEntryRoundTrip(t *testing.T) {
+	entries := map[string]CachedResponse{
+		"small": testEntry(2, 10),
+		// beyond the fix lengths of the msgpack maps, strings and binaries
+		"large": testEntry(20, 70000),
+	}
+	for _, format := range []string{FormatGob, FormatJSON, FormatMsgpack, ""} {
+		for name, entry := range entries {
+			t.Run(format+" "+name, func(t *testing.T) {
+				encoded, err := encodeEntry(format, entry)
+				if err != nil {
+					t.Fatalf("failed to encode the entry: %s", err)
+				}
+				decoded, err := decodeEntry(encoded)
+				if err != nil {
+					t.Fatalf("failed to decode the entry: %s", err)
+				}
+				if !reflect.DeepEqual(decoded, entry) {
+					t.Errorf("expected the entry to round trip, got %+v", decoded)
+				}
+			})
+		}
+	}
+}
+
+func TestDecodeEntryFormats(t *testing.T) {
+	entry := testEntry(1, 10)
+
+	// the entries written before the format marker existed are plain gob
+	var legacy bytes.Buffer
+	if err := gob.NewEncoder(&legacy).Encode(entry); err != nil {
+		t.Fatalf("failed to encode the legacy entry: %s", err)
+	}
+	if decoded, err := decodeEntry(legacy.Bytes()); err != nil || !reflect.DeepEqual(decoded, entry) {
+		t.Errorf("expected the legacy gob entry to be decoded, got %+v %v", decoded, err)
+	}
+
+	// the json entries are readable with the standard tools once the marker is skipped
+	encoded, _ := encodeEntry(FormatJSON, entry)
+	var readable map[string]interface{}
+	if err := json.Unmarshal(encoded[2:], &readable); err != nil || readable["StatusCode"] != float64(http.StatusOK) {
+		t.Errorf("expected a readable json entry, got %s", encoded)
+	}
+
+	if _, err := decodeEntry([]byte{formatMarker, 'x', '{', '}'}); err == nil {
+		t.Errorf("expected the unknown format to fail")
+	}
+	for _, format := range []string{FormatJSON, FormatMsgpack} {
+		encoded, _ := encodeEntry(format, entry)
+		if _, err := decodeEntry(encoded[:len(encoded)/2]); err == nil {
+			t.Errorf("expected the truncated %s entry to fail", format)
+		}
+	}
+}
+
+func TestServeHTTPMixedFormats(t *testing.T) {
+	formats := []string{FormatGob, FormatJSON, FormatMsgpack}
+	for _, written := range formats {
+		for _, read := range formats {
+			t.Run(written+" read as "+read, func(t *testing.T) {
+				server := redistest.NewServer()
+				upstream := newUpstream(http.StatusOK, `{"result":"0x1"}`, "Content-Type", "application/json")
+
+				serve(t, NewCache(Options{CacheExpiry: 60, Format: written}), server, get("/rpc"), upstream, "user")
+				rw := serve(t, NewCache(Options{CacheExpiry: 60, Format: read}), server, get("/rpc"), upstream, "user")
+
+				if upstream.count() != 1 || rw.Body.String() != upstream.body || rw.Header().Get("Content-Type") != "application/json" {
+					t.Errorf("expected the %s entry to be served by the %s cache, got %d upstream calls and %q", written, read, upstream.count(), rw.Body.String())
+				}
+			})
+		}
+	}
+}
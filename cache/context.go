@@ -0,0 +1,90 @@
+package cache
+
+import (
+	"context"
+)
+
+type ttlContextKey struct{}
+
+// WithTTL override the ttl in seconds of the entry written on a cache miss of the request
+func WithTTL(ctx context.Context, ttl int) context.Context {
+	return context.WithValue(ctx, ttlContextKey{}, ttl)
+}
+
+// ttlFromContext return the ttl override of the request if any
+func ttlFromContext(ctx context.Context) (int, bool) {
+	ttl, ok := ctx.Value(ttlContextKey{}).(int)
+	return ttl, ok && ttl > 0
+}
+
+type pinnedTTLContextKey struct{}
+
+// WithPinnedTTL set the ttl in seconds of the entry written on a cache miss of a request pinned to concrete blocks,
+// it isn't applied to the null json-rpc results which may only be missing yet, e.g. a pending transaction receipt
+func WithPinnedTTL(ctx context.Context, ttl int) context.Context {
+	return context.WithValue(ctx, pinnedTTLContextKey{}, ttl)
+}
+
+// pinnedTTLFromContext return the pinned ttl of the request if any
+func pinnedTTLFromContext(ctx context.Context) (int, bool) {
+	ttl, ok := ctx.Value(pinnedTTLContextKey{}).(int)
+	return ttl, ok && ttl > 0
+}
+
+type keyPathContextKey struct{}
+
+// WithKeyPath override the path the cache key of the request is derived from
+func WithKeyPath(ctx context.Context, path string) context.Context {
+	return context.WithValue(ctx, keyPathContextKey{}, path)
+}
+
+// keyPathFromContext return the key path override of the request if any
+func keyPathFromContext(ctx context.Context) (string, bool) {
+	path, ok := ctx.Value(keyPathContextKey{}).(string)
+	return path, ok
+}
+
+type maxAgeContextKey struct{}
+
+// WithMaxAge bound the age in seconds of the entries served to the request, older ones are refreshed as a miss
+func WithMaxAge(ctx context.Context, maxAge int) context.Context {
+	return context.WithValue(ctx, maxAgeContextKey{}, maxAge)
+}
+
+// maxAgeFromContext return the max age of the request if any
+func maxAgeFromContext(ctx context.Context) (int, bool) {
+	maxAge, ok := ctx.Value(maxAgeContextKey{}).(int)
+	return maxAge, ok && maxAge > 0
+}
+
+type strategyContextKey struct{}
+
+// WithStrategy select the lookup strategy of the request, StrategyCacheFirst or StrategyNetworkFirst
+func WithStrategy(ctx context.Context, strategy string) context.Context {
+	return context.WithValue(ctx, strategyContextKey{}, strategy)
+}
+
+// strategyFromContext return the lookup strategy of the request, cache first unless overridden
+func strategyFromContext(ctx context.Context) string {
+	if strategy, ok := ctx.Value(strategyContextKey{}).(string); ok && strategy != "" {
+		return strategy
+	}
+	return StrategyCacheFirst
+}
+
+type detachContextKey struct{}
+
+// WithDetach let the requests answered before their upstream call completes, i.e. the stale entries served past the
+// soft timeout, hand their resources over to the call: detach is called before the request returns and the func it
+// returns once the upstream call completed
+func WithDetach(ctx context.Context, detach func() func()) context.Context {
+	return context.WithValue(ctx, detachContextKey{}, detach)
+}
+
+// detachFromContext detach the request from its resources, the returned func releases them
+func detachFromContext(ctx context.Context) func() {
+	if detach, ok := ctx.Value(detachContextKey{}).(func() func()); ok && detach != nil {
+		return detach()
+	}
+	return func() {}
+}
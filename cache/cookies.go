@@ -0,0 +1,47 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// policies of the requests carrying a Cookie header
+const (
+	CookieSkip = "skip"
+	CookieKey  = "key"
+)
+
+// personalized return the reason the request response must not be shared, empty if it can be cached
+// credentials and cookies usually mean user specific data, they're cached only when keyed on
+func (c *cache) personalized(req *http.Request) string {
+	if req.Header.Get("Authorization") != "" && c.authorizedPolicy != AuthorizedKey {
+		return ReasonAuthorized
+	}
+	if req.Header.Get("Cookie") != "" && c.cookiePolicy != CookieKey {
+		return ReasonCookie
+	}
+	return ""
+}
+
+// cookiesHash return the hash of the request cookies participating in the cache key, empty if there is none
+func (c *cache) cookiesHash(req *http.Request) string {
+	if c.cookiePolicy != CookieKey {
+		return ""
+	}
+	var pairs []string
+	for _, cookie := range req.Cookies() {
+		if len(c.cookieNames) > 0 && !c.cookieNames[cookie.Name] {
+			continue
+		}
+		pairs = append(pairs, cookie.Name+"="+cookie.Value)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	sort.Strings(pairs)
+	hash := sha256.Sum256([]byte(strings.Join(pairs, ";")))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,75 @@
+package cache
+
+import (
+	"github.com/kotalco/crossover-managed/metrics"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// MaxDryRunKeys bound the number of keys tracked by the dry-run index
+const MaxDryRunKeys = 100000
+
+var (
+	dryRunWouldHit  = metrics.NewCounter("crossover_cache_dry_run_would_hit_total", "Number of requests the cache would have served in dry-run mode")
+	dryRunWouldMiss = metrics.NewCounter("crossover_cache_dry_run_would_miss_total", "Number of requests the cache would have missed in dry-run mode")
+)
+
+// dryRunIndex track in memory the keys the cache would have stored and until when
+// it's a per instance estimate, the real cache is shared across the plugin instances
+type dryRunIndex struct {
+	mu   sync.Mutex
+	keys map[string]time.Time
+}
+
+func newDryRunIndex() *dryRunIndex {
+	return &dryRunIndex{keys: map[string]time.Time{}}
+}
+
+func (d *dryRunIndex) hit(cacheKey string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	expiry, ok := d.keys[cacheKey]
+	if ok && time.Now().After(expiry) {
+		delete(d.keys, cacheKey)
+		return false
+	}
+	return ok
+}
+
+func (d *dryRunIndex) store(cacheKey string, ttl int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	if len(d.keys) >= MaxDryRunKeys {
+		for key, expiry := range d.keys {
+			if now.After(expiry) {
+				delete(d.keys, key)
+			}
+		}
+		if len(d.keys) >= MaxDryRunKeys {
+			return
+		}
+	}
+	d.keys[cacheKey] = now.Add(time.Duration(ttl) * time.Second)
+}
+
+// serveDryRun always call next, recording whether the cache would have served the request and whether it would store the response
+func (c *cache) serveDryRun(rw http.ResponseWriter, req *http.Request, next http.Handler, cacheKey string) {
+	hit := c.dryRun.hit(cacheKey)
+	if hit {
+		dryRunWouldHit.Inc()
+	} else {
+		dryRunWouldMiss.Inc()
+	}
+
+	recorder := &responseRecorder{rw: rw}
+	next.ServeHTTP(recorder, req)
+	_ = recorder.writeResponse()
+	if hit {
+		return
+	}
+	if _, ttl, ok := c.storable(req, recorder); ok {
+		c.dryRun.store(cacheKey, ttl)
+	}
+}
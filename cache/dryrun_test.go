@@ -0,0 +1,31 @@
+package cache
+
+import (
+	"github.com/kotalco/crossover-managed/internal/redistest"
+	"net/http"
+	"testing"
+)
+
+func TestDryRun(t *testing.T) {
+	server := redistest.NewServer()
+	c := NewCache(Options{CacheExpiry: 60, DryRun: true, IncludeQuery: true, MaxQueryVariants: 1})
+	upstream := newUpstream(http.StatusOK, `{"result":"0x1"}`)
+	hits, misses := dryRunWouldHit.Value(), dryRunWouldMiss.Value()
+
+	for i := 0; i < 3; i++ {
+		serve(t, c, server, get("/rpc?block=1"), upstream, "user")
+	}
+
+	if upstream.count() != 3 {
+		t.Errorf("expected every request to reach the upstream, got %d calls", upstream.count())
+	}
+	if server.Total() != 0 {
+		t.Errorf("expected the dry-run to never use redis, got %d ops", server.Total())
+	}
+	if delta := dryRunWouldMiss.Value() - misses; delta != 1 {
+		t.Errorf("expected 1 would-miss, got %d", delta)
+	}
+	if delta := dryRunWouldHit.Value() - hits; delta != 2 {
+		t.Errorf("expected 2 would-hits, got %d", delta)
+	}
+}
@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	EncodingIdentity = "identity"
+	EncodingGzip     = "gzip"
+	EncodingDeflate  = "deflate"
+)
+
+// canonicalize decode the body of the response so a single entry serves every client encoding
+func canonicalize(cachedResponse *CachedResponse) error {
+	encoding := strings.ToLower(strings.TrimSpace(http.Header(cachedResponse.Headers).Get("Content-Encoding")))
+	var reader io.ReadCloser
+	switch encoding {
+	case "", EncodingIdentity:
+		return nil
+	case EncodingGzip:
+		gzipReader, err := gzip.NewReader(bytes.NewReader(cachedResponse.Body))
+		if err != nil {
+			return err
+		}
+		reader = gzipReader
+	case EncodingDeflate:
+		// the http deflate coding is the zlib format (RFC 9110), not the raw deflate stream
+		zlibReader, err := zlib.NewReader(bytes.NewReader(cachedResponse.Body))
+		if err != nil {
+			return err
+		}
+		reader = zlibReader
+	default:
+		return fmt.Errorf("unsupported content encoding %s", encoding)
+	}
+	defer reader.Close()
+
+	// a small compressed body may expand to a huge one, stop past the largest cacheable body
+	body, err := io.ReadAll(io.LimitReader(reader, MaxCacheableBodySize+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > MaxCacheableBodySize {
+		return fmt.Errorf("decoded body exceeds %d bytes", MaxCacheableBodySize)
+	}
+	cachedResponse.Body = body
+	delete(cachedResponse.Headers, "Content-Encoding")
+	return nil
+}
+
+// encode the canonical body of the entry in the encoding accepted by the client
+func (c *cache) encode(req *http.Request, cachedResponse CachedResponse) CachedResponse {
+	if !c.canonicalBody || len(cachedResponse.Body) == 0 || !acceptsGzip(req) {
+		return cachedResponse
+	}
+	if http.Header(cachedResponse.Headers).Get("Content-Encoding") != "" {
+		// stored before the bodies were canonicalized
+		return cachedResponse
+	}
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err := writer.Write(cachedResponse.Body); err != nil {
+		return cachedResponse
+	}
+	if err := writer.Close(); err != nil {
+		return cachedResponse
+	}
+	headers := http.Header(cachedResponse.Headers).Clone()
+	headers.Set("Content-Encoding", EncodingGzip)
+	headers.Set("Content-Length", strconv.Itoa(buffer.Len()))
+	cachedResponse.Headers = headers
+	cachedResponse.Body = buffer.Bytes()
+	return cachedResponse
+}
+
+// acceptsGzip check whether the Accept-Encoding of the request allows gzip
+func acceptsGzip(req *http.Request) bool {
+	for _, value := range req.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name != EncodingGzip && name != "*" {
+				continue
+			}
+			if q, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q="); ok {
+				if weight, err := strconv.ParseFloat(q, 64); err == nil && weight == 0 {
+					continue
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"github.com/kotalco/crossover-managed/internal/redistest"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// deflated compress the body in the zlib format of the http deflate coding
+func deflated(t *testing.T, body string) string {
+	t.Helper()
+	var buffer bytes.Buffer
+	writer := zlib.NewWriter(&buffer)
+	_, _ = io.WriteString(writer, body)
+	if err := writer.Close(); err != nil {
+		t.Fatalf("failed to compress the body: %s", err)
+	}
+	return buffer.String()
+}
+
+func TestCanonicalBody(t *testing.T) {
+	body := `{"jsonrpc":"2.0","id":1,"result":"0x1"}`
+	tests := []struct {
+		name     string
+		upstream *testUpstream
+	}{
+		{"identity upstream", newUpstream(http.StatusOK, body)},
+		{"gzip upstream", newUpstream(http.StatusOK, gzipped(t, body), "Content-Encoding", "gzip")},
+		{"deflate upstream", newUpstream(http.StatusOK, deflated(t, body), "Content-Encoding", "deflate")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := redistest.NewServer()
+			c := NewCache(Options{CacheExpiry: 60, CanonicalBody: true})
+			serve(t, c, server, get("/rpc"), test.upstream, "user")
+
+			stored, _ := server.Value("/rpc")
+			entry, err := decodeEntry([]byte(stored))
+			if err != nil || string(entry.Body) != body || http.Header(entry.Headers).Get("Content-Encoding") != "" {
+				t.Fatalf("expected the decoded body to be stored, got %q %v", entry.Body, err)
+			}
+			if keys := server.Keys(""); len(keys) != 1 {
+				t.Errorf("expected a single entry for every encoding, got %v", keys)
+			}
+
+			identity := get("/rpc")
+			rw := serve(t, c, server, identity, test.upstream, "user")
+			if rw.Body.String() != body || rw.Header().Get("Content-Encoding") != "" || rw.Header().Get("Content-Length") != strconv.Itoa(len(body)) {
+				t.Errorf("expected the identity body with its length, got %q %v", rw.Body.String(), rw.Header())
+			}
+
+			compressed := get("/rpc")
+			compressed.Header.Set("Accept-Encoding", "br, gzip")
+			rw = serve(t, c, server, compressed, test.upstream, "user")
+			if rw.Header().Get("Content-Encoding") != EncodingGzip || rw.Header().Get("Content-Length") != strconv.Itoa(rw.Body.Len()) {
+				t.Fatalf("expected the gzip body with its length, got %v", rw.Header())
+			}
+			reader, err := gzip.NewReader(rw.Body)
+			if err != nil {
+				t.Fatalf("failed to decompress the body: %s", err)
+			}
+			if decoded, _ := io.ReadAll(reader); string(decoded) != body {
+				t.Errorf("expected the gzip body to decode to %s, got %s", body, decoded)
+			}
+			if !strings.Contains(rw.Header().Get("Vary"), "Accept-Encoding") {
+				t.Errorf("expected the hits to vary on Accept-Encoding, got %q", rw.Header().Get("Vary"))
+			}
+			if test.upstream.count() != 1 {
+				t.Errorf("expected both encodings to be served from the entry, got %d upstream calls", test.upstream.count())
+			}
+		})
+	}
+}
+
+func TestCanonicalizeBounded(t *testing.T) {
+	bomb := CachedResponse{
+		Headers: http.Header{"Content-Encoding": {"gzip"}},
+		Body:    []byte(gzipped(t, strings.Repeat("0", MaxCacheableBodySize+1))),
+	}
+	if err := canonicalize(&bomb); err == nil {
+		t.Errorf("expected the body decoding past the cacheable size to fail")
+	}
+	unsupported := CachedResponse{Headers: http.Header{"Content-Encoding": {"br"}}, Body: []byte("compressed")}
+	if err := canonicalize(&unsupported); err == nil {
+		t.Errorf("expected the unsupported encoding to fail")
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		gzip           bool
+	}{
+		{"gzip", true},
+		{"br, GZIP", true},
+		{"*", true},
+		{"gzip;q=0.5", true},
+		{"gzip; q=0", false},
+		{"identity", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		req := get("/rpc")
+		req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		if gzip := acceptsGzip(req); gzip != test.gzip {
+			t.Errorf("expected gzip %t for %q, got %t", test.gzip, test.acceptEncoding, gzip)
+		}
+	}
+}
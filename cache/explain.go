@@ -0,0 +1,76 @@
+package cache
+
+import (
+	"github.com/kotalco/crossover-managed/jsonrpc"
+	"net/http"
+)
+
+// Explanation the cache decision of a request and its response
+type Explanation struct {
+	Key       string `json:"key,omitempty"`
+	Cacheable bool   `json:"cacheable"`
+	Reason    string `json:"reason,omitempty"`
+	TTL       int    `json:"ttl,omitempty"`
+}
+
+// Explain compute the cache key and decision of the request and its response without reading nor writing redis
+func (c *cache) Explain(req *http.Request, response CachedResponse, userId string) Explanation {
+	if reason := requestReason(req, c.methods); reason != "" {
+		return Explanation{Reason: reason}
+	}
+	if reason := c.personalized(req); reason != "" {
+		return Explanation{Reason: reason}
+	}
+	key := c.cacheKey(req, userId)
+	if variant := c.queryVariant(req); variant != "" {
+		key = key + "?" + variant
+	}
+	ttl, reason := c.decide(req, response)
+	return Explanation{Key: key, Cacheable: reason == "", Reason: reason, TTL: ttl}
+}
+
+// decide whether the response of the request is stored and for how long, returning the reason when it isn't
+func (c *cache) decide(req *http.Request, response CachedResponse) (int, string) {
+	if cacheable, reason := isCacheable(req, response, c.methods); !cacheable {
+		return 0, reason
+	}
+	header := http.Header(response.Headers)
+	if !c.cacheableContentType(header.Get("Content-Type")) {
+		return 0, ReasonContentType
+	}
+	if bodySize := len(response.Body); bodySize < c.minBodySize || (c.maxBodySize > 0 && bodySize > c.maxBodySize) {
+		return 0, ReasonBodySize
+	}
+	if c.maxHeaderBytes > 0 && headersSize(header) > c.maxHeaderBytes {
+		return 0, ReasonHeadersTooLarge
+	}
+	if c.tooManyHeaders(header) {
+		return 0, ReasonTooManyHeaders
+	}
+	temporaryRedirect := temporaryRedirect(response.StatusCode)
+	if temporaryRedirect && c.redirectTTL <= 0 {
+		// replaying a temporary redirect would pin the clients to a location the upstream may already have moved off
+		return 0, ReasonTemporaryRedirect
+	}
+	defaultTTL := c.cacheExpiry
+	if c.negativeTTL > 0 && (response.StatusCode == http.StatusNotFound || response.StatusCode == http.StatusGone) {
+		// negative results usually resolve sooner than the positive ones change
+		defaultTTL = c.negativeTTL
+	}
+	ttl, _ := responseTTL(header, defaultTTL)
+	if temporaryRedirect && ttl > c.redirectTTL {
+		ttl = c.redirectTTL
+	}
+	if pinned, ok := pinnedTTLFromContext(req.Context()); ok && response.StatusCode == http.StatusOK && !jsonrpc.NullResult(response.Body) {
+		ttl = pinned
+	}
+	if override, ok := ttlFromContext(req.Context()); ok {
+		ttl = override
+	}
+	return ttl, ""
+}
+
+// temporaryRedirect check whether the status is a redirect the upstream may change, the permanent ones are cached as usual
+func temporaryRedirect(status int) bool {
+	return status == http.StatusFound || status == http.StatusSeeOther || status == http.StatusTemporaryRedirect
+}
@@ -0,0 +1,62 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"github.com/kotalco/resp"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// setFreshness set the Cache-Control max-age of the hit to the remaining ttl of its entry and its Age to the time since
+// it was stored, so the downstream caches don't keep it past the plugin one, the headers are left untouched if the ttl
+// can't be read
+func (c *cache) setFreshness(ctx context.Context, respClient resp.IClient, cacheKey string, cachedResponse CachedResponse) CachedResponse {
+	remaining, err := intReply(respClient.Do(ctx, fmt.Sprintf(TTLCmd, len(cacheKey), cacheKey)))
+	if err != nil || remaining < 0 {
+		// -1 and -2 are the replies of the keys without expiry and the missing ones
+		return cachedResponse
+	}
+	age := time.Now().Unix() - cachedResponse.CreatedAt
+	if age < 0 {
+		age = 0
+	}
+	if c.maxAge > 0 && int64(c.maxAge)-age < int64(remaining) {
+		// the max age ceiling refreshes the entry before redis expires it
+		remaining = int(int64(c.maxAge) - age)
+	}
+	if cachedResponse.Headers == nil {
+		cachedResponse.Headers = map[string][]string{}
+	}
+	headers := http.Header(cachedResponse.Headers)
+	headers.Set("Cache-Control", withMaxAge(headers.Get("Cache-Control"), remaining))
+	headers.Set("Age", strconv.FormatInt(age, 10))
+	return cachedResponse
+}
+
+// withMaxAge rewrite the max-age and s-maxage directives of the Cache-Control header to maxAge and keep the other ones,
+// max-age is appended if the header has none
+func withMaxAge(cacheControl string, maxAge int) string {
+	value := strconv.Itoa(maxAge)
+	directives := make([]string, 0, 4)
+	found := false
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.TrimSpace(directive)
+		name, _, _ := strings.Cut(directive, "=")
+		switch {
+		case directive == "":
+			continue
+		case strings.EqualFold(name, "max-age"):
+			directive, found = "max-age="+value, true
+		case strings.EqualFold(name, "s-maxage"):
+			directive = "s-maxage=" + value
+		}
+		directives = append(directives, directive)
+	}
+	if !found {
+		directives = append(directives, "max-age="+value)
+	}
+	return strings.Join(directives, ", ")
+}
@@ -0,0 +1,96 @@
+package cache
+
+import (
+	"github.com/kotalco/crossover-managed/internal/redistest"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServeHTTPFreshness(t *testing.T) {
+	tests := []struct {
+		name         string
+		freshness    bool
+		maxAge       int
+		cacheControl string
+		age          string
+	}{
+		{"remaining ttl", true, 0, "max-age=40", "20"},
+		{"max age ceiling", true, 30, "max-age=10", "20"},
+		{"disabled", false, 0, "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := redistest.NewServer()
+			c := NewCache(Options{CacheExpiry: 60, MaxAge: test.maxAge, Freshness: test.freshness})
+			upstream := newUpstream(http.StatusOK, "ok")
+
+			if rw := serve(t, c, server, get("/path"), upstream, "user"); rw.Header().Get("Cache-Control") != "" {
+				t.Errorf("expected the miss to be served as the upstream sent it, got %q", rw.Header().Get("Cache-Control"))
+			}
+			// the entry was stored 20 seconds ago and has 40 seconds left
+			backdate(t, server, "/path", 20)
+			server.Advance(20 * time.Second)
+			rw := serve(t, c, server, get("/path"), upstream, "user")
+
+			if upstream.count() != 1 {
+				t.Fatalf("expected the hit to be served from the cache, got %d upstream calls", upstream.count())
+			}
+			if cacheControl := rw.Header().Get("Cache-Control"); cacheControl != test.cacheControl {
+				t.Errorf("expected the Cache-Control %q, got %q", test.cacheControl, cacheControl)
+			}
+			if age := rw.Header().Get("Age"); age != test.age {
+				t.Errorf("expected the Age %q, got %q", test.age, age)
+			}
+		})
+	}
+}
+
+func TestServeHTTPFreshnessKeepsDirectives(t *testing.T) {
+	server := redistest.NewServer()
+	c := NewCache(Options{CacheExpiry: 60, Freshness: true})
+	upstream := newUpstream(http.StatusOK, "ok", "Cache-Control", "public, max-age=600, no-transform")
+
+	serve(t, c, server, get("/path"), upstream, "user")
+	// the upstream max-age sets the ttl of the entry, 580 seconds are left 20 seconds later
+	server.Advance(20 * time.Second)
+	rw := serve(t, c, server, get("/path"), upstream, "user")
+
+	if cacheControl := rw.Header().Get("Cache-Control"); cacheControl != "public, max-age=580, no-transform" {
+		t.Errorf("expected only the max-age to be rewritten, got %q", cacheControl)
+	}
+}
+
+func TestWithMaxAge(t *testing.T) {
+	tests := []struct {
+		cacheControl string
+		expected     string
+	}{
+		{"", "max-age=40"},
+		{"max-age=600", "max-age=40"},
+		{"private, max-age=600, no-transform", "private, max-age=40, no-transform"},
+		{"public,no-transform", "public, no-transform, max-age=40"},
+		{"Max-Age=\"600\", s-maxage=900", "max-age=40, s-maxage=40"},
+	}
+	for _, test := range tests {
+		if cacheControl := withMaxAge(test.cacheControl, 40); cacheControl != test.expected {
+			t.Errorf("expected %q to be rewritten %q, got %q", test.cacheControl, test.expected, cacheControl)
+		}
+	}
+}
+
+func TestServeHTTPFreshnessWithoutExpiry(t *testing.T) {
+	server := redistest.NewServer()
+	c := NewCache(Options{CacheExpiry: 60, Freshness: true})
+	upstream := newUpstream(http.StatusOK, "ok", "Cache-Control", "public")
+
+	serve(t, c, server, get("/path"), upstream, "user")
+	// an entry without expiry has no remaining freshness to tell
+	value, _ := server.Value("/path")
+	server.Set("/path", value)
+	rw := serve(t, c, server, get("/path"), upstream, "user")
+
+	if cacheControl := rw.Header().Get("Cache-Control"); cacheControl != "public" {
+		t.Errorf("expected the stored Cache-Control to be left untouched, got %q", cacheControl)
+	}
+}
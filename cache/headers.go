@@ -0,0 +1,47 @@
+package cache
+
+import (
+	"net/http"
+	"sort"
+)
+
+// policies of the responses with more headers than MaxHeaders
+const (
+	HeadersSkip     = "skip"
+	HeadersTruncate = "truncate"
+)
+
+// essentialHeaders kept first when the headers are truncated, the cached entry can't be served correctly without them
+var essentialHeaders = []string{"Content-Type", "Content-Length", "Content-Encoding", "Cache-Control", "Expires", "Vary", "Etag", "Last-Modified"}
+
+// tooManyHeaders check whether the response carries more distinct headers than allowed and the policy skips caching it
+func (c *cache) tooManyHeaders(header http.Header) bool {
+	return c.maxHeaders > 0 && len(header) > c.maxHeaders && c.headersPolicy != HeadersTruncate
+}
+
+// truncateHeaders drop the headers past maxHeaders, the essential ones are kept first and the others in name order
+func (c *cache) truncateHeaders(headers map[string][]string) map[string][]string {
+	if c.maxHeaders <= 0 || len(headers) <= c.maxHeaders || c.headersPolicy != HeadersTruncate {
+		return headers
+	}
+	truncated := make(map[string][]string, c.maxHeaders)
+	for _, name := range essentialHeaders {
+		if values, ok := headers[name]; ok && len(truncated) < c.maxHeaders {
+			truncated[name] = values
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if len(truncated) >= c.maxHeaders {
+			break
+		}
+		if _, ok := truncated[name]; !ok {
+			truncated[name] = headers[name]
+		}
+	}
+	return truncated
+}
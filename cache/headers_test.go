@@ -0,0 +1,107 @@
+package cache
+
+import (
+	"github.com/kotalco/crossover-managed/internal/redistest"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMaxHeaderBytes(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  string
+		stored bool
+	}{
+		{"within the limit", strings.Repeat("a", 100), true},
+		{"over the limit", strings.Repeat("a", 2000), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := redistest.NewServer()
+			c := NewCache(Options{CacheExpiry: 60, MaxHeaderBytes: 1024})
+			upstream := newUpstream(http.StatusOK, "ok", "X-Trace", test.value)
+
+			rw := serve(t, c, server, get("/rpc"), upstream, "user")
+
+			if rw.Code != http.StatusOK || rw.Body.String() != "ok" || rw.Header().Get("X-Trace") != test.value {
+				t.Errorf("expected the response to be served whole, got %d %s", rw.Code, rw.Body.String())
+			}
+			if _, stored := server.Value("/rpc"); stored != test.stored {
+				t.Errorf("expected stored %t, got %t", test.stored, stored)
+			}
+		})
+	}
+}
+
+func TestMaxCachedHeaders(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxHeaders int
+		policy     string
+		stored     int // number of headers of the stored entry, 0 when it isn't stored
+	}{
+		{"within the cap", 20, HeadersSkip, 12},
+		{"skip", 5, HeadersSkip, 0},
+		{"default policy", 5, "", 0},
+		{"truncate", 5, HeadersTruncate, 5},
+		{"disabled", 0, HeadersSkip, 12},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := redistest.NewServer()
+			c := NewCache(Options{CacheExpiry: 60, MaxHeaders: test.maxHeaders, HeadersPolicy: test.policy})
+			// 10 custom headers along with the Content-Type and the stored Content-Length
+			header := []string{"Content-Type", "application/json"}
+			for i := 0; i < 10; i++ {
+				header = append(header, "X-Custom-"+strconv.Itoa(i), "value")
+			}
+			upstream := newUpstream(http.StatusOK, "ok", header...)
+
+			rw := serve(t, c, server, get("/rpc"), upstream, "user")
+			if rw.Body.String() != "ok" || rw.Header().Get("X-Custom-9") != "value" {
+				t.Errorf("expected the response to be served whole, got %s %v", rw.Body.String(), rw.Header())
+			}
+
+			value, ok := server.Value("/rpc")
+			if test.stored == 0 {
+				if ok {
+					t.Errorf("expected the response with too many headers not to be stored")
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("expected the response to be stored")
+			}
+			cachedResponse, err := decodeEntry([]byte(value))
+			if err != nil {
+				t.Fatalf("failed to decode the entry: %s", err)
+			}
+			if len(cachedResponse.Headers) != test.stored {
+				t.Errorf("expected %d stored headers, got %v", test.stored, cachedResponse.Headers)
+			}
+			// the essential headers survive the truncation
+			hit := serve(t, c, server, get("/rpc"), upstream, "user")
+			if upstream.count() != 1 || hit.Header().Get("Content-Type") != "application/json" || hit.Header().Get("Content-Length") != "2" {
+				t.Errorf("expected the hit with its content headers, got %d upstream calls and %v", upstream.count(), hit.Header())
+			}
+		})
+	}
+}
+
+func TestTruncateHeadersOrder(t *testing.T) {
+	c := NewCache(Options{MaxHeaders: 3, HeadersPolicy: HeadersTruncate}).(*cache)
+	headers := map[string][]string{"X-B": {"b"}, "X-A": {"a"}, "Vary": {"Accept"}, "Content-Type": {"text/plain"}}
+
+	truncated := c.truncateHeaders(headers)
+
+	for _, name := range []string{"Content-Type", "Vary", "X-A"} {
+		if _, ok := truncated[name]; !ok {
+			t.Errorf("expected the essential headers first then the others in name order, got %v", truncated)
+		}
+	}
+	if len(truncated) != 3 {
+		t.Errorf("expected 3 headers, got %v", truncated)
+	}
+}
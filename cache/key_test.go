@@ -0,0 +1,265 @@
+package cache
+
+import (
+	"github.com/kotalco/crossover-managed/internal/redistest"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeHTTPPerUser(t *testing.T) {
+	tests := []struct {
+		name    string
+		perUser bool
+		calls   int
+	}{
+		{"shared", false, 1},
+		{"per user", true, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := redistest.NewServer()
+			c := NewCache(Options{CacheExpiry: 60, PerUser: test.perUser})
+			upstream := newUpstream(http.StatusOK, "balance")
+
+			serve(t, c, server, get("/rpc"), upstream, "alice")
+			serve(t, c, server, get("/rpc"), upstream, "bob")
+			// each user hits its own entry
+			serve(t, c, server, get("/rpc"), upstream, "alice")
+			serve(t, c, server, get("/rpc"), upstream, "bob")
+
+			if upstream.count() != test.calls {
+				t.Errorf("expected %d upstream calls, got %d", test.calls, upstream.count())
+			}
+			if test.perUser {
+				for _, key := range []string{"alice:/rpc", "bob:/rpc"} {
+					if _, ok := server.Value(key); !ok {
+						t.Errorf("expected the entry %s, got the keys %v", key, server.Keys(""))
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDebugKeyHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		options Options
+		path    string
+		key     string
+	}{
+		{"path", Options{}, "/rpc", "/rpc"},
+		{"per user", Options{PerUser: true}, "/rpc", "alice:/rpc"},
+		{"query", Options{IncludeQuery: true}, "/rpc?b=2&a=1", "/rpc?a=1&b=2"},
+		{"per user query", Options{PerUser: true, IncludeQuery: true}, "/rpc?a=1", "alice:/rpc?a=1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := redistest.NewServer()
+			test.options.CacheExpiry = 60
+			test.options.DebugKeyHeader = "X-Cache-Key"
+			c := NewCache(test.options)
+
+			rw := serve(t, c, server, get(test.path), newUpstream(http.StatusOK, "ok"), "alice")
+
+			key := rw.Header().Get("X-Cache-Key")
+			if key != test.key {
+				t.Errorf("expected the key header %q, got %q", test.key, key)
+			}
+			if _, ok := server.Value(key); !ok {
+				t.Errorf("expected the header to name the stored entry, got the keys %v", server.Keys(""))
+			}
+		})
+	}
+}
+
+func TestDebugKeyHeaderDisabled(t *testing.T) {
+	c := NewCache(Options{CacheExpiry: 60})
+	rw := serve(t, c, redistest.NewServer(), get("/rpc"), newUpstream(http.StatusOK, "ok"), "alice")
+	if key := rw.Header().Get("X-Cache-Key"); key != "" {
+		t.Errorf("expected no key header by default, got %q", key)
+	}
+}
+
+func TestServeHTTPAuthorized(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		calls  int
+	}{
+		{"skip", "", 5},
+		{"key", AuthorizedKey, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := redistest.NewServer()
+			c := NewCache(Options{CacheExpiry: 60, AuthorizedPolicy: test.policy})
+			calls := 0
+			upstream := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				calls++
+				_, _ = io.WriteString(rw, "balance of "+req.Header.Get("Authorization"))
+			})
+			authorized := func(token string) *http.Request {
+				req := get("/rpc")
+				if token != "" {
+					req.Header.Set("Authorization", token)
+				}
+				return req
+			}
+
+			for _, token := range []string{"alice", "bob", "", "alice", "bob"} {
+				rw := serve(t, c, server, authorized(token), upstream, "user")
+				if expected := "balance of " + token; rw.Body.String() != expected {
+					t.Errorf("expected %q, got %q", expected, rw.Body.String())
+				}
+			}
+			if calls != test.calls {
+				t.Errorf("expected %d upstream calls, got %d", test.calls, calls)
+			}
+		})
+	}
+}
+
+func TestServeHTTPCookies(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		names   []string
+		cookies []string
+		calls   int
+	}{
+		{"skip", "", nil, []string{"session=alice", "session=bob", "", "session=alice"}, 4},
+		{"key", CookieKey, nil, []string{"session=alice", "session=bob", "", "session=alice", "session=bob"}, 3},
+		{"key on the named cookies", CookieKey, []string{"session"}, []string{"session=alice; theme=dark", "session=alice; theme=light", "session=bob"}, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := redistest.NewServer()
+			c := NewCache(Options{CacheExpiry: 60, CookiePolicy: test.policy, CookieNames: test.names})
+			profile := func(req *http.Request) string {
+				if session, err := req.Cookie("session"); err == nil {
+					return "profile of " + session.Value
+				}
+				return "profile of "
+			}
+			calls := 0
+			upstream := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				calls++
+				_, _ = io.WriteString(rw, profile(req))
+			})
+
+			for _, cookie := range test.cookies {
+				req := get("/rpc")
+				if cookie != "" {
+					req.Header.Set("Cookie", cookie)
+				}
+				rw := serve(t, c, server, req, upstream, "user")
+				if expected := profile(req); rw.Body.String() != expected {
+					t.Errorf("expected %q for the cookie %q, got %q", expected, cookie, rw.Body.String())
+				}
+			}
+			if calls != test.calls {
+				t.Errorf("expected %d upstream calls, got %d", test.calls, calls)
+			}
+		})
+	}
+}
+
+func TestServeHTTPSetCookieNotCached(t *testing.T) {
+	server := redistest.NewServer()
+	c := NewCache(Options{CacheExpiry: 60})
+	upstream := newUpstream(http.StatusOK, "ok", "Set-Cookie", "session=alice")
+
+	if rw := serve(t, c, server, get("/rpc"), upstream, "user"); rw.Header().Get("Set-Cookie") != "session=alice" {
+		t.Fatalf("expected the miss to pass the cookie of its client, got %q", rw.Header().Get("Set-Cookie"))
+	}
+	rw := serve(t, c, server, get("/rpc"), upstream, "user")
+	if rw.Body.String() != "ok" || upstream.calls != 1 {
+		t.Fatalf("expected the cached response, got %s with %d upstream calls", rw.Body.String(), upstream.calls)
+	}
+	if cookie := rw.Header().Get("Set-Cookie"); cookie != "" {
+		t.Errorf("expected the cookie not to be replayed to the other clients, got %q", cookie)
+	}
+}
+
+// echoUpstream answer the request body it received and count the calls reaching it
+type echoUpstream struct {
+	testUpstream
+}
+
+func (u *echoUpstream) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	u.testUpstream.ServeHTTP(rw, req)
+	_, _ = io.Copy(rw, req.Body)
+}
+
+func TestServeHTTPIncludeBody(t *testing.T) {
+	tests := []struct {
+		name        string
+		includeBody bool
+		bodies      []string
+		calls       int
+	}{
+		{"distinct bodies", true, []string{`{"id":1}`, `{"id":2}`}, 2},
+		{"same body", true, []string{`{"id":1}`, `{"id":1}`}, 1},
+		{"body not included", false, []string{`{"id":1}`, `{"id":2}`}, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := redistest.NewServer()
+			c := NewCache(Options{CacheExpiry: 60, Methods: []string{http.MethodPost}, IncludeBody: test.includeBody})
+			upstream := &echoUpstream{}
+
+			for i, body := range test.bodies {
+				rw := serve(t, c, server, post("/rpc", body), upstream, "user")
+				// the hashed body is restored for the upstream
+				if i == 0 && rw.Body.String() != body {
+					t.Errorf("expected the upstream to read the body back, got %q", rw.Body.String())
+				}
+			}
+			if upstream.count() != test.calls {
+				t.Errorf("expected %d upstream calls, got %d", test.calls, upstream.count())
+			}
+			if keys := server.Keys("POST:/rpc"); len(keys) != test.calls {
+				t.Errorf("expected %d cache entries, got %v", test.calls, keys)
+			}
+		})
+	}
+}
+
+func TestServeHTTPIncludeBodyTooLarge(t *testing.T) {
+	tests := []struct {
+		name          string
+		contentLength bool
+	}{
+		{"declared length", true},
+		{"unknown length", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := redistest.NewServer()
+			c := NewCache(Options{CacheExpiry: 60, Methods: []string{http.MethodPost}, IncludeBody: true})
+			body := strings.Repeat("a", int(MaxHashedBodySize)+1)
+			req := httptest.NewRequest(http.MethodPost, "/rpc", strings.NewReader(body))
+			if !test.contentLength {
+				req.ContentLength = -1
+			}
+			var received int
+			upstream := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				read, _ := io.Copy(io.Discard, req.Body)
+				received = int(read)
+			})
+
+			serve(t, c, server, req, upstream, "user")
+
+			if received != len(body) {
+				t.Errorf("expected the upstream to receive the whole %d bytes body, got %d", len(body), received)
+			}
+			if keys := server.Keys(""); len(keys) != 0 {
+				t.Errorf("expected the oversized request not to be cached, got %v", keys)
+			}
+		})
+	}
+}
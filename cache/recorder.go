@@ -3,8 +3,11 @@ package cache
 import (
 	"bytes"
 	"net/http"
+	"strconv"
 )
 
+// responseRecorder buffer the status and the body of the upstream response without writing them to the client
+// its headers are the ones of the wrapped ResponseWriter, writeResponse sends the recorded response exactly once
 type responseRecorder struct {
 	rw     http.ResponseWriter
 	status int
@@ -16,11 +19,37 @@ func (r *responseRecorder) Header() http.Header {
 }
 
 func (r *responseRecorder) Write(b []byte) (int, error) {
-	r.body.Write(b)
-	return r.rw.Write(b)
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.body.Write(b)
 }
 
+// WriteHeader record the first status, the superfluous calls are ignored like the net/http ones
 func (r *responseRecorder) WriteHeader(statusCode int) {
-	r.status = statusCode
-	r.rw.WriteHeader(statusCode)
+	if r.status == 0 {
+		r.status = statusCode
+	}
+}
+
+// writeResponse write the recorded status and body to the wrapped ResponseWriter
+func (r *responseRecorder) writeResponse() error {
+	if r.status == 0 {
+		// the upstream wrote nothing, net/http would have answered an empty 200
+		r.status = http.StatusOK
+	}
+	r.rw.WriteHeader(r.status)
+	_, err := r.rw.Write(r.body.Bytes())
+	return err
+}
+
+// complete check whether the recorded response is whole, a body shorter than
+// the declared Content-Length means the upstream response was cut and must not be cached
+func (r *responseRecorder) complete() bool {
+	contentLength := r.Header().Get("Content-Length")
+	if contentLength == "" {
+		return true
+	}
+	length, err := strconv.Atoi(contentLength)
+	return err == nil && length == r.body.Len()
 }
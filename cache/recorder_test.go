@@ -0,0 +1,115 @@
+package cache
+
+import (
+	"github.com/kotalco/crossover-managed/internal/redistest"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeHTTPPartialResponse(t *testing.T) {
+	server := redistest.NewServer()
+	c := NewCache(Options{CacheExpiry: 60})
+	// the upstream connection breaks after the first half of the declared body
+	upstream := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Length", "20")
+		_, _ = io.WriteString(rw, `{"result":`)
+	})
+
+	serve(t, c, server, get("/rpc"), upstream, "user")
+
+	if _, ok := server.Value("/rpc"); ok {
+		t.Errorf("expected the partial response not to be cached")
+	}
+}
+
+func TestResponseRecorderComplete(t *testing.T) {
+	tests := []struct {
+		name          string
+		contentLength string
+		body          string
+		complete      bool
+	}{
+		{"no content length", "", "partial", true},
+		{"whole body", "7", "partial", true},
+		{"short body", "20", "partial", false},
+		{"malformed content length", "many", "partial", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := &responseRecorder{rw: &streamWriter{header: http.Header{}}}
+			if test.contentLength != "" {
+				recorder.Header().Set("Content-Length", test.contentLength)
+			}
+			_, _ = io.WriteString(recorder, test.body)
+			if complete := recorder.complete(); complete != test.complete {
+				t.Errorf("expected complete %t, got %t", test.complete, complete)
+			}
+		})
+	}
+}
+
+// countingWriter count the status and the body writes reaching the client
+type countingWriter struct {
+	*httptest.ResponseRecorder
+	headers int
+	writes  int
+}
+
+func (w *countingWriter) WriteHeader(statusCode int) {
+	w.headers++
+	w.ResponseRecorder.WriteHeader(statusCode)
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	w.writes++
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestServeHTTPMissWritesOnce(t *testing.T) {
+	body := `{"jsonrpc":"2.0","id":1,"result":"0x10"}`
+	tests := []struct {
+		name     string
+		options  Options
+		upstream http.Handler
+		status   int
+		body     string
+	}{
+		{"miss", Options{CacheExpiry: 60}, newUpstream(http.StatusOK, body), http.StatusOK, body},
+		{"dry run", Options{CacheExpiry: 60, DryRun: true}, newUpstream(http.StatusOK, body), http.StatusOK, body},
+		{"chunked body", Options{CacheExpiry: 60}, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			for _, chunk := range []string{body[:10], body[10:20], body[20:]} {
+				_, _ = io.WriteString(rw, chunk)
+			}
+		}), http.StatusOK, body},
+		{"superfluous status", Options{CacheExpiry: 60}, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.WriteHeader(http.StatusAccepted)
+			rw.WriteHeader(http.StatusInternalServerError)
+			_, _ = io.WriteString(rw, body)
+		}), http.StatusAccepted, body},
+		{"empty response", Options{CacheExpiry: 60}, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}), http.StatusOK, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := redistest.NewServer()
+			client := server.Client()
+			defer client.Close()
+			c := NewCache(test.options)
+			rw := &countingWriter{ResponseRecorder: httptest.NewRecorder()}
+
+			c.ServeHTTP(rw, get("/rpc"), test.upstream, client, "user")
+
+			if rw.headers != 1 || rw.writes != 1 {
+				t.Errorf("expected a single status and body write, got %d and %d", rw.headers, rw.writes)
+			}
+			if rw.Code != test.status || rw.Body.String() != test.body {
+				t.Errorf("expected %d %q, got %d %q", test.status, test.body, rw.Code, rw.Body.String())
+			}
+			if strings.Count(rw.Body.String(), "result") > 1 {
+				t.Errorf("expected the body not to be doubled, got %q", rw.Body.String())
+			}
+		})
+	}
+}
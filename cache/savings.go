@@ -0,0 +1,76 @@
+package cache
+
+import (
+	"github.com/kotalco/crossover-managed/metrics"
+	"net/http"
+	"sync"
+)
+
+// MaxSavingsEntries bound the number of paths or users tracked by the savings breakdown, the others are counted as OtherSavings
+const MaxSavingsEntries = 10000
+
+const OtherSavings = "other"
+
+// breakdowns of the saved backend calls
+const (
+	SavingsByPath = "path"
+	SavingsByUser = "user"
+)
+
+var savedCalls = metrics.NewCounter("crossover_cache_saved_backend_calls_total", "Number of requests served from the cache instead of the backend")
+
+// Savings the backend calls avoided by the cache hits of this instance
+type Savings struct {
+	Total     uint64            `json:"total"`
+	Breakdown map[string]uint64 `json:"breakdown,omitempty"`
+}
+
+// savingsIndex count the saved backend calls per path or per user
+type savingsIndex struct {
+	mu        sync.Mutex
+	by        string
+	total     uint64
+	breakdown map[string]uint64
+}
+
+func newSavingsIndex(by string) *savingsIndex {
+	return &savingsIndex{by: by, breakdown: map[string]uint64{}}
+}
+
+func (s *savingsIndex) record(req *http.Request, userId string) {
+	savedCalls.Inc()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.total++
+	var key string
+	switch s.by {
+	case SavingsByPath:
+		key = req.URL.Path
+	case SavingsByUser:
+		key = userId
+	default:
+		return
+	}
+	if _, ok := s.breakdown[key]; !ok && len(s.breakdown) >= MaxSavingsEntries {
+		key = OtherSavings
+	}
+	s.breakdown[key]++
+}
+
+func (s *savingsIndex) summary() Savings {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	summary := Savings{Total: s.total}
+	if len(s.breakdown) > 0 {
+		summary.Breakdown = make(map[string]uint64, len(s.breakdown))
+		for key, count := range s.breakdown {
+			summary.Breakdown[key] = count
+		}
+	}
+	return summary
+}
+
+// Savings return the backend calls avoided by the cache hits of this instance
+func (c *cache) Savings() Savings {
+	return c.savings.summary()
+}
@@ -0,0 +1,64 @@
+package cache
+
+import (
+	"github.com/kotalco/crossover-managed/internal/redistest"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestSavings(t *testing.T) {
+	tests := []struct {
+		name      string
+		by        string
+		breakdown map[string]uint64
+	}{
+		{"total", "", nil},
+		{"per path", SavingsByPath, map[string]uint64{"/a": 2, "/b": 1}},
+		{"per user", SavingsByUser, map[string]uint64{"alice": 2, "bob": 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := redistest.NewServer()
+			c := NewCache(Options{CacheExpiry: 60, SavingsBreakdown: test.by})
+			upstream := newUpstream(http.StatusOK, "ok")
+			saved := savedCalls.Value()
+
+			// the first request of each path is a miss
+			for _, request := range []struct{ path, userId string }{{"/a", "alice"}, {"/a", "alice"}, {"/b", "bob"}, {"/a", "alice"}, {"/b", "bob"}} {
+				serve(t, c, server, get(request.path), upstream, request.userId)
+			}
+
+			savings := c.Savings()
+			if savings.Total != 3 || upstream.calls != 2 {
+				t.Errorf("expected 3 saved calls for 2 misses, got %d and %d upstream calls", savings.Total, upstream.calls)
+			}
+			if delta := savedCalls.Value() - saved; delta != 3 {
+				t.Errorf("expected the metric to count the 3 hits, got %d", delta)
+			}
+			if len(savings.Breakdown) != len(test.breakdown) {
+				t.Fatalf("expected the breakdown %v, got %v", test.breakdown, savings.Breakdown)
+			}
+			for key, count := range test.breakdown {
+				if savings.Breakdown[key] != count {
+					t.Errorf("expected the breakdown %v, got %v", test.breakdown, savings.Breakdown)
+				}
+			}
+		})
+	}
+}
+
+func TestSavingsBreakdownBounded(t *testing.T) {
+	savings := newSavingsIndex(SavingsByUser)
+	for i := 0; i < MaxSavingsEntries+2; i++ {
+		savings.record(get("/rpc"), "user"+strconv.Itoa(i))
+	}
+
+	summary := savings.summary()
+	if len(summary.Breakdown) != MaxSavingsEntries+1 || summary.Breakdown[OtherSavings] != 2 {
+		t.Errorf("expected the users beyond %d to be counted as %s, got %d entries with %d others", MaxSavingsEntries, OtherSavings, len(summary.Breakdown), summary.Breakdown[OtherSavings])
+	}
+	if summary.Total != MaxSavingsEntries+2 {
+		t.Errorf("expected every saved call in the total, got %d", summary.Total)
+	}
+}
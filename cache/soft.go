@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"context"
+	"github.com/kotalco/crossover-managed/metrics"
+	"github.com/kotalco/resp"
+	"net/http"
+	"time"
+)
+
+var staleServed = metrics.NewCounter("crossover_cache_stale_served_total", "Number of stale entries served because the upstream exceeded the soft timeout")
+
+// serveSoft call the upstream and serve the stale entry of the key if it doesn't respond within the soft timeout,
+// the upstream response still refreshes the cache once it completes. It returns false when there is no stale entry
+// so the request waits for the upstream like a regular miss
+func (c *cache) serveSoft(rw http.ResponseWriter, req *http.Request, next http.Handler, respClient resp.IClient, cacheKey string, userId string) bool {
+	stale, ok := c.entry(req, respClient, cacheKey+StaleKeySuffix)
+	if !ok {
+		return false
+	}
+
+	// the upstream call outlives the client once the stale entry is served, within the request deadline if any
+	ctx, cancel := context.WithoutCancel(req.Context()), context.CancelFunc(func() {})
+	if deadline, ok := req.Context().Deadline(); ok {
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+	}
+	upstreamReq := req.WithContext(ctx)
+	recorder := &bufferRecorder{header: http.Header{}}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		next.ServeHTTP(recorder, upstreamReq)
+	}()
+
+	timer := time.NewTimer(c.softTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		cancel()
+		c.replay(rw, upstreamReq, respClient, cacheKey, recorder)
+		return true
+	case <-timer.C:
+	}
+
+	c.writeEntry(rw, req, stale)
+	if flusher, ok := rw.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	staleServed.Inc()
+	c.savings.record(req, userId)
+
+	if c.redisClient == nil {
+		// without a client of its own the refresh is stored with the request one, the request waits for the upstream
+		<-done
+		cancel()
+		c.replay(&bufferRecorder{header: http.Header{}}, upstreamReq, respClient, cacheKey, recorder)
+		return true
+	}
+	// return right away, the request resources are held by the background call until it completes and stores the refresh
+	release := detachFromContext(req.Context())
+	go func() {
+		defer release()
+		defer cancel()
+		<-done
+		refreshClient, err := c.redisClient(ctx)
+		if err != nil {
+			return
+		}
+		defer refreshClient.Close()
+		c.replay(&bufferRecorder{header: http.Header{}}, upstreamReq, refreshClient, cacheKey, recorder)
+	}()
+	return true
+}
+
+// replay write the recorded upstream response to rw and store it
+func (c *cache) replay(rw http.ResponseWriter, req *http.Request, respClient resp.IClient, cacheKey string, recorded *bufferRecorder) {
+	recorder := &responseRecorder{rw: rw}
+	for key, values := range recorded.header {
+		recorder.Header()[key] = values
+	}
+	recorder.WriteHeader(recorded.status)
+	_, _ = recorder.Write(recorded.body.Bytes())
+	_ = recorder.writeResponse()
+	c.store(req, respClient, cacheKey, recorder)
+}
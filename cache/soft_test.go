@@ -0,0 +1,124 @@
+package cache
+
+import (
+	"context"
+	"github.com/kotalco/crossover-managed/internal/redistest"
+	"github.com/kotalco/resp"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowUpstream answer v1 at once, then v2 after the delay
+type slowUpstream struct {
+	delay time.Duration
+	calls int32
+	done  chan struct{}
+}
+
+func (u *slowUpstream) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if atomic.AddInt32(&u.calls, 1) == 1 {
+		_, _ = io.WriteString(rw, "v1")
+		return
+	}
+	time.Sleep(u.delay)
+	_, _ = io.WriteString(rw, "v2")
+	u.done <- struct{}{}
+}
+
+func (u *slowUpstream) count() int {
+	return int(atomic.LoadInt32(&u.calls))
+}
+
+// newSoftCache create a cache serving the stale entries after the soft timeout, the refreshes use clients of the server
+func newSoftCache(server *redistest.Server, background bool) ICache {
+	options := Options{CacheExpiry: 1, SoftTimeout: 20, StaleTTL: 60}
+	if background {
+		options.RedisClient = func(ctx context.Context) (resp.IClient, error) {
+			return server.Client(), nil
+		}
+	}
+	return NewCache(options)
+}
+
+// awaitRefresh wait for the background refresh to store the upstream response
+func awaitRefresh(t *testing.T, server *redistest.Server, key string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := server.Value(key); ok {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("expected the upstream response to refresh the cache, got the keys %v", server.Keys(""))
+}
+
+func TestServeHTTPSoftTimeout(t *testing.T) {
+	tests := []struct {
+		name       string
+		background bool
+	}{
+		{"background refresh", true},
+		{"request client refresh", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := redistest.NewServer()
+			c := newSoftCache(server, test.background)
+			upstream := &slowUpstream{delay: 200 * time.Millisecond, done: make(chan struct{}, 10)}
+			serve(t, c, server, get("/rpc"), upstream, "user")
+			server.Advance(2 * time.Second)
+			served := staleServed.Value()
+
+			start := time.Now()
+			rw := serve(t, c, server, get("/rpc"), upstream, "user")
+			if rw.Body.String() != "v1" {
+				t.Fatalf("expected the stale entry, got %s", rw.Body.String())
+			}
+			if elapsed := time.Since(start); test.background && elapsed > 150*time.Millisecond {
+				t.Errorf("expected the stale entry within the soft timeout, got it after %s", elapsed)
+			}
+			if delta := staleServed.Value() - served; delta != 1 {
+				t.Errorf("expected the stale entry to be counted once, got %d", delta)
+			}
+
+			<-upstream.done
+			awaitRefresh(t, server, "/rpc")
+			if rw := serve(t, c, server, get("/rpc"), upstream, "user"); rw.Body.String() != "v2" || upstream.count() != 2 {
+				t.Errorf("expected the refreshed entry to be served, got %s with %d upstream calls", rw.Body.String(), upstream.count())
+			}
+		})
+	}
+}
+
+func TestServeHTTPSoftTimeoutWithoutStale(t *testing.T) {
+	server := redistest.NewServer()
+	c := newSoftCache(server, true)
+	upstream := &slowUpstream{delay: 50 * time.Millisecond, done: make(chan struct{}, 10)}
+	atomic.StoreInt32(&upstream.calls, 1)
+
+	start := time.Now()
+	rw := serve(t, c, server, get("/rpc"), upstream, "user")
+	if rw.Body.String() != "v2" || time.Since(start) < 50*time.Millisecond {
+		t.Errorf("expected the miss without a stale entry to wait for the upstream, got %s after %s", rw.Body.String(), time.Since(start))
+	}
+}
+
+func TestServeHTTPSoftTimeoutFastUpstream(t *testing.T) {
+	server := redistest.NewServer()
+	c := newSoftCache(server, true)
+	upstream := &slowUpstream{done: make(chan struct{}, 10)}
+	serve(t, c, server, get("/rpc"), upstream, "user")
+	server.Advance(2 * time.Second)
+	served := staleServed.Value()
+
+	if rw := serve(t, c, server, get("/rpc"), upstream, "user"); rw.Body.String() != "v2" {
+		t.Errorf("expected the upstream response within the soft timeout, got %s", rw.Body.String())
+	}
+	if staleServed.Value() != served {
+		t.Errorf("expected no stale entry to be served")
+	}
+}
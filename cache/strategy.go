@@ -0,0 +1,36 @@
+package cache
+
+import (
+	"github.com/kotalco/crossover-managed/metrics"
+	"github.com/kotalco/resp"
+	"net/http"
+)
+
+// lookup strategies of the cached requests
+const (
+	StrategyCacheFirst   = "cache_first"   // serve the cached entry and only call the upstream on a miss
+	StrategyNetworkFirst = "network_first" // call the upstream and only serve the cached entry when it fails
+)
+
+var networkFallbacks = metrics.NewCounter("crossover_cache_network_first_fallbacks_total", "Number of network first requests served from the cache because the upstream failed")
+
+// serveNetworkFirst call the upstream first and fall back to the cached entry of the key when it answers with a server error,
+// the successful responses are stored as usual so the fallback stays as fresh as the upstream
+func (c *cache) serveNetworkFirst(rw http.ResponseWriter, req *http.Request, next http.Handler, respClient resp.IClient, cacheKey string) {
+	recorder := &bufferRecorder{header: http.Header{}}
+	next.ServeHTTP(recorder, req)
+	if recorder.status >= http.StatusInternalServerError {
+		keys := []string{cacheKey}
+		if c.softTimeout > 0 {
+			keys = append(keys, cacheKey+StaleKeySuffix)
+		}
+		for _, key := range keys {
+			if cachedResponse, ok := c.entry(req, respClient, key); ok {
+				c.writeEntry(rw, req, cachedResponse)
+				networkFallbacks.Inc()
+				return
+			}
+		}
+	}
+	c.replay(rw, req, respClient, cacheKey, recorder)
+}
@@ -0,0 +1,64 @@
+package cache
+
+import (
+	"github.com/kotalco/crossover-managed/internal/redistest"
+	"net/http"
+	"testing"
+)
+
+func TestServeHTTPStrategies(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		cached   bool // whether v1 is cached before the request
+		status   int  // status of the upstream serving the request
+		expected string
+		calls    int
+		fallback bool // whether the cached entry stands in for the failed upstream
+	}{
+		{"cache first hit", StrategyCacheFirst, true, http.StatusOK, "v1", 0, false},
+		{"cache first miss", StrategyCacheFirst, false, http.StatusOK, "v2", 1, false},
+		{"cache first upstream error", StrategyCacheFirst, false, http.StatusBadGateway, "v2", 1, false},
+		{"network first hit", StrategyNetworkFirst, true, http.StatusOK, "v2", 1, false},
+		{"network first miss", StrategyNetworkFirst, false, http.StatusOK, "v2", 1, false},
+		{"network first upstream error", StrategyNetworkFirst, true, http.StatusBadGateway, "v1", 1, true},
+		{"network first upstream error without entry", StrategyNetworkFirst, false, http.StatusBadGateway, "v2", 1, false},
+		{"network first client error", StrategyNetworkFirst, true, http.StatusNotFound, "v2", 1, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := redistest.NewServer()
+			c := NewCache(Options{CacheExpiry: 60})
+			if test.cached {
+				serve(t, c, server, get("/rpc"), newUpstream(http.StatusOK, "v1"), "user")
+			}
+			upstream := newUpstream(test.status, "v2")
+			fallbacks := networkFallbacks.Value()
+
+			req := get("/rpc")
+			rw := serve(t, c, server, req.WithContext(WithStrategy(req.Context(), test.strategy)), upstream, "user")
+
+			if rw.Body.String() != test.expected || upstream.count() != test.calls {
+				t.Errorf("expected %s with %d upstream calls, got %s with %d", test.expected, test.calls, rw.Body.String(), upstream.count())
+			}
+			if served := networkFallbacks.Value() - fallbacks; (served == 1) != test.fallback {
+				t.Errorf("expected the fallback %t to be counted, got %d", test.fallback, served)
+			}
+		})
+	}
+}
+
+func TestServeHTTPNetworkFirstRefreshes(t *testing.T) {
+	server := redistest.NewServer()
+	c := NewCache(Options{CacheExpiry: 60})
+	serve(t, c, server, get("/rpc"), newUpstream(http.StatusOK, "v1"), "user")
+
+	req := get("/rpc")
+	serve(t, c, server, req.WithContext(WithStrategy(req.Context(), StrategyNetworkFirst)), newUpstream(http.StatusOK, "v2"), "user")
+
+	// the fresh network first response replaced the entry the cache first requests get
+	upstream := newUpstream(http.StatusOK, "v3")
+	if rw := serve(t, c, server, get("/rpc"), upstream, "user"); rw.Body.String() != "v2" || upstream.count() != 0 {
+		t.Errorf("expected the entry stored by the network first request, got %s", rw.Body.String())
+	}
+}
@@ -0,0 +1,93 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"github.com/kotalco/crossover-managed/metrics"
+	"github.com/kotalco/resp"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	TTLCmd         = "*2\r\n$3\r\nTTL\r\n$%d\r\n%s\r\n"
+	ZAddCmd        = "*4\r\n$4\r\nZADD\r\n$%d\r\n%s\r\n$%d\r\n%d\r\n$%d\r\n%s\r\n"
+	EvalCmd        = "*6\r\n$4\r\nEVAL\r\n$%d\r\n%s\r\n$1\r\n1\r\n$%d\r\n%s\r\n$%d\r\n%d\r\n$%d\r\n%d\r\n"
+	ExpiryIndexKey = "cache-expiries" // sorted set of the entries stored without a ttl scored by the unix time they expire at
+	SweepInterval  = 10 * time.Second
+	SweepBatch     = 500 // max number of expired entries deleted by a single sweep
+)
+
+// sweepScript delete the indexed entries past their expiry, it only returns their count since the client doesn't parse array replies
+const sweepScript = `local keys = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, key in ipairs(keys) do
+	redis.call('DEL', key)
+	redis.call('ZREM', KEYS[1], key)
+end
+return #keys`
+
+var (
+	ttlMissing = metrics.NewCounter("crossover_cache_ttl_missing_total", "Number of sampled cache entries stored without their ttl")
+	swept      = metrics.NewCounter("crossover_cache_swept_entries_total", "Number of expired cache entries deleted by the sweeper")
+)
+
+// ttlGuard verify a sample of the stored entries got their ttl, once one didn't the entries are indexed by expiry and swept
+type ttlGuard struct {
+	every   uint64
+	stores  uint64
+	missing int32
+	swept   int64
+}
+
+func newTTLGuard(every int) *ttlGuard {
+	if every <= 0 {
+		return nil
+	}
+	return &ttlGuard{every: uint64(every)}
+}
+
+// guardTTL check one of every n stored keys has a ttl and index the keys by expiry once the backend was found ignoring them
+func (c *cache) guardTTL(ctx context.Context, respClient resp.IClient, key string, ttl int) {
+	guard := c.ttlGuard
+	if guard == nil {
+		return
+	}
+	if atomic.LoadInt32(&guard.missing) == 0 {
+		if atomic.AddUint64(&guard.stores, 1)%guard.every != 0 {
+			return
+		}
+		// -1 is the reply of a key without expiry
+		if remaining, err := intReply(respClient.Do(ctx, fmt.Sprintf(TTLCmd, len(key), key))); err != nil || remaining != -1 {
+			return
+		}
+		ttlMissing.Inc()
+		if !atomic.CompareAndSwapInt32(&guard.missing, 0, 1) {
+			return
+		}
+		c.logger.Printf("Cache entry %s was stored without its ttl, sweeping the expired entries every %s", key, SweepInterval)
+	}
+	expiry := time.Now().Unix() + int64(ttl)
+	_, _ = respClient.Do(ctx, fmt.Sprintf(ZAddCmd, len(ExpiryIndexKey), ExpiryIndexKey, len(strconv.FormatInt(expiry, 10)), expiry, len(key), key))
+}
+
+// sweep delete the indexed entries past their expiry, at most once per SweepInterval across the requests
+func (c *cache) sweep(ctx context.Context, respClient resp.IClient) {
+	guard := c.ttlGuard
+	if guard == nil || atomic.LoadInt32(&guard.missing) == 0 {
+		return
+	}
+	now := time.Now()
+	last := atomic.LoadInt64(&guard.swept)
+	if now.UnixNano()-last < int64(SweepInterval) || !atomic.CompareAndSwapInt64(&guard.swept, last, now.UnixNano()) {
+		return
+	}
+	cutoff := now.Unix()
+	count, err := intReply(respClient.Do(ctx, fmt.Sprintf(EvalCmd, len(sweepScript), sweepScript, len(ExpiryIndexKey), ExpiryIndexKey,
+		len(strconv.FormatInt(cutoff, 10)), cutoff, len(strconv.Itoa(SweepBatch)), SweepBatch)))
+	if err != nil {
+		c.logger.Printf("Failed to sweep the expired cache entries: %s", err)
+		return
+	}
+	swept.Add(uint64(count))
+}
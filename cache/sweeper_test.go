@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"github.com/kotalco/crossover-managed/internal/redistest"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newTTLLessServer return a redis ignoring the ttls and emulating the sweep script
+func newTTLLessServer() *redistest.Server {
+	server := redistest.NewServer()
+	server.IgnoreExpiry()
+	server.Script(sweepScript, func(call func(args ...string) string, keys []string, args []string) string {
+		cutoff, _ := strconv.ParseInt(args[0], 10, 64)
+		limit, _ := strconv.Atoi(args[1])
+		expired := server.ZRangeByScore(keys[0], cutoff, limit)
+		for _, key := range expired {
+			call("DEL", key)
+			call("ZREM", keys[0], key)
+		}
+		return ":" + strconv.Itoa(len(expired))
+	})
+	return server
+}
+
+func TestSweepTTLLessBackend(t *testing.T) {
+	server := newTTLLessServer()
+	c := NewCache(Options{CacheExpiry: 60, VerifyTTL: 1})
+	upstream := newUpstream(http.StatusOK, "ok")
+	missing, sweptEntries := ttlMissing.Value(), swept.Value()
+
+	serve(t, c, server, get("/expired"), upstream, "user")
+	if delta := ttlMissing.Value() - missing; delta != 1 {
+		t.Fatalf("expected the entry stored without its ttl to be detected, got %d", delta)
+	}
+
+	// the indexed entry is past its expiry by the next sweep
+	client := server.Client()
+	defer client.Close()
+	past := time.Now().Add(-time.Minute).Unix()
+	score := strconv.FormatInt(past, 10)
+	_, _ = client.Do(context.Background(), fmt.Sprintf(ZAddCmd, len(ExpiryIndexKey), ExpiryIndexKey, len(score), past, len("/expired"), "/expired"))
+	c.(*cache).ttlGuard.swept = 0
+	serve(t, c, server, get("/fresh"), upstream, "user")
+
+	if _, ok := server.Value("/expired"); ok {
+		t.Errorf("expected the sweeper to delete the expired entry")
+	}
+	if _, ok := server.Value("/fresh"); !ok {
+		t.Errorf("expected the entry within its ttl to be kept")
+	}
+	if delta := swept.Value() - sweptEntries; delta != 1 {
+		t.Errorf("expected 1 swept entry, got %d", delta)
+	}
+}
+
+func TestSweepThrottled(t *testing.T) {
+	server := newTTLLessServer()
+	c := NewCache(Options{CacheExpiry: 60, VerifyTTL: 1})
+	upstream := newUpstream(http.StatusOK, "ok")
+
+	for _, path := range []string{"/a", "/b", "/c"} {
+		serve(t, c, server, get(path), upstream, "user")
+	}
+	if sweeps := server.Count("EVAL"); sweeps != 1 {
+		t.Errorf("expected a single sweep within the sweep interval, got %d", sweeps)
+	}
+}
+
+func TestVerifyTTL(t *testing.T) {
+	tests := []struct {
+		name      string
+		verifyTTL int
+		stores    int
+		checks    int
+	}{
+		{"every entry", 1, 4, 4},
+		{"sampled", 2, 4, 2},
+		{"disabled", 0, 4, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := redistest.NewServer()
+			c := NewCache(Options{CacheExpiry: 60, VerifyTTL: test.verifyTTL})
+			upstream := newUpstream(http.StatusOK, "ok")
+
+			for i := 0; i < test.stores; i++ {
+				serve(t, c, server, get("/path/"+strconv.Itoa(i)), upstream, "user")
+			}
+
+			if checks := server.Count("TTL"); checks != test.checks {
+				t.Errorf("expected %d ttl checks, got %d", test.checks, checks)
+			}
+			// the backend honoring the ttls never gets the expiry index
+			if keys := server.Keys(ExpiryIndexKey); len(keys) != 0 || server.Count("EVAL") != 0 {
+				t.Errorf("expected no expiry index nor sweep, got %v", keys)
+			}
+		})
+	}
+}
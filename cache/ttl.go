@@ -0,0 +1,60 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// responseTTL derive the cache ttl in seconds from the upstream response headers
+// Cache-Control max-age takes precedence over Expires, the defaultTTL is used when neither is present or parsable
+// cacheable is false when the upstream response is already expired
+func responseTTL(header http.Header, defaultTTL int) (ttl int, cacheable bool) {
+	if maxAge, ok := maxAgeSeconds(header.Get("Cache-Control")); ok {
+		if maxAge <= 0 {
+			return 0, false
+		}
+		return maxAge, true
+	}
+
+	expiresHeader := header.Get("Expires")
+	if expiresHeader == "" {
+		return defaultTTL, true
+	}
+	expires, err := http.ParseTime(expiresHeader)
+	if err != nil {
+		//malformed Expires, fallback to the default expiry
+		return defaultTTL, true
+	}
+
+	//compute ttl relative to the upstream Date header if present to avoid clock skew between the plugin and upstream
+	now := time.Now()
+	if dateHeader := header.Get("Date"); dateHeader != "" {
+		if date, err := http.ParseTime(dateHeader); err == nil {
+			now = date
+		}
+	}
+
+	ttl = int(expires.Sub(now).Seconds())
+	if ttl <= 0 {
+		return 0, false
+	}
+	return ttl, true
+}
+
+// maxAgeSeconds extract the max-age directive from the Cache-Control header
+func maxAgeSeconds(cacheControl string) (int, bool) {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.TrimSpace(directive)
+		if !strings.HasPrefix(strings.ToLower(directive), "max-age=") {
+			continue
+		}
+		maxAge, err := strconv.Atoi(strings.Trim(directive[len("max-age="):], "\""))
+		if err != nil {
+			return 0, false
+		}
+		return maxAge, true
+	}
+	return 0, false
+}
@@ -0,0 +1,200 @@
+package cache
+
+import (
+	"github.com/kotalco/crossover-managed/internal/redistest"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestResponseTTL(t *testing.T) {
+	now := time.Now().UTC()
+	date := now.Format(http.TimeFormat)
+	tests := []struct {
+		name      string
+		header    http.Header
+		ttl       int
+		cacheable bool
+	}{
+		{"no headers", http.Header{}, 60, true},
+		{"max-age", http.Header{"Cache-Control": {"public, max-age=30"}}, 30, true},
+		{"max-age zero", http.Header{"Cache-Control": {"max-age=0"}}, 0, false},
+		{"max-age over expires", http.Header{"Cache-Control": {"max-age=30"}, "Expires": {now.Add(time.Hour).Format(http.TimeFormat)}}, 30, true},
+		{"future expires", http.Header{"Date": {date}, "Expires": {now.Add(2 * time.Minute).Format(http.TimeFormat)}}, 120, true},
+		{"past expires", http.Header{"Date": {date}, "Expires": {now.Add(-time.Minute).Format(http.TimeFormat)}}, 0, false},
+		{"expires relative to date", http.Header{"Date": {now.Add(-time.Hour).Format(http.TimeFormat)}, "Expires": {now.Add(-50 * time.Minute).Format(http.TimeFormat)}}, 600, true},
+		{"malformed expires", http.Header{"Expires": {"0"}}, 60, true},
+		{"malformed max-age", http.Header{"Cache-Control": {"max-age=soon"}, "Expires": {"never"}}, 60, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ttl, cacheable := responseTTL(test.header, 60)
+			if ttl != test.ttl || cacheable != test.cacheable {
+				t.Errorf("expected ttl %d cacheable %t, got %d %t", test.ttl, test.cacheable, ttl, cacheable)
+			}
+		})
+	}
+}
+
+func TestServeHTTPExpires(t *testing.T) {
+	now := time.Now().UTC()
+	tests := []struct {
+		name    string
+		expires string
+		ttl     int // 0 when the response isn't stored
+	}{
+		{"future", now.Add(5 * time.Minute).Format(http.TimeFormat), 300},
+		{"past", now.Add(-5 * time.Minute).Format(http.TimeFormat), 0},
+		{"malformed", "yesterday", 60},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := redistest.NewServer()
+			c := NewCache(Options{CacheExpiry: 60})
+			upstream := newUpstream(http.StatusOK, "ok", "Date", now.Format(http.TimeFormat), "Expires", test.expires)
+
+			rw := serve(t, c, server, get("/path"), upstream, "user")
+			if rw.Code != http.StatusOK || rw.Body.String() != "ok" {
+				t.Fatalf("expected the upstream response, got %d %s", rw.Code, rw.Body.String())
+			}
+			if test.ttl == 0 {
+				if keys := server.Keys("/path"); len(keys) != 0 {
+					t.Fatalf("expected the expired response not to be stored, got %v", keys)
+				}
+				return
+			}
+			if ttl := storedTTL(t, server, "/path"); ttl != test.ttl {
+				t.Errorf("expected the entry to be stored for %d seconds, got %d", test.ttl, ttl)
+			}
+		})
+	}
+}
+
+func TestMaxCacheAge(t *testing.T) {
+	server := redistest.NewServer()
+	c := NewCache(Options{CacheExpiry: 3600, MaxAge: 300})
+	upstream := newUpstream(http.StatusOK, `{"result":"0x1"}`)
+
+	serve(t, c, server, get("/rpc"), upstream, "user")
+	backdate(t, server, "/rpc", 200)
+	serve(t, c, server, get("/rpc"), upstream, "user")
+	if upstream.count() != 1 {
+		t.Fatalf("expected the entry within the max age to be served, got %d upstream calls", upstream.count())
+	}
+
+	// the entry is still valid for redis but older than the ceiling
+	backdate(t, server, "/rpc", 200)
+	serve(t, c, server, get("/rpc"), upstream, "user")
+	if upstream.count() != 2 {
+		t.Errorf("expected the entry past the max age to be bypassed, got %d upstream calls", upstream.count())
+	}
+	serve(t, c, server, get("/rpc"), upstream, "user")
+	if upstream.count() != 2 {
+		t.Errorf("expected the refreshed entry to be served, got %d upstream calls", upstream.count())
+	}
+}
+
+func TestNegativeTTL(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		header []string
+		ttl    int
+	}{
+		{"found", http.StatusOK, nil, 60},
+		{"not found", http.StatusNotFound, nil, 5},
+		{"gone", http.StatusGone, nil, 5},
+		{"explicit max-age", http.StatusNotFound, []string{"Cache-Control", "max-age=30"}, 30},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := redistest.NewServer()
+			c := NewCache(Options{CacheExpiry: 60, NegativeTTL: 5})
+
+			serve(t, c, server, get("/rpc"), newUpstream(test.status, "result", test.header...), "user")
+
+			if ttl := storedTTL(t, server, "/rpc"); ttl != test.ttl {
+				t.Errorf("expected the ttl %d, got %d", test.ttl, ttl)
+			}
+		})
+	}
+}
+
+func TestServeHTTPRedirects(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		redirectTTL int
+		ttl         int // 0 when the response isn't stored
+	}{
+		{"moved permanently", http.StatusMovedPermanently, 0, 60},
+		{"permanent redirect", http.StatusPermanentRedirect, 0, 60},
+		{"found", http.StatusFound, 0, 0},
+		{"see other", http.StatusSeeOther, 0, 0},
+		{"temporary redirect", http.StatusTemporaryRedirect, 0, 0},
+		{"found with a redirect ttl", http.StatusFound, 5, 5},
+		{"temporary redirect with a redirect ttl", http.StatusTemporaryRedirect, 5, 5},
+		{"permanent redirect with a redirect ttl", http.StatusPermanentRedirect, 5, 60},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := redistest.NewServer()
+			c := NewCache(Options{CacheExpiry: 60, RedirectTTL: test.redirectTTL})
+			upstream := newUpstream(test.status, "", "Location", "https://example.com/moved")
+
+			serve(t, c, server, get("/path"), upstream, "user")
+			if test.ttl == 0 {
+				if keys := server.Keys("/path"); len(keys) != 0 {
+					t.Fatalf("expected the redirect not to be stored, got %v", keys)
+				}
+				return
+			}
+			if ttl := storedTTL(t, server, "/path"); ttl != test.ttl {
+				t.Errorf("expected the redirect to be stored for %d seconds, got %d", test.ttl, ttl)
+			}
+			rw := serve(t, c, server, get("/path"), upstream, "user")
+			if rw.Code != test.status || rw.Header().Get("Location") != "https://example.com/moved" || upstream.count() != 1 {
+				t.Errorf("expected the cached redirect with its Location, got %d %q", rw.Code, rw.Header().Get("Location"))
+			}
+		})
+	}
+}
+
+func TestServeHTTPRedirectMaxAge(t *testing.T) {
+	server := redistest.NewServer()
+	c := NewCache(Options{CacheExpiry: 60, RedirectTTL: 5})
+	upstream := newUpstream(http.StatusFound, "", "Location", "/moved", "Cache-Control", "max-age=300")
+
+	serve(t, c, server, get("/path"), upstream, "user")
+	if ttl := storedTTL(t, server, "/path"); ttl != 5 {
+		t.Errorf("expected the redirect ttl to cap the max-age, got %d", ttl)
+	}
+}
+
+func TestServeHTTPRequestMaxAge(t *testing.T) {
+	tests := []struct {
+		name   string
+		maxAge int
+		calls  int
+	}{
+		{"younger", 60, 1},
+		{"older", 5, 2},
+		{"unbounded", 0, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := redistest.NewServer()
+			c := NewCache(Options{CacheExpiry: 60})
+			upstream := newUpstream(http.StatusOK, "ok")
+
+			serve(t, c, server, get("/path"), upstream, "user")
+			backdate(t, server, "/path", 10)
+			req := get("/path")
+			serve(t, c, server, req.WithContext(WithMaxAge(req.Context(), test.maxAge)), upstream, "user")
+
+			if upstream.count() != test.calls {
+				t.Errorf("expected %d upstream calls, got %d", test.calls, upstream.count())
+			}
+		})
+	}
+}
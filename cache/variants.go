@@ -0,0 +1,55 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/kotalco/resp"
+	"net/http"
+)
+
+const (
+	VariantsKeySuffix = "-variants"
+	SIsMemberCmd      = "*3\r\n$9\r\nSISMEMBER\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n"
+	SAddCmd           = "*3\r\n$4\r\nSADD\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n"
+	SCardCmd          = "*2\r\n$5\r\nSCARD\r\n$%d\r\n%s\r\n"
+)
+
+// admitVariant check whether the query variant of the request path can be cached
+// the first maxQueryVariants distinct variants of a path are tracked in a redis set, the others bypass the cache
+func (c *cache) admitVariant(req *http.Request, respClient resp.IClient, pathKey string, variant string) bool {
+	ctx := req.Context()
+	variantsKey := pathKey + VariantsKeySuffix
+
+	member, err := intReply(respClient.Do(ctx, fmt.Sprintf(SIsMemberCmd, len(variantsKey), variantsKey, len(variant), variant)))
+	if err != nil {
+		return false
+	}
+	if member == 1 {
+		return true
+	}
+
+	count, err := intReply(respClient.Do(ctx, fmt.Sprintf(SCardCmd, len(variantsKey), variantsKey)))
+	if err != nil || count >= c.maxQueryVariants {
+		return false
+	}
+
+	if _, err = intReply(respClient.Do(ctx, fmt.Sprintf(SAddCmd, len(variantsKey), variantsKey, len(variant), variant))); err != nil {
+		return false
+	}
+	if count == 0 {
+		// the variants set follow the lifetime of the cached entries
+		_, _ = respClient.Expire(ctx, variantsKey, c.cacheExpiry)
+	}
+	return true
+}
+
+// intReply parse a redis integer reply
+func intReply(reply string, err error) (int, error) {
+	if err != nil {
+		return 0, err
+	}
+	var value int
+	if _, err := fmt.Sscanf(reply, ":%d", &value); err != nil {
+		return 0, fmt.Errorf("unexpected response from server %s", reply)
+	}
+	return value, nil
+}
@@ -0,0 +1,51 @@
+package cache
+
+import (
+	"github.com/kotalco/crossover-managed/internal/redistest"
+	"net/http"
+	"testing"
+)
+
+func TestMaxQueryVariants(t *testing.T) {
+	server := redistest.NewServer()
+	c := NewCache(Options{CacheExpiry: 60, IncludeQuery: true, MaxQueryVariants: 2})
+	upstream := newUpstream(http.StatusOK, `{"result":"0x1"}`)
+
+	for _, path := range []string{"/rpc?block=1", "/rpc?block=2", "/rpc?block=3"} {
+		serve(t, c, server, get(path), upstream, "user")
+	}
+	if upstream.count() != 3 {
+		t.Fatalf("expected every variant to miss once, got %d upstream calls", upstream.count())
+	}
+
+	// the admitted variants stay cached while the ones beyond the cap bypass the cache
+	for _, path := range []string{"/rpc?block=1", "/rpc?block=2"} {
+		serve(t, c, server, get(path), upstream, "user")
+	}
+	if upstream.count() != 3 {
+		t.Errorf("expected the variants within the cap to be hits, got %d upstream calls", upstream.count())
+	}
+	serve(t, c, server, get("/rpc?block=3"), upstream, "user")
+	if upstream.count() != 4 {
+		t.Errorf("expected the variant beyond the cap to bypass the cache, got %d upstream calls", upstream.count())
+	}
+	if _, ok := server.Value("/rpc?block=1"); !ok {
+		t.Errorf("expected the admitted variant to be stored, got the keys %v", server.Keys(""))
+	}
+	if _, ok := server.Value("/rpc?block=3"); ok {
+		t.Errorf("expected the variant beyond the cap not to be stored")
+	}
+}
+
+func TestQueryVariantCanonical(t *testing.T) {
+	server := redistest.NewServer()
+	c := NewCache(Options{CacheExpiry: 60, IncludeQuery: true, MaxQueryVariants: 1})
+	upstream := newUpstream(http.StatusOK, `{"result":"0x1"}`)
+
+	serve(t, c, server, get("/rpc?a=1&b=2"), upstream, "user")
+	serve(t, c, server, get("/rpc?b=2&a=1"), upstream, "user")
+
+	if upstream.count() != 1 {
+		t.Errorf("expected the reordered query to be the same variant, got %d upstream calls", upstream.count())
+	}
+}
@@ -0,0 +1,62 @@
+package crossover_managed
+
+import (
+	"fmt"
+	"github.com/kotalco/crossover-managed/cache"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// cacheKeySegment a path segment participating in the cache key, selected by index or by named capture group
+type cacheKeySegment struct {
+	index int // index of the path segment, -1 when selected by group
+	group int // index of the capture group of the pattern
+}
+
+// parseCacheKeySegments resolve the configured segments against the pattern
+// numeric entries select the path segment by index, the others select a named capture group of the pattern
+func parseCacheKeySegments(segments []string, pattern *regexp.Regexp) ([]cacheKeySegment, error) {
+	parsed := make([]cacheKeySegment, 0, len(segments))
+	for _, segment := range segments {
+		if index, err := strconv.Atoi(segment); err == nil {
+			if index < 0 {
+				return nil, fmt.Errorf("segment index %d can't be negative", index)
+			}
+			parsed = append(parsed, cacheKeySegment{index: index, group: -1})
+			continue
+		}
+		group := pattern.SubexpIndex(segment)
+		if group < 0 {
+			return nil, fmt.Errorf("pattern has no capture group named %s", segment)
+		}
+		parsed = append(parsed, cacheKeySegment{index: -1, group: group})
+	}
+	return parsed, nil
+}
+
+// cacheKeyPath attach the path made of the selected segments to the request context, the cache keys on it instead of the full path
+func (crossover *Crossover) cacheKeyPath(req *http.Request) *http.Request {
+	if len(crossover.cacheKeySegments) == 0 {
+		return req
+	}
+	segments := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	var match []string
+	selected := make([]string, len(crossover.cacheKeySegments))
+	for i, segment := range crossover.cacheKeySegments {
+		if segment.index >= 0 {
+			if segment.index < len(segments) {
+				selected[i] = segments[segment.index]
+			}
+			continue
+		}
+		if match == nil {
+			match = crossover.compiledPattern.FindStringSubmatch(req.URL.Path)
+		}
+		if segment.group < len(match) {
+			selected[i] = match[segment.group]
+		}
+	}
+	return req.WithContext(cache.WithKeyPath(req.Context(), "/"+strings.Join(selected, "/")))
+}
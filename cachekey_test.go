@@ -0,0 +1,46 @@
+package crossover_managed
+
+import (
+	"context"
+	"github.com/kotalco/crossover-managed/cache"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCacheKeySegments(t *testing.T) {
+	tests := []struct {
+		name     string
+		segments []string
+		keys     [2]string
+	}{
+		{"full path", nil, [2]string{testPath + "/eth/block", testPath + "/eth/tx"}},
+		{"network group and index", []string{"network", "1"}, [2]string{"/mainnet/eth", "/mainnet/eth"}},
+		{"significant suffix", []string{"network", "2"}, [2]string{"/mainnet/block", "/mainnet/tx"}},
+		{"missing segment", []string{"network", "5"}, [2]string{"/mainnet/", "/mainnet/"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.Pattern = "(?P<network>[a-z]{7})000[a-z0-9]{32}"
+			config.CacheKeySegments = test.segments
+			cacheService := cache.NewCache(cache.Options{CacheExpiry: 60, DebugKeyHeader: "X-Cache-Key"})
+			crossover := newTestPlugin(t, config, &testUpstream{body: "ok"}, WithCacheService(cacheService))
+
+			for i, path := range []string{testPath + "/eth/block", testPath + "/eth/tx"} {
+				rw := do(crossover, httptest.NewRequest(http.MethodGet, path, nil))
+				if key := rw.Header().Get("X-Cache-Key"); key != test.keys[i] {
+					t.Errorf("expected the key %s of %s, got %s", test.keys[i], path, key)
+				}
+			}
+		})
+	}
+}
+
+func TestCacheKeySegmentsUnknownGroup(t *testing.T) {
+	config := testConfig()
+	config.CacheKeySegments = []string{"network"}
+	if _, err := New(context.Background(), &testUpstream{}, config, "test"); err == nil {
+		t.Errorf("expected the unknown capture group to be rejected")
+	}
+}
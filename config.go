@@ -0,0 +1,444 @@
+package crossover_managed
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kotalco/crossover-managed/activity"
+	"github.com/kotalco/crossover-managed/cache"
+	"github.com/kotalco/crossover-managed/limiter"
+	"github.com/kotalco/crossover-managed/matcher"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Config holds configuration to passed to the plugin
+type Config struct {
+	Pattern                     string
+	APIKey                      string
+	PlanAPIKey                  string
+	ActivityAPIKey              string
+	ActivityAddress             string
+	PlanAddress                 string
+	PlanQueryParam              string
+	PlanOverrides               bool
+	PlanForwardAuthorization    bool
+	MaxConcurrentPlanFetches    int
+	PlanFetchDefault            bool
+	PlanProxyRetries            int
+	PlanProxyRetryDelay         int
+	PlanFeatureMethods          []string
+	PlanCacheTTL                int
+	PlanCountInterval           int
+	MaxCachedPlans              int
+	PlanHeader                  string
+	OutboundProxyURL            string
+	RedisAddress                string
+	RedisAuth                   string
+	RedisDB                     int
+	RedisMaxConns               int
+	RedisMaxIdleConns           int
+	CacheEnabled                bool
+	CacheExpiry                 int
+	CachePlanTTLs               []string
+	NegativeCacheTTL            int
+	TemporaryRedirectTTL        int
+	VolatileBlockTags           []string
+	VolatileBlockTTL            int
+	PinnedBlockTTL              int
+	CachePerUser                bool
+	DebugCacheKeyHeader         string
+	MaxCacheHeaderBytes         int
+	MaxCachedHeaders            int
+	CachedHeadersPolicy         string
+	CacheMinHits                int
+	CacheHitsWindow             int
+	CacheKeyIncludeQuery        bool
+	CacheKeyIncludeBody         bool
+	CacheMaxQueryVariants       int
+	CacheTTLOverrideHeader      string
+	CacheAuthorizedPolicy       string
+	CacheCookiePolicy           string
+	CacheCookieNames            []string
+	CacheSavingsBreakdown       string
+	CacheBatchCalls             bool
+	MinCacheableBodySize        int
+	MaxCacheableBodySize        int
+	CacheDryRun                 bool
+	CacheVerifyIntegrity        bool
+	CacheCanonicalEncoding      bool
+	CacheFormat                 string
+	CacheVerifyTTL              int
+	CacheFreshnessHeaders       bool
+	CacheableContentTypes       []string
+	CacheableMethods            []string
+	MaxCacheAge                 int
+	UpstreamSoftTimeout         int
+	RequestTimeout              int
+	CacheStaleTTL               int
+	CacheKeySegments            []string
+	CacheKeySamples             int
+	BufferSize                  int
+	BatchSize                   int
+	FlushInterval               int
+	MaxFlushInterval            int
+	MaxRetryQueueSize           int
+	ActivityOnSuccess           bool
+	ActivitySuccessStatuses     []int
+	ActivityAuth                string
+	ActivityHMACSecret          string
+	ActivitySpillPath           string
+	ActivitySpillMaxBytes       int64
+	ActivitySpillReplayInterval int
+	ActivityTags                map[string]string
+	JSONContentTypes            []string
+	RateLimitJSONBody           bool
+	ServeCacheWhenThrottled     bool
+	RateLimitScopeHeader        string
+	RateLimitScopes             []string
+	RateLimitBatches            bool
+	PriorityCount               int
+	CacheBypassPaths            []string
+	CacheStrategy               string
+	CacheStrategyPaths          []string
+	AnonymousPolicy             string
+	AnonymousPlanLimit          int
+	RefundOnUpstreamError       bool
+	MaxRedisOpsPerRequest       int
+	MetricsPath                 string
+	LocalFallbackLimiter        bool
+	LocalFallbackLimit          int
+	MaxConcurrentRequests       int
+	RequestQueueSize            int
+	MaxBufferedBodyBytes        int64
+	BodyBudgetWait              int
+	BodyReadTimeout             int
+	CountSkipBodySize           int64
+	CountSkipCost               int
+	LegacyRequestPolicy         string
+	AdminPath                   string
+	MaxBatchSize                int
+	DependencyRetryAfterMin     int
+	DependencyRetryAfterMax     int
+	RateLimitSmoothingBatch     int
+	RateLimitSmoothingInterval  int
+	PlanChangePolicy            string
+	RateLimitWindowSeconds      int
+	RateLimitWindowMode         string
+	LogThrottleInterval         int
+	ShutdownDrainTimeout        int
+	FlushOnSignal               bool
+}
+
+// CreateConfig populates the config data object
+func CreateConfig() *Config {
+	return &Config{
+		MaxFlushInterval:           60,
+		MaxRetryQueueSize:          activity.DefaultMaxRetryQueueSize,
+		LocalFallbackLimit:         10,
+		CacheTTLOverrideHeader:     "X-Cache-TTL-Override",
+		LegacyRequestPolicy:        LegacyNormalize,
+		DependencyRetryAfterMin:    1,
+		DependencyRetryAfterMax:    5,
+		RateLimitSmoothingInterval: 100,
+		PlanChangePolicy:           limiter.PlanChangeImmediate,
+		RateLimitWindowSeconds:     limiter.UserRateLimitingWindow,
+		RateLimitWindowMode:        limiter.WindowFixed,
+		BodyBudgetWait:             100,
+		CountSkipCost:              1,
+		LogThrottleInterval:        10,
+		PlanQueryParam:             limiter.DefaultPlanQueryParam,
+		PlanProxyRetryDelay:        limiter.DefaultPlanRetryDelay,
+		VolatileBlockTags:          []string{"latest", "pending", "safe", "finalized"},
+		ShutdownDrainTimeout:       10,
+		JSONContentTypes:           []string{"application/json", "application/json-rpc"},
+		CacheEnabled:               true,
+		RedisMaxConns:              DefaultRedisMaxConns,
+		RedisMaxIdleConns:          DefaultRedisMaxIdleConns,
+		CacheableMethods:           []string{http.MethodGet, http.MethodHead},
+		CacheFormat:                cache.FormatGob,
+		CacheStrategy:              cache.StrategyCacheFirst,
+		AnonymousPolicy:            AnonymousDeny,
+	}
+}
+
+// ConfigError describe an invalid config field
+type ConfigError struct {
+	Field   string
+	Message string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%s %s", e.Field, e.Message)
+}
+
+// validate check the config and return all the invalid fields at once joined in a single error
+func (config *Config) validate() error {
+	var errs []error
+	invalid := func(field string, format string, args ...interface{}) {
+		errs = append(errs, &ConfigError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if len(config.Pattern) == 0 {
+		invalid("pattern", "can't be empty")
+	} else if _, err := regexp.Compile(config.Pattern); err != nil {
+		invalid("pattern", "is invalid: %s", err.Error())
+	}
+	if len(config.APIKey) == 0 {
+		invalid("APIKey", "can't be empty")
+	} else if !validKey(config.APIKey) {
+		invalid("APIKey", "must be a valid header value")
+	}
+	if config.PlanAPIKey != "" && !validKey(config.PlanAPIKey) {
+		invalid("planAPIKey", "must be a valid header value")
+	}
+	if config.ActivityAPIKey != "" && !validKey(config.ActivityAPIKey) {
+		invalid("activityAPIKey", "must be a valid header value")
+	}
+	if len(config.ActivityAddress) == 0 {
+		invalid("activityAddress", "can't be empty")
+	}
+	if len(config.PlanAddress) == 0 {
+		invalid("planAddress", "can't be empty")
+	}
+	if len(config.RedisAddress) == 0 {
+		invalid("RedisAddress", "can't be empty")
+	}
+	if strings.ContainsAny(config.RedisAuth, " \t\r\n") {
+		// the client sends an inline AUTH command, whitespace would split the password into several arguments
+		invalid("redisAuth", "can't contain whitespace")
+	}
+	switch config.ActivityAuth {
+	case "", activity.AuthAPIKey, activity.AuthBearer:
+	case activity.AuthHMAC:
+		if len(config.ActivityHMACSecret) == 0 {
+			invalid("activityHMACSecret", "can't be empty with the hmac activityAuth")
+		}
+	default:
+		invalid("activityAuth", "must be one of %s, %s or %s", activity.AuthAPIKey, activity.AuthBearer, activity.AuthHMAC)
+	}
+	if config.ActivitySpillMaxBytes < 0 || config.ActivitySpillReplayInterval < 0 {
+		invalid("activitySpill", "max bytes and replay interval can't be negative")
+	}
+	if config.OutboundProxyURL != "" {
+		if proxyURL, err := url.Parse(config.OutboundProxyURL); err != nil || proxyURL.Scheme == "" || proxyURL.Host == "" {
+			invalid("outboundProxyURL", "must be an absolute url")
+		}
+	}
+	if config.RedisDB < 0 || config.RedisDB > MaxRedisDB {
+		invalid("redisDB", "must be between 0 and %d", MaxRedisDB)
+	}
+	if config.RedisMaxConns < 0 || config.RedisMaxIdleConns < 0 {
+		invalid("redisMaxConns", "and redisMaxIdleConns can't be negative")
+	} else if config.RedisMaxConns > 0 && config.RedisMaxIdleConns > config.RedisMaxConns {
+		invalid("redisMaxIdleConns", "can't exceed redisMaxConns")
+	}
+	if config.CacheEnabled && config.CacheExpiry == 0 {
+		invalid("cacheExpiry", "can't be empty")
+	}
+	if config.BufferSize == 0 {
+		invalid("bufferSize", "can't be empty")
+	}
+	if config.BatchSize == 0 {
+		invalid("batchSize", "can't be empty")
+	}
+	if config.FlushInterval == 0 {
+		invalid("flushInterval", "can't be empty")
+	}
+	switch config.CacheAuthorizedPolicy {
+	case "", cache.AuthorizedSkip, cache.AuthorizedKey:
+	default:
+		invalid("cacheAuthorizedPolicy", "must be one of %s or %s", cache.AuthorizedSkip, cache.AuthorizedKey)
+	}
+	if config.VolatileBlockTTL < 0 || config.PinnedBlockTTL < 0 {
+		invalid("blockTTL", "can't be negative")
+	}
+	if config.CacheKeySamples < 0 {
+		invalid("cacheKeySamples", "can't be negative")
+	}
+	if config.MaxCacheAge < 0 {
+		invalid("maxCacheAge", "can't be negative")
+	}
+	if config.RequestTimeout < 0 {
+		invalid("requestTimeout", "can't be negative")
+	}
+	if config.UpstreamSoftTimeout < 0 || config.CacheStaleTTL < 0 {
+		invalid("upstreamSoftTimeout", "and cacheStaleTTL can't be negative")
+	}
+	if config.TemporaryRedirectTTL < 0 {
+		invalid("temporaryRedirectTTL", "can't be negative")
+	}
+	if config.NegativeCacheTTL < 0 {
+		invalid("negativeCacheTTL", "can't be negative")
+	}
+	switch config.CacheCookiePolicy {
+	case "", cache.CookieSkip, cache.CookieKey:
+	default:
+		invalid("cacheCookiePolicy", "must be one of %s or %s", cache.CookieSkip, cache.CookieKey)
+	}
+	switch config.CacheSavingsBreakdown {
+	case "", cache.SavingsByPath, cache.SavingsByUser:
+	default:
+		invalid("cacheSavingsBreakdown", "must be one of %s or %s", cache.SavingsByPath, cache.SavingsByUser)
+	}
+	if config.MaxCachedHeaders < 0 {
+		invalid("maxCachedHeaders", "can't be negative")
+	}
+	if config.CacheVerifyTTL < 0 {
+		invalid("cacheVerifyTTL", "can't be negative")
+	}
+	switch config.CachedHeadersPolicy {
+	case "", cache.HeadersSkip, cache.HeadersTruncate:
+	default:
+		invalid("cachedHeadersPolicy", "must be one of %s or %s", cache.HeadersSkip, cache.HeadersTruncate)
+	}
+	switch config.CacheFormat {
+	case "", cache.FormatGob, cache.FormatJSON, cache.FormatMsgpack:
+	default:
+		invalid("cacheFormat", "must be one of %s, %s or %s", cache.FormatGob, cache.FormatJSON, cache.FormatMsgpack)
+	}
+	if config.MinCacheableBodySize < 0 || config.MaxCacheableBodySize < 0 {
+		invalid("cacheableBodySize", "bounds can't be negative")
+	} else if config.MaxCacheableBodySize > 0 && config.MinCacheableBodySize > config.MaxCacheableBodySize {
+		invalid("minCacheableBodySize", "can't exceed maxCacheableBodySize")
+	}
+	switch config.LegacyRequestPolicy {
+	case "", LegacyNormalize, LegacyReject:
+	default:
+		invalid("legacyRequestPolicy", "must be one of %s or %s", LegacyNormalize, LegacyReject)
+	}
+	if config.RateLimitScopeHeader != "" && len(config.RateLimitScopes) == 0 {
+		invalid("rateLimitScopes", "can't be empty with rateLimitScopeHeader, every forged value would get its own budget")
+	}
+	if config.RateLimitWindowSeconds < 0 {
+		invalid("rateLimitWindowSeconds", "can't be negative")
+	}
+	switch config.RateLimitWindowMode {
+	case "", limiter.WindowFixed, limiter.WindowSliding:
+	default:
+		invalid("rateLimitWindowMode", "must be one of %s or %s", limiter.WindowFixed, limiter.WindowSliding)
+	}
+	switch config.PlanChangePolicy {
+	case "", limiter.PlanChangeImmediate, limiter.PlanChangeNextWindow:
+	default:
+		invalid("planChangePolicy", "must be one of %s or %s", limiter.PlanChangeImmediate, limiter.PlanChangeNextWindow)
+	}
+	if config.DependencyRetryAfterMin < 0 || config.DependencyRetryAfterMax < config.DependencyRetryAfterMin {
+		invalid("dependencyRetryAfter", "range must be positive with dependencyRetryAfterMin <= dependencyRetryAfterMax")
+	}
+	if config.BodyReadTimeout < 0 {
+		invalid("bodyReadTimeout", "can't be negative")
+	}
+	if config.CountSkipBodySize < 0 {
+		invalid("countSkipBodySize", "can't be negative")
+	}
+	if config.CountSkipBodySize > 0 && config.CountSkipCost <= 0 {
+		invalid("countSkipCost", "must be positive when countSkipBodySize is set")
+	}
+	if config.MaxBufferedBodyBytes < 0 || config.BodyBudgetWait < 0 {
+		invalid("maxBufferedBodyBytes", "and bodyBudgetWait can't be negative")
+	}
+	if config.ShutdownDrainTimeout < 0 {
+		invalid("shutdownDrainTimeout", "can't be negative")
+	}
+	if config.LogThrottleInterval < 0 {
+		invalid("logThrottleInterval", "can't be negative")
+	}
+	if config.PlanCacheTTL < 0 || config.PlanCountInterval < 0 || config.MaxCachedPlans < 0 {
+		invalid("planCache", "ttl, count interval and max cached plans can't be negative")
+	}
+	if config.MaxConcurrentPlanFetches < 0 {
+		invalid("maxConcurrentPlanFetches", "can't be negative")
+	}
+	if config.PlanProxyRetries < 0 || config.PlanProxyRetryDelay < 0 {
+		invalid("planProxyRetries", "and planProxyRetryDelay can't be negative")
+	}
+	if config.MaxBatchSize < 0 {
+		invalid("maxBatchSize", "can't be negative")
+	}
+	if config.MaxConcurrentRequests < 0 {
+		invalid("maxConcurrentRequests", "can't be negative")
+	}
+	if config.RequestQueueSize < 0 {
+		invalid("requestQueueSize", "can't be negative")
+	}
+	if compiledPattern, err := regexp.Compile(config.Pattern); err == nil {
+		if _, err := parseCacheKeySegments(config.CacheKeySegments, compiledPattern); err != nil {
+			invalid("cacheKeySegments", "%s", err.Error())
+		}
+	}
+	if _, err := parseCacheStrategies(config.CacheStrategy, config.CacheStrategyPaths); err != nil {
+		invalid("cacheStrategyPaths", "%s", err.Error())
+	}
+	switch config.AnonymousPolicy {
+	case "", AnonymousDeny, AnonymousBypass:
+	case AnonymousLimit:
+		if config.AnonymousPlanLimit <= 0 {
+			invalid("anonymousPlanLimit", "must be positive with the %s policy", AnonymousLimit)
+		}
+	default:
+		invalid("anonymousPolicy", "must be %s, %s or %s", AnonymousDeny, AnonymousLimit, AnonymousBypass)
+	}
+	if _, err := parsePlanTTLs(config.CachePlanTTLs); err != nil {
+		invalid("cachePlanTTLs", "%s", err.Error())
+	}
+	if _, err := parseFeatureMethods(config.PlanFeatureMethods); err != nil {
+		invalid("planFeatureMethods", "%s", err.Error())
+	}
+	if _, err := matcher.New(config.CacheBypassPaths); err != nil {
+		invalid("cacheBypassPaths", "%s", err.Error())
+	}
+
+	return errors.Join(errs...)
+}
+
+// LongFlushInterval flush intervals in seconds above it leave the metering stale for long
+const LongFlushInterval = 5 * 60
+
+// warnings return the legal but likely misconfigured fields, they're logged and don't prevent the plugin from starting
+func (config *Config) warnings() []string {
+	var warnings []string
+	if config.BatchSize > config.BufferSize {
+		warnings = append(warnings, fmt.Sprintf("batchSize %d exceeds bufferSize %d, the batches can never fill", config.BatchSize, config.BufferSize))
+	}
+	if config.FlushInterval > LongFlushInterval {
+		warnings = append(warnings, fmt.Sprintf("flushInterval of %ds leaves the metering stale for minutes", config.FlushInterval))
+	}
+	if config.CacheEnabled && config.CacheExpiry == 1 {
+		warnings = append(warnings, "cacheExpiry of 1s expires the entries before they're reused")
+	}
+	if compiledPattern, err := regexp.Compile(config.Pattern); err == nil && compiledPattern.NumSubexp() == 0 {
+		warnings = append(warnings, fmt.Sprintf("pattern %s has no capture group", config.Pattern))
+	}
+	return warnings
+}
+
+// planAPIKey return the key authenticating the plan requests, defaults to the shared APIKey
+func (config *Config) planAPIKey() string {
+	if config.PlanAPIKey != "" {
+		return config.PlanAPIKey
+	}
+	return config.APIKey
+}
+
+// activityAPIKey return the key authenticating the activity requests, defaults to the shared APIKey
+func (config *Config) activityAPIKey() string {
+	if config.ActivityAPIKey != "" {
+		return config.ActivityAPIKey
+	}
+	return config.APIKey
+}
+
+// validKey check the key can be sent in a header, surrounding spaces and control characters would be stripped or rejected
+func validKey(key string) bool {
+	if strings.TrimSpace(key) != key {
+		return false
+	}
+	for _, r := range key {
+		if r < 0x20 || r == 0x7f {
+			return false
+		}
+	}
+	return true
+}
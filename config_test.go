@@ -0,0 +1,186 @@
+package crossover_managed
+
+import (
+	"context"
+	"errors"
+	"github.com/kotalco/crossover-managed/internal/redistest"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestValidateReportsAllErrors(t *testing.T) {
+	config := CreateConfig()
+	config.CacheExpiry, config.BufferSize, config.BatchSize, config.FlushInterval = 60, 100, 10, 1
+
+	err := config.validate()
+	if err == nil {
+		t.Fatalf("expected the empty config to be invalid")
+	}
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		t.Fatalf("expected the errors to be joined, got %T", err)
+	}
+	fields := map[string]bool{}
+	for _, err := range joined.Unwrap() {
+		var configErr *ConfigError
+		if !errors.As(err, &configErr) {
+			t.Fatalf("expected a ConfigError, got %T %s", err, err)
+		}
+		fields[configErr.Field] = true
+	}
+	for _, field := range []string{"pattern", "APIKey", "activityAddress", "planAddress", "RedisAddress"} {
+		if !fields[field] {
+			t.Errorf("expected the missing %s to be reported, got %s", field, err)
+		}
+	}
+}
+
+func TestValidateValidConfig(t *testing.T) {
+	if err := testConfig().validate(); err != nil {
+		t.Errorf("expected the test config to be valid, got %s", err)
+	}
+}
+
+func TestValidateOutboundProxyURL(t *testing.T) {
+	tests := []struct {
+		url   string
+		valid bool
+	}{
+		{"", true},
+		{"http://proxy.internal:3128", true},
+		{"proxy.internal:3128", false},
+		{"/relative", false},
+	}
+	for _, test := range tests {
+		config := testConfig()
+		config.OutboundProxyURL = test.url
+		if err := config.validate(); (err == nil) != test.valid {
+			t.Errorf("expected the proxy url %q valid %t, got %v", test.url, test.valid, err)
+		}
+	}
+}
+
+func TestServiceAPIKeys(t *testing.T) {
+	tests := []struct {
+		name        string
+		planKey     string
+		activityKey string
+	}{
+		{"shared", "", ""},
+		{"plan key", "plan-secret", ""},
+		{"activity key", "", "activity-secret"},
+		{"both", "plan-secret", "activity-secret"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var mu sync.Mutex
+			keys := map[string]string{}
+			service := func(name string) *httptest.Server {
+				server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+					mu.Lock()
+					keys[name] = req.Header.Get("X-Api-Key")
+					mu.Unlock()
+					_, _ = io.WriteString(rw, `{"data":{"request_limit":100}}`)
+				}))
+				t.Cleanup(server.Close)
+				return server
+			}
+			config := testConfig()
+			config.PlanAddress = service("plan").URL
+			config.ActivityAddress = service("activity").URL
+			config.PlanAPIKey, config.ActivityAPIKey = test.planKey, test.activityKey
+			handler, err := NewWithOptions(context.Background(), &testUpstream{}, config, "test", withRedis(redistest.NewServer()))
+			if err != nil {
+				t.Fatalf("failed to create the plugin: %s", err)
+			}
+			crossover := handler.(*Crossover)
+
+			do(crossover, httptest.NewRequest(http.MethodGet, testPath, nil))
+			_ = crossover.Close()
+
+			expected := map[string]string{"plan": test.planKey, "activity": test.activityKey}
+			for name, key := range expected {
+				if key == "" {
+					key = config.APIKey
+				}
+				if keys[name] != key {
+					t.Errorf("expected the %s requests to carry the key %q, got %q", name, key, keys[name])
+				}
+			}
+		})
+	}
+}
+
+func TestValidateServiceAPIKeys(t *testing.T) {
+	for _, key := range []string{" padded", "line\nbreak"} {
+		config := testConfig()
+		config.PlanAPIKey, config.ActivityAPIKey = key, key
+		var fields []string
+		if joined, ok := config.validate().(interface{ Unwrap() []error }); ok {
+			for _, err := range joined.Unwrap() {
+				var configErr *ConfigError
+				if errors.As(err, &configErr) {
+					fields = append(fields, configErr.Field)
+				}
+			}
+		}
+		if strings.Join(fields, ",") != "planAPIKey,activityAPIKey" {
+			t.Errorf("expected the invalid key %q to be reported for both services, got %v", key, fields)
+		}
+	}
+}
+
+func TestConfigWarnings(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(config *Config)
+		warning string
+	}{
+		{"sane", func(config *Config) {}, ""},
+		{"batch larger than the buffer", func(config *Config) { config.BatchSize = 500 }, "batchSize 500 exceeds bufferSize 100"},
+		{"long flush interval", func(config *Config) { config.FlushInterval = 3600 }, "flushInterval of 3600s"},
+		{"one second cache", func(config *Config) { config.CacheExpiry = 1 }, "cacheExpiry of 1s"},
+		{"one second cache disabled", func(config *Config) { config.CacheEnabled, config.CacheExpiry = false, 1 }, ""},
+		{"pattern without group", func(config *Config) { config.Pattern = "[a-z0-9]{42}" }, "has no capture group"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buffer strings.Builder
+			log.SetOutput(&buffer)
+			defer log.SetOutput(os.Stderr)
+			config := testConfig()
+			// the warnings of the previous cases share the throttled format
+			config.LogThrottleInterval = 0
+			test.change(config)
+
+			newTestPlugin(t, config, &testUpstream{})
+
+			logged := buffer.String()
+			if test.warning == "" {
+				if strings.Contains(logged, "Suspicious config") {
+					t.Errorf("expected no warning, got %s", logged)
+				}
+				return
+			}
+			if !strings.Contains(logged, "Suspicious config") || !strings.Contains(logged, test.warning) {
+				t.Errorf("expected the warning %q, got %s", test.warning, logged)
+			}
+		})
+	}
+}
+
+func TestValidateRateLimitWindow(t *testing.T) {
+	for window, valid := range map[int]bool{0: true, 1: true, 60: true, -1: false} {
+		config := testConfig()
+		config.RateLimitWindowSeconds = window
+		if err := config.validate(); (err == nil) != valid {
+			t.Errorf("expected the window %d valid %t, got %v", window, valid, err)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package crossover_managed
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCountSkipBodySize(t *testing.T) {
+	batch := rpcBatch(10)
+	tests := []struct {
+		name     string
+		length   int64
+		streamed bool
+		count    int
+	}{
+		{"at the threshold", 64, false, 10},
+		{"unknown length", -1, false, 10},
+		{"above the threshold", int64(len(batch)), true, 5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.CountSkipBodySize = 64
+			config.CountSkipCost = 5
+			body := &trackedBody{Reader: strings.NewReader(batch)}
+			var forwarded io.ReadCloser
+			var readsBefore int32
+			var received string
+			upstream := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				forwarded, readsBefore = req.Body, atomic.LoadInt32(&body.reads)
+				content, _ := io.ReadAll(req.Body)
+				received = string(content)
+			})
+			activityService := newFakeActivity()
+			crossover := newTestPlugin(t, config, upstream, WithActivityService(activityService))
+
+			req := httptest.NewRequest(http.MethodPost, testPath, body)
+			req.Header.Set("Content-Type", "application/json")
+			req.ContentLength = test.length
+			do(crossover, req)
+
+			if streamed := forwarded == io.ReadCloser(body) && readsBefore == 0; streamed != test.streamed {
+				t.Errorf("expected the body streamed %t, it was read %d times ahead", test.streamed, readsBefore)
+			}
+			if received != batch {
+				t.Errorf("expected the upstream to receive the whole body, got %q", received)
+			}
+			if count := activityService.logged(testRequestId); count != test.count {
+				t.Errorf("expected the request to be charged %d, got %d", test.count, count)
+			}
+		})
+	}
+}
+
+func TestCountSkipBodyInspected(t *testing.T) {
+	tests := []struct {
+		name   string
+		config func(config *Config)
+	}{
+		{"batch size", func(config *Config) { config.MaxBatchSize = 20 }},
+		{"plan features", func(config *Config) { config.PlanFeatureMethods = []string{"eth_getProof=archive_access"} }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.CountSkipBodySize = 64
+			test.config(config)
+			limiterService := &fakeLimiter{allow: true}
+			upstream := &testUpstream{body: "ok"}
+			crossover := newTestPlugin(t, config, upstream, WithLimiterService(limiterService))
+
+			// the streamed calls can't be checked, they must not skip the enforcement
+			rw := do(crossover, rpcRequest(rpcBatch(10)))
+
+			if rw.Code != http.StatusRequestEntityTooLarge || upstream.count() != 0 || len(limiterService.users) != 0 {
+				t.Errorf("expected 413 without limiting nor forwarding, got %d", rw.Code)
+			}
+		})
+	}
+}
+
+func TestValidateCountSkip(t *testing.T) {
+	tests := []struct {
+		size  int64
+		cost  int
+		valid bool
+	}{
+		{0, 0, true},
+		{1024, 1, true},
+		{1024, 0, false},
+		{-1, 1, false},
+	}
+	for _, test := range tests {
+		config := testConfig()
+		config.CountSkipBodySize, config.CountSkipCost = test.size, test.cost
+		if err := config.validate(); (err == nil) != test.valid {
+			t.Errorf("expected the size %d with the cost %d valid %t, got %v", test.size, test.cost, test.valid, err)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package crossover_managed
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var ErrQueueFull = errors.New("request queue is full")
+
+// fairQueue bound the concurrent requests reaching the upstream, waiting requests are admitted round-robin across users
+// so a single heavy user can't monopolize the upstream concurrency
+type fairQueue struct {
+	mu        sync.Mutex
+	slots     int
+	queued    int
+	maxQueued int
+	waiters   map[string][]chan struct{}
+	order     []string
+}
+
+func newFairQueue(maxConcurrent int, maxQueued int) *fairQueue {
+	return &fairQueue{
+		slots:     maxConcurrent,
+		maxQueued: maxQueued,
+		waiters:   map[string][]chan struct{}{},
+	}
+}
+
+// acquire wait for a concurrency slot, it returns ErrQueueFull when the queue is full or the context error if it's done first
+func (q *fairQueue) acquire(ctx context.Context, userId string) error {
+	q.mu.Lock()
+	if q.slots > 0 && q.queued == 0 {
+		q.slots--
+		q.mu.Unlock()
+		return nil
+	}
+	if q.queued >= q.maxQueued {
+		q.mu.Unlock()
+		return ErrQueueFull
+	}
+	ready := make(chan struct{})
+	if len(q.waiters[userId]) == 0 {
+		q.order = append(q.order, userId)
+	}
+	q.waiters[userId] = append(q.waiters[userId], ready)
+	q.queued++
+	q.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		if !q.remove(userId, ready) {
+			// the slot was granted concurrently, hand it over to the next waiter
+			q.release()
+		}
+		return ctx.Err()
+	}
+}
+
+// release free the slot or hand it over to the next user in the round-robin order
+func (q *fairQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.queued == 0 {
+		q.slots++
+		return
+	}
+	userId := q.order[0]
+	q.order = q.order[1:]
+	waiters := q.waiters[userId]
+	ready := waiters[0]
+	if len(waiters) > 1 {
+		q.waiters[userId] = waiters[1:]
+		q.order = append(q.order, userId)
+	} else {
+		delete(q.waiters, userId)
+	}
+	q.queued--
+	close(ready)
+}
+
+// remove drop a waiter that gave up, it returns false if the waiter was already granted a slot
+func (q *fairQueue) remove(userId string, ready chan struct{}) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	waiters := q.waiters[userId]
+	for i, waiter := range waiters {
+		if waiter != ready {
+			continue
+		}
+		waiters = append(waiters[:i:i], waiters[i+1:]...)
+		q.queued--
+		if len(waiters) > 0 {
+			q.waiters[userId] = waiters
+			return true
+		}
+		delete(q.waiters, userId)
+		for j, queuedUser := range q.order {
+			if queuedUser == userId {
+				q.order = append(q.order[:j:j], q.order[j+1:]...)
+				break
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package crossover_managed
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// queued wait for the queue to hold count waiters
+func queued(t *testing.T, q *fairQueue, count int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		q.mu.Lock()
+		current := q.queued
+		q.mu.Unlock()
+		if current == count {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected %d queued requests", count)
+}
+
+func TestFairQueueRoundRobin(t *testing.T) {
+	q := newFairQueue(1, 10)
+	if err := q.acquire(context.Background(), "heavy"); err != nil {
+		t.Fatalf("expected the free slot to be acquired, got %s", err)
+	}
+
+	admitted := make(chan string, 10)
+	enqueue := func(userId string, count int) {
+		for i := 0; i < count; i++ {
+			go func() {
+				if err := q.acquire(context.Background(), userId); err == nil {
+					admitted <- userId
+				}
+			}()
+		}
+	}
+	enqueue("heavy", 4)
+	queued(t, q, 4)
+	enqueue("light", 2)
+	queued(t, q, 6)
+
+	var order []string
+	for i := 0; i < 6; i++ {
+		q.release()
+		order = append(order, <-admitted)
+	}
+	expected := []string{"heavy", "light", "heavy", "light", "heavy", "heavy"}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Fatalf("expected the users to be admitted round-robin %v, got %v", expected, order)
+		}
+	}
+}
+
+func TestFairQueueFull(t *testing.T) {
+	q := newFairQueue(1, 1)
+	_ = q.acquire(context.Background(), "user")
+	go func() {
+		_ = q.acquire(context.Background(), "user")
+	}()
+	queued(t, q, 1)
+	defer q.release()
+
+	if err := q.acquire(context.Background(), "other"); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("expected ErrQueueFull, got %v", err)
+	}
+}
+
+func TestFairQueueCancelled(t *testing.T) {
+	q := newFairQueue(1, 1)
+	_ = q.acquire(context.Background(), "user")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- q.acquire(ctx, "other")
+	}()
+	queued(t, q, 1)
+	cancel()
+
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the cancelled wait to fail, got %v", err)
+	}
+	q.release()
+	if err := q.acquire(context.Background(), "user"); err != nil {
+		t.Errorf("expected the cancelled waiter to give its slot back, got %s", err)
+	}
+}
+
+func TestServeHTTPQueueFull(t *testing.T) {
+	config := testConfig()
+	config.MaxConcurrentRequests = 1
+	config.RequestQueueSize = 1
+	crossover := newTestPlugin(t, config, &testUpstream{body: "ok"})
+	_ = crossover.requestQueue.acquire(context.Background(), testUserId)
+	go func() {
+		_ = crossover.requestQueue.acquire(context.Background(), testUserId)
+	}()
+	queued(t, crossover.requestQueue, 1)
+	defer crossover.requestQueue.release()
+
+	if rw := do(crossover, httptest.NewRequest(http.MethodGet, testPath, nil)); rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 when the queue is full, got %d", rw.Code)
+	}
+}
@@ -0,0 +1,86 @@
+//go:build crossover_faults
+
+package crossover_managed
+
+import (
+	"context"
+	"errors"
+	"github.com/kotalco/crossover-managed/limiter"
+	"github.com/kotalco/resp"
+	"math/rand"
+	"net/http"
+	"sync"
+)
+
+// ErrInjectedFault the error returned by the injected failures
+var ErrInjectedFault = errors.New("injected fault")
+
+// Faults inject failures at the configured probabilities (0 to 1) to exercise the degraded paths
+// it's only compiled with the crossover_faults build tag so it can't be enabled in a production build
+type Faults struct {
+	Redis    float64    // probability the redis connection of a request is unavailable
+	Plan     float64    // probability the plan resolution fails with limiter.ErrPlanUnavailable
+	Upstream float64    // probability the upstream is answered with 502 instead of being called
+	Rand     *rand.Rand // source of the draws, nil uses the global source
+	mu       sync.Mutex
+}
+
+// WithFaultInjection wrap the services built from the config and the overridden ones with the fault injector
+func WithFaultInjection(faults *Faults) Option {
+	return func(crossover *Crossover) {
+		crossover.postInit = append(crossover.postInit, faults.inject)
+	}
+}
+
+// hit draw whether the failure of the given probability happens
+func (f *Faults) hit(probability float64) bool {
+	if probability <= 0 {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Rand == nil {
+		return rand.Float64() < probability
+	}
+	return f.Rand.Float64() < probability
+}
+
+func (f *Faults) inject(crossover *Crossover) {
+	redisClientFactory := crossover.redisClientFactory
+	crossover.redisClientFactory = func(ctx context.Context, address string, auth string, db int) (resp.IClient, error) {
+		if f.hit(f.Redis) {
+			return &unavailableClient{err: ErrInjectedFault}, nil
+		}
+		return redisClientFactory(ctx, address, auth, db)
+	}
+	crossover.limiterService = &faultyLimiter{ILimiter: crossover.limiterService, faults: f}
+	next := crossover.next
+	crossover.next = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if f.hit(f.Upstream) {
+			rw.WriteHeader(http.StatusBadGateway)
+			rw.Write([]byte(ErrInjectedFault.Error()))
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// faultyLimiter fail the plan resolution of the limiter
+type faultyLimiter struct {
+	limiter.ILimiter
+	faults *Faults
+}
+
+func (l *faultyLimiter) Limit(ctx context.Context, userId string, respClint resp.IClient) (bool, error) {
+	if l.faults.hit(l.faults.Plan) {
+		return false, limiter.ErrPlanUnavailable
+	}
+	return l.ILimiter.Limit(ctx, userId, respClint)
+}
+
+func (l *faultyLimiter) Plan(ctx context.Context, userId string, respClint resp.IClient) (int, error) {
+	if l.faults.hit(l.faults.Plan) {
+		return 0, limiter.ErrPlanUnavailable
+	}
+	return l.ILimiter.Plan(ctx, userId, respClint)
+}
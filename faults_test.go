@@ -0,0 +1,72 @@
+//go:build crossover_faults
+
+package crossover_managed
+
+import (
+	"github.com/kotalco/crossover-managed/limiter"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFaultInjection(t *testing.T) {
+	// the redis faults need a limiter using the connection, the plan address is never reached
+	redisLimiter := func(fallback bool) limiter.ILimiter {
+		return limiter.NewLimiter(limiter.Options{PlanAddress: "http://plan.invalid/plans", LocalFallback: fallback, LocalFallbackLimit: 10})
+	}
+	tests := []struct {
+		name     string
+		faults   *Faults
+		limiter  limiter.ILimiter
+		status   int
+		upstream int
+	}{
+		{"no faults", &Faults{}, &fakeLimiter{allow: true}, http.StatusOK, 1},
+		{"redis", &Faults{Redis: 1}, redisLimiter(false), http.StatusServiceUnavailable, 0},
+		{"redis with the local fallback", &Faults{Redis: 1}, redisLimiter(true), http.StatusOK, 1},
+		{"plan", &Faults{Plan: 1}, &fakeLimiter{allow: true}, http.StatusServiceUnavailable, 0},
+		{"upstream", &Faults{Upstream: 1}, &fakeLimiter{allow: true}, http.StatusBadGateway, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			upstream := &testUpstream{body: "ok"}
+			crossover := newTestPlugin(t, testConfig(), upstream, WithLimiterService(test.limiter), WithFaultInjection(test.faults))
+
+			rw := do(crossover, httptest.NewRequest(http.MethodGet, testPath, nil))
+
+			if rw.Code != test.status || upstream.count() != test.upstream {
+				t.Errorf("expected %d with %d upstream calls, got %d with %d", test.status, test.upstream, rw.Code, upstream.count())
+			}
+		})
+	}
+}
+
+func TestFaultInjectionRefundsUpstreamFaults(t *testing.T) {
+	config := testConfig()
+	config.RefundOnUpstreamError = true
+	limiterService := &fakeLimiter{allow: true}
+	crossover := newTestPlugin(t, config, &testUpstream{body: "ok"}, WithLimiterService(limiterService), WithFaultInjection(&Faults{Upstream: 1}))
+
+	do(crossover, httptest.NewRequest(http.MethodGet, testPath, nil))
+
+	if limiterService.refunds != 1 {
+		t.Errorf("expected the injected upstream failure to be refunded, got %d refunds", limiterService.refunds)
+	}
+}
+
+func TestFaultInjectionProbability(t *testing.T) {
+	upstream := &testUpstream{body: "ok"}
+	faults := &Faults{Upstream: 0.5, Rand: rand.New(rand.NewSource(1))}
+	crossover := newTestPlugin(t, testConfig(), upstream, WithFaultInjection(faults))
+
+	failed := 0
+	for i := 0; i < 100; i++ {
+		if rw := do(crossover, httptest.NewRequest(http.MethodGet, testPath, nil)); rw.Code == http.StatusBadGateway {
+			failed++
+		}
+	}
+	if failed < 30 || failed > 70 || failed+upstream.count() != 100 {
+		t.Errorf("expected about half of the requests to fail, got %d failed and %d upstream calls", failed, upstream.count())
+	}
+}
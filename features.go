@@ -0,0 +1,83 @@
+package crossover_managed
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// featureMethods map the json-rpc methods to the plan feature they require
+type featureMethods struct {
+	exact    map[string]string
+	prefixes []featurePrefix
+}
+
+// featurePrefix the feature required by the methods starting with prefix
+type featurePrefix struct {
+	prefix  string
+	feature string
+}
+
+// parseFeatureMethods parse the method=feature entries, methods ending with * match every method with that prefix
+func parseFeatureMethods(entries []string) (*featureMethods, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	methods := &featureMethods{exact: map[string]string{}}
+	for _, entry := range entries {
+		method, feature, ok := strings.Cut(entry, "=")
+		method, feature = strings.TrimSpace(method), strings.TrimSpace(feature)
+		if !ok || method == "" || feature == "" {
+			return nil, fmt.Errorf("entry %s must be method=feature", entry)
+		}
+		if prefix, ok := strings.CutSuffix(method, "*"); ok {
+			methods.prefixes = append(methods.prefixes, featurePrefix{prefix: prefix, feature: feature})
+			continue
+		}
+		methods.exact[method] = feature
+	}
+	// the longest prefixes are the most specific
+	sort.SliceStable(methods.prefixes, func(i, j int) bool {
+		return len(methods.prefixes[i].prefix) > len(methods.prefixes[j].prefix)
+	})
+	return methods, nil
+}
+
+// required return the feature required by the method, empty if any plan can call it
+func (m *featureMethods) required(method string) string {
+	if feature, ok := m.exact[method]; ok {
+		return feature
+	}
+	for _, prefix := range m.prefixes {
+		if strings.HasPrefix(method, prefix.prefix) {
+			return prefix.feature
+		}
+	}
+	return ""
+}
+
+// missingFeature return the first feature required by the json-rpc calls of the request that the plan doesn't include
+func (crossover *Crossover) missingFeature(req *http.Request, features func() (map[string]bool, error)) (string, error) {
+	rpcRequest, ok := crossover.parseJSONRPC(req)
+	if !ok {
+		return "", nil
+	}
+	var enabled map[string]bool
+	for _, method := range rpcRequest.Methods() {
+		feature := crossover.featureMethods.required(method)
+		if feature == "" {
+			continue
+		}
+		if enabled == nil {
+			var err error
+			if enabled, err = features(); err != nil {
+				return "", err
+			}
+		}
+		if !enabled[feature] {
+			return feature, nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,68 @@
+package crossover_managed
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseFeatureMethods(t *testing.T) {
+	methods, err := parseFeatureMethods([]string{"eth_getProof=archive_access", "debug_*=debug", "debug_trace*=tracing", " trace_call = tracing "})
+	if err != nil {
+		t.Fatalf("failed to parse the feature methods: %s", err)
+	}
+	tests := []struct {
+		method  string
+		feature string
+	}{
+		{"eth_getProof", "archive_access"},
+		{"debug_getRawBlock", "debug"},
+		{"debug_traceTransaction", "tracing"},
+		{"trace_call", "tracing"},
+		{"eth_chainId", ""},
+	}
+	for _, test := range tests {
+		if feature := methods.required(test.method); feature != test.feature {
+			t.Errorf("expected %s to require %q, got %q", test.method, test.feature, feature)
+		}
+	}
+
+	for _, entry := range []string{"eth_getProof", "=archive_access", "eth_getProof="} {
+		if _, err := parseFeatureMethods([]string{entry}); err == nil {
+			t.Errorf("expected the entry %q to be invalid", entry)
+		}
+	}
+}
+
+func TestServeHTTPFeatures(t *testing.T) {
+	archive := `{"jsonrpc":"2.0","id":1,"method":"eth_getProof","params":["0xabc",[],"0x1"]}`
+	tests := []struct {
+		name     string
+		body     string
+		features map[string]bool
+		status   int
+	}{
+		{"entitled", archive, map[string]bool{"archive_access": true}, http.StatusOK},
+		{"not entitled", archive, map[string]bool{}, http.StatusForbidden},
+		{"disabled feature", archive, map[string]bool{"archive_access": false}, http.StatusForbidden},
+		{"unmapped method", `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`, map[string]bool{}, http.StatusOK},
+		{"batch with an archive call", `[{"jsonrpc":"2.0","id":1,"method":"eth_chainId"},` + archive + `]`, map[string]bool{}, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.PlanFeatureMethods = []string{"eth_getProof=archive_access"}
+			limiterService := &fakeLimiter{allow: true, features: test.features}
+			upstream := &testUpstream{body: "ok"}
+			crossover := newTestPlugin(t, config, upstream, WithLimiterService(limiterService))
+
+			rw := do(crossover, rpcRequest(test.body))
+
+			if rw.Code != test.status {
+				t.Fatalf("expected %d, got %d %s", test.status, rw.Code, rw.Body.String())
+			}
+			if test.status == http.StatusForbidden && (upstream.count() != 0 || len(limiterService.users) != 0) {
+				t.Errorf("expected the rejected call to neither reach the upstream nor consume the quota")
+			}
+		})
+	}
+}
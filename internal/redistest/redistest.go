@@ -0,0 +1,520 @@
+// Package redistest an in-memory redis the tests hand to the services through the resp.IClient interface
+// it understands the RESP commands the plugin sends, the lua scripts are emulated by the registered Script
+package redistest
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/kotalco/resp"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Script emulate a lua script, call runs a redis command like redis.call and returns its raw reply
+type Script func(call func(args ...string) string, keys []string, args []string) string
+
+// Server the shared state of the clients, safe for concurrent use
+type Server struct {
+	mu       sync.Mutex
+	values   map[string]string
+	sets     map[string]map[string]bool
+	zsets    map[string]map[string]int64
+	expiry   map[string]time.Time
+	scripts  map[string]Script
+	offset   time.Duration
+	counts   map[string]int
+	err      error
+	failOn   map[string]error
+	open     int
+	maxOpen  int
+	noExpire bool
+}
+
+func NewServer() *Server {
+	return &Server{
+		values:  map[string]string{},
+		sets:    map[string]map[string]bool{},
+		zsets:   map[string]map[string]int64{},
+		expiry:  map[string]time.Time{},
+		scripts: map[string]Script{},
+		counts:  map[string]int{},
+		failOn:  map[string]error{},
+	}
+}
+
+// Client open a client of the server
+func (s *Server) Client() *Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.open++
+	if s.open > s.maxOpen {
+		s.maxOpen = s.open
+	}
+	return &Client{server: s}
+}
+
+// Script emulate the lua source passed to EVAL
+func (s *Server) Script(source string, script Script) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scripts[source] = script
+}
+
+// Advance move the clock of the key expiries forward
+func (s *Server) Advance(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offset += d
+}
+
+// Fail make every command fail with err, nil recovers
+func (s *Server) Fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+// FailOn make the command fail with err, nil recovers
+func (s *Server) FailOn(command string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		delete(s.failOn, command)
+		return
+	}
+	s.failOn[command] = err
+}
+
+// IgnoreExpiry store the keys without expiry like a backend ignoring the ttl of SET EX and EXPIRE
+func (s *Server) IgnoreExpiry() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.noExpire = true
+}
+
+// Count return the number of times the command ran, including the calls of the scripts
+func (s *Server) Count(command string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.counts[command]
+}
+
+// Total return the number of commands ran
+func (s *Server) Total() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	total := 0
+	for _, count := range s.counts {
+		total += count
+	}
+	return total
+}
+
+// Reset forget the command counts
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counts = map[string]int{}
+}
+
+// Open return the number of clients open, MaxOpen the most ever open at once
+func (s *Server) Open() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.open
+}
+
+func (s *Server) MaxOpen() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.maxOpen
+}
+
+// Value return the value of the key if it's set and not expired
+func (s *Server) Value(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(key)
+	value, ok := s.values[key]
+	return value, ok
+}
+
+// Set store the value of the key without expiry
+func (s *Server) Set(key string, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = value
+	delete(s.expiry, key)
+}
+
+// TTL return the remaining seconds of the key, -1 without expiry and -2 if it doesn't exist
+func (s *Server) TTL(key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ttl(key)
+}
+
+// Keys return the sorted keys with the prefix
+func (s *Server) Keys(prefix string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all := map[string]bool{}
+	for key := range s.values {
+		all[key] = true
+	}
+	for key := range s.sets {
+		all[key] = true
+	}
+	for key := range s.zsets {
+		all[key] = true
+	}
+	var keys []string
+	for key := range all {
+		s.expire(key)
+		if s.exists(key) && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *Server) now() time.Time {
+	return time.Now().Add(s.offset)
+}
+
+// expire drop the key once past its expiry
+func (s *Server) expire(key string) {
+	if expiry, ok := s.expiry[key]; ok && !s.now().Before(expiry) {
+		s.del(key)
+	}
+}
+
+func (s *Server) exists(key string) bool {
+	_, value := s.values[key]
+	_, set := s.sets[key]
+	_, zset := s.zsets[key]
+	return value || set || zset
+}
+
+func (s *Server) del(key string) bool {
+	existed := s.exists(key)
+	delete(s.values, key)
+	delete(s.sets, key)
+	delete(s.zsets, key)
+	delete(s.expiry, key)
+	return existed
+}
+
+func (s *Server) ttl(key string) int {
+	s.expire(key)
+	if !s.exists(key) {
+		return -2
+	}
+	expiry, ok := s.expiry[key]
+	if !ok {
+		return -1
+	}
+	return int((expiry.Sub(s.now()) + time.Second - 1) / time.Second)
+}
+
+func (s *Server) setExpiry(key string, seconds int) {
+	if s.noExpire {
+		return
+	}
+	s.expiry[key] = s.now().Add(time.Duration(seconds) * time.Second)
+}
+
+// exec run the command, the caller holds the lock
+func (s *Server) exec(args []string) (string, error) {
+	if len(args) == 0 {
+		return "", errors.New("ERR empty command")
+	}
+	command := strings.ToUpper(args[0])
+	s.counts[command]++
+	if s.err != nil {
+		return "", s.err
+	}
+	if err := s.failOn[command]; err != nil {
+		return "", err
+	}
+	for _, key := range args[1:min(len(args), 2)] {
+		s.expire(key)
+	}
+	switch command {
+	case "PING":
+		return "PONG", nil
+	case "SELECT", "AUTH":
+		return "OK", nil
+	case "GET":
+		return s.values[args[1]], nil
+	case "SET":
+		s.del(args[1])
+		s.values[args[1]] = args[2]
+		if len(args) == 5 && strings.ToUpper(args[3]) == "EX" {
+			seconds, err := strconv.Atoi(args[4])
+			if err != nil || seconds <= 0 {
+				return "", errors.New("ERR invalid expire time in 'set' command")
+			}
+			s.setExpiry(args[1], seconds)
+		}
+		return "OK", nil
+	case "DEL":
+		if s.del(args[1]) {
+			return ":1", nil
+		}
+		return ":0", nil
+	case "EXISTS":
+		if s.exists(args[1]) {
+			return ":1", nil
+		}
+		return ":0", nil
+	case "INCR", "DECR", "INCRBY":
+		increment := 1
+		if command == "DECR" {
+			increment = -1
+		}
+		if command == "INCRBY" {
+			increment, _ = strconv.Atoi(args[2])
+		}
+		value, err := strconv.Atoi(s.values[args[1]])
+		if err != nil && s.values[args[1]] != "" {
+			return "", errors.New("ERR value is not an integer or out of range")
+		}
+		value += increment
+		s.values[args[1]] = strconv.Itoa(value)
+		return ":" + strconv.Itoa(value), nil
+	case "EXPIRE":
+		if !s.exists(args[1]) {
+			return ":0", nil
+		}
+		seconds, _ := strconv.Atoi(args[2])
+		s.setExpiry(args[1], seconds)
+		return ":1", nil
+	case "TTL":
+		return ":" + strconv.Itoa(s.ttl(args[1])), nil
+	case "SADD", "PFADD":
+		set := s.sets[args[1]]
+		if set == nil {
+			set = map[string]bool{}
+			s.sets[args[1]] = set
+		}
+		added := 0
+		for _, member := range args[2:] {
+			if !set[member] {
+				set[member] = true
+				added++
+			}
+		}
+		if command == "PFADD" && added > 0 {
+			added = 1
+		}
+		return ":" + strconv.Itoa(added), nil
+	case "SISMEMBER":
+		if s.sets[args[1]][args[2]] {
+			return ":1", nil
+		}
+		return ":0", nil
+	case "SCARD", "PFCOUNT":
+		return ":" + strconv.Itoa(len(s.sets[args[1]])), nil
+	case "ZADD":
+		zset := s.zsets[args[1]]
+		if zset == nil {
+			zset = map[string]int64{}
+			s.zsets[args[1]] = zset
+		}
+		score, _ := strconv.ParseInt(args[2], 10, 64)
+		_, existed := zset[args[3]]
+		zset[args[3]] = score
+		if existed {
+			return ":0", nil
+		}
+		return ":1", nil
+	case "ZREM":
+		removed := 0
+		for _, member := range args[2:] {
+			if _, ok := s.zsets[args[1]][member]; ok {
+				delete(s.zsets[args[1]], member)
+				removed++
+			}
+		}
+		return ":" + strconv.Itoa(removed), nil
+	case "ZREMRANGEBYSCORE":
+		max, _ := strconv.ParseInt(args[3], 10, 64)
+		removed := 0
+		for member, score := range s.zsets[args[1]] {
+			if score <= max {
+				delete(s.zsets[args[1]], member)
+				removed++
+			}
+		}
+		return ":" + strconv.Itoa(removed), nil
+	case "ZCARD":
+		return ":" + strconv.Itoa(len(s.zsets[args[1]])), nil
+	case "EVAL":
+		script, ok := s.scripts[args[1]]
+		if !ok {
+			return "", errors.New("NOSCRIPT script not registered with the test server")
+		}
+		numKeys, _ := strconv.Atoi(args[2])
+		keys, argv := args[3:3+numKeys], args[3+numKeys:]
+		var failed error
+		call := func(args ...string) string {
+			reply, err := s.exec(args)
+			if err != nil && failed == nil {
+				failed = err
+			}
+			return reply
+		}
+		reply := script(call, keys, argv)
+		return reply, failed
+	}
+	return "", fmt.Errorf("ERR unknown command '%s'", command)
+}
+
+// ZRangeByScore return the members of the sorted set scored up to max, lowest first, the emulated scripts
+// call it while the server runs them, it doesn't lock
+func (s *Server) ZRangeByScore(key string, max int64, limit int) []string {
+	type scored struct {
+		member string
+		score  int64
+	}
+	var members []scored
+	for member, score := range s.zsets[key] {
+		if score <= max {
+			members = append(members, scored{member, score})
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].score < members[j].score })
+	var result []string
+	for _, member := range members {
+		if limit > 0 && len(result) == limit {
+			break
+		}
+		result = append(result, member.member)
+	}
+	return result
+}
+
+// Client a connection to the server implementing resp.IClient
+type Client struct {
+	server *Server
+	closed bool
+	// Delay hold every command, e.g. to simulate a slow redis
+	Delay time.Duration
+}
+
+var _ resp.IClient = (*Client)(nil)
+
+// ErrClosed returned by the commands of a closed client
+var ErrClosed = errors.New("redistest: client closed")
+
+func (c *Client) run(ctx context.Context, args ...string) (string, error) {
+	if c.Delay > 0 {
+		select {
+		case <-time.After(c.Delay):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	if c.closed {
+		return "", ErrClosed
+	}
+	return c.server.exec(args)
+}
+
+// Do parse the RESP command and run it
+func (c *Client) Do(ctx context.Context, command string) (string, error) {
+	args, err := parse(command)
+	if err != nil {
+		return "", err
+	}
+	return c.run(ctx, args...)
+}
+
+func (c *Client) Ping(ctx context.Context) (string, error) {
+	return c.run(ctx, "PING")
+}
+
+func (c *Client) Set(ctx context.Context, key string, value string) error {
+	_, err := c.run(ctx, "SET", key, value)
+	return err
+}
+
+func (c *Client) SetWithTTL(ctx context.Context, key string, value string, ttl int) error {
+	_, err := c.run(ctx, "SET", key, value, "EX", strconv.Itoa(ttl))
+	return err
+}
+
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	return c.run(ctx, "GET", key)
+}
+
+func (c *Client) Delete(ctx context.Context, key string) error {
+	_, err := c.run(ctx, "DEL", key)
+	return err
+}
+
+func (c *Client) Incr(ctx context.Context, key string) (int, error) {
+	reply, err := c.run(ctx, "INCR", key)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimPrefix(reply, ":"))
+}
+
+func (c *Client) Expire(ctx context.Context, key string, seconds int) (bool, error) {
+	reply, err := c.run(ctx, "EXPIRE", key, strconv.Itoa(seconds))
+	return reply == ":1", err
+}
+
+func (c *Client) Close() error {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		c.server.open--
+	}
+	return nil
+}
+
+// parse decode a RESP array of bulk strings
+func parse(command string) ([]string, error) {
+	reader := bufio.NewReader(strings.NewReader(command))
+	line, err := reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("redistest: unsupported command %q", command)
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, fmt.Errorf("redistest: malformed command %q", command)
+	}
+	args := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		line, err := reader.ReadString('\n')
+		if err != nil || !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("redistest: malformed command %q", command)
+		}
+		length, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("redistest: malformed command %q", command)
+		}
+		arg := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, arg); err != nil || string(arg[length:]) != "\r\n" {
+			return nil, fmt.Errorf("redistest: malformed command %q", command)
+		}
+		args = append(args, string(arg[:length]))
+	}
+	return args, nil
+}
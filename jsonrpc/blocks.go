@@ -0,0 +1,190 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// Volatility how likely the result of a request changes, based on the blocks it references
+type Volatility int
+
+const (
+	BlockUnknown  Volatility = iota // no block referenced
+	BlockPinned                     // only concrete block numbers or hashes referenced, the result is immutable
+	BlockVolatile                   // a block tag like latest referenced, the result changes with the chain head
+)
+
+// blockParams position of the block parameter of the methods taking one, a missing block defaults to latest
+// the other methods, e.g. eth_getTransactionReceipt, are never classified since their params aren't blocks
+var blockParams = map[string]int{
+	"eth_getBalance":                          1,
+	"eth_getCode":                             1,
+	"eth_getTransactionCount":                 1,
+	"eth_getStorageAt":                        2,
+	"eth_call":                                1,
+	"eth_estimateGas":                         1,
+	"eth_getProof":                            2,
+	"eth_feeHistory":                          1,
+	"eth_getBlockByNumber":                    0,
+	"eth_getBlockByHash":                      0,
+	"eth_getBlockReceipts":                    0,
+	"eth_getBlockTransactionCountByNumber":    0,
+	"eth_getBlockTransactionCountByHash":      0,
+	"eth_getTransactionByBlockNumberAndIndex": 0,
+	"eth_getTransactionByBlockHashAndIndex":   0,
+	"eth_getUncleCountByBlockNumber":          0,
+	"eth_getUncleCountByBlockHash":            0,
+	"eth_getUncleByBlockNumberAndIndex":       0,
+	"eth_getUncleByBlockHashAndIndex":         0,
+	"debug_traceBlockByNumber":                0,
+	"debug_traceBlockByHash":                  0,
+	"debug_traceCall":                         1,
+	"trace_block":                             0,
+	"trace_call":                              2,
+}
+
+// filterMethods methods taking a filter object whose fromBlock and toBlock default to latest unless it has a blockHash
+var filterMethods = map[string]bool{"eth_getLogs": true}
+
+// blockFields fields of the EIP-1898 block objects
+var blockFields = []string{"blockHash", "blockNumber"}
+
+// Volatility classify the request, it's volatile if any call references one of the volatile tags
+// and pinned if the calls only reference concrete block numbers or hashes
+func (r *Request) Volatility(volatileTags map[string]bool) Volatility {
+	volatility := BlockUnknown
+	for _, call := range r.Calls {
+		switch call.volatility(volatileTags) {
+		case BlockVolatile:
+			return BlockVolatile
+		case BlockPinned:
+			volatility = BlockPinned
+		case BlockUnknown:
+			if volatility == BlockPinned {
+				// a call without block reference may change, the batch isn't pinned as a whole
+				return BlockUnknown
+			}
+		}
+	}
+	return volatility
+}
+
+func (c Call) volatility(volatileTags map[string]bool) Volatility {
+	var params []json.RawMessage
+	if len(c.Params) > 0 {
+		if err := json.Unmarshal(c.Params, &params); err != nil {
+			return BlockUnknown
+		}
+	}
+	if filterMethods[c.Method] {
+		if len(params) == 0 {
+			return BlockVolatile
+		}
+		return filterVolatility(params[0], volatileTags)
+	}
+	position, ok := blockParams[c.Method]
+	if !ok {
+		return BlockUnknown
+	}
+	if position >= len(params) || isNull(params[position]) {
+		// the omitted block is implicitly latest
+		return BlockVolatile
+	}
+	param := params[position]
+	var value string
+	if err := json.Unmarshal(param, &value); err == nil {
+		return classify(value, volatileTags)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(param, &fields); err != nil {
+		return BlockUnknown
+	}
+	for _, field := range blockFields {
+		if err := json.Unmarshal(fields[field], &value); err == nil {
+			return classify(value, volatileTags)
+		}
+	}
+	return BlockUnknown
+}
+
+// filterVolatility classify a log filter, a blockHash pins it, otherwise both its bounds must be concrete blocks
+func filterVolatility(param json.RawMessage, volatileTags map[string]bool) Volatility {
+	var filter struct {
+		BlockHash string `json:"blockHash"`
+		FromBlock string `json:"fromBlock"`
+		ToBlock   string `json:"toBlock"`
+	}
+	if err := json.Unmarshal(param, &filter); err != nil {
+		return BlockUnknown
+	}
+	if filter.BlockHash != "" {
+		return classify(filter.BlockHash, volatileTags)
+	}
+	if filter.FromBlock == "" || filter.ToBlock == "" {
+		return BlockVolatile
+	}
+	from, to := classify(filter.FromBlock, volatileTags), classify(filter.ToBlock, volatileTags)
+	if from == BlockVolatile || to == BlockVolatile {
+		return BlockVolatile
+	}
+	if from == BlockPinned && to == BlockPinned {
+		return BlockPinned
+	}
+	return BlockUnknown
+}
+
+// classify a block parameter value, a volatile tag or a concrete block number or hash
+func classify(value string, volatileTags map[string]bool) Volatility {
+	switch {
+	case volatileTags[strings.ToLower(value)]:
+		return BlockVolatile
+	case blockReference(value):
+		return BlockPinned
+	}
+	return BlockUnknown
+}
+
+// blockReference check whether the value is a hex block number or a 32 bytes block hash
+func blockReference(value string) bool {
+	if !strings.HasPrefix(value, "0x") || len(value) < 3 {
+		return false
+	}
+	digits := value[2:]
+	for _, digit := range digits {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", digit) {
+			return false
+		}
+	}
+	// quantities fit in 64 bits, hashes are 32 bytes
+	return len(digits) <= 16 || len(digits) == 64
+}
+
+// NullResult check whether any response of the json-rpc body has no result, e.g. an unknown block or a pending transaction
+// bodies that aren't json-rpc responses count as null since nothing is known of them
+func NullResult(body []byte) bool {
+	body = bytes.TrimSpace(body)
+	var responses []map[string]json.RawMessage
+	if len(body) > 0 && body[0] == '[' {
+		if err := json.Unmarshal(body, &responses); err != nil {
+			return true
+		}
+	} else {
+		var response map[string]json.RawMessage
+		if err := json.Unmarshal(body, &response); err != nil {
+			return true
+		}
+		responses = append(responses, response)
+	}
+	for _, response := range responses {
+		if result, ok := response["result"]; !ok || isNull(result) {
+			return true
+		}
+	}
+	return false
+}
+
+// isNull check whether the json value is null
+func isNull(value json.RawMessage) bool {
+	return string(bytes.TrimSpace(value)) == "null"
+}
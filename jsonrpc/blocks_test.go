@@ -0,0 +1,63 @@
+package jsonrpc
+
+import "testing"
+
+func TestVolatility(t *testing.T) {
+	hash := `"0x88e96d4537bea4d9c05d12549907b32561d3bf31f45aae734cdc119f13406cb6"`
+	tests := []struct {
+		name       string
+		body       string
+		volatility Volatility
+	}{
+		{"latest", `{"jsonrpc":"2.0","id":1,"method":"eth_getBalance","params":["0xabc","latest"]}`, BlockVolatile},
+		{"tag case", `{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[{},"Pending"]}`, BlockVolatile},
+		{"omitted block", `{"jsonrpc":"2.0","id":1,"method":"eth_getBalance","params":["0xabc"]}`, BlockVolatile},
+		{"null block", `{"jsonrpc":"2.0","id":1,"method":"eth_getCode","params":["0xabc",null]}`, BlockVolatile},
+		{"numeric height", `{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber","params":["0x10d4f",false]}`, BlockPinned},
+		{"block hash", `{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByHash","params":[` + hash + `,false]}`, BlockPinned},
+		{"block object", `{"jsonrpc":"2.0","id":1,"method":"eth_getStorageAt","params":["0xabc","0x0",{"blockHash":` + hash + `}]}`, BlockPinned},
+		{"unsupported tag", `{"jsonrpc":"2.0","id":1,"method":"eth_getBalance","params":["0xabc","earliest"]}`, BlockUnknown},
+		{"no block method", `{"jsonrpc":"2.0","id":1,"method":"eth_getTransactionReceipt","params":[` + hash + `]}`, BlockUnknown},
+		{"block after the address", `{"jsonrpc":"2.0","id":1,"method":"eth_getBalance","params":["0x0000000000000000000000000000000000000001","0x1"]}`, BlockPinned},
+		{"pinned logs", `{"jsonrpc":"2.0","id":1,"method":"eth_getLogs","params":[{"fromBlock":"0x1","toBlock":"0x2"}]}`, BlockPinned},
+		{"open logs", `{"jsonrpc":"2.0","id":1,"method":"eth_getLogs","params":[{"fromBlock":"0x1"}]}`, BlockVolatile},
+		{"logs by hash", `{"jsonrpc":"2.0","id":1,"method":"eth_getLogs","params":[{"blockHash":` + hash + `}]}`, BlockPinned},
+		{"pinned batch", `[{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber","params":["0x1",false]},{"jsonrpc":"2.0","id":2,"method":"eth_getBlockByHash","params":[` + hash + `,false]}]`, BlockPinned},
+		{"volatile batch", `[{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber","params":["0x1",false]},{"jsonrpc":"2.0","id":2,"method":"eth_getBalance","params":["0xabc","latest"]}]`, BlockVolatile},
+		{"partly pinned batch", `[{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber","params":["0x1",false]},{"jsonrpc":"2.0","id":2,"method":"eth_chainId"}]`, BlockUnknown},
+	}
+	tags := map[string]bool{"latest": true, "pending": true, "safe": true, "finalized": true}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request, err := Parse([]byte(test.body))
+			if err != nil {
+				t.Fatalf("failed to parse the body: %s", err)
+			}
+			if volatility := request.Volatility(tags); volatility != test.volatility {
+				t.Errorf("expected the volatility %d, got %d", test.volatility, volatility)
+			}
+		})
+	}
+}
+
+func TestNullResult(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		null bool
+	}{
+		{"result", `{"jsonrpc":"2.0","id":1,"result":"0x1"}`, false},
+		{"null result", `{"jsonrpc":"2.0","id":1,"result":null}`, true},
+		{"error", `{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"missing"}}`, true},
+		{"batch", `[{"jsonrpc":"2.0","id":1,"result":"0x1"},{"jsonrpc":"2.0","id":2,"result":{}}]`, false},
+		{"batch with a null result", `[{"jsonrpc":"2.0","id":1,"result":"0x1"},{"jsonrpc":"2.0","id":2,"result":null}]`, true},
+		{"not json-rpc", `ok`, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if null := NullResult([]byte(test.body)); null != test.null {
+				t.Errorf("expected null %t, got %t", test.null, null)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+)
+
+// JSON-RPC error codes
+const (
+	ParseErrorCode     = -32700
+	InvalidRequestCode = -32600
+)
+
+var ErrEmptyBody = errors.New("empty json-rpc body")
+
+// Call a single JSON-RPC call
+type Call struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// Request the parsed JSON-RPC body, either a single call or a batch of calls
+type Request struct {
+	Calls []Call
+	Batch bool
+}
+
+// Parse parse a JSON-RPC single or batch body
+func Parse(body []byte) (*Request, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil, ErrEmptyBody
+	}
+	if body[0] == '[' {
+		var calls []Call
+		if err := json.Unmarshal(body, &calls); err != nil {
+			return nil, err
+		}
+		return &Request{Calls: calls, Batch: true}, nil
+	}
+	var call Call
+	if err := json.Unmarshal(body, &call); err != nil {
+		return nil, err
+	}
+	return &Request{Calls: []Call{call}}, nil
+}
+
+// Methods return the methods of the calls
+func (r *Request) Methods() []string {
+	methods := make([]string, 0, len(r.Calls))
+	for _, call := range r.Calls {
+		methods = append(methods, call.Method)
+	}
+	return methods
+}
+
+// errorResponse a JSON-RPC error response
+type errorResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Error   struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// ErrorBody build a JSON-RPC error response body with a null id
+func ErrorBody(code int, message string) []byte {
+	response := errorResponse{JSONRPC: "2.0", ID: json.RawMessage("null")}
+	response.Error.Code = code
+	response.Error.Message = message
+	body, _ := json.Marshal(response)
+	return body
+}
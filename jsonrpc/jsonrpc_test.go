@@ -0,0 +1,63 @@
+package jsonrpc
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		batch   bool
+		methods []string
+	}{
+		{"single", `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`, false, []string{"eth_chainId"}},
+		{"batch", ` [{"jsonrpc":"2.0","id":1,"method":"eth_chainId"},{"jsonrpc":"2.0","id":2,"method":"eth_blockNumber"}]`, true, []string{"eth_chainId", "eth_blockNumber"}},
+		{"empty batch", `[]`, true, []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request, err := Parse([]byte(test.body))
+			if err != nil {
+				t.Fatalf("failed to parse the body: %s", err)
+			}
+			methods := request.Methods()
+			if request.Batch != test.batch || len(methods) != len(test.methods) {
+				t.Fatalf("expected batch %t of %v, got %t of %v", test.batch, test.methods, request.Batch, methods)
+			}
+			for i := range methods {
+				if methods[i] != test.methods[i] {
+					t.Errorf("expected the methods %v, got %v", test.methods, methods)
+				}
+			}
+		})
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	if _, err := Parse([]byte(" \n")); !errors.Is(err, ErrEmptyBody) {
+		t.Errorf("expected ErrEmptyBody, got %v", err)
+	}
+	if _, err := Parse([]byte(`[{"method":`)); err == nil {
+		t.Errorf("expected the malformed body to fail")
+	}
+}
+
+func TestErrorBody(t *testing.T) {
+	var response struct {
+		JSONRPC string          `json:"jsonrpc"`
+		ID      json.RawMessage `json:"id"`
+		Error   struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(ErrorBody(InvalidRequestCode, "too many calls"), &response); err != nil {
+		t.Fatalf("failed to decode the error body: %s", err)
+	}
+	if response.JSONRPC != "2.0" || string(response.ID) != "null" || response.Error.Code != InvalidRequestCode || response.Error.Message != "too many calls" {
+		t.Errorf("unexpected error body %+v", response)
+	}
+}
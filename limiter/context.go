@@ -0,0 +1,63 @@
+package limiter
+
+import (
+	"context"
+)
+
+type authorizationContextKey struct{}
+
+// WithAuthorization attach the Authorization header forwarded to the plan service when resolving the plan of the request subject
+func WithAuthorization(ctx context.Context, authorization string) context.Context {
+	return context.WithValue(ctx, authorizationContextKey{}, authorization)
+}
+
+// authorizationFromContext return the Authorization header of the request if any
+func authorizationFromContext(ctx context.Context) string {
+	authorization, _ := ctx.Value(authorizationContextKey{}).(string)
+	return authorization
+}
+
+type scopeContextKey struct{}
+
+// WithScope scope the rate counter of the request user, each scope of a user consumes an independent budget of the user plan
+func WithScope(ctx context.Context, scope string) context.Context {
+	return context.WithValue(ctx, scopeContextKey{}, scope)
+}
+
+type batchContextKey struct{}
+
+// WithBatch count the request on the batch budget of the user, limited by the plan batch limit
+func WithBatch(ctx context.Context) context.Context {
+	return context.WithValue(ctx, batchContextKey{}, true)
+}
+
+// batchFromContext check whether the request is counted on the batch budget
+func batchFromContext(ctx context.Context) bool {
+	batch, _ := ctx.Value(batchContextKey{}).(bool)
+	return batch
+}
+
+// rateId return the id the rate counter of the user is keyed on, the user id itself unless the request is scoped or a batch
+func rateId(ctx context.Context, userId string) string {
+	id := userId
+	if scope, _ := ctx.Value(scopeContextKey{}).(string); scope != "" {
+		id = id + "@" + scope
+	}
+	if batchFromContext(ctx) {
+		id = id + BatchRateScope
+	}
+	return id
+}
+
+type planContextKey struct{}
+
+// WithPlan limit the request on a fixed plan limit instead of the one of the user, e.g. for the anonymous requests
+func WithPlan(ctx context.Context, limit int) context.Context {
+	return context.WithValue(ctx, planContextKey{}, limit)
+}
+
+// planFromContext return the fixed plan limit of the request if any
+func planFromContext(ctx context.Context) (int, bool) {
+	limit, ok := ctx.Value(planContextKey{}).(int)
+	return limit, ok
+}
@@ -2,66 +2,243 @@ package limiter
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/kotalco/crossover-managed/logger"
 	"github.com/kotalco/resp"
 	"net/http"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
 	UserRateKeySuffix      = "-rate"
+	PlanOverrideKeySuffix  = "-plan-override"
 	UserRateLimitingWindow = 1 //sec
+	TTLCmd                 = "*2\r\n$3\r\nTTL\r\n$%d\r\n%s\r\n"
+	IncrByCmd              = "*3\r\n$6\r\nINCRBY\r\n$%d\r\n%s\r\n$%d\r\n%d\r\n"
+	WindowLimitKeySuffix   = "-window-limit"
+	PlanFeaturesKeySuffix  = "-plan-features"
+	PlanBatchKeySuffix     = "-plan-batch-limit"
+	BatchRateScope         = "#batch"
 )
 
+// PlanFetchTimeout bound the plan fetch shared by the concurrent requests of a user, it outlives the request that started it
+const PlanFetchTimeout = 2 * DefaultTimeout * time.Second
+
+// policies applied when the plan limit of a user changes mid-window
+const (
+	PlanChangeImmediate  = "immediate"   // the new limit applies to the current window
+	PlanChangeNextWindow = "next-window" // the current window keeps the limit in effect when it started
+)
+
+// ErrRedisUnavailable wrap the redis failures of the limiter
+var ErrRedisUnavailable = errors.New("redis unavailable")
+
+// Options configure the limiter service
+type Options struct {
+	APIKey             string // key used to authenticate the plan proxy requests
+	PlanAddress        string // address used to get the user plan
+	LocalFallback      bool   // limit with local in-memory buckets while redis is unavailable
+	LocalFallbackLimit int    // limit used by the local fallback for users with no known plan
+	PlanOverrides      bool   // look up the per user plan overrides before the plan cache
+	ProxyURL           string // outbound http proxy of the plan requests, empty uses the default transport
+	SmoothingBatch     int    // consult redis every SmoothingBatch requests of a user, 0 disables the smoothing
+	SmoothingInterval  int    // consult redis at least every SmoothingInterval milliseconds for each user
+	PlanChangePolicy   string // one of immediate or next-window, defaults to immediate
+	MaxPlanFetches     int    // max number of concurrent plan service requests, 0 disables the cap
+	PlanFetchDefault   bool   // users exceeding the plan fetches cap get their last known plan or LocalFallbackLimit instead of waiting
+	PlanQueryParam     string // query parameter carrying the user id, ignored when the plan address path has the {userId} placeholder
+	PlanCacheTTL       int    // ttl in seconds of the cached plans, 0 keeps them until redis evicts them
+	PlanSample         int    // interval in seconds to count the cached plans, 0 disables the count
+	MaxCachedPlans     int    // count of cached plans beyond which an eviction hint is logged, 0 disables the hint
+	PlanRetries        int    // number of retries of the failed plan fetches, 0 disables them
+	PlanRetryDelay     int    // milliseconds before the first retry, doubled after every failed attempt
+	Window             int    // seconds the plan limit applies to, defaults to UserRateLimitingWindow
+	WindowMode         string // one of fixed or sliding, defaults to fixed
+
+	// Logger throttle the error logs, nil logs every message
+	Logger *logger.Logger
+}
+
+// RateLimitError returned by Limit when the user exceeded his/her plan limit, it describes the rate limit state
+type RateLimitError struct {
+	Limit        int
+	Remaining    int
+	ResetSeconds int
+}
+
+func (e *RateLimitError) Error() string {
+	return http.StatusText(http.StatusTooManyRequests)
+}
+
 type ILimiter interface {
 	Limit(ctx context.Context, userId string, respClint resp.IClient) (bool, error)
+	Refund(ctx context.Context, userId string, respClint resp.IClient) error
+	Plan(ctx context.Context, userId string, respClint resp.IClient) (int, error)
+	SetPlanOverride(ctx context.Context, userId string, limit int, ttl int, respClint resp.IClient) error
+	ClearPlanOverride(ctx context.Context, userId string, respClint resp.IClient) error
+	Features(ctx context.Context, userId string, respClint resp.IClient) (map[string]bool, error)
 }
 type limiter struct {
-	planProxy IPlanProxy
+	planProxy     IPlanProxy
+	planFlight    *singleflight
+	localLimiter  *localLimiter
+	fallbackLimit int
+	knownPlans    sync.Map
+	degraded      int32
+	planOverrides bool
+	smoother      *smoother
+	stampWindow   bool
+	planFetches   chan struct{}
+	fetchDefault  bool
+	planTTL       int
+	planSample    time.Duration
+	maxPlans      int
+	planSampled   int64
+	window        int
+	sliding       bool
+	logger        *logger.Logger
 }
 
-func NewLimiter(apiKey string, remoteAddress string) ILimiter {
-	return &limiter{
-		planProxy: NewPlanProxy(apiKey, remoteAddress),
+func NewLimiter(options Options) ILimiter {
+	if options.Window <= 0 {
+		options.Window = UserRateLimitingWindow
+	}
+	l := &limiter{
+		planProxy:     NewPlanProxy(options.APIKey, options.PlanAddress, options.ProxyURL, options.PlanQueryParam, options.PlanRetries, time.Duration(options.PlanRetryDelay)*time.Millisecond, options.Logger),
+		planFlight:    newSingleflight(),
+		fallbackLimit: options.LocalFallbackLimit,
+		planOverrides: options.PlanOverrides,
+		planTTL:       options.PlanCacheTTL,
+		planSample:    time.Duration(options.PlanSample) * time.Second,
+		maxPlans:      options.MaxCachedPlans,
+		logger:        options.Logger,
+		window:        options.Window,
+	}
+	if options.LocalFallback {
+		l.localLimiter = newLocalLimiter(l.window)
+	}
+	if options.SmoothingBatch > 1 && options.SmoothingInterval > 0 {
+		interval := time.Duration(options.SmoothingInterval) * time.Millisecond
+		if interval > time.Duration(l.window)*time.Second {
+			// a stale estimate must never outlive the window it was counted in
+			interval = time.Duration(l.window) * time.Second
+		}
+		l.smoother = newSmoother(options.SmoothingBatch, interval)
+	}
+	l.stampWindow = options.PlanChangePolicy == PlanChangeNextWindow
+	l.sliding = options.WindowMode == WindowSliding
+	if options.MaxPlanFetches > 0 {
+		l.planFetches = make(chan struct{}, options.MaxPlanFetches)
+		l.fetchDefault = options.PlanFetchDefault
 	}
+	return l
 }
 
 func (l *limiter) Limit(ctx context.Context, userId string, respClint resp.IClient) (bool, error) {
+	//the plan is resolved per user while the rate counter may be scoped, e.g. per origin
+	rateId := rateId(ctx, userId)
+
+	//decide locally while the user estimate is fresh
+	increment := 1
+	if l.smoother != nil {
+		if allowed, plan, decided := l.smoother.take(rateId); decided {
+			if !allowed {
+				return false, &RateLimitError{Limit: plan, Remaining: 0, ResetSeconds: l.window}
+			}
+			return true, nil
+		}
+		increment = l.smoother.drain(rateId)
+	}
 
 	userPlan, err := l.getUserPlan(ctx, respClint, userId)
 	if err != nil {
-		return false, err
+		return l.fallback(ctx, userId, err)
+	}
+	l.samplePlans(ctx, respClint)
+	if batchFromContext(ctx) {
+		if userPlan, err = l.batchLimit(ctx, respClint, userId, userPlan); err != nil {
+			return l.fallback(ctx, userId, err)
+		}
 	}
 
-	allow, err := l.allow(ctx, respClint, userId, userPlan)
+	var count int
+	if l.sliding {
+		count, err = l.allowSliding(ctx, respClint, rateId, increment, userPlan)
+	} else {
+		count, err = l.allow(ctx, respClint, rateId, increment)
+	}
 	if err != nil {
-		return false, err
+		return l.fallback(ctx, userId, err)
 	}
-	if !allow {
-		return false, errors.New(http.StatusText(http.StatusTooManyRequests))
+	l.resume()
+	if l.stampWindow {
+		userPlan = l.windowLimit(ctx, respClint, rateId, count == increment, userPlan)
+	}
+	if l.smoother != nil {
+		l.smoother.sync(rateId, count, userPlan)
+	}
+	if count > userPlan {
+		return false, &RateLimitError{
+			Limit:        userPlan,
+			Remaining:    0,
+			ResetSeconds: l.resetSeconds(ctx, respClint, rateId),
+		}
 	}
 	return true, nil
 }
 
+// SetPlanOverride grant the user a custom limit for ttl seconds
+func (l *limiter) SetPlanOverride(ctx context.Context, userId string, limit int, ttl int, respClint resp.IClient) error {
+	return respClint.SetWithTTL(ctx, userId+PlanOverrideKeySuffix, strconv.Itoa(limit), ttl)
+}
+
+// ClearPlanOverride remove the user custom limit
+func (l *limiter) ClearPlanOverride(ctx context.Context, userId string, respClint resp.IClient) error {
+	return respClint.Delete(ctx, userId+PlanOverrideKeySuffix)
+}
+
+// Plan return the request limit of the user plan
+func (l *limiter) Plan(ctx context.Context, userId string, respClint resp.IClient) (int, error) {
+	return l.getUserPlan(ctx, respClint, userId)
+}
+
 func (l *limiter) getUserPlan(ctx context.Context, respClint resp.IClient, userId string) (int, error) {
+	//fixed plans are never resolved nor cached
+	if limit, ok := planFromContext(ctx); ok {
+		return limit, nil
+	}
+
+	//per user overrides take precedence over the plan service for their ttl
+	if l.planOverrides {
+		override, err := respClint.Get(ctx, userId+PlanOverrideKeySuffix)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %s", ErrRedisUnavailable, err.Error())
+		}
+		if override != "" {
+			if limit, err := strconv.Atoi(override); err == nil {
+				return limit, nil
+			}
+		}
+	}
+
 	//get user plan from cache
 	userPlan, err := respClint.Get(ctx, userId)
 	if err != nil {
-		return 0, err
+		return 0, fmt.Errorf("%w: %s", ErrRedisUnavailable, err.Error())
 	}
 
 	//fetch user plan from proxy if it doesn't exist
 	if userPlan == "" {
-		userPlan, err = l.planProxy.fetch(userId)
-		if err != nil {
-			return 0, err
-		}
-		//set user plan to cache
-		err = respClint.Set(ctx, userId, userPlan)
+		plan, err := l.sharedPlan(ctx, respClint, userId)
 		if err != nil {
 			return 0, err
 		}
+		userPlan = plan.limit
 	}
 
 	//parse user plan to int
@@ -69,26 +246,263 @@ func (l *limiter) getUserPlan(ctx context.Context, respClint resp.IClient, userI
 	if err != nil {
 		return 0, errors.New(fmt.Sprintf("can't parse userPlan: %s, got error: %s", userPlan, err.Error()))
 	}
+	if l.localLimiter != nil || l.fetchDefault {
+		//remember the plan to limit the user locally while redis is unavailable
+		l.knownPlans.Store(userId, userPlanInt)
+	}
 	return userPlanInt, nil
 }
 
-func (l *limiter) allow(ctx context.Context, respClint resp.IClient, userId string, limit int) (bool, error) {
+// sharedPlan fetch and cache the plan of the user, the concurrent requests of the same user share a single fetch
+// whatever part of the plan they miss. The fetch runs detached from the requests with its own timeout so the
+// cancellation of the one starting it doesn't fail the others, each request still gives up at its own deadline
+func (l *limiter) sharedPlan(ctx context.Context, respClint resp.IClient, userId string) (planDetails, error) {
+	fetchCtx := context.WithoutCancel(ctx)
+	plan, err := l.planFlight.do(ctx, userId, func() (planDetails, bool, error) {
+		fetchCtx, cancel := context.WithTimeout(fetchCtx, PlanFetchTimeout)
+		defer cancel()
+		//the default plan is only used until a fetch slot frees up, don't cache it
+		return l.fetchPlan(fetchCtx, userId)
+	}, func(plan planDetails) error {
+		//set user plan to cache
+		return l.storePlan(ctx, respClint, userId, plan)
+	})
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return planDetails{}, fmt.Errorf("%w: %s", ErrPlanTimeout, err.Error())
+	case errors.Is(err, context.Canceled):
+		return planDetails{}, fmt.Errorf("%w: %s", ErrPlanUnavailable, err.Error())
+	}
+	return plan, err
+}
+
+// fetchPlan request the user plan from the plan service within the concurrent fetches cap
+// fetched is false when the cap is reached and the last known or default plan is returned instead
+func (l *limiter) fetchPlan(ctx context.Context, userId string) (plan planDetails, fetched bool, err error) {
+	if l.planFetches == nil {
+		plan, err = l.planProxy.fetch(ctx, userId, authorizationFromContext(ctx))
+		return plan, true, err
+	}
+	if l.fetchDefault {
+		select {
+		case l.planFetches <- struct{}{}:
+		default:
+			limit := l.fallbackLimit
+			if known, ok := l.knownPlans.Load(userId); ok {
+				limit = known.(int)
+			}
+			return planDetails{limit: strconv.Itoa(limit)}, false, nil
+		}
+	} else {
+		select {
+		case l.planFetches <- struct{}{}:
+		case <-ctx.Done():
+			return planDetails{}, false, ctx.Err()
+		}
+	}
+	defer func() { <-l.planFetches }()
+	plan, err = l.planProxy.fetch(ctx, userId, authorizationFromContext(ctx))
+	return plan, true, err
+}
+
+// storePlan cache the plan limit of the user along with its enabled features and batch limit
+func (l *limiter) storePlan(ctx context.Context, respClint resp.IClient, userId string, plan planDetails) error {
+	if err := l.set(ctx, respClint, userId, plan.limit); err != nil {
+		return fmt.Errorf("%w: %s", ErrRedisUnavailable, err.Error())
+	}
+	encoded, err := json.Marshal(plan.features)
+	if err != nil {
+		return err
+	}
+	if err := l.set(ctx, respClint, userId+PlanFeaturesKeySuffix, string(encoded)); err != nil {
+		return fmt.Errorf("%w: %s", ErrRedisUnavailable, err.Error())
+	}
+	if err := l.set(ctx, respClint, userId+PlanBatchKeySuffix, strconv.Itoa(plan.batchLimit)); err != nil {
+		return fmt.Errorf("%w: %s", ErrRedisUnavailable, err.Error())
+	}
+	l.indexPlan(ctx, respClint, userId)
+	return nil
+}
+
+// set store the plan key with the plan cache ttl, if any
+func (l *limiter) set(ctx context.Context, respClint resp.IClient, key string, value string) error {
+	if l.planTTL > 0 {
+		return respClint.SetWithTTL(ctx, key, value, l.planTTL)
+	}
+	return respClint.Set(ctx, key, value)
+}
+
+// Features return the features enabled by the user plan, plans cached without their features are fetched again
+func (l *limiter) Features(ctx context.Context, userId string, respClint resp.IClient) (map[string]bool, error) {
+	if _, ok := planFromContext(ctx); ok {
+		//fixed plans have no features
+		return map[string]bool{}, nil
+	}
+	cached, err := respClint.Get(ctx, userId+PlanFeaturesKeySuffix)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrRedisUnavailable, err.Error())
+	}
+
+	var features []string
+	if cached == "" {
+		//the default plan has no features
+		plan, err := l.sharedPlan(ctx, respClint, userId)
+		if err != nil {
+			return nil, err
+		}
+		features = plan.features
+	} else if err := json.Unmarshal([]byte(cached), &features); err != nil {
+		return nil, fmt.Errorf("can't parse plan features: %s, got error: %s", cached, err.Error())
+	}
+	enabled := make(map[string]bool, len(features))
+	for _, feature := range features {
+		enabled[feature] = true
+	}
+	return enabled, nil
+}
+
+// batchLimit return the per window limit of the user batch requests, the plan limit unless the plan sets a batch limit
+// plans cached without their batch limit are fetched again
+func (l *limiter) batchLimit(ctx context.Context, respClint resp.IClient, userId string, userPlan int) (int, error) {
+	if _, ok := planFromContext(ctx); ok {
+		return userPlan, nil
+	}
+	cached, err := respClint.Get(ctx, userId+PlanBatchKeySuffix)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrRedisUnavailable, err.Error())
+	}
+	var limit int
+	if cached == "" {
+		//the default plan has no batch limit
+		plan, err := l.sharedPlan(ctx, respClint, userId)
+		if err != nil {
+			return 0, err
+		}
+		limit = plan.batchLimit
+	} else if limit, err = strconv.Atoi(cached); err != nil {
+		return 0, fmt.Errorf("can't parse plan batch limit: %s, got error: %s", cached, err.Error())
+	}
+	if limit <= 0 {
+		return userPlan, nil
+	}
+	return limit, nil
+}
+
+// allow increment the user rate counter by increment and return the number of requests made in the current window
+func (l *limiter) allow(ctx context.Context, respClint resp.IClient, userId string, increment int) (int, error) {
 	//user limiting cache key
 	key := fmt.Sprintf("%s%s", userId, UserRateKeySuffix)
 
 	// Increment the counter for the given key.
-	count, err := respClint.Incr(ctx, key)
+	var count int
+	var err error
+	if increment == 1 {
+		count, err = respClint.Incr(ctx, key)
+	} else {
+		var reply string
+		reply, err = respClint.Do(ctx, fmt.Sprintf(IncrByCmd, len(key), key, len(strconv.Itoa(increment)), increment))
+		if err == nil {
+			if _, scanErr := fmt.Sscanf(reply, ":%d", &count); scanErr != nil {
+				err = fmt.Errorf("incrby: unexpected response from server %s", reply)
+			}
+		}
+	}
 	if err != nil {
-		return false, err
+		return 0, fmt.Errorf("%w: %s", ErrRedisUnavailable, err.Error())
 	}
-	if count == 1 {
+	if count == increment {
 		// If the key is new or expired (i.e., count == 1), set the expiration.
-		_, err = respClint.Expire(ctx, key, UserRateLimitingWindow)
+		_, err = respClint.Expire(ctx, key, l.window)
 		if err != nil {
-			return false, err
+			return 0, fmt.Errorf("%w: %s", ErrRedisUnavailable, err.Error())
 		}
 	}
 
-	// Check against the limit.
-	return count <= limit, nil
+	return count, nil
+}
+
+// windowLimit return the limit stamped on the current window, stamping it with plan when the window just started
+// so a plan refreshed mid-window only applies at the next window boundary
+func (l *limiter) windowLimit(ctx context.Context, respClint resp.IClient, userId string, started bool, plan int) int {
+	key := userId + WindowLimitKeySuffix
+	if started {
+		_ = respClint.SetWithTTL(ctx, key, strconv.Itoa(plan), l.window)
+		return plan
+	}
+	stamped, err := respClint.Get(ctx, key)
+	if err != nil || stamped == "" {
+		return plan
+	}
+	limit, err := strconv.Atoi(stamped)
+	if err != nil {
+		return plan
+	}
+	return limit
+}
+
+// fallback limit the user with the local buckets when redis is unavailable and the local fallback is enabled
+func (l *limiter) fallback(ctx context.Context, userId string, err error) (bool, error) {
+	if l.localLimiter == nil || !errors.Is(err, ErrRedisUnavailable) {
+		return false, err
+	}
+	if atomic.CompareAndSwapInt32(&l.degraded, 0, 1) {
+		l.logger.Printf("Redis unavailable, limiting with local in-memory buckets: %s", err.Error())
+	}
+
+	limit := l.fallbackLimit
+	if plan, ok := l.knownPlans.Load(userId); ok {
+		limit = plan.(int)
+	}
+	if !l.localLimiter.allow(rateId(ctx, userId), limit) {
+		return false, &RateLimitError{
+			Limit:        limit,
+			Remaining:    0,
+			ResetSeconds: l.window,
+		}
+	}
+	return true, nil
+}
+
+// resume hand back the limiting to redis after a degraded period
+func (l *limiter) resume() {
+	if l.localLimiter == nil || !atomic.CompareAndSwapInt32(&l.degraded, 1, 0) {
+		return
+	}
+	l.logger.Printf("Redis recovered, resuming redis based limiting")
+	l.localLimiter.reset()
+}
+
+// refundScript decrement the counter only while it's positive, a decrement of the expired key would create it without
+// expiry and one below zero would grant the user extra quota, it returns the decremented count or 0
+const refundScript = `local count = tonumber(redis.call('GET', KEYS[1]) or 0)
+if count > 0 then
+	return redis.call('DECR', KEYS[1])
+end
+return 0`
+
+// Refund decrement the user rate counter for a request that shouldn't be charged
+func (l *limiter) Refund(ctx context.Context, userId string, respClint resp.IClient) error {
+	if l.sliding {
+		return l.refundSliding(ctx, respClint, rateId(ctx, userId))
+	}
+	key := fmt.Sprintf("%s%s", rateId(ctx, userId), UserRateKeySuffix)
+	_, err := respClint.Do(ctx, command("EVAL", refundScript, "1", key))
+	return err
+}
+
+// resetSeconds return the remaining seconds of the current user window, defaults to the window size if it can't be read
+func (l *limiter) resetSeconds(ctx context.Context, respClint resp.IClient, userId string) int {
+	if l.sliding {
+		return l.slidingResetSeconds()
+	}
+	key := fmt.Sprintf("%s%s", userId, UserRateKeySuffix)
+	reply, err := respClint.Do(ctx, fmt.Sprintf(TTLCmd, len(key), key))
+	if err != nil {
+		return l.window
+	}
+	var ttl int
+	if _, err := fmt.Sscanf(reply, ":%d", &ttl); err != nil || ttl <= 0 {
+		return l.window
+	}
+	return ttl
 }
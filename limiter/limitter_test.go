@@ -0,0 +1,510 @@
+package limiter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/kotalco/crossover-managed/internal/redistest"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// planService serve the plan of every user, counting the fetches
+type planService struct {
+	mu       sync.Mutex
+	limits   map[string]int
+	limit    int
+	batch    int
+	features map[string]bool
+	status   int
+	delay    time.Duration
+	fetches  int32
+	inflight int32
+	peak     int32
+	requests []*http.Request
+}
+
+func newPlanService(t *testing.T, limit int) (*planService, *httptest.Server) {
+	plans := &planService{limits: map[string]int{}, limit: limit}
+	server := httptest.NewServer(plans)
+	t.Cleanup(server.Close)
+	return plans, server
+}
+
+func (p *planService) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	atomic.AddInt32(&p.fetches, 1)
+	defer atomic.AddInt32(&p.inflight, -1)
+	p.mu.Lock()
+	if inflight := atomic.AddInt32(&p.inflight, 1); inflight > p.peak {
+		p.peak = inflight
+	}
+	p.requests = append(p.requests, req.Clone(context.Background()))
+	status, limit, delay := p.status, p.limit, p.delay
+	if userLimit, ok := p.limits[req.URL.Query().Get(DefaultPlanQueryParam)]; ok {
+		limit = userLimit
+	}
+	var response PlanProxyResponse
+	response.Data.RequestLimit = limit
+	response.Data.BatchRequestLimit = p.batch
+	response.Data.Features = p.features
+	p.mu.Unlock()
+	time.Sleep(delay)
+	if status != 0 {
+		rw.WriteHeader(status)
+		return
+	}
+	_ = json.NewEncoder(rw).Encode(response)
+}
+
+func (p *planService) setLimit(limit int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.limit = limit
+}
+
+func (p *planService) count() int {
+	return int(atomic.LoadInt32(&p.fetches))
+}
+
+// newTestServer return a redis emulating the limiter scripts
+func newTestServer() *redistest.Server {
+	server := redistest.NewServer()
+	server.Script(refundScript, func(call func(args ...string) string, keys []string, args []string) string {
+		if count, _ := strconv.Atoi(call("GET", keys[0])); count > 0 {
+			return call("DECR", keys[0])
+		}
+		return ":0"
+	})
+	server.Script(slidingScript, func(call func(args ...string) string, keys []string, args []string) string {
+		increment, _ := strconv.Atoi(args[0])
+		limit, _ := strconv.Atoi(args[2])
+		count := increment
+		for _, key := range keys {
+			value, _ := strconv.Atoi(call("GET", key))
+			count += value
+		}
+		if count > limit {
+			increment--
+		}
+		if increment > 0 {
+			call("INCRBY", keys[0], strconv.Itoa(increment))
+			if call("TTL", keys[0]) == ":-1" {
+				call("EXPIRE", keys[0], args[1])
+			}
+		}
+		return ":" + strconv.Itoa(count)
+	})
+	server.Script(slidingRefundScript, func(call func(args ...string) string, keys []string, args []string) string {
+		count := 0
+		for _, key := range keys {
+			value, _ := strconv.Atoi(call("GET", key))
+			count += value
+		}
+		if count <= 0 {
+			return ":0"
+		}
+		if call("DECR", keys[0]) == ":-1" {
+			call("EXPIRE", keys[0], args[0])
+		}
+		return ":" + strconv.Itoa(count-1)
+	})
+	return server
+}
+
+// limit make a request of the user, it returns whether it was allowed
+func limit(t *testing.T, l ILimiter, server *redistest.Server, ctx context.Context, userId string) bool {
+	t.Helper()
+	client := server.Client()
+	defer client.Close()
+	allowed, err := l.Limit(ctx, userId, client)
+	if err != nil && !strings.Contains(err.Error(), http.StatusText(http.StatusTooManyRequests)) {
+		t.Fatalf("unexpected limit error: %s", err)
+	}
+	return allowed
+}
+
+func counter(server *redistest.Server, userId string) int {
+	value, _ := server.Value(userId + UserRateKeySuffix)
+	count, _ := strconv.Atoi(value)
+	return count
+}
+
+func TestRefund(t *testing.T) {
+	_, plans := newPlanService(t, 10)
+	server := newTestServer()
+	l := NewLimiter(Options{PlanAddress: plans.URL, Window: 60})
+	ctx := context.Background()
+
+	limit(t, l, server, ctx, "user")
+	limit(t, l, server, ctx, "user")
+	if err := l.Refund(ctx, "user", server.Client()); err != nil {
+		t.Fatalf("failed to refund: %s", err)
+	}
+	if count := counter(server, "user"); count != 1 {
+		t.Errorf("expected the refund to decrement the counter to 1, got %d", count)
+	}
+	if ttl := server.TTL("user" + UserRateKeySuffix); ttl <= 0 {
+		t.Errorf("expected the refunded counter to keep its expiry, got the ttl %d", ttl)
+	}
+}
+
+func TestRefundExpiredWindow(t *testing.T) {
+	_, plans := newPlanService(t, 10)
+	server := newTestServer()
+	l := NewLimiter(Options{PlanAddress: plans.URL, Window: 1})
+	ctx := context.Background()
+
+	limit(t, l, server, ctx, "user")
+	server.Advance(2 * time.Second)
+	if err := l.Refund(ctx, "user", server.Client()); err != nil {
+		t.Fatalf("failed to refund: %s", err)
+	}
+	if _, ok := server.Value("user" + UserRateKeySuffix); ok {
+		t.Errorf("expected the refund of an expired window not to create a counter without expiry")
+	}
+}
+
+func TestRefundNeverBelowZero(t *testing.T) {
+	_, plans := newPlanService(t, 2)
+	server := newTestServer()
+	l := NewLimiter(Options{PlanAddress: plans.URL, Window: 60})
+	ctx := context.Background()
+
+	limit(t, l, server, ctx, "user")
+	for i := 0; i < 3; i++ {
+		if err := l.Refund(ctx, "user", server.Client()); err != nil {
+			t.Fatalf("failed to refund: %s", err)
+		}
+	}
+	if count := counter(server, "user"); count != 0 {
+		t.Errorf("expected the repeated refunds to stop at 0, got %d", count)
+	}
+	// the extra refunds must not grant more than the plan
+	allowed := 0
+	for i := 0; i < 4; i++ {
+		if limit(t, l, server, ctx, "user") {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Errorf("expected the plan of 2 requests to hold after the refunds, got %d allowed", allowed)
+	}
+}
+
+func TestPlanOverride(t *testing.T) {
+	_, plans := newPlanService(t, 100)
+	server := newTestServer()
+	l := NewLimiter(Options{PlanAddress: plans.URL, Window: 60, PlanOverrides: true})
+	ctx := context.Background()
+	client := server.Client()
+	defer client.Close()
+
+	plan := func() int {
+		t.Helper()
+		limit, err := l.Plan(ctx, "user", client)
+		if err != nil {
+			t.Fatalf("failed to get the plan: %s", err)
+		}
+		return limit
+	}
+
+	if limit := plan(); limit != 100 {
+		t.Fatalf("expected the proxy plan 100, got %d", limit)
+	}
+	if err := l.SetPlanOverride(ctx, "user", 2, 10, client); err != nil {
+		t.Fatalf("failed to set the override: %s", err)
+	}
+	if limit := plan(); limit != 2 {
+		t.Errorf("expected the override to supersede the proxy plan, got %d", limit)
+	}
+	if !limit(t, l, server, ctx, "user") || !limit(t, l, server, ctx, "user") || limit(t, l, server, ctx, "user") {
+		t.Errorf("expected the requests to be limited by the override")
+	}
+
+	server.Advance(11 * time.Second)
+	if limit := plan(); limit != 100 {
+		t.Errorf("expected the expired override to fall back to the proxy plan, got %d", limit)
+	}
+
+	_ = l.SetPlanOverride(ctx, "user", 5, 10, client)
+	if err := l.ClearPlanOverride(ctx, "user", client); err != nil {
+		t.Fatalf("failed to clear the override: %s", err)
+	}
+	if limit := plan(); limit != 100 {
+		t.Errorf("expected the cleared override to fall back to the proxy plan, got %d", limit)
+	}
+}
+
+func TestLimitErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(plans *planService, server *redistest.Server) context.Context
+		err   error
+	}{
+		{"plan timeout", func(plans *planService, server *redistest.Server) context.Context {
+			plans.delay = 200 * time.Millisecond
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			t.Cleanup(cancel)
+			return ctx
+		}, ErrPlanTimeout},
+		{"plan unavailable", func(plans *planService, server *redistest.Server) context.Context {
+			plans.status = http.StatusBadGateway
+			return context.Background()
+		}, ErrPlanUnavailable},
+		{"redis unavailable", func(plans *planService, server *redistest.Server) context.Context {
+			server.Fail(errors.New("connection refused"))
+			return context.Background()
+		}, ErrRedisUnavailable},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plans, proxy := newPlanService(t, 10)
+			server := newTestServer()
+			l := NewLimiter(Options{PlanAddress: proxy.URL, Window: 60})
+			ctx := test.setup(plans, server)
+
+			client := server.Client()
+			defer client.Close()
+			if allowed, err := l.Limit(ctx, "user", client); allowed || !errors.Is(err, test.err) {
+				t.Errorf("expected %v, got %t %v", test.err, allowed, err)
+			}
+		})
+	}
+}
+
+func TestPlanChangePolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		allowed bool
+	}{
+		{"immediate", PlanChangeImmediate, false},
+		{"next window", PlanChangeNextWindow, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, plans := newPlanService(t, 5)
+			server := newTestServer()
+			l := NewLimiter(Options{PlanAddress: plans.URL, Window: 60, PlanChangePolicy: test.policy})
+			ctx := context.Background()
+
+			for i := 0; i < 3; i++ {
+				limit(t, l, server, ctx, "user")
+			}
+			// the plan shrinks mid-window below the requests already made
+			server.Set("user", "2")
+			if allowed := limit(t, l, server, ctx, "user"); allowed != test.allowed {
+				t.Errorf("expected the request after the plan shrank allowed %t, got %t", test.allowed, allowed)
+			}
+
+			// the next window applies the new plan whatever the policy
+			server.Advance(61 * time.Second)
+			server.Set("user", "2")
+			allowed := 0
+			for i := 0; i < 4; i++ {
+				if limit(t, l, server, ctx, "user") {
+					allowed++
+				}
+			}
+			if allowed != 2 {
+				t.Errorf("expected the new plan of 2 in the next window, got %d allowed", allowed)
+			}
+		})
+	}
+}
+
+func TestMaxPlanFetches(t *testing.T) {
+	plans, proxy := newPlanService(t, 100)
+	plans.delay = 20 * time.Millisecond
+	server := newTestServer()
+	l := NewLimiter(Options{PlanAddress: proxy.URL, Window: 60, MaxPlanFetches: 3})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(userId string) {
+			defer wg.Done()
+			client := server.Client()
+			defer client.Close()
+			if _, err := l.Limit(context.Background(), userId, client); err != nil {
+				t.Errorf("unexpected limit error: %s", err)
+			}
+		}("user" + strconv.Itoa(i))
+	}
+	wg.Wait()
+
+	if plans.count() != 20 {
+		t.Errorf("expected a plan fetch per distinct user, got %d", plans.count())
+	}
+	if plans.peak > 3 {
+		t.Errorf("expected at most 3 concurrent plan fetches, got %d", plans.peak)
+	}
+}
+
+func TestMaxPlanFetchesDefault(t *testing.T) {
+	plans, proxy := newPlanService(t, 100)
+	plans.delay = 100 * time.Millisecond
+	server := newTestServer()
+	l := NewLimiter(Options{PlanAddress: proxy.URL, Window: 60, MaxPlanFetches: 1, PlanFetchDefault: true, LocalFallbackLimit: 7})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		client := server.Client()
+		defer client.Close()
+		_, _ = l.Plan(context.Background(), "busy", client)
+	}()
+	for plans.count() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	client := server.Client()
+	defer client.Close()
+	plan, err := l.Plan(context.Background(), "user", client)
+	if err != nil || plan != 7 {
+		t.Errorf("expected the default plan while the fetches are capped, got %d %v", plan, err)
+	}
+	if _, ok := server.Value("user"); ok {
+		t.Errorf("expected the default plan not to be cached")
+	}
+	<-done
+}
+
+func TestFeatures(t *testing.T) {
+	plans, proxy := newPlanService(t, 100)
+	plans.features = map[string]bool{"archive_access": true, "websocket": false}
+	server := newTestServer()
+	l := NewLimiter(Options{PlanAddress: proxy.URL, Window: 60})
+	client := server.Client()
+	defer client.Close()
+
+	for i := 0; i < 2; i++ {
+		features, err := l.Features(context.Background(), "user", client)
+		if err != nil {
+			t.Fatalf("failed to get the plan features: %s", err)
+		}
+		if len(features) != 1 || !features["archive_access"] {
+			t.Errorf("expected only the enabled archive_access feature, got %v", features)
+		}
+	}
+	if plans.count() != 1 {
+		t.Errorf("expected the features to be cached with the plan, got %d fetches", plans.count())
+	}
+
+	// the plans cached without their features are fetched again
+	server.Set("other", "100")
+	if features, err := l.Features(context.Background(), "other", client); err != nil || !features["archive_access"] || plans.count() != 2 {
+		t.Errorf("expected the features of the plan cached without them to be fetched, got %v %v", features, err)
+	}
+
+	// the fixed plans have no features
+	if features, err := l.Features(WithPlan(context.Background(), 10), "anonymous", client); err != nil || len(features) != 0 {
+		t.Errorf("expected no features for the fixed plan, got %v %v", features, err)
+	}
+}
+
+func TestBatchBudget(t *testing.T) {
+	tests := []struct {
+		name    string
+		batch   int
+		batches int // number of batches allowed within the window
+	}{
+		{"batch limit", 2, 2},
+		{"no batch limit", 0, 4},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plans, proxy := newPlanService(t, 4)
+			plans.batch = test.batch
+			server := newTestServer()
+			l := NewLimiter(Options{PlanAddress: proxy.URL, Window: 60})
+			batchCtx := WithBatch(context.Background())
+
+			allowed := 0
+			for i := 0; i < 5; i++ {
+				if limit(t, l, server, batchCtx, "user") {
+					allowed++
+				}
+			}
+			if allowed != test.batches {
+				t.Errorf("expected %d batches within the window, got %d", test.batches, allowed)
+			}
+			// the single calls draw from their own budget
+			for i := 0; i < 4; i++ {
+				if !limit(t, l, server, context.Background(), "user") {
+					t.Fatalf("expected the single call %d to be allowed after the batch budget ran out", i+1)
+				}
+			}
+			if limit(t, l, server, context.Background(), "user") {
+				t.Errorf("expected the single calls to be limited by the plan")
+			}
+			if plans.count() != 1 {
+				t.Errorf("expected the batch limit to be cached with the plan, got %d fetches", plans.count())
+			}
+		})
+	}
+}
+
+func TestBatchBudgetRefetched(t *testing.T) {
+	plans, proxy := newPlanService(t, 4)
+	plans.batch = 1
+	server := newTestServer()
+	// the plan was cached before the batch limits existed
+	server.Set("user", "4")
+	l := NewLimiter(Options{PlanAddress: proxy.URL, Window: 60})
+
+	if !limit(t, l, server, WithBatch(context.Background()), "user") || limit(t, l, server, WithBatch(context.Background()), "user") {
+		t.Errorf("expected the batch limit 1 of the fetched plan")
+	}
+	if plans.count() != 1 {
+		t.Errorf("expected the plan cached without its batch limit to be fetched once, got %d fetches", plans.count())
+	}
+}
+
+func TestRateLimitWindow(t *testing.T) {
+	tests := []struct {
+		window int
+		ttl    int
+	}{
+		{0, UserRateLimitingWindow},
+		{1, 1},
+		{60, 60},
+	}
+	for _, test := range tests {
+		t.Run(strconv.Itoa(test.window), func(t *testing.T) {
+			_, plans := newPlanService(t, 2)
+			server := newTestServer()
+			l := NewLimiter(Options{PlanAddress: plans.URL, Window: test.window})
+			client := server.Client()
+			defer client.Close()
+			ctx := context.Background()
+
+			limit(t, l, server, ctx, "user")
+			if ttl := server.TTL("user" + UserRateKeySuffix); ttl != test.ttl {
+				t.Errorf("expected the counter to expire after %d seconds, got %d", test.ttl, ttl)
+			}
+			limit(t, l, server, ctx, "user")
+			_, err := l.Limit(ctx, "user", client)
+			var rateErr *RateLimitError
+			if !errors.As(err, &rateErr) || rateErr.ResetSeconds != test.ttl {
+				t.Errorf("expected the denial to reset within %d seconds, got %v", test.ttl, err)
+			}
+
+			// the limit holds over the whole window, not a second of it
+			server.Advance(time.Duration(test.ttl)*time.Second - time.Millisecond)
+			if limit(t, l, server, ctx, "user") {
+				t.Errorf("expected the user to stay limited until the window ends")
+			}
+			server.Advance(time.Millisecond)
+			if !limit(t, l, server, ctx, "user") {
+				t.Errorf("expected the user to be allowed again in the next window")
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package limiter
+
+import (
+	"sync"
+	"time"
+)
+
+// localLimiter a best-effort per instance token bucket limiter used while redis is unavailable
+// the limits are necessarily per instance, not global across the plugin instances
+type localLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	window  int
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newLocalLimiter(window int) *localLimiter {
+	return &localLimiter{
+		buckets: map[string]*bucket{},
+		window:  window,
+	}
+}
+
+// allow take a token from the user bucket, the bucket holds limit tokens refilled every window
+func (l *localLimiter) allow(userId string, limit int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[userId]
+	if !ok {
+		b = &bucket{tokens: float64(limit), last: now}
+		l.buckets[userId] = b
+	}
+	refillRate := float64(limit) / float64(l.window)
+	b.tokens += now.Sub(b.last).Seconds() * refillRate
+	if b.tokens > float64(limit) {
+		b.tokens = float64(limit)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// reset drop the local buckets once redis limiting resumes
+func (l *localLimiter) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.buckets = map[string]*bucket{}
+}
@@ -0,0 +1,54 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestLocalFallback(t *testing.T) {
+	_, plans := newPlanService(t, 3)
+	server := newTestServer()
+	l := NewLimiter(Options{PlanAddress: plans.URL, Window: 60, LocalFallback: true, LocalFallbackLimit: 1})
+	ctx := context.Background()
+
+	if !limit(t, l, server, ctx, "user") {
+		t.Fatalf("expected the first request to be allowed")
+	}
+
+	// the outage hands the limiting to the local buckets, with the last known plan of the user
+	server.Fail(errors.New("connection refused"))
+	for i := 0; i < 3; i++ {
+		if !limit(t, l, server, ctx, "user") {
+			t.Fatalf("expected the request %d within the plan to be allowed locally", i+1)
+		}
+	}
+	if limit(t, l, server, ctx, "user") {
+		t.Errorf("expected the local bucket to deny the requests beyond the plan")
+	}
+	if !limit(t, l, server, ctx, "unknown") || limit(t, l, server, ctx, "unknown") {
+		t.Errorf("expected the users with no known plan to get the LocalFallbackLimit")
+	}
+
+	// the recovery hands the limiting back to redis
+	server.Fail(nil)
+	if !limit(t, l, server, ctx, "user") {
+		t.Fatalf("expected the request after the recovery to be allowed")
+	}
+	if count := counter(server, "user"); count != 2 {
+		t.Errorf("expected the redis counter to resume at 2, got %d", count)
+	}
+}
+
+func TestLocalFallbackDisabled(t *testing.T) {
+	_, plans := newPlanService(t, 3)
+	server := newTestServer()
+	l := NewLimiter(Options{PlanAddress: plans.URL, Window: 60})
+	server.Fail(errors.New("connection refused"))
+
+	client := server.Client()
+	defer client.Close()
+	if allowed, err := l.Limit(context.Background(), "user", client); allowed || !errors.Is(err, ErrRedisUnavailable) {
+		t.Errorf("expected the redis outage to fail the request without the local fallback, got %t %v", allowed, err)
+	}
+}
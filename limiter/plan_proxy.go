@@ -1,77 +1,191 @@
 package limiter
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"github.com/kotalco/crossover-managed/logger"
+	"net"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
-const DefaultTimeout = 5
+const (
+	DefaultTimeout        = 5
+	DefaultPlanRetryDelay = 100 // ms, doubled after every failed attempt
+	DefaultPlanQueryParam = "userId"
+	PlanPathPlaceholder   = "{userId}" // placeholder of the plan address path replaced by the escaped user id
+)
+
+var (
+	ErrPlanTimeout     = errors.New("plan service timeout")
+	ErrPlanUnavailable = errors.New("plan service unavailable")
+)
 
 type PlanProxyResponse struct {
 	Data struct {
-		RequestLimit int `json:"request_limit"`
+		RequestLimit      int             `json:"request_limit"`
+		BatchRequestLimit int             `json:"batch_request_limit"`
+		Features          map[string]bool `json:"features"`
 	} `json:"data"`
 }
 
+// planDetails the user plan returned by the plan service
+type planDetails struct {
+	limit      string
+	features   []string
+	batchLimit int // per window limit of the batch requests, 0 counts them on the plan limit
+}
+
 type IPlanProxy interface {
-	fetch(userId string) (string, error)
+	fetch(ctx context.Context, userId string, authorization string) (planDetails, error)
 }
 
 type PlanProxy struct {
 	httpClient http.Client
 	requestUrl *url.URL
 	apiKey     string
+	queryParam string
+	pathParam  bool
+	retries    int
+	retryDelay time.Duration
+	logger     *logger.Logger
 }
 
-func NewPlanProxy(apiKey string, rawUrl string) IPlanProxy {
+// NewPlanProxy create the plan service client, the user id is sent in the queryParam query parameter
+// unless the rawUrl path contains the PlanPathPlaceholder, the failed fetches are retried up to retries times and logged with logger
+func NewPlanProxy(apiKey string, rawUrl string, rawProxyUrl string, queryParam string, retries int, retryDelay time.Duration, logger *logger.Logger) IPlanProxy {
 	requestUrl, err := url.Parse(rawUrl)
 	if err != nil {
 		panic(fmt.Sprintf("invalid raw plan proxy url %s: %v", rawUrl, err))
 	}
+	httpClient := http.Client{
+		Timeout: DefaultTimeout * time.Second,
+	}
+	if rawProxyUrl != "" {
+		proxyUrl, err := url.Parse(rawProxyUrl)
+		if err != nil {
+			panic(fmt.Sprintf("invalid raw outbound proxy url %s: %v", rawProxyUrl, err))
+		}
+		httpClient.Transport = &http.Transport{Proxy: http.ProxyURL(proxyUrl)}
+	}
+	if queryParam == "" {
+		queryParam = DefaultPlanQueryParam
+	}
+	if retryDelay <= 0 {
+		retryDelay = DefaultPlanRetryDelay * time.Millisecond
+	}
 	return &PlanProxy{
-		httpClient: http.Client{
-			Timeout: DefaultTimeout * time.Second,
-		},
+		httpClient: httpClient,
 		requestUrl: requestUrl,
 		apiKey:     apiKey,
+		queryParam: queryParam,
+		pathParam:  strings.Contains(requestUrl.Path, PlanPathPlaceholder),
+		retries:    retries,
+		retryDelay: retryDelay,
+		logger:     logger,
 	}
 }
 
-func (proxy *PlanProxy) fetch(userId string) (string, error) {
-	queryParams := url.Values{}
-	queryParams.Set("userId", userId)
-	proxy.requestUrl.RawQuery = queryParams.Encode()
-	httpReq, err := http.NewRequest(http.MethodGet, proxy.requestUrl.String(), nil)
+// fetch request the plan limits and the enabled features of the user, the authorization of the request is forwarded so the plan service can resolve the token subject
+// the network errors and the 5xx responses are retried with an exponential backoff, the retries stop at the context deadline
+func (proxy *PlanProxy) fetch(ctx context.Context, userId string, authorization string) (planDetails, error) {
+	delay := proxy.retryDelay
+	for attempt := 0; ; attempt++ {
+		plan, retryable, err := proxy.fetchOnce(ctx, userId, authorization)
+		if err == nil || !retryable || attempt >= proxy.retries {
+			return plan, err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			// the backoff alone would exceed the request budget
+			return plan, err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return plan, err
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+// fetchOnce make a single plan request, retryable reports whether the failure may be transient
+func (proxy *PlanProxy) fetchOnce(ctx context.Context, userId string, authorization string) (plan planDetails, retryable bool, err error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, proxy.userUrl(userId), nil)
 	if err != nil {
-		log.Printf("FetchUserPlan:NewRequest, %s", err.Error())
-		return "", errors.New("something went wrong")
+		proxy.logger.Printf("FetchUserPlan:NewRequest, %s", err.Error())
+		return planDetails{}, false, errors.New("something went wrong")
 	}
 	httpReq.Header.Set("Content-Type", "application/json")
 	httpReq.Header.Set("X-Api-Key", proxy.apiKey)
+	if authorization != "" {
+		httpReq.Header.Set("Authorization", authorization)
+	}
 
 	httpRes, err := proxy.httpClient.Do(httpReq)
-	defer httpRes.Body.Close()
 	if err != nil {
-		log.Printf("FetchUserPlan:Do, %s", err.Error())
-		return "", errors.New("something went wrong")
+		proxy.logger.Printf("FetchUserPlan:Do, %s", err.Error())
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return planDetails{}, true, fmt.Errorf("%w: %s", ErrPlanTimeout, err.Error())
+		}
+		return planDetails{}, true, fmt.Errorf("%w: %s", ErrPlanUnavailable, err.Error())
 	}
+	// the response is only valid once the transport error is checked
+	defer httpRes.Body.Close()
 
 	if httpRes.StatusCode != http.StatusOK {
-		log.Printf("FetchUserPlan:InvalidStatusCode: %d", httpRes.StatusCode)
-		return "", errors.New("something went wrong")
+		proxy.logger.Printf("FetchUserPlan:InvalidStatusCode: %d", httpRes.StatusCode)
+		return planDetails{}, httpRes.StatusCode >= http.StatusInternalServerError, ErrPlanUnavailable
 	}
 
 	var response PlanProxyResponse
 	if err = json.NewDecoder(httpRes.Body).Decode(&response); err != nil {
-		log.Printf("FetchUserPlan:UNMARSHAERPlan, %s", err.Error())
-		return "", errors.New("something went wrong")
+		proxy.logger.Printf("FetchUserPlan:UNMARSHAERPlan, %s", err.Error())
+		return planDetails{}, false, errors.New("something went wrong")
 	}
 
-	return strconv.Itoa(response.Data.RequestLimit), nil
+	var features []string
+	for feature, enabled := range response.Data.Features {
+		if enabled {
+			features = append(features, feature)
+		}
+	}
+	sort.Strings(features)
+	return planDetails{
+		limit:      strconv.Itoa(response.Data.RequestLimit),
+		features:   features,
+		batchLimit: response.Data.BatchRequestLimit,
+	}, false, nil
+}
+
+// userUrl build the plan url of the user on a copy of the request url, fetch is called concurrently
+func (proxy *PlanProxy) userUrl(userId string) string {
+	requestUrl := *proxy.requestUrl
+	if proxy.pathParam {
+		// the escaped id stays a single segment, a / or .. in a resolved subject can't rewrite the plan path
+		segments := strings.Split(requestUrl.Path, PlanPathPlaceholder)
+		for i, segment := range segments {
+			segments[i] = (&url.URL{Path: segment}).EscapedPath()
+		}
+		escaped := url.PathEscape(userId)
+		if userId == "." || userId == ".." {
+			// PathEscape leaves the dot segments the servers resolve
+			escaped = strings.ReplaceAll(userId, ".", "%2E")
+		}
+		requestUrl.RawPath = strings.Join(segments, escaped)
+		requestUrl.Path = strings.ReplaceAll(requestUrl.Path, PlanPathPlaceholder, userId)
+		return requestUrl.String()
+	}
+	queryParams := requestUrl.Query()
+	queryParams.Set(proxy.queryParam, userId)
+	requestUrl.RawQuery = queryParams.Encode()
+	return requestUrl.String()
 }
@@ -0,0 +1,211 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPlanProxyOutboundProxy(t *testing.T) {
+	// the outbound proxy answers the plan requests itself
+	plans, proxy := newPlanService(t, 42)
+	planProxy := NewPlanProxy("key", "http://plan.invalid/plans", proxy.URL, "", 0, 0, nil)
+
+	plan, err := planProxy.fetch(context.Background(), "user", "")
+	if err != nil {
+		t.Fatalf("failed to fetch the plan through the proxy: %s", err)
+	}
+	if plan.limit != "42" {
+		t.Errorf("expected the plan 42, got %s", plan.limit)
+	}
+	if plans.count() != 1 || plans.requests[0].URL.Host != "plan.invalid" {
+		t.Errorf("expected the plan request to go through the outbound proxy")
+	}
+}
+
+func TestPlanProxyForwardsAuthorization(t *testing.T) {
+	plans, proxy := newPlanService(t, 42)
+	server := newTestServer()
+	l := NewLimiter(Options{PlanAddress: proxy.URL, Window: 60})
+
+	ctx := WithAuthorization(context.Background(), "Bearer token")
+	if !limit(t, l, server, ctx, "service-account") {
+		t.Fatalf("expected the subject request to be allowed")
+	}
+	request := plans.requests[0]
+	if request.URL.Query().Get(DefaultPlanQueryParam) != "service-account" || request.Header.Get("Authorization") != "Bearer token" {
+		t.Errorf("expected the plan of the subject to be fetched with the token, got %s %q", request.URL, request.Header.Get("Authorization"))
+	}
+	if _, ok := server.Value("service-account"); !ok {
+		t.Errorf("expected the plan to be cached on the subject, got the keys %v", server.Keys(""))
+	}
+}
+
+func TestPlanProxyUserLocation(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		queryParam string
+		userId     string
+		requestURI string
+	}{
+		{"default query param", "/plans", "", "user", "/plans?userId=user"},
+		{"configured query param", "/plans", "account_id", "user", "/plans?account_id=user"},
+		{"existing query", "/plans?network=mainnet", "user", "user", "/plans?network=mainnet&user=user"},
+		{"escaped query", "/plans", "", "a&b=c", "/plans?userId=a%26b%3Dc"},
+		{"path placeholder", "/users/{userId}/plan", "account_id", "user", "/users/user/plan"},
+		{"escaped segment", "/users/{userId}/plan", "", "a/../b", "/users/a%2F..%2Fb/plan"},
+		{"dot segment", "/users/{userId}/plan", "", "..", "/users/%2E%2E/plan"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plans, server := newPlanService(t, 42)
+			planProxy := NewPlanProxy("key", server.URL+test.path, "", test.queryParam, 0, 0, nil)
+
+			if _, err := planProxy.fetch(context.Background(), test.userId, ""); err != nil {
+				t.Fatalf("failed to fetch the plan: %s", err)
+			}
+			if requestURI := plans.requests[0].RequestURI; requestURI != test.requestURI {
+				t.Errorf("expected the plan request %s, got %s", test.requestURI, requestURI)
+			}
+		})
+	}
+}
+
+func TestPlanProxyTransportError(t *testing.T) {
+	// the closed plan service refuses the connections, the transport error comes without a response
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	planProxy := NewPlanProxy("key", server.URL, "", "", 0, 0, nil)
+
+	_, err := planProxy.fetch(context.Background(), "user", "")
+	if !errors.Is(err, ErrPlanUnavailable) || !strings.Contains(err.Error(), strings.TrimPrefix(server.URL, "http://")) {
+		t.Errorf("expected ErrPlanUnavailable wrapping the transport error, got %v", err)
+	}
+
+	l := NewLimiter(Options{PlanAddress: server.URL, Window: 60})
+	client := newTestServer().Client()
+	defer client.Close()
+	if allowed, err := l.Limit(context.Background(), "user", client); allowed || !errors.Is(err, ErrPlanUnavailable) {
+		t.Errorf("expected the limit to fail with the plan service down, got %t %v", allowed, err)
+	}
+}
+
+// flakyPlanService fail the first failures plan requests with the status
+type flakyPlanService struct {
+	*planService
+	failures int32
+	status   int
+	calls    int32
+}
+
+func (p *flakyPlanService) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if atomic.AddInt32(&p.calls, 1) <= p.failures {
+		rw.WriteHeader(p.status)
+		return
+	}
+	p.planService.ServeHTTP(rw, req)
+}
+
+func TestPlanProxyRetries(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		retries int
+		timeout time.Duration
+		calls   int32
+		ok      bool
+	}{
+		{"recovers within the retries", http.StatusServiceUnavailable, 2, 0, 3, true},
+		{"out of retries", http.StatusInternalServerError, 1, 0, 2, false},
+		{"client error", http.StatusNotFound, 2, 0, 1, false},
+		{"backoff past the deadline", http.StatusBadGateway, 2, 5 * time.Millisecond, 1, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plans := &flakyPlanService{planService: &planService{limits: map[string]int{}, limit: 42}, failures: 2, status: test.status}
+			server := httptest.NewServer(plans)
+			t.Cleanup(server.Close)
+			planProxy := NewPlanProxy("key", server.URL, "", "", test.retries, 10*time.Millisecond, nil)
+			ctx := context.Background()
+			if test.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, test.timeout)
+				defer cancel()
+			}
+
+			plan, err := planProxy.fetch(ctx, "user", "")
+
+			if test.ok && (err != nil || plan.limit != "42") {
+				t.Errorf("expected the plan 42 after the retries, got %q %v", plan.limit, err)
+			}
+			if !test.ok && !errors.Is(err, ErrPlanUnavailable) {
+				t.Errorf("expected ErrPlanUnavailable, got %v", err)
+			}
+			if calls := atomic.LoadInt32(&plans.calls); calls != test.calls {
+				t.Errorf("expected %d plan requests, got %d", test.calls, calls)
+			}
+		})
+	}
+}
+
+func TestPlanProxyRetryBackoff(t *testing.T) {
+	plans := &flakyPlanService{planService: &planService{limits: map[string]int{}, limit: 42}, failures: 2, status: http.StatusServiceUnavailable}
+	server := httptest.NewServer(plans)
+	t.Cleanup(server.Close)
+	planProxy := NewPlanProxy("key", server.URL, "", "", 2, 20*time.Millisecond, nil)
+
+	start := time.Now()
+	if _, err := planProxy.fetch(context.Background(), "user", ""); err != nil {
+		t.Fatalf("failed to fetch the plan: %s", err)
+	}
+	// 20ms then 40ms
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Errorf("expected the retries to back off exponentially, took %s", elapsed)
+	}
+}
+
+func TestPlanProxyFetchCancelled(t *testing.T) {
+	plans, proxy := newPlanService(t, 42)
+	plans.delay = 500 * time.Millisecond
+	planProxy := NewPlanProxy("key", proxy.URL, "", "", 2, 0, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := planProxy.fetch(ctx, "user", "")
+
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("expected the cancelled fetch to return promptly, took %s", elapsed)
+	}
+	if !errors.Is(err, ErrPlanUnavailable) || !strings.Contains(err.Error(), context.Canceled.Error()) {
+		t.Errorf("expected the context error, got %v", err)
+	}
+	if plans.count() != 1 {
+		t.Errorf("expected the cancelled fetch not to be retried, got %d fetches", plans.count())
+	}
+}
+
+func TestLimitPlanFetchDeadline(t *testing.T) {
+	plans, proxy := newPlanService(t, 42)
+	plans.delay = 500 * time.Millisecond
+	server := newTestServer()
+	l := NewLimiter(Options{PlanAddress: proxy.URL, Window: 60})
+	client := server.Client()
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if allowed, err := l.Limit(ctx, "user", client); allowed || err == nil {
+		t.Errorf("expected the limit to fail once the request deadline passed, got %t %v", allowed, err)
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("expected the plan fetch to stop at the request deadline, took %s", elapsed)
+	}
+}
@@ -0,0 +1,61 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"github.com/kotalco/crossover-managed/metrics"
+	"github.com/kotalco/resp"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ZAddCmd             = "*4\r\n$4\r\nZADD\r\n$%d\r\n%s\r\n$%d\r\n%d\r\n$%d\r\n%s\r\n"
+	ZRemRangeByScoreCmd = "*4\r\n$16\r\nZREMRANGEBYSCORE\r\n$%d\r\n%s\r\n$4\r\n-inf\r\n$%d\r\n%d\r\n"
+	ZCardCmd            = "*2\r\n$5\r\nZCARD\r\n$%d\r\n%s\r\n"
+	CachedPlansKey      = "cached-plans" // sorted set of the users with a cached plan scored by the unix time it was stored at
+)
+
+var cachedPlans = metrics.NewGauge("crossover_limiter_cached_plans", "Number of user plans cached in redis, sampled periodically")
+
+// indexPlan record the user in the cached plans index, the redis client can't scan the plan keys
+// since it doesn't parse array replies so the count is kept alongside them
+func (l *limiter) indexPlan(ctx context.Context, respClint resp.IClient, userId string) {
+	if l.planSample <= 0 {
+		return
+	}
+	now := time.Now().Unix()
+	score := strconv.FormatInt(now, 10)
+	_, _ = respClint.Do(ctx, fmt.Sprintf(ZAddCmd, len(CachedPlansKey), CachedPlansKey, len(score), now, len(userId), userId))
+}
+
+// samplePlans count the cached plans at most once per sample interval, the plans past their ttl are pruned from the index first
+// it hints at an lru eviction policy once the count exceeds the configured max
+func (l *limiter) samplePlans(ctx context.Context, respClint resp.IClient) {
+	if l.planSample <= 0 {
+		return
+	}
+	now := time.Now()
+	last := atomic.LoadInt64(&l.planSampled)
+	if now.UnixNano()-last < int64(l.planSample) || !atomic.CompareAndSwapInt64(&l.planSampled, last, now.UnixNano()) {
+		return
+	}
+
+	if l.planTTL > 0 {
+		expired := now.Unix() - int64(l.planTTL)
+		_, _ = respClint.Do(ctx, fmt.Sprintf(ZRemRangeByScoreCmd, len(CachedPlansKey), CachedPlansKey, len(strconv.FormatInt(expired, 10)), expired))
+	}
+	reply, err := respClint.Do(ctx, fmt.Sprintf(ZCardCmd, len(CachedPlansKey), CachedPlansKey))
+	if err != nil {
+		return
+	}
+	var count int
+	if _, err := fmt.Sscanf(reply, ":%d", &count); err != nil {
+		return
+	}
+	cachedPlans.Set(float64(count))
+	if l.maxPlans > 0 && count > l.maxPlans {
+		l.logger.Printf("Cached plans %d exceed the max of %d, lower the plan cache ttl or configure redis with an lru maxmemory-policy", count, l.maxPlans)
+	}
+}
@@ -0,0 +1,66 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCachedPlansGauge(t *testing.T) {
+	_, proxy := newPlanService(t, 100)
+	server := newTestServer()
+	l := NewLimiter(Options{PlanAddress: proxy.URL, Window: 60, PlanSample: 60}).(*limiter)
+
+	for _, userId := range []string{"alice", "bob", "carol"} {
+		limit(t, l, server, context.Background(), userId)
+	}
+	// the plans fetched since are counted at the next sample only
+	if cachedPlans.Value() != 1 {
+		t.Errorf("expected the first sample to count 1 plan, got %v", cachedPlans.Value())
+	}
+
+	l.planSampled = 0
+	limit(t, l, server, context.Background(), "alice")
+	if cachedPlans.Value() != 3 {
+		t.Errorf("expected the gauge to count the 3 cached plans, got %v", cachedPlans.Value())
+	}
+}
+
+func TestCachedPlansGaugePrunesExpired(t *testing.T) {
+	_, proxy := newPlanService(t, 100)
+	server := newTestServer()
+	l := NewLimiter(Options{PlanAddress: proxy.URL, Window: 60, PlanSample: 60, PlanCacheTTL: 60}).(*limiter)
+	client := server.Client()
+	defer client.Close()
+
+	// a plan indexed before the plan cache ttl has expired in redis
+	stored := time.Now().Add(-2 * time.Minute).Unix()
+	score := strconv.FormatInt(stored, 10)
+	if _, err := client.Do(context.Background(), fmt.Sprintf(ZAddCmd, len(CachedPlansKey), CachedPlansKey, len(score), stored, len("gone"), "gone")); err != nil {
+		t.Fatalf("failed to index the expired plan: %s", err)
+	}
+
+	limit(t, l, server, context.Background(), "alice")
+	if cachedPlans.Value() != 1 {
+		t.Errorf("expected the expired plan to be pruned from the count, got %v", cachedPlans.Value())
+	}
+	if ttl := server.TTL("alice"); ttl != 60 {
+		t.Errorf("expected the plan to be cached with the plan cache ttl, got %d", ttl)
+	}
+}
+
+func TestCachedPlansGaugeDisabled(t *testing.T) {
+	_, proxy := newPlanService(t, 100)
+	server := newTestServer()
+	l := NewLimiter(Options{PlanAddress: proxy.URL, Window: 60})
+
+	limit(t, l, server, context.Background(), "alice")
+	if count := server.Count("ZADD") + server.Count("ZCARD"); count != 0 {
+		t.Errorf("expected no index without a sample interval, got %d commands", count)
+	}
+	if ttl := server.TTL("alice"); ttl != -1 {
+		t.Errorf("expected the plan to be kept without a plan cache ttl, got %d", ttl)
+	}
+}
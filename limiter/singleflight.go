@@ -0,0 +1,65 @@
+package limiter
+
+import (
+	"context"
+	"sync"
+)
+
+// call an in-flight or completed fetch shared by the callers of the same key
+type call struct {
+	done     chan struct{}
+	value    planDetails
+	fetched  bool
+	err      error
+	stored   sync.Once
+	storeErr error
+}
+
+// singleflight deduplicate concurrent plan fetches of the same user, results are only shared while the fetch is in-flight
+// so errors are never cached beyond the callers waiting on them
+type singleflight struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+func newSingleflight() *singleflight {
+	return &singleflight{calls: map[string]*call{}}
+}
+
+// do execute fetch once for all the concurrent callers of key and store its result once, by the first caller receiving it
+// the fetch runs in the background so each caller returns once its own ctx is done, fetch must not depend on the ctx of
+// any caller. fetched false skips the store
+func (g *singleflight) do(ctx context.Context, key string, fetch func() (value planDetails, fetched bool, err error), store func(value planDetails) error) (planDetails, error) {
+	g.mu.Lock()
+	c, ok := g.calls[key]
+	if !ok {
+		c = &call{done: make(chan struct{})}
+		g.calls[key] = c
+		go func() {
+			c.value, c.fetched, c.err = fetch()
+			g.mu.Lock()
+			delete(g.calls, key)
+			g.mu.Unlock()
+			close(c.done)
+		}()
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		return planDetails{}, ctx.Err()
+	}
+	if c.err != nil {
+		return planDetails{}, c.err
+	}
+	if c.fetched {
+		c.stored.Do(func() {
+			c.storeErr = store(c.value)
+		})
+		if c.storeErr != nil {
+			return planDetails{}, c.storeErr
+		}
+	}
+	return c.value, nil
+}
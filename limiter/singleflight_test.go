@@ -0,0 +1,134 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestColdUserFetchesPlanOnce(t *testing.T) {
+	plans, proxy := newPlanService(t, 100)
+	plans.delay = 50 * time.Millisecond
+	server := newTestServer()
+	l := NewLimiter(Options{PlanAddress: proxy.URL, Window: 60})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client := server.Client()
+			defer client.Close()
+			if _, err := l.Limit(context.Background(), "user", client); err != nil {
+				t.Errorf("unexpected limit error: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if plans.count() != 1 {
+		t.Errorf("expected the concurrent requests of a cold user to share a single plan fetch, got %d", plans.count())
+	}
+}
+
+func TestSingleflightDoesNotCacheErrors(t *testing.T) {
+	plans, proxy := newPlanService(t, 100)
+	plans.status = 500
+	server := newTestServer()
+	l := NewLimiter(Options{PlanAddress: proxy.URL, Window: 60})
+	ctx := context.Background()
+
+	client := server.Client()
+	defer client.Close()
+	if _, err := l.Limit(ctx, "user", client); err == nil {
+		t.Fatalf("expected the failed plan fetch to fail the request")
+	}
+	plans.mu.Lock()
+	plans.status = 0
+	plans.mu.Unlock()
+	if !limit(t, l, server, ctx, "user") {
+		t.Errorf("expected the request after the plan service recovered to be allowed")
+	}
+	if plans.count() != 2 {
+		t.Errorf("expected the failed fetch not to be shared with the later request, got %d fetches", plans.count())
+	}
+}
+
+func TestColdUserPlanPartsFetchedOnce(t *testing.T) {
+	plans, proxy := newPlanService(t, 100)
+	plans.delay = 50 * time.Millisecond
+	plans.batch = 10
+	plans.features = map[string]bool{"archive": true}
+	server := newTestServer()
+	l := NewLimiter(Options{PlanAddress: proxy.URL, Window: 60})
+
+	// the plan, its features and its batch limit are derived from the same fetch
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			client := server.Client()
+			defer client.Close()
+			if _, err := l.Limit(context.Background(), "user", client); err != nil {
+				t.Errorf("unexpected limit error: %s", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			client := server.Client()
+			defer client.Close()
+			if _, err := l.Limit(WithBatch(context.Background()), "user", client); err != nil {
+				t.Errorf("unexpected batch limit error: %s", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			client := server.Client()
+			defer client.Close()
+			if features, err := l.Features(context.Background(), "user", client); err != nil || !features["archive"] {
+				t.Errorf("expected the plan features, got %v %v", features, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if plans.count() != 1 {
+		t.Errorf("expected a cold user to be fetched once for all the parts of the plan, got %d", plans.count())
+	}
+}
+
+func TestCancelledCallerDoesNotFailWaiters(t *testing.T) {
+	plans, proxy := newPlanService(t, 100)
+	plans.delay = 100 * time.Millisecond
+	server := newTestServer()
+	l := NewLimiter(Options{PlanAddress: proxy.URL, Window: 60})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		client := server.Client()
+		defer client.Close()
+		_, err := l.Limit(ctx, "user", client)
+		first <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	client := server.Client()
+	defer client.Close()
+	if allowed, err := l.Limit(context.Background(), "user", client); !allowed || err != nil {
+		t.Errorf("expected the waiting request to get the shared plan, got %t %v", allowed, err)
+	}
+	if err := <-first; !errors.Is(err, ErrPlanUnavailable) {
+		t.Errorf("expected the cancelled request to give up, got %v", err)
+	}
+	if plans.count() != 1 {
+		t.Errorf("expected the cancelled request to keep the fetch shared, got %d fetches", plans.count())
+	}
+	if plan, _ := server.Value("user"); plan != "100" {
+		t.Errorf("expected the shared plan to be cached, got %q", plan)
+	}
+}
@@ -0,0 +1,121 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"github.com/kotalco/resp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// algorithms counting the user requests against the plan limit
+const (
+	WindowFixed   = "fixed"   // a counter reset every window, a burst across a boundary may reach twice the limit
+	WindowSliding = "sliding" // bucketed counters summed over the last window, the limit holds within any rolling window
+)
+
+// SlidingBuckets number of buckets a sliding window is split into, the window effectively spans one more bucket
+// since the oldest one still counts until it's entirely out of the window
+const SlidingBuckets = 10
+
+// slidingScript return the sum of the window buckets plus the ARGV[1] requests and count them on the current bucket,
+// the request exceeding the ARGV[3] limit isn't counted so a client retrying a throttled request isn't starved
+// the buckets are given most recent first and expire after ARGV[2] seconds
+const slidingScript = `local count = tonumber(ARGV[1])
+for i = 1, #KEYS do
+	count = count + (tonumber(redis.call('GET', KEYS[i])) or 0)
+end
+local increment = tonumber(ARGV[1])
+if count > tonumber(ARGV[3]) then
+	increment = increment - 1
+end
+if increment > 0 then
+	redis.call('INCRBY', KEYS[1], increment)
+	if redis.call('TTL', KEYS[1]) == -1 then
+		redis.call('EXPIRE', KEYS[1], ARGV[2])
+	end
+end
+return count`
+
+// slidingRefundScript decrement the current bucket while the window counts requests, a sum going below zero would
+// grant the user extra quota, and expire the bucket after ARGV[1] seconds if the decrement created it, in one step so
+// the bucket is never left without expiry. The buckets are given most recent first
+const slidingRefundScript = `local count = 0
+for i = 1, #KEYS do
+	count = count + (tonumber(redis.call('GET', KEYS[i])) or 0)
+end
+if count <= 0 then
+	return 0
+end
+if redis.call('DECR', KEYS[1]) == -1 then
+	redis.call('EXPIRE', KEYS[1], ARGV[1])
+end
+return count - 1`
+
+// bucketSize return the duration covered by a bucket of the sliding window
+func (l *limiter) bucketSize() time.Duration {
+	return time.Duration(l.window) * time.Second / SlidingBuckets
+}
+
+// bucketKey return the counter key of the bucket at index
+func bucketKey(userId string, index int64) string {
+	return fmt.Sprintf("%s%s:%d", userId, UserRateKeySuffix, index)
+}
+
+// bucketKeys return the keys of the current bucket and the previous SlidingBuckets ones, most recent first
+func (l *limiter) bucketKeys(userId string) []string {
+	current := time.Now().UnixNano() / int64(l.bucketSize())
+	keys := make([]string, 0, SlidingBuckets+1)
+	for index := current; index >= current-SlidingBuckets; index-- {
+		keys = append(keys, bucketKey(userId, index))
+	}
+	return keys
+}
+
+// allowSliding return the number of requests made in the current bucket and the previous SlidingBuckets ones including
+// the increment ones, they're counted unless the last exceeds the limit, the buckets are indexed by the clock of the instance
+func (l *limiter) allowSliding(ctx context.Context, respClint resp.IClient, userId string, increment int, limit int) (int, error) {
+	args := append([]string{"EVAL", slidingScript, strconv.Itoa(SlidingBuckets + 1)}, l.bucketKeys(userId)...)
+	// twice the window outlives the SlidingBuckets+1 buckets the sum covers
+	args = append(args, strconv.Itoa(increment), strconv.Itoa(2*l.window), strconv.Itoa(limit))
+
+	reply, err := respClint.Do(ctx, command(args...))
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrRedisUnavailable, err.Error())
+	}
+	var count int
+	if _, err := fmt.Sscanf(reply, ":%d", &count); err != nil {
+		return 0, fmt.Errorf("%w: eval: unexpected response from server %s", ErrRedisUnavailable, reply)
+	}
+	return count, nil
+}
+
+// refundSliding decrement the current bucket of the user while its window counts requests, the bucket may go
+// negative to offset a request counted in an earlier bucket of the window
+func (l *limiter) refundSliding(ctx context.Context, respClint resp.IClient, userId string) error {
+	args := append([]string{"EVAL", slidingRefundScript, strconv.Itoa(SlidingBuckets + 1)}, l.bucketKeys(userId)...)
+	_, err := respClint.Do(ctx, command(append(args, strconv.Itoa(2*l.window))...))
+	return err
+}
+
+// slidingResetSeconds return the seconds until the oldest bucket leaves the window, at least 1
+func (l *limiter) slidingResetSeconds() int {
+	size := l.bucketSize()
+	remaining := size - time.Duration(time.Now().UnixNano()%int64(size))
+	seconds := int((remaining + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		return 1
+	}
+	return seconds
+}
+
+// command encode the arguments as a redis command
+func command(args ...string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return b.String()
+}
@@ -0,0 +1,106 @@
+package limiter
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSlidingWindowNeverExceeded(t *testing.T) {
+	const plan = 10
+	_, plans := newPlanService(t, plan)
+	server := newTestServer()
+	l := NewLimiter(Options{PlanAddress: plans.URL, Window: 1, WindowMode: WindowSliding})
+	ctx := context.Background()
+
+	// open the window then burst from its end across the boundary, a fixed window would allow twice the plan there
+	allowed := []time.Time{time.Now()}
+	limit(t, l, server, ctx, "user")
+	time.Sleep(900 * time.Millisecond)
+	for end := time.Now().Add(1500 * time.Millisecond); time.Now().Before(end); time.Sleep(5 * time.Millisecond) {
+		start := time.Now()
+		if limit(t, l, server, ctx, "user") {
+			allowed = append(allowed, start)
+		}
+	}
+
+	// the buckets are stamped a bit after the request started, leave some slack to the rolling window
+	window := time.Second - 50*time.Millisecond
+	for i := range allowed {
+		count := 0
+		for j := i; j < len(allowed) && allowed[j].Sub(allowed[i]) < window; j++ {
+			count++
+		}
+		if count > plan {
+			t.Fatalf("expected at most %d requests within any rolling window, got %d from %s", plan, count, allowed[i].Format(time.StampMilli))
+		}
+	}
+	if len(allowed) <= plan {
+		t.Errorf("expected the plan to be granted again as the window slides, got %d allowed requests", len(allowed))
+	}
+}
+
+func TestSlidingRefund(t *testing.T) {
+	_, plans := newPlanService(t, 1)
+	server := newTestServer()
+	l := NewLimiter(Options{PlanAddress: plans.URL, Window: 60, WindowMode: WindowSliding})
+	ctx := context.Background()
+
+	limit(t, l, server, ctx, "user")
+	if limit(t, l, server, ctx, "user") {
+		t.Fatalf("expected the plan of a single request to be exhausted")
+	}
+	if err := l.Refund(ctx, "user", server.Client()); err != nil {
+		t.Fatalf("failed to refund: %s", err)
+	}
+	if !limit(t, l, server, ctx, "user") {
+		t.Errorf("expected the refunded request to be granted again")
+	}
+}
+
+func TestSlidingRefundExpires(t *testing.T) {
+	_, plans := newPlanService(t, 10)
+	server := newTestServer()
+	l := NewLimiter(Options{PlanAddress: plans.URL, Window: 1, WindowMode: WindowSliding})
+	ctx := context.Background()
+
+	// the refund of a request counted in an earlier bucket creates the current one
+	limit(t, l, server, ctx, "user")
+	time.Sleep(l.(*limiter).bucketSize())
+	if err := l.Refund(ctx, "user", server.Client()); err != nil {
+		t.Fatalf("failed to refund: %s", err)
+	}
+	keys := server.Keys("user" + UserRateKeySuffix)
+	if len(keys) != 2 {
+		t.Fatalf("expected the refund to create the current bucket, got %v", keys)
+	}
+	for _, key := range keys {
+		if ttl := server.TTL(key); ttl != 2 {
+			t.Errorf("expected the bucket %s to expire after twice the window, got the ttl %d", key, ttl)
+		}
+	}
+}
+
+func TestSlidingRefundNeverBelowZero(t *testing.T) {
+	_, plans := newPlanService(t, 2)
+	server := newTestServer()
+	l := NewLimiter(Options{PlanAddress: plans.URL, Window: 60, WindowMode: WindowSliding})
+	ctx := context.Background()
+
+	limit(t, l, server, ctx, "user")
+	for i := 0; i < 3; i++ {
+		if err := l.Refund(ctx, "user", server.Client()); err != nil {
+			t.Fatalf("failed to refund: %s", err)
+		}
+	}
+	// the extra refunds must not grant more than the plan
+	allowed := 0
+	for i := 0; i < 4; i++ {
+		if limit(t, l, server, ctx, "user") {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Errorf("expected the plan of 2 requests to hold after the refunds, got %d allowed", allowed)
+	}
+}
@@ -0,0 +1,78 @@
+package limiter
+
+import (
+	"sync"
+	"time"
+)
+
+// MaxSmoothedUsers bound the number of users tracked by the smoother
+const MaxSmoothedUsers = 100000
+
+// smoother keep a short-lived local estimate of the user rate counters so hot users only consult redis
+// every batch requests or interval, the others are decided locally
+// the estimate trades exactness for redis load: each instance may admit up to batch-1 requests over the
+// limit before it syncs with the other instances
+type smoother struct {
+	mu       sync.Mutex
+	users    map[string]*estimate
+	batch    int
+	interval time.Duration
+}
+
+type estimate struct {
+	count   int // counter returned by redis on the last sync
+	pending int // requests admitted locally since the last sync
+	plan    int
+	synced  time.Time
+}
+
+func newSmoother(batch int, interval time.Duration) *smoother {
+	return &smoother{
+		users:    map[string]*estimate{},
+		batch:    batch,
+		interval: interval,
+	}
+}
+
+// take decide the request locally, decided is false when the estimate is stale and redis must be consulted
+func (s *smoother) take(userId string) (allowed bool, plan int, decided bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.users[userId]
+	if !ok || time.Since(e.synced) >= s.interval || e.pending+1 >= s.batch {
+		return false, 0, false
+	}
+	if e.count+e.pending+1 > e.plan {
+		return false, e.plan, true
+	}
+	e.pending++
+	return true, e.plan, true
+}
+
+// drain return the number of locally admitted requests to push to redis along with the current one
+func (s *smoother) drain(userId string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.users[userId]
+	if !ok {
+		return 1
+	}
+	pending := e.pending
+	e.pending = 0
+	return pending + 1
+}
+
+// sync record the redis counter and plan of the user
+func (s *smoother) sync(userId string, count int, plan int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if _, ok := s.users[userId]; !ok && len(s.users) >= MaxSmoothedUsers {
+		for id, e := range s.users {
+			if now.Sub(e.synced) >= s.interval {
+				delete(s.users, id)
+			}
+		}
+	}
+	s.users[userId] = &estimate{count: count, plan: plan, synced: now}
+}
@@ -0,0 +1,44 @@
+package limiter
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSmoothingConsultsRedisLess(t *testing.T) {
+	_, plans := newPlanService(t, 1000)
+	server := newTestServer()
+	l := NewLimiter(Options{PlanAddress: plans.URL, Window: 60, SmoothingBatch: 10, SmoothingInterval: 60000})
+	ctx := context.Background()
+
+	for i := 0; i < 50; i++ {
+		if !limit(t, l, server, ctx, "user") {
+			t.Fatalf("expected the request %d within the plan to be allowed", i+1)
+		}
+	}
+
+	if increments := server.Count("INCR") + server.Count("INCRBY"); increments != 5 {
+		t.Errorf("expected redis to be consulted every 10 requests, got %d increments", increments)
+	}
+	// the locally admitted requests are pushed to redis on the next sync
+	if count := counter(server, "user"); count != 41 {
+		t.Errorf("expected the redis counter to include the drained requests, got %d", count)
+	}
+}
+
+func TestSmoothingBoundsOveradmission(t *testing.T) {
+	_, plans := newPlanService(t, 20)
+	server := newTestServer()
+	l := NewLimiter(Options{PlanAddress: plans.URL, Window: 60, SmoothingBatch: 5, SmoothingInterval: 60000})
+	ctx := context.Background()
+
+	allowed := 0
+	for i := 0; i < 40; i++ {
+		if limit(t, l, server, ctx, "user") {
+			allowed++
+		}
+	}
+	if allowed < 20 || allowed > 20+5-1 {
+		t.Errorf("expected at most batch-1 requests over the plan of 20, got %d allowed", allowed)
+	}
+}
@@ -0,0 +1,67 @@
+package logger
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// MaxThrottledMessages bound the number of distinct messages tracked by the throttle
+const MaxThrottledMessages = 1000
+
+// Logger throttle the repeated messages of a plugin instance, each instance has its own so one doesn't silence another
+// a nil Logger logs every message
+type Logger struct {
+	mu       sync.Mutex
+	interval time.Duration
+	messages map[string]*throttled
+}
+
+// throttled the state of a message within its window
+type throttled struct {
+	logged     time.Time
+	suppressed int
+}
+
+// New create a logger logging each message at most once per interval, 0 disables the throttle
+func New(interval time.Duration) *Logger {
+	return &Logger{interval: interval, messages: map[string]*throttled{}}
+}
+
+// Printf log the message unless the same one was already logged within the interval
+// messages are deduplicated once formatted so the ones only differing by their arguments (user ids, errors) are logged apart,
+// the number of suppressed messages is reported when the message is logged again after its window rolls
+func (l *Logger) Printf(format string, v ...interface{}) {
+	text := fmt.Sprintf(format, v...)
+	if l == nil || l.interval <= 0 {
+		log.Print(text)
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	message, ok := l.messages[text]
+	if ok && now.Sub(message.logged) < l.interval {
+		message.suppressed++
+		l.mu.Unlock()
+		return
+	}
+	suppressed := 0
+	if ok {
+		suppressed = message.suppressed
+	} else if len(l.messages) >= MaxThrottledMessages {
+		for key, message := range l.messages {
+			if now.Sub(message.logged) >= l.interval {
+				delete(l.messages, key)
+			}
+		}
+	}
+	l.messages[text] = &throttled{logged: now}
+	l.mu.Unlock()
+
+	if suppressed > 0 {
+		log.Printf("%s (suppressed %d identical messages)", text, suppressed)
+		return
+	}
+	log.Print(text)
+}
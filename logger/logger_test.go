@@ -0,0 +1,83 @@
+package logger
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// capture redirect the standard logger to a buffer until the test ends
+func capture(t *testing.T) *bytes.Buffer {
+	var buffer bytes.Buffer
+	flags := log.Flags()
+	log.SetOutput(&buffer)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(flags)
+	})
+	return &buffer
+}
+
+func lines(buffer *bytes.Buffer) []string {
+	return strings.Split(strings.TrimSpace(buffer.String()), "\n")
+}
+
+func TestPrintfThrottled(t *testing.T) {
+	buffer := capture(t)
+	logger := New(50 * time.Millisecond)
+
+	for i := 0; i < 10; i++ {
+		logger.Printf("Redis failed: %s", "connection refused")
+	}
+	logger.Printf("Redis failed: %s", "i/o timeout")
+	if logged := lines(buffer); len(logged) != 2 || logged[0] != "Redis failed: connection refused" || logged[1] != "Redis failed: i/o timeout" {
+		t.Fatalf("expected each message to be logged once per interval, got %q", logged)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	buffer.Reset()
+	logger.Printf("Redis failed: %s", "connection refused")
+	if logged := lines(buffer); len(logged) != 1 || logged[0] != "Redis failed: connection refused (suppressed 9 identical messages)" {
+		t.Errorf("expected the suppressed count once the window rolled, got %q", logged)
+	}
+}
+
+func TestPrintfDistinctArguments(t *testing.T) {
+	buffer := capture(t)
+	logger := New(time.Minute)
+
+	// the messages sharing a format aren't merged, e.g. the config warnings of different instances
+	for i := 0; i < 3; i++ {
+		logger.Printf("Plan service failed for user %d", i)
+	}
+	if logged := lines(buffer); len(logged) != 3 {
+		t.Errorf("expected the distinct messages to be logged apart, got %q", logged)
+	}
+}
+
+func TestPrintfPerInstance(t *testing.T) {
+	buffer := capture(t)
+	first, second := New(time.Minute), New(0)
+
+	first.Printf("Suspicious config: %s", "cacheExpiry is 0")
+	second.Printf("Suspicious config: %s", "cacheExpiry is 0")
+	second.Printf("Suspicious config: %s", "cacheExpiry is 0")
+	if logged := lines(buffer); len(logged) != 3 {
+		t.Errorf("expected each instance to throttle with its own interval, got %q", logged)
+	}
+}
+
+func TestPrintfUnthrottled(t *testing.T) {
+	buffer := capture(t)
+
+	for _, logger := range []*Logger{New(0), nil} {
+		logger.Printf("Redis failed: %s", "connection refused")
+	}
+	if logged := lines(buffer); len(logged) != 2 {
+		t.Errorf("expected every message to be logged without the throttle, got %q", logged)
+	}
+}
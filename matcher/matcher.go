@@ -0,0 +1,101 @@
+package matcher
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// PrefixWildcard when used as the last segment of a pattern it matches any remaining path segments
+const PrefixWildcard = "**"
+
+// Matcher match request paths against a set of patterns compiled once
+// a pattern is either an exact path (/v1/health), a glob where each segment is matched using path.Match (/v1/users/*/health)
+// or a prefix ending with /** (/v1/admin/**)
+type Matcher struct {
+	patterns []pattern
+}
+
+type pattern struct {
+	raw      string
+	segments []string
+	exact    bool
+	prefix   bool
+	literals int
+}
+
+// New compile the patterns, it returns an error if any of them is malformed
+func New(patterns []string) (*Matcher, error) {
+	m := &Matcher{}
+	for _, raw := range patterns {
+		if raw == "" {
+			continue
+		}
+		p := pattern{
+			raw:      raw,
+			segments: strings.Split(strings.Trim(raw, "/"), "/"),
+			exact:    !strings.ContainsAny(raw, "*?["),
+		}
+		if last := len(p.segments) - 1; p.segments[last] == PrefixWildcard {
+			p.prefix = true
+			p.segments = p.segments[:last]
+		}
+		for _, segment := range p.segments {
+			if _, err := path.Match(segment, ""); err != nil {
+				return nil, fmt.Errorf("invalid path pattern %s: %s", raw, err.Error())
+			}
+			p.literals += len(strings.Trim(segment, "*?"))
+		}
+		m.patterns = append(m.patterns, p)
+	}
+	return m, nil
+}
+
+// Match return the pattern matching the path
+// when multiple patterns match, an exact pattern wins, then the most specific one (most literal characters), then the first declared
+func (m *Matcher) Match(urlPath string) (string, bool) {
+	if m == nil || len(m.patterns) == 0 {
+		return "", false
+	}
+	segments := strings.Split(strings.Trim(urlPath, "/"), "/")
+
+	var best *pattern
+	for i := range m.patterns {
+		p := &m.patterns[i]
+		if !p.match(urlPath, segments) {
+			continue
+		}
+		if best == nil || p.precedes(best) {
+			best = p
+		}
+	}
+	if best == nil {
+		return "", false
+	}
+	return best.raw, true
+}
+
+func (p *pattern) match(urlPath string, segments []string) bool {
+	if p.exact && !p.prefix {
+		return strings.Trim(p.raw, "/") == strings.Trim(urlPath, "/")
+	}
+	if len(segments) < len(p.segments) || (!p.prefix && len(segments) != len(p.segments)) {
+		return false
+	}
+	for i, segment := range p.segments {
+		if ok, _ := path.Match(segment, segments[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *pattern) precedes(other *pattern) bool {
+	if p.exact != other.exact {
+		return p.exact
+	}
+	if p.prefix != other.prefix {
+		return !p.prefix
+	}
+	return p.literals > other.literals
+}
@@ -0,0 +1,84 @@
+package matcher
+
+import (
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	m, err := New([]string{
+		"/v1/admin/**",
+		"/v1/users/*/health",
+		"/v1/users/me/health",
+		"/v1/*/health",
+		"/v1/users/*",
+		"/v1/admin/stats",
+	})
+	if err != nil {
+		t.Fatalf("failed to compile the patterns: %s", err)
+	}
+	tests := []struct {
+		path    string
+		pattern string
+		ok      bool
+	}{
+		// exact
+		{"/v1/admin/stats", "/v1/admin/stats", true},
+		{"/v1/users/me/health", "/v1/users/me/health", true},
+		{"v1/users/me/health/", "/v1/users/me/health", true},
+		// wildcard, the most literal one wins
+		{"/v1/users/42/health", "/v1/users/*/health", true},
+		{"/v1/blocks/health", "/v1/*/health", true},
+		{"/v1/users/42", "/v1/users/*", true},
+		// a wildcard matches a single segment
+		{"/v1/users/42/balance", "", false},
+		// prefix
+		{"/v1/admin", "/v1/admin/**", true},
+		{"/v1/admin/users/42", "/v1/admin/**", true},
+		{"/v2/admin/stats", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			pattern, ok := m.Match(test.path)
+			if pattern != test.pattern || ok != test.ok {
+				t.Errorf("expected %q %t, got %q %t", test.pattern, test.ok, pattern, ok)
+			}
+		})
+	}
+}
+
+func TestMatchPrecedence(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		path     string
+		pattern  string
+	}{
+		{"exact over wildcard", []string{"/a/*", "/a/b"}, "/a/b", "/a/b"},
+		{"wildcard over prefix", []string{"/a/**", "/a/*"}, "/a/b", "/a/*"},
+		{"first declared on a tie", []string{"/a/*/c", "/a/b*/*"}, "/a/b/c", "/a/*/c"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, err := New(test.patterns)
+			if err != nil {
+				t.Fatalf("failed to compile the patterns: %s", err)
+			}
+			if pattern, _ := m.Match(test.path); pattern != test.pattern {
+				t.Errorf("expected %q, got %q", test.pattern, pattern)
+			}
+		})
+	}
+}
+
+func TestNewInvalidPattern(t *testing.T) {
+	if _, err := New([]string{"/v1/[users"}); err == nil {
+		t.Errorf("expected the malformed pattern to be rejected")
+	}
+}
+
+func TestMatchNil(t *testing.T) {
+	var m *Matcher
+	if _, ok := m.Match("/v1"); ok {
+		t.Errorf("expected a nil matcher to match nothing")
+	}
+}
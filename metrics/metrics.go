@@ -0,0 +1,233 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBuckets histogram buckets used when none are provided
+var DefaultBuckets = []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000}
+
+var registry = struct {
+	mu      sync.Mutex
+	metrics map[string]*described
+}{metrics: map[string]*described{}}
+
+type metric interface {
+	write(w io.Writer, name string, openMetrics bool)
+}
+
+// register add the metric to the registry, the first registered metric wins if the name is reused
+func register(name string, help string, kind string, m metric) metric {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if existing, ok := registry.metrics[name]; ok {
+		return existing.metric
+	}
+	registry.metrics[name] = &described{help: help, kind: kind, metric: m}
+	return m
+}
+
+type described struct {
+	help   string
+	kind   string
+	metric metric
+}
+
+func (d *described) write(w io.Writer, name string, openMetrics bool) {
+	family := name
+	if openMetrics && d.kind == "counter" {
+		// openmetrics counter families are named without the _total suffix of their samples
+		family = strings.TrimSuffix(name, "_total")
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", family, d.help, family, d.kind)
+	d.metric.write(w, name, openMetrics)
+}
+
+// Counter a monotonically increasing value
+type Counter struct {
+	value uint64
+}
+
+// NewCounter create and register a counter
+func NewCounter(name string, help string) *Counter {
+	c := &Counter{}
+	if existing, ok := register(name, help, "counter", c).(*Counter); ok {
+		return existing
+	}
+	return c
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+func (c *Counter) write(w io.Writer, name string, openMetrics bool) {
+	if openMetrics && !strings.HasSuffix(name, "_total") {
+		name += "_total"
+	}
+	fmt.Fprintf(w, "%s %d\n", name, c.Value())
+}
+
+// Gauge a value that can go up and down
+type Gauge struct {
+	bits uint64
+}
+
+// NewGauge create and register a gauge
+func NewGauge(name string, help string) *Gauge {
+	g := &Gauge{}
+	if existing, ok := register(name, help, "gauge", g).(*Gauge); ok {
+		return existing
+	}
+	return g
+}
+
+func (g *Gauge) Set(value float64) {
+	atomic.StoreUint64(&g.bits, math.Float64bits(value))
+}
+
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+func (g *Gauge) write(w io.Writer, name string, openMetrics bool) {
+	fmt.Fprintf(w, "%s %s\n", name, strconv.FormatFloat(g.Value(), 'g', -1, 64))
+}
+
+// Histogram count observations in cumulative buckets
+type Histogram struct {
+	mu        sync.Mutex
+	buckets   []float64
+	counts    []uint64
+	sum       float64
+	count     uint64
+	exemplars []*exemplar // last exemplar of each bucket and +Inf, only exposed in the openmetrics format
+}
+
+// exemplar an observation linked to the trace it was made in
+type exemplar struct {
+	traceID   string
+	value     float64
+	timestamp time.Time
+}
+
+// NewHistogram create and register a histogram, DefaultBuckets are used if buckets is empty
+func NewHistogram(name string, help string, buckets []float64) *Histogram {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	h := &Histogram{
+		buckets:   buckets,
+		counts:    make([]uint64, len(buckets)),
+		exemplars: make([]*exemplar, len(buckets)+1),
+	}
+	if existing, ok := register(name, help, "histogram", h).(*Histogram); ok {
+		return existing
+	}
+	return h
+}
+
+func (h *Histogram) Observe(value float64) {
+	h.ObserveWithExemplar(value, "")
+}
+
+// ObserveWithExemplar observe the value and attach the trace id as the exemplar of its bucket, an empty trace id only observes the value
+func (h *Histogram) ObserveWithExemplar(value float64, traceID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	bucket := len(h.buckets)
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+			if i < bucket {
+				bucket = i
+			}
+		}
+	}
+	h.sum += value
+	h.count++
+	if traceID != "" {
+		h.exemplars[bucket] = &exemplar{traceID: traceID, value: value, timestamp: time.Now()}
+	}
+}
+
+// Count return the number of observations
+func (h *Histogram) Count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+// Sum return the sum of the observations
+func (h *Histogram) Sum() float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.sum
+}
+
+func (h *Histogram) write(w io.Writer, name string, openMetrics bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d%s\n", name, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i], h.exemplar(i, openMetrics))
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d%s\n", name, h.count, h.exemplar(len(h.buckets), openMetrics))
+	fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+// exemplar format the exemplar of the bucket, exemplars are only part of the openmetrics format
+func (h *Histogram) exemplar(bucket int, openMetrics bool) string {
+	e := h.exemplars[bucket]
+	if !openMetrics || e == nil {
+		return ""
+	}
+	timestamp := float64(e.timestamp.UnixNano()) / float64(time.Second)
+	return fmt.Sprintf(" # {trace_id=\"%s\"} %s %s", e.traceID, strconv.FormatFloat(e.value, 'g', -1, 64), strconv.FormatFloat(timestamp, 'f', 3, 64))
+}
+
+// WriteText write all the registered metrics in the prometheus text exposition format
+func WriteText(w io.Writer) {
+	write(w, false)
+}
+
+// WriteOpenMetrics write all the registered metrics in the openmetrics text format, including the histogram exemplars
+func WriteOpenMetrics(w io.Writer) {
+	write(w, true)
+	fmt.Fprint(w, "# EOF\n")
+}
+
+func write(w io.Writer, openMetrics bool) {
+	registry.mu.Lock()
+	names := make([]string, 0, len(registry.metrics))
+	for name := range registry.metrics {
+		names = append(names, name)
+	}
+	registry.mu.Unlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		registry.mu.Lock()
+		m := registry.metrics[name]
+		registry.mu.Unlock()
+		m.write(w, name, openMetrics)
+	}
+}
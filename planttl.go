@@ -0,0 +1,71 @@
+package crossover_managed
+
+import (
+	"fmt"
+	"github.com/kotalco/crossover-managed/cache"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ResolveCacheTTL return the cache ttl in seconds of the request of a user on the plan limit, 0 keeps the default ttl
+type ResolveCacheTTL func(req *http.Request, userId string, plan int) int
+
+// WithCacheTTLResolver resolve the cache ttl of every request from the user plan, it takes precedence over the CachePlanTTLs
+func WithCacheTTLResolver(resolveCacheTTL ResolveCacheTTL) Option {
+	return func(crossover *Crossover) {
+		crossover.resolveCacheTTL = resolveCacheTTL
+	}
+}
+
+// planTTL the cache ttl of the plans with a limit of at least minLimit
+type planTTL struct {
+	minLimit int
+	ttl      int
+}
+
+// parsePlanTTLs parse the minLimit=ttl entries, sorted by decreasing minLimit so the first match is the highest tier
+func parsePlanTTLs(entries []string) ([]planTTL, error) {
+	parsed := make([]planTTL, 0, len(entries))
+	for _, entry := range entries {
+		minLimit, ttl, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("entry %s must be minLimit=ttl", entry)
+		}
+		limit, err := strconv.Atoi(strings.TrimSpace(minLimit))
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("entry %s has an invalid plan limit", entry)
+		}
+		seconds, err := strconv.Atoi(strings.TrimSpace(ttl))
+		if err != nil || seconds <= 0 {
+			return nil, fmt.Errorf("entry %s has an invalid ttl", entry)
+		}
+		parsed = append(parsed, planTTL{minLimit: limit, ttl: seconds})
+	}
+	sort.Slice(parsed, func(i, j int) bool {
+		return parsed[i].minLimit > parsed[j].minLimit
+	})
+	return parsed, nil
+}
+
+// planCacheTTL attach the cache ttl of the user plan to the request context, the entries served to the request
+// are bounded by the same age so the plans with a shorter ttl get fresher data from the shared entries
+func (crossover *Crossover) planCacheTTL(req *http.Request, userId string, plan int) *http.Request {
+	ttl := 0
+	if crossover.resolveCacheTTL != nil {
+		ttl = crossover.resolveCacheTTL(req, userId, plan)
+	} else {
+		for _, tier := range crossover.planTTLs {
+			if plan >= tier.minLimit {
+				ttl = tier.ttl
+				break
+			}
+		}
+	}
+	if ttl <= 0 {
+		return req
+	}
+	ctx := cache.WithTTL(req.Context(), ttl)
+	return req.WithContext(cache.WithMaxAge(ctx, ttl))
+}
@@ -0,0 +1,91 @@
+package crossover_managed
+
+import (
+	"github.com/kotalco/crossover-managed/cache"
+	"github.com/kotalco/crossover-managed/internal/redistest"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParsePlanTTLs(t *testing.T) {
+	tiers, err := parsePlanTTLs([]string{"100=30", " 1000 = 5 ", "0=120"})
+	if err != nil {
+		t.Fatalf("failed to parse the plan ttls: %s", err)
+	}
+	expected := []planTTL{{1000, 5}, {100, 30}, {0, 120}}
+	if len(tiers) != len(expected) {
+		t.Fatalf("expected the tiers %v, got %v", expected, tiers)
+	}
+	for i := range expected {
+		if tiers[i] != expected[i] {
+			t.Errorf("expected the tiers sorted by decreasing limit %v, got %v", expected, tiers)
+		}
+	}
+
+	for _, entry := range []string{"100", "many=30", "-1=30", "100=0", "100=soon"} {
+		if _, err := parsePlanTTLs([]string{entry}); err == nil {
+			t.Errorf("expected the entry %s to be rejected", entry)
+		}
+	}
+}
+
+// servePlan make a cacheable request of a user on the plan limit, it returns the ttl of the stored entry
+func servePlan(t *testing.T, config *Config, plan int, opts ...Option) int {
+	t.Helper()
+	server := redistest.NewServer()
+	cacheService := cache.NewCache(cache.Options{CacheExpiry: 60})
+	opts = append([]Option{withRedis(server), WithCacheService(cacheService), WithLimiterService(&fakeLimiter{allow: true, plan: plan})}, opts...)
+	crossover := newTestPlugin(t, config, &testUpstream{body: "ok"}, opts...)
+
+	do(crossover, httptest.NewRequest(http.MethodGet, testPath, nil))
+
+	keys := server.Keys("")
+	if len(keys) != 1 {
+		t.Fatalf("expected a single cached entry, got %v", keys)
+	}
+	return server.TTL(keys[0])
+}
+
+func TestCachePlanTTLs(t *testing.T) {
+	tests := []struct {
+		name string
+		plan int
+		ttl  int
+	}{
+		{"premium", 5000, 5},
+		{"exact limit", 1000, 5},
+		{"standard", 500, 30},
+		{"below every tier", 10, 60},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.CachePlanTTLs = []string{"100=30", "1000=5"}
+			if ttl := servePlan(t, config, test.plan); ttl != test.ttl {
+				t.Errorf("expected the plan %d to be cached for %d seconds, got %d", test.plan, test.ttl, ttl)
+			}
+		})
+	}
+}
+
+func TestCacheTTLResolver(t *testing.T) {
+	config := testConfig()
+	config.CachePlanTTLs = []string{"0=30"}
+	var resolved []string
+	resolver := WithCacheTTLResolver(func(req *http.Request, userId string, plan int) int {
+		resolved = append(resolved, userId)
+		return plan / 10
+	})
+
+	// the resolver takes precedence over the plan ttls
+	if ttl := servePlan(t, config, 200, resolver); ttl != 20 {
+		t.Errorf("expected the resolved ttl 20, got %d", ttl)
+	}
+	if ttl := servePlan(t, config, 0, resolver); ttl != 60 {
+		t.Errorf("expected no resolved ttl to keep the default, got %d", ttl)
+	}
+	if len(resolved) != 2 || resolved[0] != testUserId {
+		t.Errorf("expected the ttl of the user %s to be resolved, got %v", testUserId, resolved)
+	}
+}
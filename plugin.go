@@ -3,22 +3,44 @@ package crossover_managed
 import (
 	"bytes"
 	"context"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/kotalco/crossover-managed/activity"
 	"github.com/kotalco/crossover-managed/cache"
+	"github.com/kotalco/crossover-managed/jsonrpc"
 	"github.com/kotalco/crossover-managed/limiter"
+	"github.com/kotalco/crossover-managed/logger"
+	"github.com/kotalco/crossover-managed/matcher"
+	"github.com/kotalco/crossover-managed/metrics"
 	"github.com/kotalco/resp"
 	"io"
-	"log"
+	"math/rand"
+	"mime"
 	"net/http"
 	"regexp"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-const MaxRequestBodySize int64 = 2 * 1024 * 1024 // 2 MB
+const (
+	MaxRequestBodySize int64 = 2 * 1024 * 1024 // 2 MB
+	TrustedKeyHeader         = "X-Api-Key"     // header carrying the APIKey of trusted internal clients
+)
+
+// policies of the HTTP/1.0 and missing Host requests
+const (
+	LegacyNormalize = "normalize"
+	LegacyReject    = "reject"
+)
+
+var upstreamSeconds = metrics.NewHistogram("crossover_upstream_latency_seconds", "Latency of the requests forwarded to the upstream", []float64{0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10})
 
 // implement buffer pool using the sync.Pool type,to reduce the allocation when you are encoding JSON
 var cloneBufferPool = sync.Pool{
@@ -27,149 +49,869 @@ var cloneBufferPool = sync.Pool{
 	},
 }
 
-// Config holds configuration to passed to the plugin
-type Config struct {
-	Pattern         string
-	APIKey          string
-	ActivityAddress string
-	PlanAddress     string
-	RedisAddress    string
-	RedisAuth       string
-	CacheExpiry     int
-	BufferSize      int
-	BatchSize       int
-	FlushInterval   int
+type Crossover struct {
+	next                http.Handler
+	logger              *logger.Logger
+	name                string
+	compiledPattern     *regexp.Regexp
+	apiKey              string
+	planAddress         string
+	redisAddress        string
+	redisAuth           string
+	cacheExpiry         int
+	rateLimitJSON       bool
+	priorityCount       int
+	cacheBypass         *matcher.Matcher
+	activityService     activity.IActivity
+	cacheService        cache.ICache
+	limiterService      limiter.ILimiter
+	authorizeUser       AuthorizeUser
+	refundOnError       bool
+	maxRedisOps         int
+	metricsPath         string
+	redisDB             int
+	redisPool           *redisPool
+	redisClientFactory  RedisClientFactory
+	activityOnSuccess   bool
+	successStatuses     map[int]bool
+	localFallback       bool
+	ttlOverrideHeader   string
+	requestQueue        *fairQueue
+	planHeader          string
+	legacyRequestPolicy string
+	adminPath           string
+	maxBatchSize        int
+	retryAfterMin       int
+	retryAfterMax       int
+	activityStream      chan<- activity.Event
+	cacheKeySegments    []cacheKeySegment
+	bodyBudget          *bodyBudget
+	resolveSubject      ResolveSubject
+	forwardAuth         bool
+	cacheWhenThrottled  bool
+	jsonContentTypes    map[string]bool
+	inflight            int64
+	drainTimeout        time.Duration
+	volatileTags        map[string]bool
+	volatileTTL         int
+	pinnedTTL           int
+	postInit            []Option
+	bodyReadTimeout     time.Duration
+	countSkipSize       int64
+	countSkipCost       int
+	scopeHeader         string
+	rateScopes          map[string]bool
+	rateLimitBatches    bool
+	cacheStrategies     *cacheStrategies
+	anonymousPolicy     string
+	anonymousLimit      int
+	batchCalls          bool
+	featureMethods      *featureMethods
+	cacheEnabled        bool
+	requestTimeout      time.Duration
+	resolveCacheTTL     ResolveCacheTTL
+	planTTLs            []planTTL
 }
 
-// CreateConfig populates the config data object
-func CreateConfig() *Config {
-	return &Config{}
+// Option customize the services used by the plugin
+type Option func(crossover *Crossover)
+
+// WithActivityService override the default activity service
+func WithActivityService(activityService activity.IActivity) Option {
+	return func(crossover *Crossover) {
+		crossover.activityService = activityService
+	}
 }
 
-type Crossover struct {
-	next            http.Handler
-	name            string
-	compiledPattern *regexp.Regexp
-	apiKey          string
-	planAddress     string
-	redisAddress    string
-	redisAuth       string
-	cacheExpiry     int
-	activityService activity.IActivity
-	cacheService    cache.ICache
-	limiterService  limiter.ILimiter
+// WithActivityStream emit every logged activity entry to the stream in real time, entries are dropped when it's full
+// it's ignored when the activity service is overridden
+func WithActivityStream(stream chan<- activity.Event) Option {
+	return func(crossover *Crossover) {
+		crossover.activityStream = stream
+	}
+}
+
+// WithCacheService override the default cache service
+func WithCacheService(cacheService cache.ICache) Option {
+	return func(crossover *Crossover) {
+		crossover.cacheService = cacheService
+	}
+}
+
+// WithLimiterService override the default limiter service
+func WithLimiterService(limiterService limiter.ILimiter) Option {
+	return func(crossover *Crossover) {
+		crossover.limiterService = limiterService
+	}
+}
+
+// WithRedisClientFactory override how the per request redis client is created
+func WithRedisClientFactory(redisClientFactory RedisClientFactory) Option {
+	return func(crossover *Crossover) {
+		crossover.redisClientFactory = redisClientFactory
+	}
+}
+
+// AuthorizeUser verify that the user id resolved from the path is authorized to make the request
+type AuthorizeUser func(ctx context.Context, userId string, req *http.Request) error
+
+// WithUserAuthorizer cross-check the resolved user id before limiting, a non-nil error rejects the request with 403
+func WithUserAuthorizer(authorizeUser AuthorizeUser) Option {
+	return func(crossover *Crossover) {
+		crossover.authorizeUser = authorizeUser
+	}
+}
+
+// ResolveSubject return the authenticated subject of the request the plan is resolved and limited on, empty falls back to the path user id
+type ResolveSubject func(req *http.Request) string
+
+// WithSubjectResolver key the plan resolution and the rate limit on the subject of the request credentials instead of the path user id
+func WithSubjectResolver(resolveSubject ResolveSubject) Option {
+	return func(crossover *Crossover) {
+		crossover.resolveSubject = resolveSubject
+	}
 }
 
 // New created a new  plugin.
 func New(ctx context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
-	if len(config.Pattern) == 0 {
-		return nil, fmt.Errorf("pattern can't be empty")
+	return NewWithOptions(ctx, next, config, name)
+}
+
+// NewWithOptions created a new plugin, services not overridden by the options are built from the config
+func NewWithOptions(ctx context.Context, next http.Handler, config *Config, name string, opts ...Option) (http.Handler, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	//each instance throttles its own logs so one doesn't silence the messages of another
+	instanceLogger := logger.New(time.Duration(config.LogThrottleInterval) * time.Second)
+	if warnings := config.warnings(); len(warnings) > 0 {
+		instanceLogger.Printf("Suspicious config: %s", strings.Join(warnings, "; "))
 	}
-	if len(config.APIKey) == 0 {
-		return nil, fmt.Errorf("APIKey can't be empty")
+
+	compiledPattern := regexp.MustCompile(config.Pattern)
+	cacheBypass, err := matcher.New(config.CacheBypassPaths)
+	if err != nil {
+		return nil, err
+	}
+	cacheKeySegments, err := parseCacheKeySegments(config.CacheKeySegments, compiledPattern)
+	if err != nil {
+		return nil, err
 	}
-	if len(config.ActivityAddress) == 0 {
-		return nil, fmt.Errorf("activityAddress can't be empty")
+	featureMethods, err := parseFeatureMethods(config.PlanFeatureMethods)
+	if err != nil {
+		return nil, err
 	}
-	if len(config.PlanAddress) == 0 {
-		return nil, fmt.Errorf("planAddress can't be empty")
+	planTTLs, err := parsePlanTTLs(config.CachePlanTTLs)
+	if err != nil {
+		return nil, err
 	}
-	if len(config.RedisAddress) == 0 {
-		return nil, fmt.Errorf("RedisAddress can't be empty")
+	cacheStrategies, err := parseCacheStrategies(config.CacheStrategy, config.CacheStrategyPaths)
+	if err != nil {
+		return nil, err
+	}
+
+	handler := &Crossover{
+		next:                next,
+		logger:              instanceLogger,
+		name:                name,
+		compiledPattern:     compiledPattern,
+		apiKey:              config.APIKey,
+		planAddress:         config.PlanAddress,
+		redisAddress:        config.RedisAddress,
+		redisAuth:           config.RedisAuth,
+		cacheExpiry:         config.CacheExpiry,
+		rateLimitJSON:       config.RateLimitJSONBody,
+		priorityCount:       config.PriorityCount,
+		cacheBypass:         cacheBypass,
+		refundOnError:       config.RefundOnUpstreamError,
+		maxRedisOps:         config.MaxRedisOpsPerRequest,
+		metricsPath:         config.MetricsPath,
+		redisDB:             config.RedisDB,
+		redisPool:           newRedisPool(config.RedisMaxConns, config.RedisMaxIdleConns),
+		redisClientFactory:  newRedisClient,
+		activityOnSuccess:   config.ActivityOnSuccess,
+		successStatuses:     map[int]bool{},
+		localFallback:       config.LocalFallbackLimiter,
+		ttlOverrideHeader:   config.CacheTTLOverrideHeader,
+		planHeader:          config.PlanHeader,
+		legacyRequestPolicy: config.LegacyRequestPolicy,
+		adminPath:           strings.TrimSuffix(config.AdminPath, "/"),
+		maxBatchSize:        config.MaxBatchSize,
+		retryAfterMin:       config.DependencyRetryAfterMin,
+		retryAfterMax:       config.DependencyRetryAfterMax,
+		cacheKeySegments:    cacheKeySegments,
+		forwardAuth:         config.PlanForwardAuthorization,
+		cacheWhenThrottled:  config.ServeCacheWhenThrottled,
+		jsonContentTypes:    map[string]bool{},
+		drainTimeout:        time.Duration(config.ShutdownDrainTimeout) * time.Second,
+		volatileTags:        map[string]bool{},
+		volatileTTL:         config.VolatileBlockTTL,
+		pinnedTTL:           config.PinnedBlockTTL,
+		bodyReadTimeout:     time.Duration(config.BodyReadTimeout) * time.Millisecond,
+		countSkipSize:       config.CountSkipBodySize,
+		countSkipCost:       config.CountSkipCost,
+		scopeHeader:         config.RateLimitScopeHeader,
+		rateLimitBatches:    config.RateLimitBatches,
+		cacheStrategies:     cacheStrategies,
+		anonymousPolicy:     config.AnonymousPolicy,
+		anonymousLimit:      config.AnonymousPlanLimit,
+		batchCalls:          config.CacheBatchCalls,
+		featureMethods:      featureMethods,
+		cacheEnabled:        config.CacheEnabled,
+		requestTimeout:      time.Duration(config.RequestTimeout) * time.Millisecond,
+		planTTLs:            planTTLs,
+		rateScopes:          map[string]bool{},
+	}
+	for _, contentType := range config.JSONContentTypes {
+		handler.jsonContentTypes[strings.ToLower(strings.TrimSpace(contentType))] = true
+	}
+	for _, tag := range config.VolatileBlockTags {
+		handler.volatileTags[strings.ToLower(tag)] = true
+	}
+	for _, scope := range config.RateLimitScopes {
+		if origin := normalizeOrigin(scope); origin != "" {
+			scope = origin
+		}
+		handler.rateScopes[strings.ToLower(scope)] = true
 	}
-	if config.CacheExpiry == 0 {
-		return nil, fmt.Errorf("cacheExpiry can't be empty")
+	for _, status := range config.ActivitySuccessStatuses {
+		handler.successStatuses[status] = true
 	}
-	if config.BufferSize == 0 {
-		return nil, fmt.Errorf("bufferSize can't be empty")
+	if config.MaxConcurrentRequests > 0 {
+		handler.requestQueue = newFairQueue(config.MaxConcurrentRequests, config.RequestQueueSize)
 	}
-	if config.BatchSize == 0 {
-		return nil, fmt.Errorf("batchSize can't be empty")
+	if config.MaxBufferedBodyBytes > 0 {
+		handler.bodyBudget = newBodyBudget(config.MaxBufferedBodyBytes, time.Duration(config.BodyBudgetWait)*time.Millisecond)
 	}
-	if config.FlushInterval == 0 {
-		return nil, fmt.Errorf("flushInterval can't be empty")
+	for _, opt := range opts {
+		opt(handler)
 	}
 
-	compiledPattern := regexp.MustCompile(config.Pattern)
 	//newActivityService
-	newActivity := activity.NewActivity(
-		config.ActivityAddress,
-		config.APIKey,
-		config.BufferSize,
-		config.BatchSize,
-		config.FlushInterval,
-	)
+	if handler.activityService == nil {
+		handler.activityService = activity.NewActivity(activity.Options{
+			RemoteAddress:     config.ActivityAddress,
+			APIKey:            config.activityAPIKey(),
+			BufferSize:        config.BufferSize,
+			BatchSize:         config.BatchSize,
+			FlushInterval:     config.FlushInterval,
+			MaxFlushInterval:  config.MaxFlushInterval,
+			MaxRetryQueueSize: config.MaxRetryQueueSize,
+			AuthScheme:        config.ActivityAuth,
+			HMACSecret:        config.ActivityHMACSecret,
+			ProxyURL:          config.OutboundProxyURL,
+			Stream:            handler.activityStream,
+			SpillPath:         config.ActivitySpillPath,
+			MaxSpillBytes:     config.ActivitySpillMaxBytes,
+			SpillReplay:       config.ActivitySpillReplayInterval,
+			Tags:              config.ActivityTags,
+			Logger:            instanceLogger,
+		})
+	}
 	//cache service
-	newCacheService := cache.NewCache(config.CacheExpiry)
+	if handler.cacheService == nil {
+		handler.cacheService = cache.NewCache(cache.Options{
+			CacheExpiry:      config.CacheExpiry,
+			PerUser:          config.CachePerUser,
+			DebugKeyHeader:   config.DebugCacheKeyHeader,
+			MaxHeaderBytes:   config.MaxCacheHeaderBytes,
+			MinHits:          config.CacheMinHits,
+			HitsWindow:       config.CacheHitsWindow,
+			IncludeQuery:     config.CacheKeyIncludeQuery,
+			MaxQueryVariants: config.CacheMaxQueryVariants,
+			AuthorizedPolicy: config.CacheAuthorizedPolicy,
+			CookiePolicy:     config.CacheCookiePolicy,
+			CookieNames:      config.CacheCookieNames,
+			SavingsBreakdown: config.CacheSavingsBreakdown,
+			MinBodySize:      config.MinCacheableBodySize,
+			MaxBodySize:      config.MaxCacheableBodySize,
+			DryRun:           config.CacheDryRun,
+			ContentTypes:     config.CacheableContentTypes,
+			MaxAge:           config.MaxCacheAge,
+			NegativeTTL:      config.NegativeCacheTTL,
+			VerifyIntegrity:  config.CacheVerifyIntegrity,
+			SoftTimeout:      config.UpstreamSoftTimeout,
+			StaleTTL:         config.CacheStaleTTL,
+			CanonicalBody:    config.CacheCanonicalEncoding,
+			KeySamples:       config.CacheKeySamples,
+			RedirectTTL:      config.TemporaryRedirectTTL,
+			Methods:          config.CacheableMethods,
+			IncludeBody:      config.CacheKeyIncludeBody,
+			Format:           config.CacheFormat,
+			MaxHeaders:       config.MaxCachedHeaders,
+			HeadersPolicy:    config.CachedHeadersPolicy,
+			VerifyTTL:        config.CacheVerifyTTL,
+			Freshness:        config.CacheFreshnessHeaders,
+			RedisClient:      handler.redisClient,
+			Logger:           instanceLogger,
+		})
+	}
 	//limiter service
-	newLimiterService := limiter.NewLimiter(config.APIKey, config.PlanAddress)
-
-	handler := &Crossover{
-		next:            next,
-		name:            name,
-		compiledPattern: compiledPattern,
-		apiKey:          config.APIKey,
-		planAddress:     config.PlanAddress,
-		redisAddress:    config.RedisAddress,
-		redisAuth:       config.RedisAuth,
-		cacheExpiry:     config.CacheExpiry,
-		activityService: newActivity,
-		cacheService:    newCacheService,
-		limiterService:  newLimiterService,
+	if handler.limiterService == nil {
+		handler.limiterService = limiter.NewLimiter(limiter.Options{
+			APIKey:             config.planAPIKey(),
+			PlanAddress:        config.PlanAddress,
+			LocalFallback:      config.LocalFallbackLimiter,
+			LocalFallbackLimit: config.LocalFallbackLimit,
+			PlanOverrides:      config.PlanOverrides,
+			ProxyURL:           config.OutboundProxyURL,
+			SmoothingBatch:     config.RateLimitSmoothingBatch,
+			SmoothingInterval:  config.RateLimitSmoothingInterval,
+			PlanChangePolicy:   config.PlanChangePolicy,
+			MaxPlanFetches:     config.MaxConcurrentPlanFetches,
+			PlanFetchDefault:   config.PlanFetchDefault,
+			PlanQueryParam:     config.PlanQueryParam,
+			PlanCacheTTL:       config.PlanCacheTTL,
+			PlanSample:         config.PlanCountInterval,
+			MaxCachedPlans:     config.MaxCachedPlans,
+			PlanRetries:        config.PlanProxyRetries,
+			PlanRetryDelay:     config.PlanProxyRetryDelay,
+			Window:             config.RateLimitWindowSeconds,
+			WindowMode:         config.RateLimitWindowMode,
+			Logger:             instanceLogger,
+		})
+	}
+	//options wrapping the final services, e.g. the fault injection of the crossover_faults builds
+	for _, opt := range handler.postInit {
+		opt(handler)
 	}
 	go handler.activityService.BatchProcessor()
+	if config.FlushOnSignal {
+		handler.closeOnSignal()
+	}
 	return handler, nil
 }
 
 func (crossover *Crossover) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	respClient, err := resp.NewRedisClient(crossover.redisAddress, crossover.redisAuth)
+	//the request resources are released once it completes, or by its upstream call if the cache answered first
+	scope := &requestScope{}
+	defer scope.close()
+	atomic.AddInt64(&crossover.inflight, 1)
+	scope.onRelease(func() {
+		atomic.AddInt64(&crossover.inflight, -1)
+	})
+
+	//strip the plugin APIKey of every request so it never reaches the upstream, whatever the route it takes
+	trusted := crossover.trusted(req)
+
+	//expose the plugin metrics
+	if crossover.metricsPath != "" && req.URL.Path == crossover.metricsPath {
+		if strings.Contains(req.Header.Get("Accept"), "application/openmetrics-text") {
+			rw.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+			metrics.WriteOpenMetrics(rw)
+			return
+		}
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.WriteText(rw)
+		return
+	}
+
+	//internal admin routes
+	if crossover.serveAdmin(rw, req, trusted) {
+		return
+	}
+
+	redisClient, err := crossover.redisClient(req.Context())
 	if err != nil {
-		log.Printf("Failed to create Redis Connection %s", err.Error())
-		rw.WriteHeader(http.StatusInternalServerError)
-		rw.Write([]byte("something went wrong"))
+		crossover.logger.Printf("Failed to create Redis Connection %s", err.Error())
+		if !crossover.localFallback {
+			rw.WriteHeader(http.StatusInternalServerError)
+			rw.Write([]byte("something went wrong"))
+			return
+		}
+		redisClient = &unavailableClient{err: err}
+	}
+	respClient := newCountingClient(redisClient, crossover.maxRedisOps)
+	scope.onRelease(func() {
+		_ = respClient.Close()
+	})
+
+	//reject or normalize the HTTP/1.0 and missing Host requests before keying and forwarding them
+	if !crossover.normalizeLegacyRequest(req) {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte("unsupported request"))
 		return
 	}
-	defer respClient.Close()
 
 	//extract user id from request
 	userId := crossover.extractUserID(req.URL.Path)
 	if userId == "" {
-		rw.WriteHeader(http.StatusBadRequest)
-		rw.Write([]byte("invalid requestId"))
+		switch crossover.anonymousPolicy {
+		case AnonymousBypass:
+			crossover.next.ServeHTTP(rw, req)
+			return
+		case AnonymousLimit:
+			userId = AnonymousSubject
+		default:
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte("invalid requestId"))
+			return
+		}
+	}
+
+	//verify the user is authorized for the path
+	if crossover.authorizeUser != nil && userId != AnonymousSubject {
+		if err := crossover.authorizeUser(req.Context(), userId, req); err != nil {
+			rw.WriteHeader(http.StatusForbidden)
+			rw.Write([]byte(http.StatusText(http.StatusForbidden)))
+			return
+		}
+	}
+
+	//the streamed bodies aren't inspected, refuse them rather than letting their calls skip the plan features and the batch size
+	if crossover.streamedBody(req) && (crossover.featureMethods != nil || crossover.maxBatchSize > 0) {
+		rw.WriteHeader(http.StatusRequestEntityTooLarge)
+		rw.Write([]byte(http.StatusText(http.StatusRequestEntityTooLarge)))
 		return
 	}
 
+	//reserve the memory of the buffered body across the concurrent requests
+	if crossover.bodyBudget != nil {
+		if size := crossover.bufferedBodySize(req); size > 0 {
+			if err := crossover.bodyBudget.acquire(req.Context(), size); err != nil {
+				rw.WriteHeader(http.StatusServiceUnavailable)
+				rw.Write([]byte(http.StatusText(http.StatusServiceUnavailable)))
+				return
+			}
+			scope.onRelease(func() {
+				crossover.bodyBudget.release(size)
+			})
+		}
+	}
+
+	//read the json body ahead so a disconnecting or stalled client can't pin the request while it's counted
+	if crossover.bufferedJSON(req) {
+		if err := crossover.bufferBody(req); err != nil {
+			if req.Context().Err() != nil {
+				//the client is gone, there is nobody to answer
+				return
+			}
+			rw.WriteHeader(http.StatusRequestTimeout)
+			rw.Write([]byte(http.StatusText(http.StatusRequestTimeout)))
+			return
+		}
+		req = withParsedRPC(req)
+	}
+
+	//reject the oversized json-rpc batches before they consume the user quota
+	if crossover.maxBatchSize > 0 {
+		if rpcRequest, ok := crossover.parseJSONRPC(req); ok && rpcRequest.Batch && len(rpcRequest.Calls) > crossover.maxBatchSize {
+			rw.Header().Set("Content-Type", "application/json")
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write(jsonrpc.ErrorBody(jsonrpc.InvalidRequestCode, fmt.Sprintf("batch size exceeds the limit of %d calls", crossover.maxBatchSize)))
+			return
+		}
+	}
+
 	//
 	//limit user request according to his/her plan
 	//
+	subject := crossover.planSubject(req, userId)
+	if subject == AnonymousSubject {
+		//the anonymous requests have no plan to resolve, they're limited on the configured one
+		req = req.WithContext(limiter.WithPlan(req.Context(), crossover.anonymousLimit))
+	}
+	if crossover.scopeHeader != "" {
+		//per (user, scope) budgets sourced from the user plan
+		req = req.WithContext(limiter.WithScope(req.Context(), crossover.rateScope(req)))
+	}
+	if crossover.rateLimitBatches {
+		//the batches draw from their own budget so the plans can cap them apart from the single calls
+		if rpcRequest, ok := crossover.parseJSONRPC(req); ok && rpcRequest.Batch {
+			req = req.WithContext(limiter.WithBatch(req.Context()))
+		}
+	}
 	newLimiter := crossover.limiterService
-	allow, err := newLimiter.Limit(req.Context(), crossover.extractUserID(req.URL.Path), respClient)
+
+	//reject the calls to the features the user plan doesn't include before they consume the user quota
+	if crossover.featureMethods != nil {
+		missing, err := crossover.missingFeature(req, func() (map[string]bool, error) {
+			return newLimiter.Features(crossover.planContext(req), subject, respClient)
+		})
+		if err != nil {
+			crossover.logger.Printf("Failed to resolve the plan features of user %s: %s", userId, err.Error())
+			rw.Header().Set("Retry-After", strconv.Itoa(crossover.jitteredRetryAfter()))
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			rw.Write([]byte(http.StatusText(http.StatusServiceUnavailable)))
+			return
+		}
+		if missing != "" {
+			rw.Header().Set("Content-Type", "application/json")
+			rw.WriteHeader(http.StatusForbidden)
+			rw.Write(jsonrpc.ErrorBody(jsonrpc.InvalidRequestCode, fmt.Sprintf("plan doesn't include the %s feature", missing)))
+			return
+		}
+	}
+
+	allow, err := newLimiter.Limit(crossover.planContext(req), subject, respClient)
 	if err != nil {
-		if err.Error() == http.StatusText(http.StatusTooManyRequests) {
-			rw.WriteHeader(http.StatusTooManyRequests)
-			rw.Write([]byte(err.Error()))
+		var rateLimitErr *limiter.RateLimitError
+		if errors.As(err, &rateLimitErr) {
+			if crossover.serveThrottled(rw, req, respClient, userId) {
+				return
+			}
+			crossover.writeRateLimited(rw, rateLimitErr)
 			return
 		}
-		rw.WriteHeader(http.StatusInternalServerError)
+		switch {
+		case errors.Is(err, limiter.ErrPlanTimeout):
+			crossover.logger.Printf("Plan service timed out for user %s", userId)
+			rw.Header().Set("Retry-After", strconv.Itoa(crossover.jitteredRetryAfter()))
+			rw.WriteHeader(http.StatusGatewayTimeout)
+			// the wrapped transport error names the plan service, don't leak it to the client
+			err = limiter.ErrPlanTimeout
+		case errors.Is(err, limiter.ErrPlanUnavailable):
+			crossover.logger.Printf("Plan service failed for user %s", userId)
+			rw.Header().Set("Retry-After", strconv.Itoa(crossover.jitteredRetryAfter()))
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			err = limiter.ErrPlanUnavailable
+		case errors.Is(err, limiter.ErrRedisUnavailable):
+			crossover.logger.Printf("Redis failed while limiting user %s: %s", userId, err.Error())
+			rw.Header().Set("Retry-After", strconv.Itoa(crossover.jitteredRetryAfter()))
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			rw.WriteHeader(http.StatusInternalServerError)
+		}
 		rw.Write([]byte(err.Error()))
 		return
 	}
 	if !allow {
+		if crossover.serveThrottled(rw, req, respClient, userId) {
+			return
+		}
 		rw.WriteHeader(http.StatusTooManyRequests)
 		rw.Write([]byte("too many requests"))
 		return
 	}
 
-	//store user activity
+	//forward the resolved plan to the upstream and derive the cache ttl from it
+	if crossover.planHeader != "" || crossover.resolveCacheTTL != nil || len(crossover.planTTLs) > 0 {
+		if crossover.planHeader != "" {
+			req.Header.Del(crossover.planHeader)
+		}
+		if plan, err := crossover.limiterService.Plan(crossover.planContext(req), subject, respClient); err == nil {
+			if crossover.planHeader != "" {
+				req.Header.Set(crossover.planHeader, strconv.Itoa(plan))
+			}
+			req = crossover.planCacheTTL(req, subject, plan)
+		}
+	}
+
+	//apply the block and the trusted clients cache ttl overrides, the latter wins
+	req = crossover.blockTTL(req)
+	req = crossover.ttlOverride(req, trusted)
+	req = crossover.cacheKeyPath(req)
+
+	//store user activity, the anonymous requests have no user to meter
 	requestKey := crossover.requestKey(req.URL.Path)
-	crossover.activityService.LogActivity(requestKey, 1)
+	count := crossover.activityCount(req)
+	switch {
+	case requestKey == "":
+	case crossover.activityOnSuccess:
+		//defer the activity log until the response is written and only meter the successful ones
+		response := &statusRecorder{rw: rw}
+		rw = response
+		defer func() {
+			if crossover.successStatus(response.code()) {
+				crossover.logActivity(requestKey, count)
+			}
+		}()
+	default:
+		crossover.logActivity(requestKey, count)
+	}
+
+	//bound the upstream concurrency, admitting the waiting requests fairly across users
+	if crossover.requestQueue != nil {
+		if err := crossover.requestQueue.acquire(req.Context(), userId); err != nil {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			rw.Write([]byte(http.StatusText(http.StatusServiceUnavailable)))
+			return
+		}
+		scope.onRelease(crossover.requestQueue.release)
+	}
+
+	//record the upstream status to refund the user quota on server errors, cache hits never reach the upstream
+	next := crossover.next
+	upstream := &statusRecorder{}
+	if crossover.refundOnError {
+		next = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			upstream.rw = rw
+			crossover.next.ServeHTTP(upstream, req)
+		})
+		//req is rebound to the RequestTimeout context below, which is cancelled before this refund runs, and the
+		//refund of a detached request runs after the handler returned
+		refundCtx := context.WithoutCancel(req.Context())
+		scope.onRelease(func() {
+			if upstream.code() < http.StatusInternalServerError {
+				return
+			}
+			if err := crossover.limiterService.Refund(refundCtx, subject, respClient); err != nil {
+				crossover.logger.Printf("Failed to refund user %s rate counter %s", subject, err.Error())
+			}
+		})
+	}
+
+	//carry the deadline to the upstream so a cooperative backend can abort its work early
+	if crossover.requestTimeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), crossover.requestTimeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
+	//time the upstream, linking the observations to the request trace
+	timed := next
+	next = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		timed.ServeHTTP(rw, req)
+		upstreamSeconds.ObserveWithExemplar(time.Since(start).Seconds(), traceID(req))
+	})
 
-	//cache response
-	crossover.cacheService.ServeHTTP(rw, req, crossover.next, respClient)
-	return
+	//bypass the cache when it's disabled or for the configured paths
+	if !crossover.cacheEnabled {
+		next.ServeHTTP(rw, req)
+		return
+	}
+	if _, ok := crossover.cacheBypass.Match(req.URL.Path); ok {
+		next.ServeHTTP(rw, req)
+		return
+	}
+
+	//serve the cached calls of the json-rpc batches and forward the others
+	if crossover.batchCalls {
+		if rpcRequest, ok := crossover.parseJSONRPC(req); ok && rpcRequest.Batch {
+			crossover.cacheService.ServeBatch(rw, req, next, respClient, userId, rpcRequest.Calls)
+			return
+		}
+	}
+
+	//cache response, a stale entry served past the soft timeout leaves the request resources to the upstream call
+	req = req.WithContext(cache.WithDetach(req.Context(), scope.detach))
+	if strategy := crossover.cacheStrategies.strategy(req.URL.Path); strategy != cache.StrategyCacheFirst {
+		req = req.WithContext(cache.WithStrategy(req.Context(), strategy))
+	}
+	crossover.cacheService.ServeHTTP(rw, req, next, respClient, userId)
+}
+
+// traceID return the trace id of the W3C traceparent header, empty when the request isn't traced
+func traceID(req *http.Request) string {
+	// version-traceid-parentid-flags
+	parts := strings.Split(req.Header.Get("traceparent"), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || strings.Trim(parts[1], "0") == "" {
+		return ""
+	}
+	if _, err := hex.DecodeString(parts[1]); err != nil {
+		return ""
+	}
+	return parts[1]
+}
+
+// Close wait up to ShutdownDrainTimeout for the in-flight requests to finish before stopping the activity processor
+// it proceeds after the timeout even if some requests are still running, the last flush gets another activity.DefaultTimeout
+func (crossover *Crossover) Close() error {
+	crossover.stopOnSignal()
+	drainCtx, cancel := context.WithTimeout(context.Background(), crossover.drainTimeout)
+	defer cancel()
+	crossover.drain(drainCtx)
+	flushCtx, cancel := context.WithTimeout(context.Background(), activity.DefaultTimeout*time.Second)
+	defer cancel()
+	return crossover.activityService.Close(flushCtx)
+}
+
+// Shutdown drain the in-flight requests and flush the activity buffer until the context is done
+func (crossover *Crossover) Shutdown(ctx context.Context) error {
+	crossover.stopOnSignal()
+	crossover.drain(ctx)
+	return crossover.activityService.Close(ctx)
+}
+
+// drain wait for the in-flight requests to finish until the context is done
+func (crossover *Crossover) drain(ctx context.Context) {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&crossover.inflight) > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			crossover.logger.Printf("Shutdown drain timed out with %d in-flight requests", atomic.LoadInt64(&crossover.inflight))
+			return
+		}
+	}
+}
+
+// trusted check whether the request carries the plugin APIKey, the key is stripped so it never reaches the upstream
+func (crossover *Crossover) trusted(req *http.Request) bool {
+	key := req.Header.Get(TrustedKeyHeader)
+	if key == "" {
+		return false
+	}
+	req.Header.Del(TrustedKeyHeader)
+	return subtle.ConstantTimeCompare([]byte(key), []byte(crossover.apiKey)) == 1
+}
+
+// serveThrottled serve the cached response of a throttled request when ServeCacheWhenThrottled is enabled
+// hits cost the upstream nothing so they're served and metered, it returns false on a miss
+func (crossover *Crossover) serveThrottled(rw http.ResponseWriter, req *http.Request, respClient resp.IClient, userId string) bool {
+	if !crossover.cacheEnabled || !crossover.cacheWhenThrottled {
+		return false
+	}
+	if _, bypass := crossover.cacheBypass.Match(req.URL.Path); bypass {
+		return false
+	}
+	req = crossover.cacheKeyPath(req)
+	if !crossover.cacheService.ServeCached(rw, req, respClient, userId) {
+		return false
+	}
+	crossover.logActivity(crossover.requestKey(req.URL.Path), crossover.activityCount(req))
+	return true
+}
+
+// planSubject return the subject the plan is resolved and limited on
+func (crossover *Crossover) planSubject(req *http.Request, userId string) string {
+	if crossover.resolveSubject == nil {
+		return userId
+	}
+	if subject := crossover.resolveSubject(req); subject != "" {
+		return subject
+	}
+	return userId
+}
+
+// planContext attach the request Authorization to the context forwarded to the plan service
+func (crossover *Crossover) planContext(req *http.Request) context.Context {
+	authorization := req.Header.Get("Authorization")
+	if !crossover.forwardAuth || authorization == "" {
+		return req.Context()
+	}
+	return limiter.WithAuthorization(req.Context(), authorization)
+}
+
+// blockTTL attach the cache ttl derived from the blocks referenced by the json-rpc calls to the request context
+// calls on volatile tags get VolatileBlockTTL and calls pinned to concrete blocks get PinnedBlockTTL
+func (crossover *Crossover) blockTTL(req *http.Request) *http.Request {
+	if crossover.volatileTTL <= 0 && crossover.pinnedTTL <= 0 {
+		return req
+	}
+	rpcRequest, ok := crossover.parseJSONRPC(req)
+	if !ok {
+		return req
+	}
+	switch rpcRequest.Volatility(crossover.volatileTags) {
+	case jsonrpc.BlockVolatile:
+		if crossover.volatileTTL > 0 {
+			return req.WithContext(cache.WithTTL(req.Context(), crossover.volatileTTL))
+		}
+	case jsonrpc.BlockPinned:
+		if crossover.pinnedTTL > 0 {
+			return req.WithContext(cache.WithPinnedTTL(req.Context(), crossover.pinnedTTL))
+		}
+	}
+	return req
+}
+
+// ttlOverride attach the ttl requested by a trusted client to the request context, the header is ignored for untrusted clients
+func (crossover *Crossover) ttlOverride(req *http.Request, trusted bool) *http.Request {
+	if crossover.ttlOverrideHeader == "" {
+		return req
+	}
+	value := req.Header.Get(crossover.ttlOverrideHeader)
+	if value == "" {
+		return req
+	}
+	req.Header.Del(crossover.ttlOverrideHeader)
+	if !trusted {
+		return req
+	}
+	ttl, err := strconv.Atoi(value)
+	if err != nil || ttl <= 0 {
+		return req
+	}
+	return req.WithContext(cache.WithTTL(req.Context(), ttl))
+}
+
+// logActivity log the user activity, entries with count over the PriorityCount are flushed immediately
+func (crossover *Crossover) logActivity(requestKey string, count int) {
+	if crossover.priorityCount > 0 && count >= crossover.priorityCount {
+		crossover.activityService.LogPriorityActivity(requestKey, count)
+		return
+	}
+	crossover.activityService.LogActivity(requestKey, count)
+}
 
-	crossover.next.ServeHTTP(rw, req)
-	return
+// successStatus check whether the response status should be metered, any 2xx is successful unless ActivitySuccessStatuses is set
+func (crossover *Crossover) successStatus(status int) bool {
+	if status == 0 {
+		//nothing written explicitly, net/http defaults to 200
+		status = http.StatusOK
+	}
+	if len(crossover.successStatuses) > 0 {
+		return crossover.successStatuses[status]
+	}
+	return status >= http.StatusOK && status < http.StatusMultipleChoices
+}
+
+// jitteredRetryAfter pick a random Retry-After within the configured range, spreading the client retries during dependency outages
+func (crossover *Crossover) jitteredRetryAfter() int {
+	if crossover.retryAfterMax <= crossover.retryAfterMin {
+		return crossover.retryAfterMin
+	}
+	return crossover.retryAfterMin + rand.Intn(crossover.retryAfterMax-crossover.retryAfterMin+1)
+}
+
+// rateLimitBody the json body returned on 429 when RateLimitJSONBody is enabled
+type rateLimitBody struct {
+	Limit        int `json:"limit"`
+	Remaining    int `json:"remaining"`
+	ResetSeconds int `json:"reset_seconds"`
+	RetryAfter   int `json:"retry_after"`
+}
+
+// writeRateLimited write the 429 response along with the rate limit state headers and the optional json body
+func (crossover *Crossover) writeRateLimited(rw http.ResponseWriter, rateLimitErr *limiter.RateLimitError) {
+	rw.Header().Set("X-RateLimit-Limit", strconv.Itoa(rateLimitErr.Limit))
+	rw.Header().Set("X-RateLimit-Remaining", strconv.Itoa(rateLimitErr.Remaining))
+	rw.Header().Set("X-RateLimit-Reset", strconv.Itoa(rateLimitErr.ResetSeconds))
+	rw.Header().Set("Retry-After", strconv.Itoa(rateLimitErr.ResetSeconds))
+
+	if !crossover.rateLimitJSON {
+		rw.WriteHeader(http.StatusTooManyRequests)
+		rw.Write([]byte(rateLimitErr.Error()))
+		return
+	}
+
+	body, err := json.Marshal(rateLimitBody{
+		Limit:        rateLimitErr.Limit,
+		Remaining:    rateLimitErr.Remaining,
+		ResetSeconds: rateLimitErr.ResetSeconds,
+		RetryAfter:   rateLimitErr.ResetSeconds,
+	})
+	if err != nil {
+		crossover.logger.Printf("Failed to marshal rate limit body %s", err.Error())
+		rw.WriteHeader(http.StatusTooManyRequests)
+		rw.Write([]byte(rateLimitErr.Error()))
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusTooManyRequests)
+	rw.Write(body)
+}
+
+// normalizeLegacyRequest handle the HTTP/1.0 and missing Host requests according to the LegacyRequestPolicy
+// it returns false if the request should be rejected
+func (crossover *Crossover) normalizeLegacyRequest(req *http.Request) bool {
+	if req.Host == "" {
+		req.Host = req.URL.Host
+	}
+	legacy := req.Host == "" || (req.ProtoMajor == 1 && req.ProtoMinor == 0)
+	if !legacy {
+		return true
+	}
+	if crossover.legacyRequestPolicy == LegacyReject {
+		return false
+	}
+	if req.ProtoMajor == 1 && req.ProtoMinor == 0 {
+		req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/1.1", 1, 1
+	}
+	return true
 }
 
 // extractUserID extract user id from the request
@@ -195,6 +937,53 @@ func (crossover *Crossover) requestKey(path string) string {
 	return match[0]
 }
 
+type rpcContextKey struct{}
+
+// parsedRPC the json-rpc body of the request, parsed by the first parseJSONRPC call
+type parsedRPC struct {
+	parsed  bool
+	request *jsonrpc.Request
+	ok      bool
+}
+
+// withParsedRPC let the parseJSONRPC calls of the request share a single parse of its body
+func withParsedRPC(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), rpcContextKey{}, &parsedRPC{}))
+}
+
+// parseJSONRPC return the json-rpc body of the request, the requests passed through withParsedRPC are parsed once
+func (crossover *Crossover) parseJSONRPC(req *http.Request) (*jsonrpc.Request, bool) {
+	parsed, shared := req.Context().Value(rpcContextKey{}).(*parsedRPC)
+	if shared && parsed.parsed {
+		return parsed.request, parsed.ok
+	}
+	rpcRequest, ok := crossover.parseBody(req)
+	if shared {
+		parsed.parsed, parsed.request, parsed.ok = true, rpcRequest, ok
+	}
+	return rpcRequest, ok
+}
+
+// parseBody parse the json-rpc body of the request, the body is restored for the upstream
+func (crossover *Crossover) parseBody(req *http.Request) (*jsonrpc.Request, bool) {
+	if !crossover.bufferedJSON(req) {
+		return nil, false
+	}
+	clonedRequest, err := crossover.cloneRequest(req)
+	if err != nil {
+		return nil, false
+	}
+	body, err := io.ReadAll(clonedRequest.Body)
+	if err != nil {
+		return nil, false
+	}
+	rpcRequest, err := jsonrpc.Parse(body)
+	if err != nil {
+		return nil, false
+	}
+	return rpcRequest, true
+}
+
 func (crossover *Crossover) cloneRequest(req *http.Request) (*http.Request, error) {
 	buf := cloneBufferPool.Get().(*bytes.Buffer)
 	buf.Reset()
@@ -205,19 +994,55 @@ func (crossover *Crossover) cloneRequest(req *http.Request) (*http.Request, erro
 	_, err := io.CopyN(buf, req.Body, MaxRequestBodySize)
 	req.Body.Close()
 	if err != nil && err != io.EOF {
-		log.Printf("Error reading request body: %s", err)
+		crossover.logger.Printf("Error reading request body: %s", err)
 		return nil, errors.New("error reading request body")
 	}
-	bodyReader := bytes.NewReader(buf.Bytes())
-	req.Body = io.NopCloser(bodyReader)
+	//copy the body out of the pooled buffer, the next request reusing it would overwrite the bytes of this one
+	body := append([]byte(nil), buf.Bytes()...)
+	req.Body = io.NopCloser(bytes.NewReader(body))
 	clonedRequest := req.Clone(req.Context())
-	clonedRequest.Body = io.NopCloser(bytes.NewReader(buf.Bytes()))
+	clonedRequest.Body = io.NopCloser(bytes.NewReader(body))
 	return clonedRequest, nil
 }
 
+// activityCount return the number of requests to meter, only json bodies are buffered to count batches
+// the other requests are passed through untouched and count as 1, the streamed bodies count as CountSkipCost
+func (crossover *Crossover) activityCount(req *http.Request) int {
+	if crossover.streamedBody(req) {
+		return crossover.countSkipCost
+	}
+	if !crossover.bufferedJSON(req) {
+		return 1
+	}
+	clonedRequest, err := crossover.cloneRequest(req)
+	if err != nil {
+		return 1
+	}
+	return crossover.requestCount(clonedRequest)
+}
+
+// jsonBody check whether the request media type, stripped of its parameters, is one of the JSONContentTypes
+func (crossover *Crossover) jsonBody(req *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	return crossover.jsonContentTypes[mediaType]
+}
+
+// streamedBody check whether the declared body length is above CountSkipBodySize, such bodies aren't worth
+// buffering to be counted and are streamed to the upstream
+func (crossover *Crossover) streamedBody(req *http.Request) bool {
+	return crossover.countSkipSize > 0 && req.ContentLength > crossover.countSkipSize && crossover.jsonBody(req)
+}
+
+// bufferedJSON check whether the plugin reads the request body ahead, i.e. a json body that isn't streamed
+func (crossover *Crossover) bufferedJSON(req *http.Request) bool {
+	return req.Body != nil && req.Body != http.NoBody && crossover.jsonBody(req) && !crossover.streamedBody(req)
+}
+
 func (crossover *Crossover) requestCount(req *http.Request) (count int) {
-	contentType := req.Header.Get("Content-Type")
-	if contentType != "application/json" {
+	if !crossover.jsonBody(req) {
 		// if it's not of type json default to 1 and return before reading the body
 		return 1
 	}
@@ -0,0 +1,1277 @@
+package crossover_managed
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kotalco/crossover-managed/activity"
+	"github.com/kotalco/crossover-managed/cache"
+	"github.com/kotalco/crossover-managed/internal/redistest"
+	"github.com/kotalco/crossover-managed/jsonrpc"
+	"github.com/kotalco/crossover-managed/limiter"
+	"github.com/kotalco/resp"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testRequestId = "mainnet0006f1e9c2a4b3d4e5f8a7b6c5d4e3f2a1b"
+	testUserId    = "6f1e9c2a-4b3d-4e5f-8a7b-6c5d4e3f2a1b"
+	testPath      = "/" + testRequestId
+)
+
+// fakeActivity record the logged entries instead of sending them
+type fakeActivity struct {
+	activity.IActivity
+	mu       sync.Mutex
+	logs     map[string]int
+	priority map[string]int
+	closed   int
+}
+
+func newFakeActivity() *fakeActivity {
+	return &fakeActivity{logs: map[string]int{}, priority: map[string]int{}}
+}
+
+func (a *fakeActivity) LogActivity(requestId string, count int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.logs[requestId] += count
+}
+
+func (a *fakeActivity) LogPriorityActivity(requestId string, count int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.priority[requestId] += count
+}
+
+func (a *fakeActivity) BatchProcessor() {}
+
+func (a *fakeActivity) Close(ctx context.Context) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.closed++
+	return nil
+}
+
+func (a *fakeActivity) logged(requestId string) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.logs[requestId]
+}
+
+// fakeLimiter allow or deny every request
+type fakeLimiter struct {
+	limiter.ILimiter
+	mu        sync.Mutex
+	allow     bool
+	err       error
+	plan      int
+	features  map[string]bool
+	users     []string
+	refunds   int
+	cancelled int
+	overrides map[string]int
+}
+
+func (l *fakeLimiter) Limit(ctx context.Context, userId string, respClient resp.IClient) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.users = append(l.users, userId)
+	return l.allow, l.err
+}
+
+func (l *fakeLimiter) Refund(ctx context.Context, userId string, respClient resp.IClient) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refunds++
+	if ctx.Err() != nil {
+		// the refund can't reach redis on a done context
+		l.cancelled++
+	}
+	return nil
+}
+
+func (l *fakeLimiter) Plan(ctx context.Context, userId string, respClient resp.IClient) (int, error) {
+	return l.plan, nil
+}
+
+func (l *fakeLimiter) SetPlanOverride(ctx context.Context, userId string, limit int, ttl int, respClient resp.IClient) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.overrides == nil {
+		l.overrides = map[string]int{}
+	}
+	l.overrides[userId] = limit
+	return nil
+}
+
+func (l *fakeLimiter) ClearPlanOverride(ctx context.Context, userId string, respClient resp.IClient) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.overrides, userId)
+	return nil
+}
+
+func (l *fakeLimiter) Features(ctx context.Context, userId string, respClient resp.IClient) (map[string]bool, error) {
+	return l.features, nil
+}
+
+// fakeCache pass the requests through to the upstream, or serve the hit if any
+type fakeCache struct {
+	cache.ICache
+	served  int32
+	batches int32
+	hit     string
+}
+
+func (c *fakeCache) ServeHTTP(rw http.ResponseWriter, req *http.Request, next http.Handler, respClient resp.IClient, userId string) {
+	atomic.AddInt32(&c.served, 1)
+	if c.hit != "" {
+		_, _ = io.WriteString(rw, c.hit)
+		return
+	}
+	next.ServeHTTP(rw, req)
+}
+
+func (c *fakeCache) ServeCached(rw http.ResponseWriter, req *http.Request, respClient resp.IClient, userId string) bool {
+	if c.hit == "" {
+		return false
+	}
+	_, _ = io.WriteString(rw, c.hit)
+	return true
+}
+
+func (c *fakeCache) ServeBatch(rw http.ResponseWriter, req *http.Request, next http.Handler, respClient resp.IClient, userId string, calls []jsonrpc.Call) {
+	atomic.AddInt32(&c.batches, 1)
+	next.ServeHTTP(rw, req)
+}
+
+// testUpstream answer every request with the status and count the calls reaching it
+type testUpstream struct {
+	status int
+	body   string
+	calls  int32
+	header http.Header
+}
+
+func (u *testUpstream) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	atomic.AddInt32(&u.calls, 1)
+	for key, values := range u.header {
+		rw.Header()[key] = values
+	}
+	if u.status != 0 {
+		rw.WriteHeader(u.status)
+	}
+	_, _ = io.WriteString(rw, u.body)
+}
+
+func (u *testUpstream) count() int {
+	return int(atomic.LoadInt32(&u.calls))
+}
+
+func testConfig() *Config {
+	config := CreateConfig()
+	config.Pattern = "([a-z0-9]{42})"
+	config.APIKey = "secret"
+	config.ActivityAddress = "http://activity.invalid/stats"
+	config.PlanAddress = "http://plan.invalid/plans"
+	config.RedisAddress = "redis.invalid:6379"
+	config.CacheExpiry = 60
+	config.BufferSize = 100
+	config.BatchSize = 10
+	config.FlushInterval = 1
+	return config
+}
+
+// withRedis hand the clients of the test server to the requests
+func withRedis(server *redistest.Server) Option {
+	return WithRedisClientFactory(func(ctx context.Context, address string, auth string, db int) (resp.IClient, error) {
+		return server.Client(), nil
+	})
+}
+
+// newTestPlugin build the plugin, the services not given as options are faked
+func newTestPlugin(t *testing.T, config *Config, next http.Handler, opts ...Option) *Crossover {
+	t.Helper()
+	defaults := []Option{
+		withRedis(redistest.NewServer()),
+		WithActivityService(newFakeActivity()),
+		WithCacheService(&fakeCache{}),
+		WithLimiterService(&fakeLimiter{allow: true}),
+	}
+	handler, err := NewWithOptions(context.Background(), next, config, "test", append(defaults, opts...)...)
+	if err != nil {
+		t.Fatalf("failed to create the plugin: %s", err)
+	}
+	crossover := handler.(*Crossover)
+	t.Cleanup(func() {
+		_ = crossover.Close()
+	})
+	return crossover
+}
+
+func do(handler http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+	return rw
+}
+
+func rpcRequest(body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, testPath, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+func TestServeHTTPAllowed(t *testing.T) {
+	activityService, cacheService, limiterService := newFakeActivity(), &fakeCache{}, &fakeLimiter{allow: true}
+	upstream := &testUpstream{body: "ok"}
+	crossover := newTestPlugin(t, testConfig(), upstream,
+		WithActivityService(activityService), WithCacheService(cacheService), WithLimiterService(limiterService))
+
+	rw := do(crossover, rpcRequest(`[{"jsonrpc":"2.0","id":1,"method":"eth_chainId"},{"jsonrpc":"2.0","id":2,"method":"eth_blockNumber"}]`))
+
+	if rw.Code != http.StatusOK || rw.Body.String() != "ok" {
+		t.Fatalf("expected the upstream response, got %d %s", rw.Code, rw.Body.String())
+	}
+	if len(limiterService.users) != 1 || limiterService.users[0] != testUserId {
+		t.Errorf("expected the user %s to be limited, got %v", testUserId, limiterService.users)
+	}
+	if count := activityService.logged(testRequestId); count != 2 {
+		t.Errorf("expected the batch to be metered as 2 requests, got %d", count)
+	}
+	if cacheService.served != 1 || upstream.count() != 1 {
+		t.Errorf("expected the request to go through the cache to the upstream, got %d cache and %d upstream calls", cacheService.served, upstream.count())
+	}
+}
+
+func TestServeHTTPCacheHit(t *testing.T) {
+	cacheService := &fakeCache{hit: "cached"}
+	upstream := &testUpstream{body: "ok"}
+	crossover := newTestPlugin(t, testConfig(), upstream, WithCacheService(cacheService))
+
+	rw := do(crossover, httptest.NewRequest(http.MethodGet, testPath, nil))
+
+	if rw.Body.String() != "cached" || upstream.count() != 0 {
+		t.Errorf("expected the cached response without calling the upstream, got %s and %d upstream calls", rw.Body.String(), upstream.count())
+	}
+}
+
+func TestServeHTTPDenied(t *testing.T) {
+	tests := []struct {
+		name   string
+		allow  bool
+		err    error
+		status int
+	}{
+		{"denied", false, nil, http.StatusTooManyRequests},
+		{"rate limited", false, &limiter.RateLimitError{Limit: 10, ResetSeconds: 1}, http.StatusTooManyRequests},
+		{"plan timeout", false, limiter.ErrPlanTimeout, http.StatusGatewayTimeout},
+		{"plan unavailable", false, limiter.ErrPlanUnavailable, http.StatusServiceUnavailable},
+		{"redis unavailable", false, limiter.ErrRedisUnavailable, http.StatusServiceUnavailable},
+		{"unexpected", false, errors.New("unexpected"), http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			activityService, cacheService := newFakeActivity(), &fakeCache{}
+			upstream := &testUpstream{body: "ok"}
+			crossover := newTestPlugin(t, testConfig(), upstream,
+				WithActivityService(activityService), WithCacheService(cacheService), WithLimiterService(&fakeLimiter{allow: test.allow, err: test.err}))
+
+			rw := do(crossover, httptest.NewRequest(http.MethodGet, testPath, nil))
+
+			if rw.Code != test.status {
+				t.Errorf("expected %d, got %d", test.status, rw.Code)
+			}
+			if upstream.count() != 0 || cacheService.served != 0 || activityService.logged(testRequestId) != 0 {
+				t.Errorf("expected the denied request to be neither served nor metered")
+			}
+		})
+	}
+}
+
+func TestServeHTTPInvalidRequestId(t *testing.T) {
+	limiterService := &fakeLimiter{allow: true}
+	upstream := &testUpstream{body: "ok"}
+	crossover := newTestPlugin(t, testConfig(), upstream, WithLimiterService(limiterService))
+
+	rw := do(crossover, httptest.NewRequest(http.MethodGet, "/unknown", nil))
+
+	if rw.Code != http.StatusBadRequest || upstream.count() != 0 || len(limiterService.users) != 0 {
+		t.Errorf("expected 400 without limiting nor forwarding, got %d", rw.Code)
+	}
+}
+
+func TestCloseFlushesActivity(t *testing.T) {
+	activityService := newFakeActivity()
+	crossover := newTestPlugin(t, testConfig(), &testUpstream{}, WithActivityService(activityService))
+
+	if err := crossover.Close(); err != nil {
+		t.Fatalf("failed to close the plugin: %s", err)
+	}
+	if activityService.closed != 1 {
+		t.Errorf("expected the activity service to be closed once, got %d", activityService.closed)
+	}
+}
+
+func TestRateLimitedJSONBody(t *testing.T) {
+	config := testConfig()
+	config.RateLimitJSONBody = true
+	rateLimitErr := &limiter.RateLimitError{Limit: 10, Remaining: 0, ResetSeconds: 7}
+	crossover := newTestPlugin(t, config, &testUpstream{}, WithLimiterService(&fakeLimiter{err: rateLimitErr}))
+
+	rw := do(crossover, httptest.NewRequest(http.MethodGet, testPath, nil))
+
+	if rw.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", rw.Code)
+	}
+	if contentType := rw.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("expected a json body, got the Content-Type %q", contentType)
+	}
+	var body rateLimitBody
+	if err := json.Unmarshal(rw.Body.Bytes(), &body); err != nil {
+		t.Fatalf("failed to decode the body %s: %s", rw.Body.String(), err)
+	}
+	fields := map[string]int{
+		"X-RateLimit-Limit":     body.Limit,
+		"X-RateLimit-Remaining": body.Remaining,
+		"X-RateLimit-Reset":     body.ResetSeconds,
+		"Retry-After":           body.RetryAfter,
+	}
+	for header, value := range fields {
+		if rw.Header().Get(header) != strconv.Itoa(value) {
+			t.Errorf("expected the %s header %q to match the body value %d", header, rw.Header().Get(header), value)
+		}
+	}
+	if body.Limit != 10 || body.ResetSeconds != 7 {
+		t.Errorf("expected the limiter state in the body, got %+v", body)
+	}
+}
+
+func TestRateLimitedPlainBody(t *testing.T) {
+	rateLimitErr := &limiter.RateLimitError{Limit: 10, ResetSeconds: 7}
+	crossover := newTestPlugin(t, testConfig(), &testUpstream{}, WithLimiterService(&fakeLimiter{err: rateLimitErr}))
+
+	rw := do(crossover, httptest.NewRequest(http.MethodGet, testPath, nil))
+
+	if rw.Code != http.StatusTooManyRequests || rw.Header().Get("Content-Type") == "application/json" {
+		t.Errorf("expected a plain 429 without the json body, got %d %q", rw.Code, rw.Header().Get("Content-Type"))
+	}
+	if rw.Header().Get("X-RateLimit-Reset") != "7" {
+		t.Errorf("expected the rate limit headers, got %v", rw.Header())
+	}
+}
+
+func TestUserAuthorizer(t *testing.T) {
+	errUnauthorized := errors.New("token subject doesn't match the path user")
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"authorized", testUserId, http.StatusOK},
+		{"unauthorized", "another-user", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiterService := &fakeLimiter{allow: true}
+			upstream := &testUpstream{body: "ok"}
+			authorizeUser := func(ctx context.Context, userId string, req *http.Request) error {
+				if req.Header.Get("Authorization") != "Bearer "+userId {
+					return errUnauthorized
+				}
+				return nil
+			}
+			crossover := newTestPlugin(t, testConfig(), upstream, WithLimiterService(limiterService), WithUserAuthorizer(authorizeUser))
+
+			req := httptest.NewRequest(http.MethodGet, testPath, nil)
+			req.Header.Set("Authorization", "Bearer "+test.token)
+			rw := do(crossover, req)
+
+			if rw.Code != test.status {
+				t.Fatalf("expected %d, got %d", test.status, rw.Code)
+			}
+			if test.status == http.StatusForbidden && (upstream.count() != 0 || len(limiterService.users) != 0) {
+				t.Errorf("expected the unauthorized user to be neither limited nor forwarded")
+			}
+		})
+	}
+}
+
+func TestRefundOnUpstreamError(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		hit     string
+		refunds int
+	}{
+		{"server error", http.StatusInternalServerError, "", 1},
+		{"bad gateway", http.StatusBadGateway, "", 1},
+		{"success", http.StatusOK, "", 0},
+		{"client error", http.StatusNotFound, "", 0},
+		{"cache hit", http.StatusInternalServerError, "cached", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.RefundOnUpstreamError = true
+			limiterService := &fakeLimiter{allow: true}
+			crossover := newTestPlugin(t, config, &testUpstream{status: test.status},
+				WithLimiterService(limiterService), WithCacheService(&fakeCache{hit: test.hit}))
+
+			do(crossover, httptest.NewRequest(http.MethodGet, testPath, nil))
+
+			if limiterService.refunds != test.refunds {
+				t.Errorf("expected %d refunds, got %d", test.refunds, limiterService.refunds)
+			}
+		})
+	}
+}
+
+func TestActivityOnSuccess(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		statuses []int
+		logged   int
+	}{
+		{"success", http.StatusOK, nil, 1},
+		{"server error", http.StatusInternalServerError, nil, 0},
+		{"listed status", http.StatusNotFound, []int{http.StatusOK, http.StatusNotFound}, 1},
+		{"unlisted status", http.StatusAccepted, []int{http.StatusOK}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.ActivityOnSuccess = true
+			config.ActivitySuccessStatuses = test.statuses
+			activityService := newFakeActivity()
+			crossover := newTestPlugin(t, config, &testUpstream{status: test.status}, WithActivityService(activityService))
+
+			do(crossover, rpcRequest(`{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`))
+
+			if count := activityService.logged(testRequestId); count != test.logged {
+				t.Errorf("expected %d metered requests, got %d", test.logged, count)
+			}
+		})
+	}
+}
+
+func TestActivityOnSuccessCarriesCount(t *testing.T) {
+	config := testConfig()
+	config.ActivityOnSuccess = true
+	activityService := newFakeActivity()
+	crossover := newTestPlugin(t, config, &testUpstream{body: "ok"}, WithActivityService(activityService))
+
+	do(crossover, rpcRequest(`[{"jsonrpc":"2.0","id":1,"method":"eth_chainId"},{"jsonrpc":"2.0","id":2,"method":"eth_blockNumber"},{"jsonrpc":"2.0","id":3,"method":"eth_gasPrice"}]`))
+
+	if count := activityService.logged(testRequestId); count != 3 {
+		t.Errorf("expected the deferred log to carry the batch count 3, got %d", count)
+	}
+}
+
+func TestCacheTTLOverride(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		ttl  int
+	}{
+		{"trusted", "secret", 300},
+		{"untrusted", "", 60},
+		{"wrong key", "guess", 60},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := redistest.NewServer()
+			cacheService := cache.NewCache(cache.Options{CacheExpiry: 60})
+			var forwarded http.Header
+			upstream := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				forwarded = req.Header.Clone()
+				_, _ = io.WriteString(rw, "ok")
+			})
+			crossover := newTestPlugin(t, testConfig(), upstream, withRedis(server), WithCacheService(cacheService))
+
+			req := httptest.NewRequest(http.MethodGet, testPath, nil)
+			req.Header.Set("X-Cache-TTL-Override", "300")
+			if test.key != "" {
+				req.Header.Set(TrustedKeyHeader, test.key)
+			}
+			do(crossover, req)
+
+			keys := server.Keys("")
+			if len(keys) != 1 {
+				t.Fatalf("expected a single cached entry, got %v", keys)
+			}
+			if ttl := server.TTL(keys[0]); ttl != test.ttl {
+				t.Errorf("expected the ttl %d, got %d", test.ttl, ttl)
+			}
+			if forwarded.Get(TrustedKeyHeader) != "" {
+				t.Errorf("expected the trusted key not to reach the upstream")
+			}
+		})
+	}
+}
+
+func TestTrustedKeyStripped(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		path   string
+	}{
+		{"no ttl override header", "", testPath},
+		{"ttl override not requested", "X-Cache-TTL-Override", testPath},
+		{"post request", "X-Cache-TTL-Override", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.CacheTTLOverrideHeader = test.header
+			var forwarded http.Header
+			upstream := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				forwarded = req.Header.Clone()
+				_, _ = io.WriteString(rw, "ok")
+			})
+			crossover := newTestPlugin(t, config, upstream)
+
+			req := rpcRequest(`{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`)
+			if test.path != "" {
+				req = httptest.NewRequest(http.MethodGet, test.path, nil)
+			}
+			req.Header.Set(TrustedKeyHeader, "secret")
+			do(crossover, req)
+
+			if forwarded == nil {
+				t.Fatalf("expected the request to be forwarded")
+			}
+			if forwarded.Get(TrustedKeyHeader) != "" {
+				t.Errorf("expected the trusted key not to reach the upstream")
+			}
+		})
+	}
+}
+
+func TestPlanHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		expected string
+	}{
+		{"enabled", "X-Plan-Limit", "250"},
+		{"disabled", "", "1000000"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.PlanHeader = test.header
+			var forwarded string
+			upstream := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				forwarded = req.Header.Get("X-Plan-Limit")
+			})
+			crossover := newTestPlugin(t, config, upstream, WithLimiterService(&fakeLimiter{allow: true, plan: 250}))
+
+			req := httptest.NewRequest(http.MethodGet, testPath, nil)
+			req.Header.Set("X-Plan-Limit", "1000000")
+			do(crossover, req)
+
+			if forwarded != test.expected {
+				t.Errorf("expected the forwarded plan header %q, got %q", test.expected, forwarded)
+			}
+		})
+	}
+}
+
+func TestLegacyRequestPolicy(t *testing.T) {
+	emptyHost := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, testPath, nil)
+		req.Host, req.URL.Host = "", ""
+		return req
+	}
+	http10 := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, testPath, nil)
+		req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/1.0", 1, 0
+		return req
+	}
+	tests := []struct {
+		name   string
+		policy string
+		req    func() *http.Request
+		status int
+	}{
+		{"empty host normalized", LegacyNormalize, emptyHost, http.StatusOK},
+		{"http/1.0 normalized", LegacyNormalize, http10, http.StatusOK},
+		{"empty host rejected", LegacyReject, emptyHost, http.StatusBadRequest},
+		{"http/1.0 rejected", LegacyReject, http10, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.LegacyRequestPolicy = test.policy
+			upstream := &testUpstream{body: "ok"}
+			cacheService := cache.NewCache(cache.Options{CacheExpiry: 60})
+			crossover := newTestPlugin(t, config, upstream, WithCacheService(cacheService))
+
+			if rw := do(crossover, test.req()); rw.Code != test.status {
+				t.Fatalf("expected %d, got %d", test.status, rw.Code)
+			}
+			if test.status != http.StatusOK {
+				if upstream.count() != 0 {
+					t.Errorf("expected the rejected request not to be forwarded")
+				}
+				return
+			}
+			// the normalized request shares the cache key of a regular one
+			do(crossover, httptest.NewRequest(http.MethodGet, testPath, nil))
+			if upstream.count() != 1 {
+				t.Errorf("expected the regular request to hit the entry of the normalized one, got %d upstream calls", upstream.count())
+			}
+		})
+	}
+}
+
+// rpcBatch build a json-rpc batch body of count calls
+func rpcBatch(count int) string {
+	calls := make([]string, count)
+	for i := range calls {
+		calls[i] = `{"jsonrpc":"2.0","id":` + strconv.Itoa(i) + `,"method":"eth_blockNumber"}`
+	}
+	return "[" + strings.Join(calls, ",") + "]"
+}
+
+func TestMaxBatchSize(t *testing.T) {
+	tests := []struct {
+		name   string
+		calls  int
+		status int
+	}{
+		{"below the limit", 2, http.StatusOK},
+		{"at the limit", 3, http.StatusOK},
+		{"above the limit", 4, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.MaxBatchSize = 3
+			limiterService := &fakeLimiter{allow: true}
+			upstream := &testUpstream{body: "ok"}
+			crossover := newTestPlugin(t, config, upstream, WithLimiterService(limiterService))
+
+			rw := do(crossover, rpcRequest(rpcBatch(test.calls)))
+
+			if rw.Code != test.status {
+				t.Fatalf("expected %d, got %d %s", test.status, rw.Code, rw.Body.String())
+			}
+			if test.status == http.StatusBadRequest {
+				if rw.Header().Get("Content-Type") != "application/json" || !strings.Contains(rw.Body.String(), strconv.Itoa(jsonrpc.InvalidRequestCode)) {
+					t.Errorf("expected a json-rpc error body, got %s", rw.Body.String())
+				}
+				if upstream.count() != 0 || len(limiterService.users) != 0 {
+					t.Errorf("expected the oversized batch to be rejected before the quota and the upstream")
+				}
+			}
+		})
+	}
+}
+
+// trackedBody count the reads of a request body
+type trackedBody struct {
+	io.Reader
+	reads int32
+}
+
+func (b *trackedBody) Read(p []byte) (int, error) {
+	atomic.AddInt32(&b.reads, 1)
+	return b.Reader.Read(p)
+}
+
+func (b *trackedBody) Close() error {
+	return nil
+}
+
+func TestNonJSONBodyNotBuffered(t *testing.T) {
+	body := &trackedBody{Reader: strings.NewReader("binary payload")}
+	var forwarded io.ReadCloser
+	var readsBefore int32
+	upstream := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		forwarded, readsBefore = req.Body, atomic.LoadInt32(&body.reads)
+	})
+	activityService := newFakeActivity()
+	crossover := newTestPlugin(t, testConfig(), upstream, WithActivityService(activityService))
+
+	req := httptest.NewRequest(http.MethodPost, testPath, body)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	do(crossover, req)
+
+	if forwarded != io.ReadCloser(body) || readsBefore != 0 {
+		t.Errorf("expected the non-JSON body to reach the upstream untouched, it was read %d times", readsBefore)
+	}
+	if count := activityService.logged(testRequestId); count != 1 {
+		t.Errorf("expected the non-JSON request to count as 1, got %d", count)
+	}
+}
+
+func BenchmarkServeHTTPNonJSON(b *testing.B) {
+	crossover, err := NewWithOptions(context.Background(), &testUpstream{}, testConfig(), "bench",
+		withRedis(redistest.NewServer()), WithActivityService(newFakeActivity()), WithCacheService(&fakeCache{}), WithLimiterService(&fakeLimiter{allow: true}))
+	if err != nil {
+		b.Fatalf("failed to create the plugin: %s", err)
+	}
+	defer crossover.(*Crossover).Close()
+	payload := strings.Repeat("x", 64*1024)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := httptest.NewRequest(http.MethodPost, testPath, strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		do(crossover, req)
+	}
+}
+
+func TestDependencyRetryAfter(t *testing.T) {
+	config := testConfig()
+	config.DependencyRetryAfterMin, config.DependencyRetryAfterMax = 3, 7
+	tests := []struct {
+		name   string
+		err    error
+		status int
+	}{
+		{"plan unavailable", limiter.ErrPlanUnavailable, http.StatusServiceUnavailable},
+		{"redis unavailable", limiter.ErrRedisUnavailable, http.StatusServiceUnavailable},
+		{"plan timeout", limiter.ErrPlanTimeout, http.StatusGatewayTimeout},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			crossover := newTestPlugin(t, config, &testUpstream{}, WithLimiterService(&fakeLimiter{err: test.err}))
+			seen := map[int]bool{}
+			for i := 0; i < 50; i++ {
+				rw := do(crossover, httptest.NewRequest(http.MethodGet, testPath, nil))
+				retryAfter, err := strconv.Atoi(rw.Header().Get("Retry-After"))
+				if rw.Code != test.status || err != nil || retryAfter < 3 || retryAfter > 7 {
+					t.Fatalf("expected %d with a Retry-After within [3, 7], got %d %q", test.status, rw.Code, rw.Header().Get("Retry-After"))
+				}
+				seen[retryAfter] = true
+			}
+			if len(seen) < 2 {
+				t.Errorf("expected the Retry-After to be jittered, got %v", seen)
+			}
+		})
+	}
+}
+
+func TestPlanSubject(t *testing.T) {
+	resolveSubject := func(req *http.Request) string {
+		return strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	}
+	tests := []struct {
+		name          string
+		authorization string
+		subject       string
+	}{
+		{"token subject", "Bearer service-account", "service-account"},
+		{"no token", "", testUserId},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiterService := &fakeLimiter{allow: true}
+			crossover := newTestPlugin(t, testConfig(), &testUpstream{}, WithLimiterService(limiterService), WithSubjectResolver(resolveSubject))
+
+			req := httptest.NewRequest(http.MethodGet, testPath, nil)
+			if test.authorization != "" {
+				req.Header.Set("Authorization", test.authorization)
+			}
+			do(crossover, req)
+
+			if len(limiterService.users) != 1 || limiterService.users[0] != test.subject {
+				t.Errorf("expected the plan to be resolved for %s, got %v", test.subject, limiterService.users)
+			}
+		})
+	}
+}
+
+func TestServeCacheWhenThrottled(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		hit     string
+		status  int
+	}{
+		{"cached hit", true, "cached", http.StatusOK},
+		{"cache miss", true, "", http.StatusTooManyRequests},
+		{"disabled", false, "cached", http.StatusTooManyRequests},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.ServeCacheWhenThrottled = test.enabled
+			upstream := &testUpstream{body: "ok"}
+			throttled := &fakeLimiter{err: &limiter.RateLimitError{Limit: 10, ResetSeconds: 30}}
+			crossover := newTestPlugin(t, config, upstream, WithLimiterService(throttled), WithCacheService(&fakeCache{hit: test.hit}))
+
+			rw := do(crossover, httptest.NewRequest(http.MethodGet, testPath, nil))
+
+			if rw.Code != test.status {
+				t.Fatalf("expected %d, got %d", test.status, rw.Code)
+			}
+			if test.status == http.StatusOK && rw.Body.String() != test.hit {
+				t.Errorf("expected the cached response, got %s", rw.Body.String())
+			}
+			if upstream.count() != 0 {
+				t.Errorf("expected the throttled user never to reach the upstream")
+			}
+		})
+	}
+}
+
+func TestUpstreamExemplars(t *testing.T) {
+	config := testConfig()
+	config.MetricsPath = "/metrics"
+	crossover := newTestPlugin(t, config, &testUpstream{body: "ok"})
+	traceId := "4bf92f3577b34da6a3ce929d0e0e4736"
+	count := upstreamSeconds.Count()
+
+	req := rpcRequest(`{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`)
+	req.Header.Set("traceparent", "00-"+traceId+"-00f067aa0ba902b7-01")
+	do(crossover, req)
+	if delta := upstreamSeconds.Count() - count; delta != 1 {
+		t.Fatalf("expected the upstream latency to be observed once, got %d", delta)
+	}
+
+	scrape := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	scrape.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	rw := do(crossover, scrape)
+	if !strings.Contains(rw.Body.String(), `# {trace_id="`+traceId+`"}`) {
+		t.Errorf("expected the latency bucket to carry the trace exemplar, got\n%s", rw.Body.String())
+	}
+	if !strings.HasSuffix(rw.Body.String(), "# EOF\n") {
+		t.Errorf("expected the openmetrics exposition to end with # EOF")
+	}
+
+	rw = do(crossover, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if strings.Contains(rw.Body.String(), "trace_id") {
+		t.Errorf("expected no exemplars in the prometheus text format")
+	}
+}
+
+func TestTraceID(t *testing.T) {
+	tests := []struct {
+		name        string
+		traceparent string
+		traceId     string
+	}{
+		{"traced", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "4bf92f3577b34da6a3ce929d0e0e4736"},
+		{"untraced", "", ""},
+		{"zero trace id", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", ""},
+		{"not hex", "00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01", ""},
+		{"malformed", "00-4bf92f3577b34da6a3ce929d0e0e4736", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, testPath, nil)
+			req.Header.Set("traceparent", test.traceparent)
+			if traceId := traceID(req); traceId != test.traceId {
+				t.Errorf("expected the trace id %q, got %q", test.traceId, traceId)
+			}
+		})
+	}
+}
+
+func TestJSONContentTypes(t *testing.T) {
+	tests := []struct {
+		name         string
+		contentType  string
+		contentTypes []string
+		logged       int
+	}{
+		{"json", "application/json", nil, 2},
+		{"charset", "application/json; charset=utf-8", nil, 2},
+		{"json-rpc", "application/json-rpc", nil, 2},
+		{"case", "Application/JSON", nil, 2},
+		{"not json", "text/plain", nil, 1},
+		{"configured", "application/x-rpc", []string{"application/x-rpc"}, 2},
+		{"not configured", "application/json-rpc", []string{"application/json"}, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			if test.contentTypes != nil {
+				config.JSONContentTypes = test.contentTypes
+			}
+			activityService := newFakeActivity()
+			crossover := newTestPlugin(t, config, &testUpstream{body: "ok"}, WithActivityService(activityService))
+
+			req := rpcRequest(rpcBatch(2))
+			req.Header.Set("Content-Type", test.contentType)
+			do(crossover, req)
+
+			if count := activityService.logged(testRequestId); count != test.logged {
+				t.Errorf("expected %d metered requests, got %d", test.logged, count)
+			}
+		})
+	}
+}
+
+// blockingUpstream hold the requests until released
+type blockingUpstream struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (u *blockingUpstream) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	u.entered <- struct{}{}
+	<-u.release
+	_, _ = io.WriteString(rw, "ok")
+}
+
+func TestCloseDrainsInflightRequests(t *testing.T) {
+	tests := []struct {
+		name     string
+		drain    time.Duration
+		finished bool
+	}{
+		{"within the drain window", time.Second, true},
+		{"drain timeout", 50 * time.Millisecond, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			activityService := newFakeActivity()
+			upstream := &blockingUpstream{entered: make(chan struct{}), release: make(chan struct{})}
+			crossover := newTestPlugin(t, testConfig(), upstream, WithActivityService(activityService))
+			crossover.drainTimeout = test.drain
+
+			var finished int32
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				do(crossover, rpcRequest(`{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`))
+				atomic.StoreInt32(&finished, 1)
+			}()
+			<-upstream.entered
+			if test.finished {
+				// the request finishes a moment after the shutdown starts
+				time.AfterFunc(20*time.Millisecond, func() { close(upstream.release) })
+			}
+
+			if err := crossover.Close(); err != nil {
+				t.Fatalf("failed to close the plugin: %s", err)
+			}
+			if got := atomic.LoadInt32(&finished) == 1; got != test.finished {
+				t.Errorf("expected the in-flight request finished %v when Close returned, got %v", test.finished, got)
+			}
+			if activityService.closed != 1 {
+				t.Errorf("expected the activity service to be closed once, got %d", activityService.closed)
+			}
+			if !test.finished {
+				close(upstream.release)
+			}
+			<-done
+		})
+	}
+}
+
+func TestBlockTTL(t *testing.T) {
+	hash := "0x88e96d4537bea4d9c05d12549907b32561d3bf31f45aae734cdc119f13406cb6"
+	tests := []struct {
+		name   string
+		body   string
+		result string
+		ttl    int
+	}{
+		{"latest", `{"jsonrpc":"2.0","id":1,"method":"eth_getBalance","params":["0xabc","latest"]}`, `"0x1"`, 5},
+		{"numeric height", `{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber","params":["0x10d4f",false]}`, `{}`, 3600},
+		{"block hash", `{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByHash","params":["` + hash + `",false]}`, `{}`, 3600},
+		{"unknown block", `{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByHash","params":["` + hash + `",false]}`, `null`, 60},
+		{"no block", `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`, `"0x1"`, 60},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.VolatileBlockTTL = 5
+			config.PinnedBlockTTL = 3600
+			server := redistest.NewServer()
+			cacheService := cache.NewCache(cache.Options{CacheExpiry: 60, Methods: []string{http.MethodPost}})
+			upstream := &testUpstream{body: `{"jsonrpc":"2.0","id":1,"result":` + test.result + `}`}
+			crossover := newTestPlugin(t, config, upstream, withRedis(server), WithCacheService(cacheService))
+
+			do(crossover, rpcRequest(test.body))
+
+			keys := server.Keys("")
+			if len(keys) != 1 {
+				t.Fatalf("expected a single cached entry, got %v", keys)
+			}
+			if ttl := server.TTL(keys[0]); ttl != test.ttl {
+				t.Errorf("expected the ttl %d, got %d", test.ttl, ttl)
+			}
+		})
+	}
+}
+
+// unusedCache panic on any call, the cache must not be consulted
+type unusedCache struct {
+	cache.ICache
+}
+
+func TestCacheDisabled(t *testing.T) {
+	config := testConfig()
+	config.CacheEnabled = false
+	config.CacheExpiry = 0
+	config.ServeCacheWhenThrottled = true
+	activityService, limiterService := newFakeActivity(), &fakeLimiter{allow: true}
+	upstream := &testUpstream{body: "ok"}
+	crossover := newTestPlugin(t, config, upstream,
+		WithActivityService(activityService), WithLimiterService(limiterService), WithCacheService(&unusedCache{}))
+
+	rw := do(crossover, httptest.NewRequest(http.MethodGet, testPath, nil))
+	if rw.Code != http.StatusOK || rw.Body.String() != "ok" || upstream.count() != 1 {
+		t.Fatalf("expected the request to be forwarded to the upstream, got %d %s", rw.Code, rw.Body.String())
+	}
+	if len(limiterService.users) != 1 || activityService.logged(testRequestId) != 1 {
+		t.Errorf("expected the bypassed request to be limited and metered")
+	}
+
+	limiterService.allow = false
+	if rw := do(crossover, httptest.NewRequest(http.MethodGet, testPath, nil)); rw.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the throttled request not to be served from the disabled cache, got %d", rw.Code)
+	}
+}
+
+// deadlineUpstream record the deadline of the request context reaching it
+type deadlineUpstream struct {
+	status   int
+	deadline time.Time
+	ok       bool
+}
+
+func (u *deadlineUpstream) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	u.deadline, u.ok = req.Context().Deadline()
+	if u.status != 0 {
+		rw.WriteHeader(u.status)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout int
+		cache   cache.ICache
+	}{
+		{"disabled", 0, &fakeCache{}},
+		{"through the cache", 500, &fakeCache{}},
+		{"through the cache recorder", 500, cache.NewCache(cache.Options{CacheExpiry: 60})},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.RequestTimeout = test.timeout
+			upstream := &deadlineUpstream{}
+			crossover := newTestPlugin(t, config, upstream, WithCacheService(test.cache))
+
+			start := time.Now()
+			do(crossover, httptest.NewRequest(http.MethodGet, testPath, nil))
+			end := time.Now()
+
+			if test.timeout == 0 {
+				if upstream.ok {
+					t.Errorf("expected no deadline without a request timeout, got %s", upstream.deadline)
+				}
+				return
+			}
+			timeout := time.Duration(test.timeout) * time.Millisecond
+			if !upstream.ok || upstream.deadline.Before(start.Add(timeout)) || upstream.deadline.After(end.Add(timeout)) {
+				t.Errorf("expected the upstream to see a deadline %s after the request, got %s %t", timeout, upstream.deadline.Sub(start), upstream.ok)
+			}
+		})
+	}
+}
+
+func TestRequestTimeoutRefund(t *testing.T) {
+	config := testConfig()
+	config.RequestTimeout = 500
+	config.RefundOnUpstreamError = true
+	limiterService := &fakeLimiter{allow: true}
+	crossover := newTestPlugin(t, config, &deadlineUpstream{status: http.StatusBadGateway}, WithLimiterService(limiterService))
+
+	do(crossover, httptest.NewRequest(http.MethodGet, testPath, nil))
+
+	if limiterService.refunds != 1 || limiterService.cancelled != 0 {
+		t.Errorf("expected the refund on a live context, got %d refunds %d on a done context", limiterService.refunds, limiterService.cancelled)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	activityService := newFakeActivity()
+	upstream := &blockingUpstream{entered: make(chan struct{}), release: make(chan struct{})}
+	crossover := newTestPlugin(t, testConfig(), upstream, WithActivityService(activityService))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		do(crossover, rpcRequest(`{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`))
+	}()
+	<-upstream.entered
+
+	// the in-flight request outlives the shutdown context
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := crossover.Shutdown(ctx); err != nil {
+		t.Fatalf("failed to shut the plugin down: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the shutdown to stop draining with its context, took %s", elapsed)
+	}
+	if activityService.closed != 1 {
+		t.Errorf("expected the activity service to be closed once, got %d", activityService.closed)
+	}
+	close(upstream.release)
+	<-done
+}
+
+func TestRateLimitBatches(t *testing.T) {
+	config := testConfig()
+	config.RateLimitBatches = true
+	server := redistest.NewServer()
+	// the cached plan of the user grants 2 single calls and a single batch per window
+	server.Set(testUserId, "2")
+	server.Set(testUserId+limiter.PlanBatchKeySuffix, "1")
+	limiterService := limiter.NewLimiter(limiter.Options{PlanAddress: config.PlanAddress, Window: 60})
+	crossover := newTestPlugin(t, config, &testUpstream{body: "ok"}, withRedis(server), WithLimiterService(limiterService))
+
+	single := `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`
+	requests := []struct {
+		body   string
+		status int
+	}{
+		{rpcBatch(1), http.StatusOK},
+		{rpcBatch(1), http.StatusTooManyRequests},
+		{single, http.StatusOK},
+		{single, http.StatusOK},
+		{single, http.StatusTooManyRequests},
+	}
+	for i, request := range requests {
+		if rw := do(crossover, rpcRequest(request.body)); rw.Code != request.status {
+			t.Errorf("expected %d for the request %d, got %d", request.status, i+1, rw.Code)
+		}
+	}
+}
+
+func TestPlanServiceErrorNotLeaked(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+	}{
+		{"unavailable", fmt.Errorf("%w: dial tcp plan.internal:443: connection refused", limiter.ErrPlanUnavailable), http.StatusServiceUnavailable},
+		{"timeout", fmt.Errorf("%w: Get https://plan.internal: i/o timeout", limiter.ErrPlanTimeout), http.StatusGatewayTimeout},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			crossover := newTestPlugin(t, testConfig(), &testUpstream{}, WithLimiterService(&fakeLimiter{err: test.err}))
+
+			rw := do(crossover, httptest.NewRequest(http.MethodGet, testPath, nil))
+
+			if rw.Code != test.status || strings.Contains(rw.Body.String(), "plan.internal") {
+				t.Errorf("expected %d without the transport error, got %d %q", test.status, rw.Code, rw.Body.String())
+			}
+		})
+	}
+}
+
+func TestCloneRequestBodiesNotShared(t *testing.T) {
+	crossover := newTestPlugin(t, testConfig(), &testUpstream{})
+	first := rpcRequest(`{"user":"alice","secret":"a"}`)
+	if _, err := crossover.cloneRequest(first); err != nil {
+		t.Fatalf("failed to clone the request: %s", err)
+	}
+	// the next clone reuses the pooled buffer, it must not overwrite the body of the request in flight
+	if _, err := crossover.cloneRequest(rpcRequest(`{"user":"bob-----secret":"b"}`)); err != nil {
+		t.Fatalf("failed to clone the request: %s", err)
+	}
+
+	if body, _ := io.ReadAll(first.Body); string(body) != `{"user":"alice","secret":"a"}` {
+		t.Errorf("expected the first body to be kept, got %s", body)
+	}
+}
+
+func TestParseJSONRPCOnce(t *testing.T) {
+	crossover := newTestPlugin(t, testConfig(), &testUpstream{})
+	req := withParsedRPC(rpcRequest(rpcBatch(2)))
+
+	parsed, ok := crossover.parseJSONRPC(req)
+	if !ok || len(parsed.Calls) != 2 {
+		t.Fatalf("expected the batch of 2 calls to be parsed, got %v", parsed)
+	}
+	if again, _ := crossover.parseJSONRPC(req); again != parsed {
+		t.Errorf("expected the later calls to reuse the parsed body")
+	}
+	if body, _ := io.ReadAll(req.Body); string(body) != rpcBatch(2) {
+		t.Errorf("expected the body to be restored for the upstream, got %s", body)
+	}
+}
+
+// staleUpstream answer the first request at once, the next ones with status once released
+type staleUpstream struct {
+	status  int
+	calls   int32
+	release chan struct{}
+}
+
+func (u *staleUpstream) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if atomic.AddInt32(&u.calls, 1) == 1 {
+		_, _ = io.WriteString(rw, "v1")
+		return
+	}
+	<-u.release
+	rw.WriteHeader(u.status)
+}
+
+func TestSoftTimeoutHoldsRequestResources(t *testing.T) {
+	config := testConfig()
+	config.RefundOnUpstreamError = true
+	config.MaxConcurrentRequests = 1
+	config.RequestQueueSize = 1
+	server := redistest.NewServer()
+	cacheService := cache.NewCache(cache.Options{CacheExpiry: 1, SoftTimeout: 20, StaleTTL: 60, RedisClient: func(ctx context.Context) (resp.IClient, error) {
+		return server.Client(), nil
+	}})
+	limiterService := &fakeLimiter{allow: true}
+	upstream := &staleUpstream{status: http.StatusBadGateway, release: make(chan struct{})}
+	crossover := newTestPlugin(t, config, upstream, withRedis(server), WithCacheService(cacheService), WithLimiterService(limiterService))
+
+	do(crossover, httptest.NewRequest(http.MethodGet, testPath, nil))
+	server.Advance(2 * time.Second)
+	if rw := do(crossover, httptest.NewRequest(http.MethodGet, testPath, nil)); rw.Body.String() != "v1" {
+		t.Fatalf("expected the stale entry past the soft timeout, got %d %q", rw.Code, rw.Body.String())
+	}
+
+	// the upstream call still runs, it keeps the concurrency slot, the drain count and the refund decision
+	if inflight := atomic.LoadInt64(&crossover.inflight); inflight != 1 {
+		t.Errorf("expected the background call to be counted in flight, got %d", inflight)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if rw := do(crossover, httptest.NewRequest(http.MethodGet, testPath, nil).WithContext(ctx)); rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected the next request to wait for the slot of the background call, got %d", rw.Code)
+	}
+
+	close(upstream.release)
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt64(&crossover.inflight) > 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if inflight := atomic.LoadInt64(&crossover.inflight); inflight != 0 {
+		t.Fatalf("expected the background call to release the request, got %d in flight", inflight)
+	}
+	limiterService.mu.Lock()
+	refunds := limiterService.refunds
+	limiterService.mu.Unlock()
+	if refunds != 1 {
+		t.Errorf("expected the 5xx of the background call to be refunded, got %d refunds", refunds)
+	}
+}
@@ -0,0 +1,50 @@
+package crossover_managed
+
+import (
+	"net/http"
+	"sync"
+)
+
+// statusRecorder capture the status code written by the upstream while writing through to the wrapped ResponseWriter
+// the upstream may still write once the request returned, e.g. to refresh the cache after a soft timeout, read it with code
+type statusRecorder struct {
+	rw     http.ResponseWriter
+	mu     sync.Mutex
+	status int
+}
+
+// record keep the first status written
+func (r *statusRecorder) record(statusCode int) {
+	r.mu.Lock()
+	if r.status == 0 {
+		r.status = statusCode
+	}
+	r.mu.Unlock()
+}
+
+// code return the recorded status, 0 until a status is written
+func (r *statusRecorder) code() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status
+}
+
+func (r *statusRecorder) Header() http.Header {
+	return r.rw.Header()
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.record(http.StatusOK)
+	return r.rw.Write(b)
+}
+
+func (r *statusRecorder) WriteHeader(statusCode int) {
+	r.record(statusCode)
+	r.rw.WriteHeader(statusCode)
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.rw.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
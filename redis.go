@@ -0,0 +1,186 @@
+package crossover_managed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/kotalco/crossover-managed/cache"
+	"github.com/kotalco/crossover-managed/metrics"
+	"github.com/kotalco/resp"
+)
+
+const (
+	MaxRedisDB = 15 // highest logical database of the default redis configuration
+	SelectCmd  = "*2\r\n$6\r\nSELECT\r\n$%d\r\n%d\r\n"
+)
+
+var (
+	ErrTooManyRedisOps = errors.New("too many redis operations for a single request")
+	ErrRedisDiscarded  = errors.New("redis connection discarded after an invalid reply")
+
+	redisOpsPerRequest = metrics.NewHistogram("crossover_redis_ops_per_request", "Number of redis operations made by a single request", []float64{1, 2, 3, 4, 5, 6, 8, 10, 15, 20})
+)
+
+// RedisClientFactory create the redis client used by a single request
+type RedisClientFactory func(ctx context.Context, address string, auth string, db int) (resp.IClient, error)
+
+// newRedisClient connect to redis and select the configured logical database
+func newRedisClient(ctx context.Context, address string, auth string, db int) (resp.IClient, error) {
+	client, err := dialRedis(ctx, resp.NewDialer(), address, auth)
+	if err != nil {
+		if auth != "" {
+			return nil, fmt.Errorf("redis %s: %w, check it's reachable and accepts the RedisAuth", address, err)
+		}
+		return nil, fmt.Errorf("redis %s: %w", address, err)
+	}
+	if db == 0 {
+		return client, nil
+	}
+	dbLength := len(fmt.Sprintf("%d", db))
+	reply, err := client.Do(ctx, fmt.Sprintf(SelectCmd, dbLength, db))
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	if reply != "OK" {
+		client.Close()
+		return nil, fmt.Errorf("select: unexpected response from server %s", reply)
+	}
+	return client, nil
+}
+
+// unavailableClient stand in for redis when the connection can't be established, every operation fails
+// it lets the limiter fallback and the cache miss path handle the outage instead of rejecting the requests
+type unavailableClient struct {
+	err error
+}
+
+func (c *unavailableClient) Do(ctx context.Context, command string) (string, error) {
+	return "", c.err
+}
+
+func (c *unavailableClient) Ping(ctx context.Context) (string, error) {
+	return "", c.err
+}
+
+func (c *unavailableClient) Set(ctx context.Context, key string, value string) error {
+	return c.err
+}
+
+func (c *unavailableClient) SetWithTTL(ctx context.Context, key string, value string, ttl int) error {
+	return c.err
+}
+
+func (c *unavailableClient) Get(ctx context.Context, key string) (string, error) {
+	return "", c.err
+}
+
+func (c *unavailableClient) Delete(ctx context.Context, key string) error {
+	return c.err
+}
+
+func (c *unavailableClient) Incr(ctx context.Context, key string) (int, error) {
+	return 0, c.err
+}
+
+func (c *unavailableClient) Expire(ctx context.Context, key string, seconds int) (bool, error) {
+	return false, c.err
+}
+
+func (c *unavailableClient) Close() error {
+	return nil
+}
+
+// countingClient count the redis operations made by a single request and reject them beyond maxOps
+type countingClient struct {
+	client    resp.IClient
+	ops       int
+	maxOps    int
+	discarded bool
+}
+
+func newCountingClient(client resp.IClient, maxOps int) *countingClient {
+	return &countingClient{client: client, maxOps: maxOps}
+}
+
+// count increment the operations counter and check it against maxOps
+func (c *countingClient) count() error {
+	if c.discarded {
+		return ErrRedisDiscarded
+	}
+	c.ops++
+	if c.maxOps > 0 && c.ops > c.maxOps {
+		return ErrTooManyRedisOps
+	}
+	return nil
+}
+
+func (c *countingClient) Do(ctx context.Context, command string) (string, error) {
+	if err := c.count(); err != nil {
+		return "", err
+	}
+	return c.client.Do(ctx, command)
+}
+
+func (c *countingClient) Ping(ctx context.Context) (string, error) {
+	if err := c.count(); err != nil {
+		return "", err
+	}
+	return c.client.Ping(ctx)
+}
+
+func (c *countingClient) Set(ctx context.Context, key string, value string) error {
+	if err := c.count(); err != nil {
+		return err
+	}
+	return c.client.Set(ctx, key, value)
+}
+
+func (c *countingClient) SetWithTTL(ctx context.Context, key string, value string, ttl int) error {
+	if err := c.count(); err != nil {
+		return err
+	}
+	return c.client.SetWithTTL(ctx, key, value, ttl)
+}
+
+func (c *countingClient) Get(ctx context.Context, key string) (string, error) {
+	if err := c.count(); err != nil {
+		return "", err
+	}
+	return c.client.Get(ctx, key)
+}
+
+func (c *countingClient) Delete(ctx context.Context, key string) error {
+	if err := c.count(); err != nil {
+		return err
+	}
+	return c.client.Delete(ctx, key)
+}
+
+func (c *countingClient) Incr(ctx context.Context, key string) (int, error) {
+	if err := c.count(); err != nil {
+		return 0, err
+	}
+	return c.client.Incr(ctx, key)
+}
+
+func (c *countingClient) Expire(ctx context.Context, key string, seconds int) (bool, error) {
+	if err := c.count(); err != nil {
+		return false, err
+	}
+	return c.client.Expire(ctx, key, seconds)
+}
+
+// Discard fail the next operations of the request and drop the underlying connection once released
+func (c *countingClient) Discard() {
+	c.discarded = true
+	if discarder, ok := c.client.(cache.Discarder); ok {
+		discarder.Discard()
+	}
+}
+
+// Close release the underlying connection and record the number of operations made
+func (c *countingClient) Close() error {
+	redisOpsPerRequest.Observe(float64(c.ops))
+	return c.client.Close()
+}
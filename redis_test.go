@@ -0,0 +1,204 @@
+package crossover_managed
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/kotalco/crossover-managed/cache"
+	"github.com/kotalco/crossover-managed/internal/redistest"
+	"github.com/kotalco/resp"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRedisOpsPerRequest(t *testing.T) {
+	server := redistest.NewServer()
+	cacheService := cache.NewCache(cache.Options{CacheExpiry: 60})
+	crossover := newTestPlugin(t, testConfig(), &testUpstream{body: "ok"}, withRedis(server), WithCacheService(cacheService))
+
+	do(crossover, httptest.NewRequest(http.MethodGet, testPath, nil))
+	if ops := server.Total(); ops != 2 {
+		t.Errorf("expected a miss to get and set the entry, got %d ops", ops)
+	}
+	server.Reset()
+	do(crossover, httptest.NewRequest(http.MethodGet, testPath, nil))
+	if ops := server.Total(); ops != 1 {
+		t.Errorf("expected a hit to only get the entry, got %d ops", ops)
+	}
+}
+
+func TestCountingClientMaxOps(t *testing.T) {
+	server := redistest.NewServer()
+	client := newCountingClient(server.Client(), 2)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.Get(ctx, "key"); err != nil {
+			t.Fatalf("unexpected error within the cap: %s", err)
+		}
+	}
+	if _, err := client.Get(ctx, "key"); !errors.Is(err, ErrTooManyRedisOps) {
+		t.Errorf("expected ErrTooManyRedisOps past the cap, got %v", err)
+	}
+	if server.Total() != 2 {
+		t.Errorf("expected the rejected op not to reach redis, got %d ops", server.Total())
+	}
+}
+
+func TestRedisDB(t *testing.T) {
+	config := testConfig()
+	config.RedisDB = 3
+	server := redistest.NewServer()
+	var databases []int
+	factory := WithRedisClientFactory(func(ctx context.Context, address string, auth string, db int) (resp.IClient, error) {
+		databases = append(databases, db)
+		return server.Client(), nil
+	})
+	crossover := newTestPlugin(t, config, &testUpstream{body: "ok"}, factory)
+
+	do(crossover, httptest.NewRequest(http.MethodGet, testPath, nil))
+
+	if len(databases) == 0 {
+		t.Fatalf("expected the request to connect to redis")
+	}
+	for _, db := range databases {
+		if db != 3 {
+			t.Errorf("expected the connections to select the database 3, got %d", db)
+		}
+	}
+}
+
+func TestRedisDBOutOfRange(t *testing.T) {
+	for _, db := range []int{-1, MaxRedisDB + 1} {
+		config := testConfig()
+		config.RedisDB = db
+		if _, err := New(context.Background(), &testUpstream{}, config, "test"); err == nil || !strings.Contains(err.Error(), "redisDB") {
+			t.Errorf("expected the database %d to be rejected, got %v", db, err)
+		}
+	}
+}
+
+func TestRedisAuthForwarded(t *testing.T) {
+	config := testConfig()
+	config.RedisAuth = "hunter2"
+	server := redistest.NewServer()
+	var auths []string
+	factory := WithRedisClientFactory(func(ctx context.Context, address string, auth string, db int) (resp.IClient, error) {
+		auths = append(auths, auth)
+		return server.Client(), nil
+	})
+	crossover := newTestPlugin(t, config, &testUpstream{body: "ok"}, factory)
+
+	do(crossover, httptest.NewRequest(http.MethodGet, testPath, nil))
+
+	if len(auths) == 0 {
+		t.Fatalf("expected the request to connect to redis")
+	}
+	for _, auth := range auths {
+		if auth != "hunter2" {
+			t.Errorf("expected the RedisAuth to be forwarded to the client, got %q", auth)
+		}
+	}
+}
+
+// authServer accept the redis connections, it answers the AUTH commands and records them
+type authServer struct {
+	mu       sync.Mutex
+	password string
+	commands []string
+}
+
+func newAuthServer(t *testing.T, password string) (*authServer, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	server := &authServer{password: password}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server, listener.Addr().String()
+}
+
+func (s *authServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.TrimSpace(line)
+		s.mu.Lock()
+		s.commands = append(s.commands, command)
+		s.mu.Unlock()
+		if command == "AUTH "+s.password {
+			_, _ = conn.Write([]byte("+OK\r\n"))
+		} else {
+			_, _ = conn.Write([]byte("-ERR invalid password\r\n"))
+		}
+	}
+}
+
+func (s *authServer) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+func TestNewRedisClientAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		auth     string
+		commands []string
+		err      bool
+	}{
+		{"accepted", "hunter2", []string{"AUTH hunter2"}, false},
+		{"rejected", "guess", []string{"AUTH guess"}, true},
+		{"no auth", "", nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, address := newAuthServer(t, "hunter2")
+
+			client, err := newRedisClient(context.Background(), address, test.auth, 0)
+			if client != nil {
+				client.Close()
+			}
+
+			if test.err {
+				if err == nil || !strings.Contains(err.Error(), address) || !strings.Contains(err.Error(), "RedisAuth") {
+					t.Errorf("expected an error naming the address and the RedisAuth, got %v", err)
+				}
+			} else if err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			if received := server.received(); strings.Join(received, ",") != strings.Join(test.commands, ",") {
+				t.Errorf("expected the commands %v, got %v", test.commands, received)
+			}
+		})
+	}
+}
+
+func TestValidateRedisAuth(t *testing.T) {
+	for _, auth := range []string{"two words", "tab\tted", "line\n"} {
+		config := testConfig()
+		config.RedisAuth = auth
+		if err := config.validate(); err == nil || !strings.Contains(err.Error(), "redisAuth") {
+			t.Errorf("expected the RedisAuth %q to be rejected, got %v", auth, err)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package crossover_managed
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/kotalco/resp"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RedisDialTimeout bound the dial and the authentication of a redis connection
+const RedisDialTimeout = 5 * time.Second
+
+var errMalformedBulk = errors.New("malformed bulk reply")
+
+// respClient speak the same resp subset as resp.Client but read the bulk replies whole, resp.Client reads them with a
+// single Read returning at most its buffered bytes and leaves the rest of the large replies on the connection
+type respClient struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+}
+
+// dialRedis connect to redis and authenticate the connection if auth is set
+func dialRedis(ctx context.Context, dialer resp.IDialer, address string, auth string) (*respClient, error) {
+	ctx, cancel := context.WithTimeout(ctx, RedisDialTimeout)
+	defer cancel()
+
+	conn, err := dialer.Dial(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	client := &respClient{conn: conn, rw: bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))}
+	if auth != "" {
+		if err := client.send(ctx, "AUTH "+auth); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		reply, err := client.receive(ctx)
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		if reply != "OK" {
+			_ = conn.Close()
+			return nil, errors.New("authentication failed")
+		}
+	}
+	return client, nil
+}
+
+// redisDeadline return the deadline of the context, 5 seconds from now if it has none
+func redisDeadline(ctx context.Context) time.Time {
+	if deadline, ok := ctx.Deadline(); ok {
+		return deadline
+	}
+	return time.Now().Add(5 * time.Second)
+}
+
+func (c *respClient) send(ctx context.Context, command string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := c.conn.SetWriteDeadline(redisDeadline(ctx)); err != nil {
+		return err
+	}
+	if _, err := c.rw.WriteString(command + "\r\n"); err != nil {
+		return err
+	}
+	return c.rw.Flush()
+}
+
+// receive read a reply, the simple strings and the bulk ones are returned without their prefix, the other replies as is
+func (c *respClient) receive(ctx context.Context) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if err := c.conn.SetReadDeadline(redisDeadline(ctx)); err != nil {
+		return "", err
+	}
+	line, err := c.rw.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	switch line[0] {
+	case '-':
+		return "", errors.New(strings.TrimSuffix(line[1:], "\r\n"))
+	case '$':
+		length, err := strconv.Atoi(strings.TrimSuffix(line[1:], "\r\n"))
+		if err != nil {
+			return "", errMalformedBulk
+		}
+		if length < 0 {
+			// nil reply
+			return "", nil
+		}
+		buf := make([]byte, length+2)
+		if _, err := io.ReadFull(c.rw, buf); err != nil {
+			return "", err
+		}
+		if buf[length] != '\r' || buf[length+1] != '\n' {
+			return "", errMalformedBulk
+		}
+		return string(buf[:length]), nil
+	case '+':
+		return strings.TrimSuffix(line[1:], "\r\n"), nil
+	default:
+		return strings.TrimSuffix(line, "\r\n"), nil
+	}
+}
+
+func (c *respClient) Do(ctx context.Context, command string) (string, error) {
+	type result struct {
+		reply string
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		if err := c.send(ctx, command); err != nil {
+			done <- result{err: err}
+			return
+		}
+		reply, err := c.receive(ctx)
+		done <- result{reply: reply, err: err}
+	}()
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case result := <-done:
+		return result.reply, result.err
+	}
+}
+
+func (c *respClient) Ping(ctx context.Context) (string, error) {
+	reply, err := c.Do(ctx, resp.PingCmd)
+	if err != nil {
+		return "", err
+	}
+	if reply != "PONG" {
+		return "", errors.New("unexpected response from server")
+	}
+	return reply, nil
+}
+
+func (c *respClient) Set(ctx context.Context, key string, value string) error {
+	reply, err := c.Do(ctx, fmt.Sprintf(resp.SendCmd, len(key), key, len(value), value))
+	if err != nil {
+		return err
+	}
+	if reply != "OK" {
+		return fmt.Errorf("set: unexpected response from server %s", reply)
+	}
+	return nil
+}
+
+func (c *respClient) SetWithTTL(ctx context.Context, key string, value string, ttl int) error {
+	reply, err := c.Do(ctx, fmt.Sprintf(resp.SetWithTTLCmd, len(key), key, len(value), value, len(strconv.Itoa(ttl)), ttl))
+	if err != nil {
+		return err
+	}
+	if reply != "OK" {
+		return fmt.Errorf("setWithTTL: unexpected response from server %s", reply)
+	}
+	return nil
+}
+
+func (c *respClient) Get(ctx context.Context, key string) (string, error) {
+	return c.Do(ctx, fmt.Sprintf(resp.GetCmd, len(key), key))
+}
+
+func (c *respClient) Delete(ctx context.Context, key string) error {
+	reply, err := c.Do(ctx, fmt.Sprintf(resp.DeleteCmd, len(key), key))
+	if err != nil {
+		return err
+	}
+	if reply != ":1" && reply != ":0" {
+		return fmt.Errorf("delete: unexpected response from server %s", reply)
+	}
+	return nil
+}
+
+func (c *respClient) Incr(ctx context.Context, key string) (int, error) {
+	reply, err := c.Do(ctx, fmt.Sprintf(resp.IncrCmd, len(key), key))
+	if err != nil {
+		return 0, err
+	}
+	var value int
+	if _, err := fmt.Sscanf(reply, ":%d", &value); err != nil {
+		return 0, fmt.Errorf("incr: unexpected response from server %s", reply)
+	}
+	return value, nil
+}
+
+func (c *respClient) Expire(ctx context.Context, key string, seconds int) (bool, error) {
+	reply, err := c.Do(ctx, fmt.Sprintf(resp.ExpireCmd, len(key), key, len(strconv.Itoa(seconds)), seconds))
+	if err != nil {
+		return false, err
+	}
+	switch reply {
+	case ":1":
+		return true, nil
+	case ":0":
+		return false, nil
+	default:
+		return false, fmt.Errorf("expire: unexpected response from server %s", reply)
+	}
+}
+
+func (c *respClient) Close() error {
+	return c.conn.Close()
+}
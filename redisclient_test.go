@@ -0,0 +1,73 @@
+package crossover_managed
+
+import (
+	"bufio"
+	"context"
+	"github.com/kotalco/resp"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newReplyServer answer the commands of every connection with the replies in order, each written in pieces
+func newReplyServer(t *testing.T, replies ...string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for _, reply := range replies {
+			if _, err := reader.ReadString('\n'); err != nil {
+				return
+			}
+			// a reply split across the writes arrives in several reads
+			half := len(reply) / 2
+			_, _ = conn.Write([]byte(reply[:half]))
+			time.Sleep(10 * time.Millisecond)
+			_, _ = conn.Write([]byte(reply[half:]))
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestRespClientLargeBulkReply(t *testing.T) {
+	value := strings.Repeat("x", 64*1024)
+	address := newReplyServer(t, "$"+strconv.Itoa(len(value))+"\r\n"+value+"\r\n", "+OK\r\n")
+	client, err := dialRedis(context.Background(), resp.NewDialer(), address, "")
+	if err != nil {
+		t.Fatalf("failed to dial: %s", err)
+	}
+	defer client.Close()
+
+	if reply, err := client.Get(context.Background(), "key"); err != nil || reply != value {
+		t.Fatalf("expected the whole %d bytes, got %d bytes %v", len(value), len(reply), err)
+	}
+	// the next reply must not be read from the rest of the previous one
+	if err := client.Set(context.Background(), "key", "value"); err != nil {
+		t.Errorf("expected the next reply to be in sync, got %s", err)
+	}
+}
+
+func TestRespClientMalformedBulkReply(t *testing.T) {
+	address := newReplyServer(t, "$3\r\nabcdef\r\n")
+	client, err := dialRedis(context.Background(), resp.NewDialer(), address, "")
+	if err != nil {
+		t.Fatalf("failed to dial: %s", err)
+	}
+	defer client.Close()
+
+	if _, err := client.Get(context.Background(), "key"); err != errMalformedBulk {
+		t.Errorf("expected the malformed bulk reply to be reported, got %v", err)
+	}
+}
@@ -0,0 +1,187 @@
+package crossover_managed
+
+import (
+	"context"
+	"github.com/kotalco/crossover-managed/metrics"
+	"github.com/kotalco/resp"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultRedisMaxConns     = 128
+	DefaultRedisMaxIdleConns = 8
+	RedisIdleCheck           = 10 * time.Second // idle connections older than it are pinged before their reuse
+)
+
+var (
+	poolInUse = metrics.NewGauge("crossover_redis_pool_in_use", "Number of pooled redis connections used by the requests")
+	poolIdle  = metrics.NewGauge("crossover_redis_pool_idle", "Number of idle redis connections kept open by the pool")
+	poolWaits = metrics.NewCounter("crossover_redis_pool_waits_total", "Number of requests that waited for a redis connection of an exhausted pool")
+)
+
+// redisPool reuse the redis connections across the requests, at most maxConns connections are open at once
+// and up to maxIdle of them are kept open between the requests, the others are closed once released
+type redisPool struct {
+	slots    chan struct{}
+	mu       sync.Mutex
+	idle     []idleConn
+	inUse    int
+	maxConns int
+	maxIdle  int
+}
+
+func newRedisPool(maxConns int, maxIdle int) *redisPool {
+	if maxConns <= 0 {
+		return nil
+	}
+	return &redisPool{slots: make(chan struct{}, maxConns), maxConns: maxConns, maxIdle: maxIdle}
+}
+
+// idleConn a connection kept open between the requests
+type idleConn struct {
+	client   resp.IClient
+	released time.Time
+}
+
+// get return an idle connection or dial a new one, waiting for a free slot until the context is done
+func (p *redisPool) get(ctx context.Context, dial func(ctx context.Context) (resp.IClient, error)) (resp.IClient, error) {
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		poolWaits.Inc()
+		select {
+		case p.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	p.mu.Lock()
+	p.inUse++
+	var idle idleConn
+	if last := len(p.idle) - 1; last >= 0 {
+		idle = p.idle[last]
+		p.idle = p.idle[:last]
+	}
+	p.report()
+	p.mu.Unlock()
+
+	client := idle.client
+	if client != nil && time.Since(idle.released) > RedisIdleCheck {
+		// the server or a NAT may have dropped the connection while it was idle
+		if _, err := client.Ping(ctx); err != nil {
+			_ = client.Close()
+			client = nil
+		}
+	}
+	if client == nil {
+		var err error
+		if client, err = dial(ctx); err != nil {
+			p.release(nil, true)
+			return nil, err
+		}
+	}
+	return &pooledClient{client: client, pool: p}, nil
+}
+
+// release hand the connection back, the broken ones and the ones past maxIdle are closed
+// the idle connections count towards maxConns so the pool never opens more of them
+func (p *redisPool) release(client resp.IClient, broken bool) {
+	p.mu.Lock()
+	p.inUse--
+	keep := client != nil && !broken && len(p.idle) < p.maxIdle && p.inUse+len(p.idle) < p.maxConns
+	if keep {
+		p.idle = append(p.idle, idleConn{client: client, released: time.Now()})
+	}
+	p.report()
+	p.mu.Unlock()
+	if !keep && client != nil {
+		_ = client.Close()
+	}
+	<-p.slots
+}
+
+// report the pool stats, the caller holds the lock
+func (p *redisPool) report() {
+	poolInUse.Set(float64(p.inUse))
+	poolIdle.Set(float64(len(p.idle)))
+}
+
+// pooledClient a connection borrowed from the pool, Close returns it to the pool
+// a connection that failed an operation may be left mid-reply and is never reused
+type pooledClient struct {
+	client resp.IClient
+	pool   *redisPool
+	broken bool
+}
+
+// check mark the connection broken on any failure
+func (c *pooledClient) check(err error) error {
+	if err != nil {
+		c.broken = true
+	}
+	return err
+}
+
+func (c *pooledClient) Do(ctx context.Context, command string) (string, error) {
+	reply, err := c.client.Do(ctx, command)
+	return reply, c.check(err)
+}
+
+func (c *pooledClient) Ping(ctx context.Context) (string, error) {
+	reply, err := c.client.Ping(ctx)
+	return reply, c.check(err)
+}
+
+func (c *pooledClient) Set(ctx context.Context, key string, value string) error {
+	return c.check(c.client.Set(ctx, key, value))
+}
+
+func (c *pooledClient) SetWithTTL(ctx context.Context, key string, value string, ttl int) error {
+	return c.check(c.client.SetWithTTL(ctx, key, value, ttl))
+}
+
+func (c *pooledClient) Get(ctx context.Context, key string) (string, error) {
+	value, err := c.client.Get(ctx, key)
+	return value, c.check(err)
+}
+
+func (c *pooledClient) Delete(ctx context.Context, key string) error {
+	return c.check(c.client.Delete(ctx, key))
+}
+
+func (c *pooledClient) Incr(ctx context.Context, key string) (int, error) {
+	value, err := c.client.Incr(ctx, key)
+	return value, c.check(err)
+}
+
+func (c *pooledClient) Expire(ctx context.Context, key string, seconds int) (bool, error) {
+	ok, err := c.client.Expire(ctx, key, seconds)
+	return ok, c.check(err)
+}
+
+// Discard never return the connection to the pool, its replies can't be trusted anymore
+func (c *pooledClient) Discard() {
+	c.broken = true
+}
+
+// Close return the connection to the pool, it must not be used afterwards
+func (c *pooledClient) Close() error {
+	if c.pool != nil {
+		c.pool.release(c.client, c.broken)
+		c.pool = nil
+	}
+	return nil
+}
+
+// redisClient borrow a connection of the pool, or create one with the factory when pooling is disabled
+func (crossover *Crossover) redisClient(ctx context.Context) (resp.IClient, error) {
+	dial := func(ctx context.Context) (resp.IClient, error) {
+		return crossover.redisClientFactory(ctx, crossover.redisAddress, crossover.redisAuth, crossover.redisDB)
+	}
+	if crossover.redisPool == nil {
+		return dial(ctx)
+	}
+	return crossover.redisPool.get(ctx, dial)
+}
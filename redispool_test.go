@@ -0,0 +1,159 @@
+package crossover_managed
+
+import (
+	"context"
+	"errors"
+	"github.com/kotalco/crossover-managed/internal/redistest"
+	"github.com/kotalco/resp"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingDial open the clients of the server, counting the dials
+func countingDial(server *redistest.Server, dials *int32) func(ctx context.Context) (resp.IClient, error) {
+	return func(ctx context.Context) (resp.IClient, error) {
+		atomic.AddInt32(dials, 1)
+		return server.Client(), nil
+	}
+}
+
+func TestRedisPoolMaxConns(t *testing.T) {
+	server := redistest.NewServer()
+	pool := newRedisPool(3, 2)
+	var dials int32
+	waits := poolWaits.Value()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client, err := pool.get(context.Background(), countingDial(server, &dials))
+			if err != nil {
+				t.Errorf("failed to get a connection: %s", err)
+				return
+			}
+			_, _ = client.Get(context.Background(), "key")
+			time.Sleep(time.Millisecond)
+			_ = client.Close()
+		}()
+	}
+	wg.Wait()
+
+	if maxOpen := server.MaxOpen(); maxOpen > 3 {
+		t.Errorf("expected at most 3 connections open at once, got %d", maxOpen)
+	}
+	if poolWaits.Value() == waits {
+		t.Errorf("expected the requests beyond the cap to wait for a connection")
+	}
+	if dials := atomic.LoadInt32(&dials); dials >= 50 {
+		t.Errorf("expected the connections to be reused, got %d dials", dials)
+	}
+	// the idle connections stay open up to the max idle
+	if poolInUse.Value() != 0 || poolIdle.Value() != 2 || server.Open() != 2 {
+		t.Errorf("expected 2 idle connections once released, got %v in use %v idle and %d open", poolInUse.Value(), poolIdle.Value(), server.Open())
+	}
+}
+
+func TestRedisPoolStats(t *testing.T) {
+	server := redistest.NewServer()
+	pool := newRedisPool(4, 4)
+	var dials int32
+
+	first, _ := pool.get(context.Background(), countingDial(server, &dials))
+	second, _ := pool.get(context.Background(), countingDial(server, &dials))
+	if poolInUse.Value() != 2 || poolIdle.Value() != 0 {
+		t.Errorf("expected 2 connections in use, got %v in use %v idle", poolInUse.Value(), poolIdle.Value())
+	}
+	_ = first.Close()
+	if poolInUse.Value() != 1 || poolIdle.Value() != 1 {
+		t.Errorf("expected 1 connection in use and 1 idle, got %v in use %v idle", poolInUse.Value(), poolIdle.Value())
+	}
+	_ = second.Close()
+	third, _ := pool.get(context.Background(), countingDial(server, &dials))
+	_ = third.Close()
+	if dials != 2 {
+		t.Errorf("expected the idle connection to be reused, got %d dials", dials)
+	}
+}
+
+func TestRedisPoolBrokenConnections(t *testing.T) {
+	server := redistest.NewServer()
+	pool := newRedisPool(2, 2)
+	var dials int32
+
+	client, _ := pool.get(context.Background(), countingDial(server, &dials))
+	server.Fail(errors.New("connection reset"))
+	_, _ = client.Get(context.Background(), "key")
+	server.Fail(nil)
+	_ = client.Close()
+
+	client, _ = pool.get(context.Background(), countingDial(server, &dials))
+	client.(*pooledClient).Discard()
+	_ = client.Close()
+
+	if server.Open() != 0 || dials != 2 {
+		t.Errorf("expected the failed and discarded connections to be closed, got %d open after %d dials", server.Open(), dials)
+	}
+}
+
+func TestRedisPoolIdleCheck(t *testing.T) {
+	server := redistest.NewServer()
+	pool := newRedisPool(2, 2)
+	var dials int32
+
+	client, _ := pool.get(context.Background(), countingDial(server, &dials))
+	_ = client.Close()
+	// the connection idled past the idle check and the server dropped it meanwhile
+	pool.idle[0].released = time.Now().Add(-2 * RedisIdleCheck)
+	server.FailOn("PING", errors.New("broken pipe"))
+
+	client, err := pool.get(context.Background(), countingDial(server, &dials))
+	if err != nil {
+		t.Fatalf("failed to get a connection: %s", err)
+	}
+	_ = client.Close()
+	if server.Count("PING") != 1 || dials != 2 || server.Open() != 1 {
+		t.Errorf("expected the dropped idle connection to be pinged and replaced, got %d pings %d dials %d open", server.Count("PING"), dials, server.Open())
+	}
+}
+
+func TestRedisPoolWaitContext(t *testing.T) {
+	server := redistest.NewServer()
+	pool := newRedisPool(1, 1)
+	var dials int32
+	held, _ := pool.get(context.Background(), countingDial(server, &dials))
+	defer held.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := pool.get(ctx, countingDial(server, &dials)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the wait for a connection to end with the context, got %v", err)
+	}
+}
+
+func TestServeHTTPRedisMaxConns(t *testing.T) {
+	config := testConfig()
+	config.RedisMaxConns, config.RedisMaxIdleConns = 2, 1
+	server := redistest.NewServer()
+	upstream := &testUpstream{body: "ok"}
+	crossover := newTestPlugin(t, config, upstream, withRedis(server))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			do(crossover, httptest.NewRequest(http.MethodGet, testPath, nil))
+		}()
+	}
+	wg.Wait()
+
+	if upstream.count() != 20 || server.MaxOpen() == 0 || server.MaxOpen() > 2 {
+		t.Errorf("expected the 20 requests served over at most 2 connections, got %d served over %d", upstream.count(), server.MaxOpen())
+	}
+}
@@ -0,0 +1,47 @@
+package crossover_managed
+
+import "sync"
+
+// requestScope the resources held by a request until it completes, the concurrency slots, the body budget, the
+// drain count and the refund decision. A cache hit served before its upstream call completes detaches the scope so
+// they're released by the background call instead of the returning handler
+type requestScope struct {
+	mu       sync.Mutex
+	releases []func()
+	detached bool
+}
+
+// onRelease register a release, they run in the reverse order of their registration like deferred calls
+func (s *requestScope) onRelease(release func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.releases = append(s.releases, release)
+}
+
+// close run the releases unless the scope was detached
+func (s *requestScope) close() {
+	s.mu.Lock()
+	detached := s.detached
+	s.mu.Unlock()
+	if !detached {
+		s.release()
+	}
+}
+
+// detach hand the releases over to the returned func
+func (s *requestScope) detach() func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.detached = true
+	return s.release
+}
+
+func (s *requestScope) release() {
+	s.mu.Lock()
+	releases := s.releases
+	s.releases = nil
+	s.mu.Unlock()
+	for i := len(releases) - 1; i >= 0; i-- {
+		releases[i]()
+	}
+}
@@ -0,0 +1,35 @@
+package crossover_managed
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// OtherScope the shared rate scope of the requests missing the scope header or carrying a value outside of RateLimitScopes
+const OtherScope = "other"
+
+// rateScope return the rate scope of the request, origins are normalized to their scheme and host
+// missing values and the ones outside of RateLimitScopes share OtherScope so forged values can't multiply the budget
+func (crossover *Crossover) rateScope(req *http.Request) string {
+	value := strings.TrimSpace(req.Header.Get(crossover.scopeHeader))
+	switch http.CanonicalHeaderKey(crossover.scopeHeader) {
+	case "Origin", "Referer":
+		value = normalizeOrigin(value)
+	default:
+		value = strings.ToLower(value)
+	}
+	if value == "" || !crossover.rateScopes[value] {
+		return OtherScope
+	}
+	return value
+}
+
+// normalizeOrigin return the lowercase scheme://host of the origin or referer, empty if it isn't an absolute url
+func normalizeOrigin(value string) string {
+	origin, err := url.Parse(value)
+	if err != nil || origin.Scheme == "" || origin.Host == "" {
+		return ""
+	}
+	return strings.ToLower(origin.Scheme + "://" + origin.Host)
+}
@@ -0,0 +1,86 @@
+package crossover_managed
+
+import (
+	"errors"
+	"github.com/kotalco/crossover-managed/internal/redistest"
+	"github.com/kotalco/crossover-managed/limiter"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRateScope(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		scope  string
+	}{
+		{"origin", "Origin", "https://app.example", "https://app.example"},
+		{"origin case", "Origin", "HTTPS://App.Example", "https://app.example"},
+		{"referer path", "Referer", "https://app.example/wallet?tab=1", "https://app.example"},
+		{"unknown origin", "Origin", "https://forged.example", OtherScope},
+		{"relative referer", "Referer", "/wallet", OtherScope},
+		{"missing", "Origin", "", OtherScope},
+		{"custom header", "X-App", " Wallet ", "wallet"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.RateLimitScopeHeader = test.header
+			config.RateLimitScopes = []string{"https://app.example", "wallet"}
+			crossover := newTestPlugin(t, config, &testUpstream{})
+
+			req := httptest.NewRequest(http.MethodGet, testPath, nil)
+			req.Header.Set(test.header, test.value)
+			if scope := crossover.rateScope(req); scope != test.scope {
+				t.Errorf("expected the scope %q, got %q", test.scope, scope)
+			}
+		})
+	}
+}
+
+func TestServeHTTPRateScopes(t *testing.T) {
+	config := testConfig()
+	config.RateLimitScopeHeader = "Origin"
+	config.RateLimitScopes = []string{"https://a.example", "https://b.example"}
+	server := redistest.NewServer()
+	// the cached plan of the user grants 2 requests per window
+	server.Set(testUserId, "2")
+	limiterService := limiter.NewLimiter(limiter.Options{PlanAddress: config.PlanAddress, Window: 60})
+	crossover := newTestPlugin(t, config, &testUpstream{body: "ok"}, withRedis(server), WithLimiterService(limiterService))
+
+	requests := []struct {
+		origin string
+		status int
+	}{
+		{"https://a.example", http.StatusOK},
+		{"https://a.example", http.StatusOK},
+		{"https://a.example", http.StatusTooManyRequests},
+		// the other origin of the user has its own budget
+		{"https://b.example", http.StatusOK},
+		{"https://b.example", http.StatusOK},
+		// the forged origins share a single budget
+		{"https://c.example", http.StatusOK},
+		{"", http.StatusOK},
+		{"https://d.example", http.StatusTooManyRequests},
+	}
+	for _, request := range requests {
+		req := httptest.NewRequest(http.MethodGet, testPath, nil)
+		if request.origin != "" {
+			req.Header.Set("Origin", request.origin)
+		}
+		if rw := do(crossover, req); rw.Code != request.status {
+			t.Errorf("expected %d for the origin %q, got %d", request.status, request.origin, rw.Code)
+		}
+	}
+}
+
+func TestValidateRateLimitScopes(t *testing.T) {
+	config := testConfig()
+	config.RateLimitScopeHeader = "Origin"
+	var configErr *ConfigError
+	if err := config.validate(); !errors.As(err, &configErr) || configErr.Field != "rateLimitScopes" {
+		t.Errorf("expected the scope header without scopes to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+package crossover_managed
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+)
+
+// the signal handler is registered once per process, the instances of each middleware name replace their
+// predecessor on a config reload. Yaegi doesn't expose syscall so only os.Interrupt can be handled, SIGTERM, the
+// default stop signal of docker and kubernetes, never reaches the handler: the deployments relying on the flush
+// have to stop traefik with SIGINT, e.g. with STOPSIGNAL SIGINT in its image, traefik shuts down gracefully on both
+var (
+	signalsMu      sync.Mutex
+	signals        chan os.Signal
+	signalHandlers = map[string]*Crossover{}
+)
+
+// closeOnSignal register the opt-in SIGINT handler flushing the activity buffer, the signal still reaches the other handlers
+// SIGTERM isn't handled, see above
+func (crossover *Crossover) closeOnSignal() {
+	signalsMu.Lock()
+	defer signalsMu.Unlock()
+	signalHandlers[crossover.name] = crossover
+	if signals == nil {
+		signals = make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt)
+		go awaitSignal(signals)
+	}
+}
+
+// stopOnSignal unregister the instance, the handler is stopped along with the last one
+func (crossover *Crossover) stopOnSignal() {
+	signalsMu.Lock()
+	defer signalsMu.Unlock()
+	if signalHandlers[crossover.name] == crossover {
+		delete(signalHandlers, crossover.name)
+	}
+	if len(signalHandlers) == 0 && signals != nil {
+		signal.Stop(signals)
+		close(signals)
+		signals = nil
+	}
+}
+
+// awaitSignal close the registered instances once the first signal is received, it returns when the handler is stopped
+func awaitSignal(received <-chan os.Signal) {
+	sig, ok := <-received
+	if !ok {
+		return
+	}
+	signalsMu.Lock()
+	handlers := make([]*Crossover, 0, len(signalHandlers))
+	for _, handler := range signalHandlers {
+		handlers = append(handlers, handler)
+	}
+	signalsMu.Unlock()
+	log.Printf("Received %s, draining the in-flight requests and flushing the activity buffer", sig)
+	for _, handler := range handlers {
+		_ = handler.Close()
+	}
+}
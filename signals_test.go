@@ -0,0 +1,73 @@
+package crossover_managed
+
+import (
+	"encoding/json"
+	"github.com/kotalco/crossover-managed/activity"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFlushOnSignal(t *testing.T) {
+	var received int64
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var batch []struct {
+			Count int `json:"count"`
+		}
+		_ = json.NewDecoder(req.Body).Decode(&batch)
+		for _, entry := range batch {
+			atomic.AddInt64(&received, int64(entry.Count))
+		}
+	}))
+	defer backend.Close()
+	config := testConfig()
+	config.FlushOnSignal = true
+	activityService := activity.NewActivity(activity.Options{RemoteAddress: backend.URL, BufferSize: 100, BatchSize: 10, FlushInterval: 60})
+	crossover := newTestPlugin(t, config, &testUpstream{}, WithActivityService(activityService))
+
+	for i := 0; i < 3; i++ {
+		do(crossover, httptest.NewRequest(http.MethodGet, testPath, nil))
+	}
+	if atomic.LoadInt64(&received) != 0 {
+		t.Fatalf("expected the activity to be buffered until the flush interval")
+	}
+
+	// simulate the signal instead of interrupting the test process
+	simulated := make(chan os.Signal, 1)
+	simulated <- os.Interrupt
+	awaitSignal(simulated)
+
+	if flushed := atomic.LoadInt64(&received); flushed != 3 {
+		t.Errorf("expected the 3 buffered entries to be flushed on the signal, got %d", flushed)
+	}
+	signalsMu.Lock()
+	defer signalsMu.Unlock()
+	if len(signalHandlers) != 0 || signals != nil {
+		t.Errorf("expected the closed instance to stop the signal handler, got %d handlers", len(signalHandlers))
+	}
+}
+
+func TestSignalHandlerReplacedOnReload(t *testing.T) {
+	config := testConfig()
+	config.FlushOnSignal = true
+	previous := newTestPlugin(t, config, &testUpstream{})
+	reloaded := newTestPlugin(t, config, &testUpstream{})
+
+	// the previous instance of the middleware name no longer owns the handler
+	_ = previous.Close()
+	signalsMu.Lock()
+	handler, stopped := signalHandlers[reloaded.name], signals == nil
+	signalsMu.Unlock()
+	if handler != reloaded || stopped {
+		t.Fatalf("expected the reloaded instance to keep the signal handler")
+	}
+
+	_ = reloaded.Close()
+	signalsMu.Lock()
+	defer signalsMu.Unlock()
+	if signals != nil {
+		t.Errorf("expected the handler to be stopped along with the last instance")
+	}
+}
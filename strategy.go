@@ -0,0 +1,54 @@
+package crossover_managed
+
+import (
+	"fmt"
+	"github.com/kotalco/crossover-managed/cache"
+	"github.com/kotalco/crossover-managed/matcher"
+	"strings"
+)
+
+// cacheStrategies the lookup strategy of the cached paths, the most specific pattern wins
+type cacheStrategies struct {
+	fallback   string
+	paths      *matcher.Matcher
+	strategies map[string]string
+}
+
+// parseCacheStrategies parse the pattern=strategy entries, the paths matching none of them use the fallback strategy
+func parseCacheStrategies(fallback string, entries []string) (*cacheStrategies, error) {
+	if fallback == "" {
+		fallback = cache.StrategyCacheFirst
+	}
+	if !validStrategy(fallback) {
+		return nil, fmt.Errorf("strategy %s must be %s or %s", fallback, cache.StrategyCacheFirst, cache.StrategyNetworkFirst)
+	}
+	parsed := &cacheStrategies{fallback: fallback, strategies: map[string]string{}}
+	patterns := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		pattern, strategy, ok := strings.Cut(entry, "=")
+		pattern, strategy = strings.TrimSpace(pattern), strings.TrimSpace(strategy)
+		if !ok || pattern == "" || !validStrategy(strategy) {
+			return nil, fmt.Errorf("entry %s must be pattern=%s or pattern=%s", entry, cache.StrategyCacheFirst, cache.StrategyNetworkFirst)
+		}
+		patterns = append(patterns, pattern)
+		parsed.strategies[pattern] = strategy
+	}
+	paths, err := matcher.New(patterns)
+	if err != nil {
+		return nil, err
+	}
+	parsed.paths = paths
+	return parsed, nil
+}
+
+func validStrategy(strategy string) bool {
+	return strategy == cache.StrategyCacheFirst || strategy == cache.StrategyNetworkFirst
+}
+
+// strategy return the lookup strategy of the path
+func (s *cacheStrategies) strategy(path string) string {
+	if pattern, ok := s.paths.Match(path); ok {
+		return s.strategies[pattern]
+	}
+	return s.fallback
+}
@@ -0,0 +1,59 @@
+package crossover_managed
+
+import (
+	"github.com/kotalco/crossover-managed/cache"
+	"github.com/kotalco/crossover-managed/internal/redistest"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseCacheStrategies(t *testing.T) {
+	strategies, err := parseCacheStrategies("", []string{"/v1/*/latest=network_first", "/v1/** = cache_first", "/live/**=network_first"})
+	if err != nil {
+		t.Fatalf("failed to parse the cache strategies: %s", err)
+	}
+	tests := []struct {
+		path     string
+		strategy string
+	}{
+		{"/v1/mainnet/latest", cache.StrategyNetworkFirst},
+		{"/v1/mainnet/blocks", cache.StrategyCacheFirst},
+		{"/live/feed", cache.StrategyNetworkFirst},
+		{"/other", cache.StrategyCacheFirst},
+	}
+	for _, test := range tests {
+		if strategy := strategies.strategy(test.path); strategy != test.strategy {
+			t.Errorf("expected %s to use %s, got %s", test.path, test.strategy, strategy)
+		}
+	}
+
+	fallback, _ := parseCacheStrategies(cache.StrategyNetworkFirst, nil)
+	if strategy := fallback.strategy("/other"); strategy != cache.StrategyNetworkFirst {
+		t.Errorf("expected the unmatched paths to use the fallback strategy, got %s", strategy)
+	}
+	for _, entries := range [][]string{{"/v1=stale_first"}, {"/v1"}, {"=network_first"}} {
+		if _, err := parseCacheStrategies("", entries); err == nil {
+			t.Errorf("expected the entries %v to be rejected", entries)
+		}
+	}
+	if _, err := parseCacheStrategies("stale_first", nil); err == nil {
+		t.Errorf("expected the unknown fallback strategy to be rejected")
+	}
+}
+
+func TestServeHTTPCacheStrategy(t *testing.T) {
+	config := testConfig()
+	config.CacheStrategyPaths = []string{"/" + testRequestId + "=network_first"}
+	server := redistest.NewServer()
+	cacheService := cache.NewCache(cache.Options{CacheExpiry: 60})
+	upstream := &testUpstream{body: "ok"}
+	crossover := newTestPlugin(t, config, upstream, withRedis(server), WithCacheService(cacheService))
+
+	for i := 0; i < 2; i++ {
+		do(crossover, httptest.NewRequest(http.MethodGet, testPath, nil))
+	}
+	if upstream.count() != 2 {
+		t.Errorf("expected the network first path to reach the upstream every time, got %d calls", upstream.count())
+	}
+}